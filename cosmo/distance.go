@@ -0,0 +1,35 @@
+package cosmo
+
+import (
+	"math"
+)
+
+const (
+	// distanceSteps is the number of integration steps per unit redshift
+	// used by ComovingDistance.
+	distanceSteps = 1000
+)
+
+// HubbleDistance returns c/H0 in Mpc/h.
+func HubbleDistance() float64 {
+	return CMks / 1e5
+}
+
+// ComovingDistance calculates the line-of-sight comoving distance to an
+// object at redshift z, D = (c/H0) int_0^z dz'/h(z'), where h(z) is given by
+// HubbleFrac. Assumes k, r = 0. The returned value is in Mpc/h.
+func ComovingDistance(omegaM, omegaL, z float64) float64 {
+	if z <= 0 { return 0 }
+
+	// Simpson's rule with an even number of steps.
+	n := 2*int(math.Ceil(z*distanceSteps/2))
+	dz := z / float64(n)
+	sum := 1/HubbleFrac(omegaM, omegaL, 0) + 1/HubbleFrac(omegaM, omegaL, z)
+	for i := 1; i < n; i++ {
+		w := 2.0
+		if i % 2 == 1 { w = 4 }
+		sum += w / HubbleFrac(omegaM, omegaL, float64(i)*dz)
+	}
+
+	return HubbleDistance() * sum * dz / 3
+}
@@ -89,6 +89,7 @@ func blockHeaderOffsets(rd io.ReadSeeker, hd *BinhHeader) []int {
 		len(hd.TextColumnNames)
 
 	headerOffsets := make([]int, hd.Blocks)
+	if hd.Blocks == 0 { return headerOffsets }
 	headerOffsets[0] = headerSize
 
 	haloes := int64(0)
@@ -13,7 +13,10 @@ type TextConfig struct {
 	Separator byte // Character used to separated fields
 	Comment byte // Character used to start comments.
 	SkipLines int // Number of lines to skip at the start of file.
-	ColumnNames map[string]int // Map from column names to 
+	// ColumnNames maps column names to indices. Names in the file's header
+	// are found automatically, so this is only needed for files without
+	// headers or to override the header.
+	ColumnNames map[string]int
 	MaxBlockSize int // Largest amount of text you want to read at one time.
 	MaxLineSize int // Largest possible line size.
 }
@@ -30,6 +33,18 @@ var DefaultConfig = TextConfig{
 	MaxLineSize: 1<<20, // If you have a megabyte-sized line, I'm disowning you.
 }
 
+// AHFConfig is a TextConfig instance which can read the tab-separated
+// AHF_halos files written by AHF.
+var AHFConfig = TextConfig{
+	Separator: '\t',
+	Comment: '#',
+	SkipLines: 0,
+	ColumnNames: map[string]int{},
+
+	MaxBlockSize: 10 * 1<<30,
+	MaxLineSize: 1<<20,
+}
+
 // Reader allows the user to access data fields in a halo catalog of different
 // types, potentially in blocks.
 type Reader interface {
@@ -75,3 +90,63 @@ func Stdin(config ...TextConfig) Reader {
 func BinH(fname string) Reader {
 	return newBinhReader(fname)
 }
+
+// RockstarBinary creates a Reader for a set of Rockstar halos_*.bin files.
+// Each file is a block.
+func RockstarBinary(fnames ...string) *RockstarBinaryReader {
+	return newRockstarBinaryReader(fnames)
+}
+
+// SubfindFOFGroups creates a Reader for the FOF groups in a set of group_tab
+// files.
+func SubfindFOFGroups(fnames ...string) *SubfindReader {
+	return newSubfindReader(fnames, subfindFOFFields, false, 24,
+		DefaultSubfindConfig)
+}
+
+// SubfindGroups creates a Reader for the FOF groups in a set of subhalo_tab
+// files. An optional config describes the layout of the files, otherwise
+// DefaultSubfindConfig is used.
+func SubfindGroups(fnames []string, config ...SubfindConfig) *SubfindReader {
+	c := DefaultSubfindConfig
+	if len(config) > 0 { c = config[0] }
+	return newSubfindReader(fnames, subhaloTabFields(c), false, 32, c)
+}
+
+// SubfindSubhalos creates a Reader for the subhalos in a set of subhalo_tab
+// files. An optional config describes the layout of the files, otherwise
+// DefaultSubfindConfig is used.
+func SubfindSubhalos(fnames []string, config ...SubfindConfig) *SubfindReader {
+	c := DefaultSubfindConfig
+	if len(config) > 0 { c = config[0] }
+	return newSubfindReader(fnames, subhaloTabFields(c), true, 32, c)
+}
+
+// Columnar creates a Reader for a columnar file written by ColumnarWriter.
+func Columnar(fname string) *ColumnarReader {
+	return newColumnarReader(fname)
+}
+
+// TextWriter creates a Writer for a text catalogue. The first line of the
+// file is a comment which contains the column names, so the catalogue can be
+// read by name with TextFile. Every line of config.Header follows it as a
+// comment. An optional TextConfig gives the separator and comment
+// characters, otherwise DefaultConfig is used.
+func TextWriter(
+	fname string, config WriterConfig, textConfig ...TextConfig,
+) (Writer, error) {
+	return newTextWriter(fname, config, textConfig...)
+}
+
+// BinhWriter creates a Writer for a .binh file which can be read with BinH.
+// Each call to WriteBlock creates a new block.
+func BinhWriter(fname string, config WriterConfig) (Writer, error) {
+	return newBinhWriter(fname, config)
+}
+
+// ColumnarWriter creates a Writer for a columnar file which can be read with
+// Columnar. Unlike binh files, values are stored without any loss of
+// precision.
+func ColumnarWriter(fname string, config WriterConfig) (Writer, error) {
+	return newColumnarWriter(fname, config)
+}
@@ -156,6 +156,84 @@ func TestFloat32s(t *testing.T) {
 	}
 }
 
+func TestSkipLines(t *testing.T) {
+	text := []byte("# Header\n3\n#tree 1\n1 2\n3 4\n#tree 2\n5 6\n")
+	config := DefaultConfig
+	config.SkipLines = 2
+
+	col := Text(text, config).ReadInts([]int{1})[0]
+	target := []int{2, 4, 6}
+	if !intsEq(col, target) {
+		t.Errorf("Read %d, but wanted %d", col, target)
+	}
+
+	config.MaxLineSize = 4
+	config.MaxBlockSize = 8
+	rd := Text(text, config)
+	col = rd.ReadInts([]int{0})[0]
+	target = []int{1, 3, 5}
+	if rd.Blocks() < 2 || !intsEq(col, target) {
+		t.Errorf("Read %d from %d blocks, but wanted %d", col,
+			rd.Blocks(), target)
+	}
+}
+
+func TestColumnNames(t *testing.T) {
+	tests := []struct{
+		text string
+		names []string
+		target [][]float64
+	}{
+		// Rockstar out_*.list
+		{"#ID DescID Mvir Vmax Vrms Rvir b_to_a(500c)\n#a = 0.5\n" +
+			"1 -1 1e12 200 150 250 0.5\n2 1 3e11 100 80 160 0.7\n",
+			[]string{"Mvir", "Rvir", "b_to_a(500c)", "id"},
+			[][]float64{{1e12, 3e11}, {250, 160}, {0.5, 0.7}, {1, 2}}},
+		// consistent-trees
+		{"#scale(0) id(1) desc_scale(2) desc_id(3) mmp?(4)\n" +
+			"#Omega_M = 0.27\n1\n#tree 7\n" +
+			"1.0 7 0.0 -1 0\n0.5 3 1.0 7 1\n",
+			[]string{"id", "desc_id", "mmp?", "scale"},
+			[][]float64{{7, 3}, {-1, 7}, {0, 1}, {1, 0.5}}},
+		// AHF, which counts columns from 1.
+		{"#ID(1)\thostHalo(2)\tnumSubStruct(3)\tMvir(4)\tnpart(5)\t" +
+			"Rvir(6)\n12\t-1\t2\t5e12\t1000\t400\n" +
+			"13\t12\t0\t1e11\t20\t90\n",
+			[]string{"Mvir", "Rvir", "hostHalo", "ID"},
+			[][]float64{{5e12, 1e11}, {400, 90}, {-1, 12}, {12, 13}}},
+	}
+
+	for i, test := range tests {
+		config := DefaultConfig
+		if i == 1 { config.SkipLines = 3 }
+		if i == 2 { config = AHFConfig }
+
+		cols := Text([]byte(test.text), config).ReadFloat64s(test.names)
+		for j := range test.target {
+			if !float64sEq(cols[j], test.target[j]) {
+				t.Errorf("%d) Read %g from column '%s', but wanted %g",
+					i, cols[j], test.names[j], test.target[j])
+			}
+		}
+	}
+
+	// ColumnNames takes precedence over the header.
+	config := DefaultConfig
+	config.ColumnNames = map[string]int{"Mvir": 0}
+	col := Text([]byte("#ID Mvir\n1 2\n"), config).ReadInts(
+		[]string{"Mvir"})[0]
+	if !intsEq(col, []int{1}) {
+		t.Errorf("Read %d, but wanted [1]", col)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for a missing column name.")
+		}
+	}()
+	Text([]byte("#ID Mvir\n1 2\n")).ReadInts([]string{"Rvir"})
+}
+
 func intsEq(x, y []int) bool {
 	if len(x) != len(y) { return false }
 	for i := range x {
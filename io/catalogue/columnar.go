@@ -0,0 +1,382 @@
+package catalogue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+/*
+Columnar files are a simple, uncompressed binary catalogue format. Every
+value is little-endian. The file starts with a ColumnarHeader, followed by
+the text header and the comma-separated column names. Each block then
+starts with its number of haloes (int64) and the ColumnFlag of each column
+(int64), which is one of Int64, Float64, or Float32. After these come the
+contents of each column, one after another.
+*/
+
+const (
+	ColumnarMagic = 0xc01a2ca7
+	ColumnarVersion = 1
+)
+
+// ColumnarHeader is the fixed-width header at the start of a columnar file.
+type ColumnarHeader struct {
+	Magic, Version int64
+	Columns int64 // Number of columns in each block.
+	Blocks int64 // Number of blocks in the file.
+	TextHeaderLength int64 // Number of bytes in the text header.
+	TextColumnNamesLength int64 // Number of bytes in the column names.
+}
+
+var columnarHeaderSize = int(unsafe.Sizeof(ColumnarHeader{ }))
+
+// ColumnarReader is a Reader for columnar files. Files are only open while
+// they're being read.
+type ColumnarReader struct {
+	fname string
+	hd ColumnarHeader
+	text string
+	names []string
+	lookup map[string]int
+
+	haloes int
+	blockHaloes []int
+	blockFlags [][]ColumnFlag
+	blockOffsets []int64 // Start of the first column in each block.
+	buf []byte
+}
+
+func newColumnarReader(fname string) *ColumnarReader {
+	f, err := os.Open(fname)
+	if err != nil { panic(err.Error()) }
+	info, err := f.Stat()
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+	rd := &ColumnarReader{ fname: fname, lookup: map[string]int{ } }
+
+	corrupt := fmt.Sprintf("Corruption detected in the file %s.", fname)
+	err = binary.Read(f, binary.LittleEndian, &rd.hd)
+	if err != nil || rd.hd.Magic != ColumnarMagic { panic(corrupt) }
+	if rd.hd.Version != ColumnarVersion {
+		panic(fmt.Sprintf("ColumnarVersion = %d, but reader is version %d.",
+			rd.hd.Version, ColumnarVersion))
+	}
+
+	text := make([]byte, rd.hd.TextHeaderLength)
+	names := make([]byte, rd.hd.TextColumnNamesLength)
+	err = binary.Read(f, binary.LittleEndian, text)
+	if err != nil { panic(corrupt) }
+	err = binary.Read(f, binary.LittleEndian, names)
+	if err != nil { panic(corrupt) }
+	rd.text, rd.names = string(text), strings.Split(string(names), ",")
+	if len(rd.names) != int(rd.hd.Columns) { panic(corrupt) }
+	for i := range rd.names { rd.lookup[strings.ToLower(rd.names[i])] = i }
+
+	offset := int64(columnarHeaderSize + len(text) + len(names))
+	for i := 0; i < int(rd.hd.Blocks); i++ {
+		n := int64(0)
+		flags := make([]ColumnFlag, rd.hd.Columns)
+		_, err = f.Seek(offset, 0)
+		if err == nil { err = binary.Read(f, binary.LittleEndian, &n) }
+		if err == nil { err = binary.Read(f, binary.LittleEndian, flags) }
+		if err != nil { panic(corrupt) }
+
+		offset += 8 * (rd.hd.Columns + 1)
+		rd.blockHaloes = append(rd.blockHaloes, int(n))
+		rd.blockFlags = append(rd.blockFlags, flags)
+		rd.blockOffsets = append(rd.blockOffsets, offset)
+		rd.haloes += int(n)
+
+		for _, flag := range flags {
+			if flag != Int64 && flag != Float64 && flag != Float32 {
+				panic(corrupt)
+			}
+			offset += n * int64(flag.Size())
+		}
+	}
+	if offset != info.Size() { panic(corrupt) }
+
+	return rd
+}
+
+// Header returns the file's fixed-width header.
+func (rd *ColumnarReader) Header() ColumnarHeader { return rd.hd }
+
+// TextHeader returns the text header written with the catalogue.
+func (rd *ColumnarReader) TextHeader() string { return rd.text }
+
+// Names returns the name of each column.
+func (rd *ColumnarReader) Names() []string { return rd.names }
+
+// Blocks returns the number of blocks in the file.
+func (rd *ColumnarReader) Blocks() int { return int(rd.hd.Blocks) }
+
+// ReadInts reads the given int columns across every block. Float columns
+// can't be read as ints.
+func (rd *ColumnarReader) ReadInts(
+	columns interface{}, optBuf ...[][]int,
+) [][]int {
+	cols := rd.columnIndices(columns)
+	bufs := cleanIntBuffer(optBuf, len(cols), rd.haloes)
+
+	start := 0
+	for block, n := range rd.blockHaloes {
+		for i := range cols {
+			rd.readIntColumn(block, cols[i], bufs[i][start: start + n])
+		}
+		start += n
+	}
+
+	return bufs
+}
+
+// ReadFloat64s reads the given columns across every block as float64s.
+func (rd *ColumnarReader) ReadFloat64s(
+	columns interface{}, optBuf ...[][]float64,
+) [][]float64 {
+	cols := rd.columnIndices(columns)
+	bufs := cleanFloat64Buffer(optBuf, len(cols), rd.haloes)
+
+	start := 0
+	for block, n := range rd.blockHaloes {
+		for i := range cols {
+			rd.readFloat64Column(block, cols[i], bufs[i][start: start + n])
+		}
+		start += n
+	}
+
+	return bufs
+}
+
+// ReadFloat32s reads the given columns across every block as float32s.
+func (rd *ColumnarReader) ReadFloat32s(
+	columns interface{}, optBuf ...[][]float32,
+) [][]float32 {
+	cols := rd.columnIndices(columns)
+	bufs := cleanFloat32Buffer(optBuf, len(cols), rd.haloes)
+
+	start := 0
+	for block, n := range rd.blockHaloes {
+		for i := range cols {
+			rd.readFloat32Column(block, cols[i], bufs[i][start: start + n])
+		}
+		start += n
+	}
+
+	return bufs
+}
+
+// ReadIntBlock reads the given int columns from a single block. Float columns
+// can't be read as ints.
+func (rd *ColumnarReader) ReadIntBlock(
+	columns interface{}, block int, optBuf ...[][]int,
+) [][]int {
+	cols := rd.columnIndices(columns)
+	bufs := cleanIntBuffer(optBuf, len(cols), rd.blockHaloes[block])
+	for i := range cols { rd.readIntColumn(block, cols[i], bufs[i]) }
+	return bufs
+}
+
+// ReadFloat64Block reads the given columns from a single block as float64s.
+func (rd *ColumnarReader) ReadFloat64Block(
+	columns interface{}, block int, optBuf ...[][]float64,
+) [][]float64 {
+	cols := rd.columnIndices(columns)
+	bufs := cleanFloat64Buffer(optBuf, len(cols), rd.blockHaloes[block])
+	for i := range cols { rd.readFloat64Column(block, cols[i], bufs[i]) }
+	return bufs
+}
+
+// ReadFloat32Block reads the given columns from a single block as float32s.
+func (rd *ColumnarReader) ReadFloat32Block(
+	columns interface{}, block int, optBuf ...[][]float32,
+) [][]float32 {
+	cols := rd.columnIndices(columns)
+	bufs := cleanFloat32Buffer(optBuf, len(cols), rd.blockHaloes[block])
+	for i := range cols { rd.readFloat32Column(block, cols[i], bufs[i]) }
+	return bufs
+}
+
+// columnIndices converts the generic columns variable into integer indices.
+// Names are case-insensitive.
+func (rd *ColumnarReader) columnIndices(columns interface{}) []int {
+	if intCols, ok := columns.([]int); ok {
+		for _, col := range intCols {
+			if col < 0 || col >= int(rd.hd.Columns) {
+				panic(fmt.Sprintf("Column %d out of range for a file with " +
+					"%d columns.", col, rd.hd.Columns))
+			}
+		}
+		return intCols
+	} else if strCols, ok := columns.([]string); ok {
+		idxs := make([]int, len(strCols))
+		for i := range strCols {
+			name := strings.ToLower(strings.Trim(strCols[i], " "))
+			if idx, ok := rd.lookup[name]; ok {
+				idxs[i] = idx
+			} else {
+				panic(fmt.Sprintf("Name '%s' not in columns.", strCols[i]))
+			}
+		}
+		return idxs
+	}
+	panic("Columns argument must be []int or []string.")
+}
+
+// readColumn returns the raw bytes of a column within a block.
+func (rd *ColumnarReader) readColumn(block, col int) []byte {
+	n, flags := rd.blockHaloes[block], rd.blockFlags[block]
+	offset := rd.blockOffsets[block]
+	for i := 0; i < col; i++ { offset += int64(n * flags[i].Size()) }
+
+	size := n * flags[col].Size()
+	if cap(rd.buf) < size { rd.buf = make([]byte, size) }
+	rd.buf = rd.buf[:size]
+
+	f, err := os.Open(rd.fname)
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+	_, err = f.ReadAt(rd.buf, offset)
+	if err != nil { panic(err.Error()) }
+	return rd.buf
+}
+
+func (rd *ColumnarReader) readIntColumn(block, col int, out []int) {
+	if rd.blockFlags[block][col] != Int64 {
+		panic(fmt.Sprintf("Column '%s' contains floats, not ints.",
+			rd.names[col]))
+	}
+	buf := rd.readColumn(block, col)
+	for i := range out {
+		out[i] = int(int64(binary.LittleEndian.Uint64(buf[8*i:])))
+	}
+}
+
+func (rd *ColumnarReader) readFloat64Column(block, col int, out []float64) {
+	buf := rd.readColumn(block, col)
+	switch rd.blockFlags[block][col] {
+	case Int64:
+		for i := range out {
+			out[i] = float64(int64(binary.LittleEndian.Uint64(buf[8*i:])))
+		}
+	case Float64:
+		for i := range out {
+			out[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[8*i:]))
+		}
+	case Float32:
+		for i := range out {
+			out[i] = float64(
+				math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:])),
+			)
+		}
+	}
+}
+
+func (rd *ColumnarReader) readFloat32Column(block, col int, out []float32) {
+	buf := rd.readColumn(block, col)
+	switch rd.blockFlags[block][col] {
+	case Int64:
+		for i := range out {
+			out[i] = float32(int64(binary.LittleEndian.Uint64(buf[8*i:])))
+		}
+	case Float64:
+		for i := range out {
+			out[i] = float32(
+				math.Float64frombits(binary.LittleEndian.Uint64(buf[8*i:])),
+			)
+		}
+	case Float32:
+		for i := range out {
+			out[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+		}
+	}
+}
+
+type columnarWriter struct {
+	f *os.File
+	wr *bufio.Writer
+	hd ColumnarHeader
+	cols *writerColumns
+	flags []ColumnFlag
+	buf []byte
+}
+
+func newColumnarWriter(
+	fname string, config WriterConfig,
+) (*columnarWriter, error) {
+	cols, err := newWriterColumns(config)
+	if err != nil { return nil, err }
+
+	names := []byte(strings.Join(config.Names, ","))
+	text := []byte(config.Header)
+
+	f, err := os.Create(fname)
+	if err != nil { return nil, err }
+	w := &columnarWriter{
+		f: f, wr: bufio.NewWriter(f), cols: cols,
+		flags: make([]ColumnFlag, len(config.Names)),
+	}
+
+	// Blocks is filled in by Close.
+	w.hd = ColumnarHeader{
+		Magic: ColumnarMagic, Version: ColumnarVersion,
+		Columns: int64(len(config.Names)),
+		TextHeaderLength: int64(len(text)),
+		TextColumnNamesLength: int64(len(names)),
+	}
+	binary.Write(w.wr, binary.LittleEndian, w.hd)
+	w.wr.Write(text)
+	w.wr.Write(names)
+
+	return w, nil
+}
+
+func (w *columnarWriter) WriteBlock(cols []interface{}) error {
+	n, err := w.cols.check(cols)
+	if err != nil { return err }
+	copy(w.flags, w.cols.types)
+
+	binary.Write(w.wr, binary.LittleEndian, int64(n))
+	binary.Write(w.wr, binary.LittleEndian, w.flags)
+
+	for i := range cols {
+		size := n * w.flags[i].Size()
+		if cap(w.buf) < size { w.buf = make([]byte, size) }
+		buf := w.buf[:size]
+
+		switch x := cols[i].(type) {
+		case []int:
+			for j := range x {
+				binary.LittleEndian.PutUint64(buf[8*j:], uint64(x[j]))
+			}
+		case []float64:
+			for j := range x {
+				binary.LittleEndian.PutUint64(buf[8*j:],
+					math.Float64bits(x[j]))
+			}
+		case []float32:
+			for j := range x {
+				binary.LittleEndian.PutUint32(buf[4*j:],
+					math.Float32bits(x[j]))
+			}
+		}
+
+		if _, err = w.wr.Write(buf); err != nil { return err }
+	}
+
+	w.hd.Blocks++
+	return nil
+}
+
+func (w *columnarWriter) Close() error {
+	err := w.wr.Flush()
+	if err == nil { _, err = w.f.Seek(0, 0) }
+	if err == nil { err = binary.Write(w.f, binary.LittleEndian, w.hd) }
+	if cerr := w.f.Close(); err == nil { err = cerr }
+	return err
+}
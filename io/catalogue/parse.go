@@ -203,6 +203,48 @@ func parseFloat32s(
 	return nil
 }
 
+// parseColumnNames returns the column names in a commented header line, e.g.
+// "#ID DescID Mvir ..." from Rockstar, "#scale(0) id(1) ..." from
+// consistent-trees, or "#ID(1) hostHalo(2) ..." from AHF. Numeric "(N)"
+// suffixes are removed, since they count from 0 in some formats and from 1
+// in others, and the column index is taken from the name's position
+// instead. nil is returned if the line isn't a comment.
+func parseColumnNames(line []byte, sep, comm byte) []string {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] != comm { return nil }
+	line = bytes.TrimLeft(line, string([]byte{ comm }))
+
+	var words [][]byte
+	if sep == ' ' || sep == '\t' {
+		words = bytes.Fields(line)
+	} else {
+		words = bytes.Split(line, []byte{ sep })
+	}
+
+	names := make([]string, len(words))
+	for i, word := range words {
+		word = bytes.TrimSpace(word)
+		if n := len(word); n > 0 && word[n-1] == ')' {
+			start := bytes.LastIndexByte(word, '(')
+			if start > 0 && isDigits(word[start+1: n-1]) {
+				word = word[:start]
+			}
+		}
+		names[i] = string(word)
+	}
+
+	return names
+}
+
+// isDigits returns true if b is a non-empty string of decimal digits.
+func isDigits(b []byte) bool {
+	if len(b) == 0 { return false }
+	for _, c := range b {
+		if c < '0' || c > '9' { return false }
+	}
+	return true
+}
+
 // Optimized and buffered analog to the standard library's bytes.FieldsFunc()
 // function.
 func fields(data []byte, sep byte, buf [][]byte) [][]byte {
@@ -0,0 +1,432 @@
+package catalogue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RockstarMagic is the first eight bytes of every Rockstar binary file.
+const RockstarMagic = 0xfadedacec0c0d0d0
+
+// RockstarHeader is the 256-byte header at the start of a Rockstar
+// halos_*.bin file.
+type RockstarHeader struct {
+	Magic uint64
+	Snap, Chunk int64
+	Scale, OmegaM, OmegaL, H0 float32
+	Bounds [6]float32 // Lower and upper corners of the chunk in Mpc/h.
+	Haloes, Particles int64
+	BoxSize, ParticleMass float32
+	ParticleType int64
+	FormatRevision int32
+	Version [12]byte // Null-terminated Rockstar version string.
+	_ [144]byte
+}
+
+// rockstarHalo is the layout of struct halo in Rockstar's halo.h, including
+// the padding at the end of the C struct.
+type rockstarHalo struct {
+	ID int64
+	Pos [6]float32
+	CoreVel, BulkVel [3]float32
+	M, R, ChildR, VmaxR, MGrav, Vmax, RVmax, Rs, KlypinRs, Vrms float32
+	J [3]float32
+	Energy, Spin float32
+	AltM [4]float32
+	Xoff, Voff, BToA, CToA float32
+	A [3]float32
+	BToA2, CToA2 float32
+	A2 [3]float32
+	BullockSpin, KinToPot, MPeB, MPeD, HalfmassRadius float32
+	NumP, NumChildParticles, PStart, Desc, Flags, NCore int64
+	MinPosErr, MinVelErr, MinBulkVelErr float32
+	_ float32
+}
+
+var (
+	rockstarHeaderSize = int64(binary.Size(RockstarHeader{ }))
+	rockstarHaloSize = int64(binary.Size(rockstarHalo{ }))
+)
+
+// rockstarColumn is a single column of a Rockstar catalogue. Only one of f
+// and i is set, and neither is set if the column isn't stored in binary
+// files.
+type rockstarColumn struct {
+	name string
+	f func(h *rockstarHalo) float32
+	i func(h *rockstarHalo) int64
+}
+
+// rockstarColumns lists the columns of a Rockstar binary file. The first 54
+// have the same names and indices as the columns of a halos_*.ascii file,
+// and the remainder are only stored in binary files.
+var rockstarColumns = []rockstarColumn{
+	{ name: "id", i: func(h *rockstarHalo) int64 { return h.ID } },
+	{ name: "num_p", i: func(h *rockstarHalo) int64 { return h.NumP } },
+	{ name: "mvir", f: func(h *rockstarHalo) float32 { return h.M } },
+	{ name: "mbound_vir", f: func(h *rockstarHalo) float32 { return h.MGrav } },
+	{ name: "rvir", f: func(h *rockstarHalo) float32 { return h.R } },
+	{ name: "vmax", f: func(h *rockstarHalo) float32 { return h.Vmax } },
+	{ name: "rvmax", f: func(h *rockstarHalo) float32 { return h.RVmax } },
+	{ name: "vrms", f: func(h *rockstarHalo) float32 { return h.Vrms } },
+	{ name: "x", f: func(h *rockstarHalo) float32 { return h.Pos[0] } },
+	{ name: "y", f: func(h *rockstarHalo) float32 { return h.Pos[1] } },
+	{ name: "z", f: func(h *rockstarHalo) float32 { return h.Pos[2] } },
+	{ name: "vx", f: func(h *rockstarHalo) float32 { return h.Pos[3] } },
+	{ name: "vy", f: func(h *rockstarHalo) float32 { return h.Pos[4] } },
+	{ name: "vz", f: func(h *rockstarHalo) float32 { return h.Pos[5] } },
+	{ name: "jx", f: func(h *rockstarHalo) float32 { return h.J[0] } },
+	{ name: "jy", f: func(h *rockstarHalo) float32 { return h.J[1] } },
+	{ name: "jz", f: func(h *rockstarHalo) float32 { return h.J[2] } },
+	{ name: "e", f: func(h *rockstarHalo) float32 { return h.Energy } },
+	{ name: "spin", f: func(h *rockstarHalo) float32 { return h.Spin } },
+	{
+		name: "posuncertainty",
+		f: func(h *rockstarHalo) float32 { return h.MinPosErr },
+	},
+	{
+		name: "veluncertainty",
+		f: func(h *rockstarHalo) float32 { return h.MinVelErr },
+	},
+	{
+		name: "bulk_vx",
+		f: func(h *rockstarHalo) float32 { return h.BulkVel[0] },
+	},
+	{
+		name: "bulk_vy",
+		f: func(h *rockstarHalo) float32 { return h.BulkVel[1] },
+	},
+	{
+		name: "bulk_vz",
+		f: func(h *rockstarHalo) float32 { return h.BulkVel[2] },
+	},
+	{
+		name: "bulkvelunc",
+		f: func(h *rockstarHalo) float32 { return h.MinBulkVelErr },
+	},
+	{ name: "n_core", i: func(h *rockstarHalo) int64 { return h.NCore } },
+	{ name: "m200b", f: func(h *rockstarHalo) float32 { return h.AltM[0] } },
+	{ name: "m200c", f: func(h *rockstarHalo) float32 { return h.AltM[1] } },
+	{ name: "m500c", f: func(h *rockstarHalo) float32 { return h.AltM[2] } },
+	{ name: "m2500c", f: func(h *rockstarHalo) float32 { return h.AltM[3] } },
+	{ name: "xoff", f: func(h *rockstarHalo) float32 { return h.Xoff } },
+	{ name: "voff", f: func(h *rockstarHalo) float32 { return h.Voff } },
+	{
+		name: "spin_bullock",
+		f: func(h *rockstarHalo) float32 { return h.BullockSpin },
+	},
+	{ name: "b_to_a", f: func(h *rockstarHalo) float32 { return h.BToA } },
+	{ name: "c_to_a", f: func(h *rockstarHalo) float32 { return h.CToA } },
+	{ name: "a[x]", f: func(h *rockstarHalo) float32 { return h.A[0] } },
+	{ name: "a[y]", f: func(h *rockstarHalo) float32 { return h.A[1] } },
+	{ name: "a[z]", f: func(h *rockstarHalo) float32 { return h.A[2] } },
+	{
+		name: "b_to_a(500c)",
+		f: func(h *rockstarHalo) float32 { return h.BToA2 },
+	},
+	{
+		name: "c_to_a(500c)",
+		f: func(h *rockstarHalo) float32 { return h.CToA2 },
+	},
+	{ name: "a[x](500c)", f: func(h *rockstarHalo) float32 { return h.A2[0] } },
+	{ name: "a[y](500c)", f: func(h *rockstarHalo) float32 { return h.A2[1] } },
+	{ name: "a[z](500c)", f: func(h *rockstarHalo) float32 { return h.A2[2] } },
+	{ name: "rs", f: func(h *rockstarHalo) float32 { return h.Rs } },
+	{
+		name: "rs_klypin",
+		f: func(h *rockstarHalo) float32 { return h.KlypinRs },
+	},
+	{ name: "t/|u|", f: func(h *rockstarHalo) float32 { return h.KinToPot } },
+	{
+		name: "m_pe_behroozi",
+		f: func(h *rockstarHalo) float32 { return h.MPeB },
+	},
+	{ name: "m_pe_diemer", f: func(h *rockstarHalo) float32 { return h.MPeD } },
+	{
+		name: "halfmass_radius",
+		f: func(h *rockstarHalo) float32 { return h.HalfmassRadius },
+	},
+	// These are computed while Rockstar writes text files.
+	{ name: "idx" }, { name: "i_so" }, { name: "i_ph" },
+	{
+		name: "num_cp",
+		i: func(h *rockstarHalo) int64 { return h.NumChildParticles },
+	},
+	{ name: "mmetric" },
+
+	{ name: "desc", i: func(h *rockstarHalo) int64 { return h.Desc } },
+	{ name: "flags", i: func(h *rockstarHalo) int64 { return h.Flags } },
+	{ name: "p_start", i: func(h *rockstarHalo) int64 { return h.PStart } },
+	{ name: "child_r", f: func(h *rockstarHalo) float32 { return h.ChildR } },
+	{ name: "vmax_r", f: func(h *rockstarHalo) float32 { return h.VmaxR } },
+	{
+		name: "core_vx",
+		f: func(h *rockstarHalo) float32 { return h.CoreVel[0] },
+	},
+	{
+		name: "core_vy",
+		f: func(h *rockstarHalo) float32 { return h.CoreVel[1] },
+	},
+	{
+		name: "core_vz",
+		f: func(h *rockstarHalo) float32 { return h.CoreVel[2] },
+	},
+}
+
+// RockstarBinaryReader is a Reader for Rockstar's halos_*.bin files. Each
+// file is a single block. Columns have the same names and indices as the
+// columns of halos_*.ascii files, and names are case-insensitive. idx, i_so,
+// i_ph, and mmetric aren't stored, but binary files also have the columns
+// desc, flags, p_start, child_r, vmax_r, core_vx, core_vy, and core_vz.
+type RockstarBinaryReader struct {
+	fnames []string
+	hds []RockstarHeader
+	lookup map[string]int
+}
+
+// newRockstarBinaryReader reads the headers of the given files and checks
+// that their sizes are consistent with them.
+func newRockstarBinaryReader(fnames []string) *RockstarBinaryReader {
+	rd := &RockstarBinaryReader{
+		fnames: fnames, hds: make([]RockstarHeader, len(fnames)),
+		lookup: map[string]int{ },
+	}
+	for i := range rockstarColumns { rd.lookup[rockstarColumns[i].name] = i }
+
+	for i, fname := range fnames {
+		f, err := os.Open(fname)
+		if err != nil { panic(err.Error()) }
+		info, err := f.Stat()
+		if err != nil { panic(err.Error()) }
+		err = binary.Read(f, binary.LittleEndian, &rd.hds[i])
+		f.Close()
+		if err != nil { panic(err.Error()) }
+
+		hd := &rd.hds[i]
+		size := rockstarHeaderSize + hd.Haloes*rockstarHaloSize +
+			hd.Particles*8
+		if hd.Magic != RockstarMagic || info.Size() != size {
+			panic(fmt.Sprintf("Corruption detected in the file %s.", fname))
+		}
+	}
+
+	return rd
+}
+
+// Header returns the header of the file associated with block i.
+func (rd *RockstarBinaryReader) Header(i int) *RockstarHeader {
+	return &rd.hds[i]
+}
+
+// readHaloes reads every halo in block i.
+func (rd *RockstarBinaryReader) readHaloes(i int) []rockstarHalo {
+	f, err := os.Open(rd.fnames[i])
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+
+	_, err = f.Seek(rockstarHeaderSize, 0)
+	if err != nil { panic(err.Error()) }
+	haloes := make([]rockstarHalo, rd.hds[i].Haloes)
+	err = binary.Read(f, binary.LittleEndian, haloes)
+	if err != nil { panic(err.Error()) }
+
+	return haloes
+}
+
+// columns converts the generic columns variable into rockstarColumns.
+func (rd *RockstarBinaryReader) columns(columns interface{}) []rockstarColumn {
+	var idxs []int
+	if intCols, ok := columns.([]int); ok {
+		idxs = intCols
+	} else if strCols, ok := columns.([]string); ok {
+		idxs = make([]int, len(strCols))
+		for i := range strCols {
+			name := strings.ToLower(strings.Trim(strCols[i], " "))
+			idx, ok := rd.lookup[name]
+			if !ok {
+				panic(fmt.Sprintf("Name '%s' not in columns.", strCols[i]))
+			}
+			idxs[i] = idx
+		}
+	} else {
+		panic("Columns argument must be []int or []string.")
+	}
+
+	cols := make([]rockstarColumn, len(idxs))
+	for i, idx := range idxs {
+		if idx < 0 || idx >= len(rockstarColumns) {
+			panic(fmt.Sprintf("Column %d is not in Rockstar binary files.",
+				idx))
+		}
+		cols[i] = rockstarColumns[idx]
+		if cols[i].f == nil && cols[i].i == nil {
+			panic(fmt.Sprintf("Column '%s' is not stored in Rockstar " +
+				"binary files.", cols[i].name))
+		}
+	}
+
+	return cols
+}
+
+// haloes returns the total number of haloes in every block.
+func (rd *RockstarBinaryReader) haloes() int {
+	n := 0
+	for i := range rd.hds { n += int(rd.hds[i].Haloes) }
+	return n
+}
+
+func (rd *RockstarBinaryReader) ReadInts(
+	columns interface{}, optBuf ...[][]int,
+) [][]int {
+	cols := rd.columns(columns)
+	bufs := cleanIntBuffer(optBuf, len(cols), rd.haloes())
+
+	start := 0
+	for block := range rd.hds {
+		n := int(rd.hds[block].Haloes)
+		sub := make([][]int, len(cols))
+		for i := range sub { sub[i] = bufs[i][start: start + n] }
+		rd.ReadIntBlock(columns, block, sub)
+		start += n
+	}
+
+	return bufs
+}
+
+func (rd *RockstarBinaryReader) ReadFloat64s(
+	columns interface{}, optBuf ...[][]float64,
+) [][]float64 {
+	cols := rd.columns(columns)
+	bufs := cleanFloat64Buffer(optBuf, len(cols), rd.haloes())
+
+	start := 0
+	for block := range rd.hds {
+		n := int(rd.hds[block].Haloes)
+		sub := make([][]float64, len(cols))
+		for i := range sub { sub[i] = bufs[i][start: start + n] }
+		rd.ReadFloat64Block(columns, block, sub)
+		start += n
+	}
+
+	return bufs
+}
+
+func (rd *RockstarBinaryReader) ReadFloat32s(
+	columns interface{}, optBuf ...[][]float32,
+) [][]float32 {
+	cols := rd.columns(columns)
+	bufs := cleanFloat32Buffer(optBuf, len(cols), rd.haloes())
+
+	start := 0
+	for block := range rd.hds {
+		n := int(rd.hds[block].Haloes)
+		sub := make([][]float32, len(cols))
+		for i := range sub { sub[i] = bufs[i][start: start + n] }
+		rd.ReadFloat32Block(columns, block, sub)
+		start += n
+	}
+
+	return bufs
+}
+
+func (rd *RockstarBinaryReader) Blocks() int {
+	return len(rd.hds)
+}
+
+func (rd *RockstarBinaryReader) ReadIntBlock(
+	columns interface{}, block int, optBuf ...[][]int,
+) [][]int {
+	cols := rd.columns(columns)
+	haloes := rd.readHaloes(block)
+	bufs := cleanIntBuffer(optBuf, len(cols), len(haloes))
+
+	for i, col := range cols {
+		for j := range haloes {
+			if col.i != nil {
+				bufs[i][j] = int(col.i(&haloes[j]))
+			} else {
+				bufs[i][j] = int(col.f(&haloes[j]))
+			}
+		}
+	}
+
+	return bufs
+}
+
+func (rd *RockstarBinaryReader) ReadFloat64Block(
+	columns interface{}, block int, optBuf ...[][]float64,
+) [][]float64 {
+	cols := rd.columns(columns)
+	haloes := rd.readHaloes(block)
+	bufs := cleanFloat64Buffer(optBuf, len(cols), len(haloes))
+
+	for i, col := range cols {
+		for j := range haloes {
+			if col.i != nil {
+				bufs[i][j] = float64(col.i(&haloes[j]))
+			} else {
+				bufs[i][j] = float64(col.f(&haloes[j]))
+			}
+		}
+	}
+
+	return bufs
+}
+
+func (rd *RockstarBinaryReader) ReadFloat32Block(
+	columns interface{}, block int, optBuf ...[][]float32,
+) [][]float32 {
+	cols := rd.columns(columns)
+	haloes := rd.readHaloes(block)
+	bufs := cleanFloat32Buffer(optBuf, len(cols), len(haloes))
+
+	for i, col := range cols {
+		for j := range haloes {
+			if col.i != nil {
+				bufs[i][j] = float32(col.i(&haloes[j]))
+			} else {
+				bufs[i][j] = col.f(&haloes[j])
+			}
+		}
+	}
+
+	return bufs
+}
+
+// ReadParticleIDBlock returns the IDs of the member particles of every halo
+// in block i, in the same order as the halos returned by ReadIntBlock.
+func (rd *RockstarBinaryReader) ReadParticleIDBlock(i int) [][]int64 {
+	haloes := rd.readHaloes(i)
+
+	f, err := os.Open(rd.fnames[i])
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+
+	_, err = f.Seek(rockstarHeaderSize + rd.hds[i].Haloes*rockstarHaloSize, 0)
+	if err != nil { panic(err.Error()) }
+	ids := make([]int64, rd.hds[i].Particles)
+	err = binary.Read(f, binary.LittleEndian, ids)
+	if err != nil { panic(err.Error()) }
+
+	out := make([][]int64, len(haloes))
+	for j := range haloes {
+		start, end := haloes[j].PStart, haloes[j].PStart + haloes[j].NumP
+		if start < 0 || end > int64(len(ids)) || start > end {
+			panic(fmt.Sprintf("Corruption detected in the file %s.",
+				rd.fnames[i]))
+		}
+		out[j] = ids[start: end: end]
+	}
+
+	return out
+}
+
+// ReadParticleIDs returns the IDs of the member particles of every halo in
+// every block, in the same order as the halos returned by ReadInts.
+func (rd *RockstarBinaryReader) ReadParticleIDs() [][]int64 {
+	out := make([][]int64, 0, rd.haloes())
+	for i := range rd.hds { out = append(out, rd.ReadParticleIDBlock(i)...) }
+	return out
+}
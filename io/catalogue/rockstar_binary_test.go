@@ -0,0 +1,161 @@
+package catalogue
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeTestRockstarBinary writes a halos_*.bin file with the given haloes
+// and member particle IDs. PStart and NumP are set from ids.
+func writeTestRockstarBinary(
+	fname string, haloes []rockstarHalo, ids [][]int64,
+) error {
+	hd := RockstarHeader{
+		Magic: RockstarMagic, Scale: 0.5, BoxSize: 125,
+		Haloes: int64(len(haloes)),
+	}
+	copy(hd.Version[:], "0.99.9-RC3")
+
+	flat := []int64{ }
+	for i := range haloes {
+		haloes[i].PStart = int64(len(flat))
+		haloes[i].NumP = int64(len(ids[i]))
+		flat = append(flat, ids[i]...)
+	}
+	hd.Particles = int64(len(flat))
+
+	f, err := os.Create(fname)
+	if err != nil { return err }
+	defer f.Close()
+	err = binary.Write(f, binary.LittleEndian, &hd)
+	if err != nil { return err }
+	err = binary.Write(f, binary.LittleEndian, haloes)
+	if err != nil { return err }
+	return binary.Write(f, binary.LittleEndian, flat)
+}
+
+func TestRockstarBinary(t *testing.T) {
+	if rockstarHeaderSize != 256 || rockstarHaloSize != 264 {
+		t.Fatalf("Header and halo sizes are %d and %d, not 256 and 264.",
+			rockstarHeaderSize, rockstarHaloSize)
+	}
+
+	dir, err := ioutil.TempDir(".", "test_rockstar_data")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	haloes := [][]rockstarHalo{
+		make([]rockstarHalo, 3), make([]rockstarHalo, 2),
+	}
+	ids := [][][]int64{
+		{ { 1, 2, 3 }, { }, { 10, 11 } }, { { 7 }, { 8, 9, 12, 13 } },
+	}
+	fnames := []string{
+		path.Join(dir, "halos_0.0.bin"), path.Join(dir, "halos_0.1.bin"),
+	}
+	n := 0
+	for b := range haloes {
+		for i := range haloes[b] {
+			h := &haloes[b][i]
+			h.ID = int64(100 + n)
+			h.Pos = [6]float32{
+				float32(n), float32(n) + 0.5, 2, 300, -100, float32(n),
+			}
+			h.M, h.AltM[1], h.KinToPot = 1e3*float32(n + 1), 3, 0.25
+			h.NumChildParticles, h.Desc = int64(2*n), int64(-1)
+			n++
+		}
+		err = writeTestRockstarBinary(fnames[b], haloes[b], ids[b])
+		if err != nil { t.Fatal(err.Error()) }
+	}
+
+	rd := RockstarBinary(fnames...)
+	if rd.Blocks() != 2 {
+		t.Fatalf("Expected 2 blocks, got %d.", rd.Blocks())
+	}
+	if hd := rd.Header(1); hd.Haloes != 2 || hd.Particles != 5 ||
+		hd.BoxSize != 125 || hd.Scale != 0.5 {
+		t.Errorf("Header of block 1 is %+v.", hd)
+	}
+
+	// Names are case-insensitive and match halos_*.ascii column indices.
+	intCols := rd.ReadInts([]string{ "ID", "num_p", "num_cp", "desc" })
+	idxCols := rd.ReadInts([]int{ 0, 1, 52, 54 })
+	if !intsEq(intCols[0], []int{ 100, 101, 102, 103, 104 }) ||
+		!intsEq(intCols[1], []int{ 3, 0, 2, 1, 4 }) ||
+		!intsEq(intCols[2], []int{ 0, 2, 4, 6, 8 }) ||
+		!intsEq(intCols[3], []int{ -1, -1, -1, -1, -1 }) {
+		t.Errorf("Read %d from integer columns.", intCols)
+	}
+	for i := range intCols {
+		if !intsEq(intCols[i], idxCols[i]) {
+			t.Errorf("Column %d is %d by name and %d by index.",
+				i, intCols[i], idxCols[i])
+		}
+	}
+
+	floatCols := rd.ReadFloat64Block(
+		[]string{ "x", "y", "vx", "Mvir", "m200c", "T/|U|" }, 1,
+	)
+	expected := [][]float64{
+		{ 3, 4 }, { 3.5, 4.5 }, { 300, 300 }, { 4e3, 5e3 }, { 3, 3 },
+		{ 0.25, 0.25 },
+	}
+	for i := range expected {
+		if !float64sAlmostEq(floatCols[i], expected[i], 1e-3) {
+			t.Errorf("Expected column %d of block 1 to be %g, got %g.",
+				i, expected[i], floatCols[i])
+		}
+	}
+
+	f32 := rd.ReadFloat32s([]int{ 8, 13 })
+	if !float32sAlmostEq(f32[0], []float32{ 0, 1, 2, 3, 4 }, 1e-6) ||
+		!float32sAlmostEq(f32[1], []float32{ 0, 1, 2, 3, 4 }, 1e-6) {
+		t.Errorf("Read %g from float32 columns.", f32)
+	}
+
+	block := rd.ReadParticleIDBlock(1)
+	if len(block) != 2 || !int64sEq(block[0], []int64{ 7 }) ||
+		!int64sEq(block[1], []int64{ 8, 9, 12, 13 }) {
+		t.Errorf("Read %d as the particle IDs of block 1.", block)
+	}
+	all := rd.ReadParticleIDs()
+	flat := append(append([][]int64{ }, ids[0]...), ids[1]...)
+	if len(all) != len(flat) {
+		t.Fatalf("Read %d particle ID lists, expected %d.",
+			len(all), len(flat))
+	}
+	for i := range all {
+		if !int64sEq(all[i], flat[i]) {
+			t.Errorf("Read %d as the particle IDs of halo %d, not %d.",
+				all[i], i, flat[i])
+		}
+	}
+
+	// Columns which only exist in text files can't be read.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic when reading 'mmetric'.")
+			}
+		}()
+		rd.ReadFloat64s([]string{ "mmetric" })
+	}()
+
+	// Truncated files are detected.
+	info, err := os.Stat(fnames[1])
+	if err != nil { t.Fatal(err.Error()) }
+	err = os.Truncate(fnames[1], info.Size() - 8)
+	if err != nil { t.Fatal(err.Error()) }
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic for a truncated file.")
+			}
+		}()
+		RockstarBinary(fnames...)
+	}()
+}
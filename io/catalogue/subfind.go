@@ -0,0 +1,528 @@
+package catalogue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// SubfindConfig describes the compile-time options of the Gadget run which
+// wrote a set of SUBFIND files. These change the layout of subhalo_tab and
+// *_ids files.
+type SubfindConfig struct {
+	LongIDs bool // Particle IDs are 64-bit (LONGIDS).
+	// VelDisp is true if groups store velocity dispersions
+	// (SO_VEL_DISPERSIONS).
+	VelDisp bool
+	// MassTable is true if subhalos store the mass of each particle type
+	// (SAVE_MASS_TAB).
+	MassTable bool
+}
+
+// DefaultSubfindConfig is a SubfindConfig instance for Gadget runs compiled
+// without any of the optional SUBFIND outputs.
+var DefaultSubfindConfig = SubfindConfig{ }
+
+// SubfindHeader is the header of a group_tab, subhalo_tab, group_ids, or
+// subhalo_ids file. Subhalos and TotSubhalos are only set for subhalo_tab
+// files, and Offset is only set for *_ids files.
+type SubfindHeader struct {
+	Groups, TotGroups int32
+	IDs int32
+	TotIDs int64
+	Tasks int32
+	Subhalos, TotSubhalos int32
+	Offset int32 // Index of the file's first ID in the full ID list.
+}
+
+// subfindType is the type of a single field in a SUBFIND file.
+type subfindType int
+
+const (
+	subfindInt32 subfindType = iota
+	subfindUint32
+	subfindFloat32
+	subfindID // uint32 or int64, depending on SubfindConfig.LongIDs.
+)
+
+// subfindField is a single array in a SUBFIND file. Fields are stored one
+// after another, with every element of the first field followed by every
+// element of the second field and so on.
+type subfindField struct {
+	name string
+	kind subfindType
+	dim int // Number of components per object.
+	sub bool // True if the array has one element per subhalo.
+}
+
+var (
+	// subfindFOFFields are the fields of a group_tab file.
+	subfindFOFFields = []subfindField{
+		{ "group_len", subfindInt32, 1, false },
+		{ "group_offset", subfindUint32, 1, false },
+		{ "group_mass", subfindFloat32, 1, false },
+		{ "group_cm", subfindFloat32, 3, false },
+		{ "group_vel", subfindFloat32, 3, false },
+		{ "group_len_type", subfindInt32, 6, false },
+		{ "group_mass_type", subfindFloat32, 6, false },
+	}
+
+	// subfindGroupFields are the group fields of a subhalo_tab file, split
+	// around the optional velocity dispersions.
+	subfindGroupFields = []subfindField{
+		{ "group_len", subfindInt32, 1, false },
+		{ "group_offset", subfindUint32, 1, false },
+		{ "group_mass", subfindFloat32, 1, false },
+		{ "group_pos", subfindFloat32, 3, false },
+		{ "group_m_mean200", subfindFloat32, 1, false },
+		{ "group_r_mean200", subfindFloat32, 1, false },
+		{ "group_m_crit200", subfindFloat32, 1, false },
+		{ "group_r_crit200", subfindFloat32, 1, false },
+		{ "group_m_tophat200", subfindFloat32, 1, false },
+		{ "group_r_tophat200", subfindFloat32, 1, false },
+	}
+	subfindVelDispFields = []subfindField{
+		{ "group_veldisp_mean200", subfindFloat32, 1, false },
+		{ "group_veldisp_crit200", subfindFloat32, 1, false },
+		{ "group_veldisp_tophat200", subfindFloat32, 1, false },
+	}
+	subfindGroupTailFields = []subfindField{
+		{ "group_contamination_count", subfindInt32, 1, false },
+		{ "group_contamination_mass", subfindFloat32, 1, false },
+		{ "group_nsubs", subfindInt32, 1, false },
+		{ "group_firstsub", subfindInt32, 1, false },
+	}
+
+	// subfindSubhaloFields are the subhalo fields of a subhalo_tab file.
+	subfindSubhaloFields = []subfindField{
+		{ "sub_len", subfindInt32, 1, true },
+		{ "sub_offset", subfindUint32, 1, true },
+		{ "sub_parent", subfindInt32, 1, true },
+		{ "sub_mass", subfindFloat32, 1, true },
+		{ "sub_pos", subfindFloat32, 3, true },
+		{ "sub_vel", subfindFloat32, 3, true },
+		{ "sub_cm", subfindFloat32, 3, true },
+		{ "sub_spin", subfindFloat32, 3, true },
+		{ "sub_veldisp", subfindFloat32, 1, true },
+		{ "sub_vmax", subfindFloat32, 1, true },
+		{ "sub_vmaxrad", subfindFloat32, 1, true },
+		{ "sub_halfmassrad", subfindFloat32, 1, true },
+		{ "sub_id_most_bound", subfindID, 1, true },
+		{ "sub_grnr", subfindInt32, 1, true },
+	}
+	subfindMassTableFields = []subfindField{
+		{ "sub_masstab", subfindFloat32, 6, true },
+	}
+)
+
+// subfindColumn is a single column of a SubfindReader: one component of a
+// field.
+type subfindColumn struct {
+	field, comp int
+}
+
+// SubfindReader is a Reader for the groups or subhalos in a set of SUBFIND
+// group_tab or subhalo_tab files. Each file is a block. Column names are the
+// lower-case field names used by Gadget's readsubf.py, e.g. "group_len" or
+// "sub_mass". Vector fields are split into components with the suffixes
+// "_x", "_y", and "_z", and per-type fields with the suffixes "_0" to "_5".
+//
+// The group_offset and sub_offset columns index into the full list of IDs
+// returned by ReadSubfindIDs. Use Members to find the IDs of an object's
+// particles and snapshot.FindParticles to read them from the matching
+// Snapshot.
+type SubfindReader struct {
+	fnames []string
+	hds []SubfindHeader
+	config SubfindConfig
+	headerSize int64
+	fields []subfindField
+	sub bool // True if rows are subhalos.
+
+	columns []subfindColumn
+	lookup map[string]int
+	offset, length []int64 // Cached offset table.
+}
+
+// subhaloTabFields returns every field in a subhalo_tab file.
+func subhaloTabFields(config SubfindConfig) []subfindField {
+	fields := append([]subfindField{ }, subfindGroupFields...)
+	if config.VelDisp {
+		fields = append(fields, subfindVelDispFields...)
+	}
+	fields = append(fields, subfindGroupTailFields...)
+	fields = append(fields, subfindSubhaloFields...)
+	if config.MassTable {
+		fields = append(fields, subfindMassTableFields...)
+	}
+	return fields
+}
+
+func newSubfindReader(
+	fnames []string, fields []subfindField, sub bool, headerSize int64,
+	config SubfindConfig,
+) *SubfindReader {
+	rd := &SubfindReader{
+		fnames: fnames, hds: make([]SubfindHeader, len(fnames)),
+		config: config, headerSize: headerSize, fields: fields, sub: sub,
+		lookup: map[string]int{ },
+	}
+
+	for i, field := range fields {
+		if field.sub != sub { continue }
+		for comp := 0; comp < field.dim; comp++ {
+			name := field.name
+			if field.dim == 3 {
+				name = fmt.Sprintf("%s_%c", name, "xyz"[comp])
+			} else if field.dim > 1 {
+				name = fmt.Sprintf("%s_%d", name, comp)
+			}
+			rd.lookup[name] = len(rd.columns)
+			rd.columns = append(rd.columns, subfindColumn{ i, comp })
+		}
+	}
+
+	for i, fname := range fnames {
+		f, err := os.Open(fname)
+		if err != nil { panic(err.Error()) }
+		info, err := f.Stat()
+		if err != nil { panic(err.Error()) }
+		rd.hds[i], err = readSubfindHeader(f, headerSize)
+		f.Close()
+		if err != nil { panic(err.Error()) }
+
+		if info.Size() != rd.fieldOffset(i, len(fields)) {
+			panic(fmt.Sprintf("Corruption detected in the file %s.", fname))
+		}
+	}
+
+	return rd
+}
+
+// readSubfindHeader reads the header at the start of a SUBFIND file. The
+// size of the header determines which fields it contains.
+func readSubfindHeader(
+	rd io.Reader, headerSize int64,
+) (SubfindHeader, error) {
+	hd := SubfindHeader{ }
+	fields := []interface{}{
+		&hd.Groups, &hd.TotGroups, &hd.IDs, &hd.TotIDs, &hd.Tasks,
+	}
+	switch headerSize {
+	case 28:
+		fields = append(fields, &hd.Offset)
+	case 32:
+		fields = append(fields, &hd.Subhalos, &hd.TotSubhalos)
+	}
+
+	for _, field := range fields {
+		err := binary.Read(rd, binary.LittleEndian, field)
+		if err != nil { return hd, err }
+	}
+	return hd, nil
+}
+
+// Header returns the header of the file associated with block i.
+func (rd *SubfindReader) Header(i int) *SubfindHeader {
+	return &rd.hds[i]
+}
+
+// typeSize returns the number of bytes used by a single element of a type.
+func (rd *SubfindReader) typeSize(kind subfindType) int64 {
+	if kind == subfindID && rd.config.LongIDs { return 8 }
+	return 4
+}
+
+// rows returns the number of elements in a field of block i.
+func (rd *SubfindReader) rows(i int, sub bool) int64 {
+	if sub { return int64(rd.hds[i].Subhalos) }
+	return int64(rd.hds[i].Groups)
+}
+
+// fieldOffset returns the byte offset of field k in block i. If k is the
+// number of fields, the size of the file is returned.
+func (rd *SubfindReader) fieldOffset(i, k int) int64 {
+	offset := rd.headerSize
+	for _, field := range rd.fields[:k] {
+		offset += rd.rows(i, field.sub) * int64(field.dim) *
+			rd.typeSize(field.kind)
+	}
+	return offset
+}
+
+// columnIndices converts the generic columns variable into integer indices.
+func (rd *SubfindReader) columnIndices(columns interface{}) []int {
+	if intCols, ok := columns.([]int); ok {
+		for _, col := range intCols {
+			if col < 0 || col >= len(rd.columns) {
+				panic(fmt.Sprintf("Column %d is out of range.", col))
+			}
+		}
+		return intCols
+	} else if strCols, ok := columns.([]string); ok {
+		idxs := make([]int, len(strCols))
+		for i := range strCols {
+			name := strings.ToLower(strings.Trim(strCols[i], " "))
+			idx, ok := rd.lookup[name]
+			if !ok {
+				panic(fmt.Sprintf("Name '%s' not in columns.", strCols[i]))
+			}
+			idxs[i] = idx
+		}
+		return idxs
+	}
+	panic("Columns argument must be []int or []string.")
+}
+
+// readColumn reads a column of block i. Integer fields are returned as ints
+// and floating point fields as floats.
+func (rd *SubfindReader) readColumn(
+	i, col int,
+) (ints []int64, floats []float32) {
+	k, comp := rd.columns[col].field, rd.columns[col].comp
+	field := rd.fields[k]
+	n := rd.rows(i, field.sub)
+
+	f, err := os.Open(rd.fnames[i])
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+	_, err = f.Seek(rd.fieldOffset(i, k), 0)
+	if err != nil { panic(err.Error()) }
+
+	size := rd.typeSize(field.kind)
+	buf := make([]byte, n*int64(field.dim)*size)
+	_, err = io.ReadFull(f, buf)
+	if err != nil { panic(err.Error()) }
+
+	order := binary.LittleEndian
+	if field.kind == subfindFloat32 {
+		floats = make([]float32, n)
+		for j := range floats {
+			b := buf[(int64(j)*int64(field.dim) + int64(comp))*size:]
+			floats[j] = math.Float32frombits(order.Uint32(b))
+		}
+		return nil, floats
+	}
+
+	ints = make([]int64, n)
+	for j := range ints {
+		b := buf[(int64(j)*int64(field.dim) + int64(comp))*size:]
+		switch {
+		case size == 8:
+			ints[j] = int64(order.Uint64(b))
+		case field.kind == subfindInt32:
+			ints[j] = int64(int32(order.Uint32(b)))
+		default:
+			ints[j] = int64(order.Uint32(b))
+		}
+	}
+	return ints, nil
+}
+
+// totalRows returns the number of rows in every block.
+func (rd *SubfindReader) totalRows() int {
+	n := 0
+	for i := range rd.hds { n += int(rd.rows(i, rd.sub)) }
+	return n
+}
+
+func (rd *SubfindReader) ReadInts(
+	columns interface{}, optBuf ...[][]int,
+) [][]int {
+	cols := rd.columnIndices(columns)
+	bufs := cleanIntBuffer(optBuf, len(cols), rd.totalRows())
+
+	start := 0
+	for block := range rd.hds {
+		n := int(rd.rows(block, rd.sub))
+		sub := make([][]int, len(cols))
+		for i := range sub { sub[i] = bufs[i][start: start + n] }
+		rd.ReadIntBlock(cols, block, sub)
+		start += n
+	}
+
+	return bufs
+}
+
+func (rd *SubfindReader) ReadFloat64s(
+	columns interface{}, optBuf ...[][]float64,
+) [][]float64 {
+	cols := rd.columnIndices(columns)
+	bufs := cleanFloat64Buffer(optBuf, len(cols), rd.totalRows())
+
+	start := 0
+	for block := range rd.hds {
+		n := int(rd.rows(block, rd.sub))
+		sub := make([][]float64, len(cols))
+		for i := range sub { sub[i] = bufs[i][start: start + n] }
+		rd.ReadFloat64Block(cols, block, sub)
+		start += n
+	}
+
+	return bufs
+}
+
+func (rd *SubfindReader) ReadFloat32s(
+	columns interface{}, optBuf ...[][]float32,
+) [][]float32 {
+	cols := rd.columnIndices(columns)
+	bufs := cleanFloat32Buffer(optBuf, len(cols), rd.totalRows())
+
+	start := 0
+	for block := range rd.hds {
+		n := int(rd.rows(block, rd.sub))
+		sub := make([][]float32, len(cols))
+		for i := range sub { sub[i] = bufs[i][start: start + n] }
+		rd.ReadFloat32Block(cols, block, sub)
+		start += n
+	}
+
+	return bufs
+}
+
+func (rd *SubfindReader) Blocks() int {
+	return len(rd.hds)
+}
+
+func (rd *SubfindReader) ReadIntBlock(
+	columns interface{}, block int, optBuf ...[][]int,
+) [][]int {
+	cols := rd.columnIndices(columns)
+	n := int(rd.rows(block, rd.sub))
+	bufs := cleanIntBuffer(optBuf, len(cols), n)
+
+	for i, col := range cols {
+		ints, floats := rd.readColumn(block, col)
+		for j := 0; j < n; j++ {
+			if ints != nil {
+				bufs[i][j] = int(ints[j])
+			} else {
+				bufs[i][j] = int(floats[j])
+			}
+		}
+	}
+
+	return bufs
+}
+
+func (rd *SubfindReader) ReadFloat64Block(
+	columns interface{}, block int, optBuf ...[][]float64,
+) [][]float64 {
+	cols := rd.columnIndices(columns)
+	n := int(rd.rows(block, rd.sub))
+	bufs := cleanFloat64Buffer(optBuf, len(cols), n)
+
+	for i, col := range cols {
+		ints, floats := rd.readColumn(block, col)
+		for j := 0; j < n; j++ {
+			if ints != nil {
+				bufs[i][j] = float64(ints[j])
+			} else {
+				bufs[i][j] = float64(floats[j])
+			}
+		}
+	}
+
+	return bufs
+}
+
+func (rd *SubfindReader) ReadFloat32Block(
+	columns interface{}, block int, optBuf ...[][]float32,
+) [][]float32 {
+	cols := rd.columnIndices(columns)
+	n := int(rd.rows(block, rd.sub))
+	bufs := cleanFloat32Buffer(optBuf, len(cols), n)
+
+	for i, col := range cols {
+		ints, floats := rd.readColumn(block, col)
+		for j := 0; j < n; j++ {
+			if ints != nil {
+				bufs[i][j] = float32(ints[j])
+			} else {
+				bufs[i][j] = floats[j]
+			}
+		}
+	}
+
+	return bufs
+}
+
+// Offsets returns the offset table of every group or subhalo: the index of
+// its first particle in the list returned by ReadSubfindIDs and its number
+// of particles. The returned slices must not be modified.
+func (rd *SubfindReader) Offsets() (offset, length []int64) {
+	if rd.offset != nil { return rd.offset, rd.length }
+
+	prefix := "group"
+	if rd.sub { prefix = "sub" }
+
+	cols := rd.columnIndices([]string{ prefix + "_offset", prefix + "_len" })
+	rd.offset, rd.length = []int64{ }, []int64{ }
+	for i := range rd.hds {
+		off, _ := rd.readColumn(i, cols[0])
+		n, _ := rd.readColumn(i, cols[1])
+		rd.offset = append(rd.offset, off...)
+		rd.length = append(rd.length, n...)
+	}
+
+	return rd.offset, rd.length
+}
+
+// Members returns the IDs of the member particles of the group or subhalo
+// in row i, given the full list of IDs returned by ReadSubfindIDs.
+func (rd *SubfindReader) Members(ids []int64, i int) []int64 {
+	offset, length := rd.Offsets()
+	start, end := offset[i], offset[i] + length[i]
+	if start < 0 || end > int64(len(ids)) {
+		panic(fmt.Sprintf("Row %d has particles [%d, %d), but there are " +
+			"only %d IDs.", i, start, end, len(ids)))
+	}
+	return ids[start: end: end]
+}
+
+// ReadSubfindIDs reads the full list of particle IDs from a set of
+// group_ids or subhalo_ids files. An optional config describes the layout of
+// the files, otherwise DefaultSubfindConfig is used.
+func ReadSubfindIDs(fnames []string, config ...SubfindConfig) []int64 {
+	c := DefaultSubfindConfig
+	if len(config) > 0 { c = config[0] }
+	size := int64(4)
+	if c.LongIDs { size = 8 }
+
+	var ids []int64
+	for _, fname := range fnames {
+		f, err := os.Open(fname)
+		if err != nil { panic(err.Error()) }
+		info, err := f.Stat()
+		if err != nil { panic(err.Error()) }
+		hd, err := readSubfindHeader(f, 28)
+		if err != nil { panic(err.Error()) }
+
+		if ids == nil { ids = make([]int64, hd.TotIDs) }
+		end := int64(hd.Offset) + int64(hd.IDs)
+		if info.Size() != 28 + int64(hd.IDs)*size || hd.Offset < 0 ||
+			end > int64(len(ids)) {
+			panic(fmt.Sprintf("Corruption detected in the file %s.", fname))
+		}
+
+		buf := make([]byte, int64(hd.IDs)*size)
+		_, err = io.ReadFull(f, buf)
+		f.Close()
+		if err != nil { panic(err.Error()) }
+
+		for j := int64(0); j < int64(hd.IDs); j++ {
+			if size == 8 {
+				ids[int64(hd.Offset) + j] =
+					int64(binary.LittleEndian.Uint64(buf[j*8:]))
+			} else {
+				ids[int64(hd.Offset) + j] =
+					int64(binary.LittleEndian.Uint32(buf[j*4:]))
+			}
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,168 @@
+package catalogue
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeTestSubfind writes a SUBFIND file containing each of the given values
+// in order, starting with the header.
+func writeTestSubfind(fname string, values ...interface{}) error {
+	f, err := os.Create(fname)
+	if err != nil { return err }
+	defer f.Close()
+
+	for _, val := range values {
+		err = binary.Write(f, binary.LittleEndian, val)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+// zeros32 returns a float32 array of length n.
+func zeros32(n int) []float32 { return make([]float32, n) }
+
+func TestSubfindFOFGroups(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_subfind_data")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	tabs := []string{
+		path.Join(dir, "group_tab_005.0"), path.Join(dir, "group_tab_005.1"),
+	}
+	idFiles := []string{
+		path.Join(dir, "group_ids_005.0"), path.Join(dir, "group_ids_005.1"),
+	}
+
+	// File 0 has two groups and file 1 has one.
+	lenType := make([]int32, 18)
+	lenType[6*1 + 1] = 2
+	err = writeTestSubfind(tabs[0], int32(2), int32(3), int32(5), int64(8),
+		int32(2), []int32{ 3, 2 }, []uint32{ 0, 3 }, []float32{ 3, 2 },
+		[]float32{ 1, 2, 3, 4, 5, 6 }, zeros32(6), lenType[:12],
+		zeros32(12))
+	if err != nil { t.Fatal(err.Error()) }
+	err = writeTestSubfind(tabs[1], int32(1), int32(3), int32(3), int64(8),
+		int32(2), []int32{ 3 }, []uint32{ 5 }, []float32{ 3 },
+		[]float32{ 7, 8, 9 }, zeros32(3), lenType[12:], zeros32(6))
+	if err != nil { t.Fatal(err.Error()) }
+
+	// The second file is written first to check that Offset is used.
+	err = writeTestSubfind(idFiles[0], int32(2), int32(3), int32(5),
+		int64(8), int32(2), int32(0), []uint32{ 10, 11, 12, 20, 21 })
+	if err != nil { t.Fatal(err.Error()) }
+	err = writeTestSubfind(idFiles[1], int32(1), int32(3), int32(3),
+		int64(8), int32(2), int32(5), []uint32{ 30, 31, 32 })
+	if err != nil { t.Fatal(err.Error()) }
+
+	rd := SubfindFOFGroups(tabs...)
+	if rd.Blocks() != 2 || rd.Header(0).TotGroups != 3 {
+		t.Fatalf("Expected 2 blocks and 3 groups, got %d and %d.",
+			rd.Blocks(), rd.Header(0).TotGroups)
+	}
+
+	ints := rd.ReadInts([]string{ "group_len", "Group_Len_Type_1" })
+	if !intsEq(ints[0], []int{ 3, 2, 3 }) ||
+		!intsEq(ints[1], []int{ 0, 2, 0 }) {
+		t.Errorf("Read %d from integer columns.", ints)
+	}
+	floats := rd.ReadFloat32s([]string{ "group_cm_y", "group_mass" })
+	if !float32sEq(floats[0], []float32{ 2, 5, 8 }) ||
+		!float32sEq(floats[1], []float32{ 3, 2, 3 }) {
+		t.Errorf("Read %g from float columns.", floats)
+	}
+	if block := rd.ReadFloat64Block([]int{ 4 }, 1)[0]; !float64sEq(
+		block, []float64{ 8 }) {
+		t.Errorf("Read %g from column 4 of block 1.", block)
+	}
+
+	ids := ReadSubfindIDs([]string{ idFiles[1], idFiles[0] })
+	if !int64sEq(ids, []int64{ 10, 11, 12, 20, 21, 30, 31, 32 }) {
+		t.Fatalf("Read IDs %d.", ids)
+	}
+
+	offset, length := rd.Offsets()
+	if !int64sEq(offset, []int64{ 0, 3, 5 }) ||
+		!int64sEq(length, []int64{ 3, 2, 3 }) {
+		t.Errorf("Read offsets %d and lengths %d.", offset, length)
+	}
+	members := [][]int64{ { 10, 11, 12 }, { 20, 21 }, { 30, 31, 32 } }
+	for i := range members {
+		if m := rd.Members(ids, i); !int64sEq(m, members[i]) {
+			t.Errorf("Group %d has members %d, not %d.", i, m, members[i])
+		}
+	}
+}
+
+func TestSubfindSubhalos(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_subfind_data")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	fname := path.Join(dir, "subhalo_tab_005.0")
+	config := SubfindConfig{ LongIDs: true, VelDisp: true }
+
+	// Two groups, followed by three subhalos.
+	values := []interface{}{
+		int32(2), int32(2), int32(6), int64(6), int32(1), int32(3), int32(3),
+		[]int32{ 4, 2 }, []uint32{ 0, 4 }, []float32{ 4, 2 }, zeros32(6),
+	}
+	for i := 0; i < 6; i++ { values = append(values, zeros32(2)) }
+	values = append(values,
+		[]float32{ 0, 1 }, []float32{ 100, 200 }, []float32{ 0, 2 },
+		[]int32{ 0, 0 }, zeros32(2), []int32{ 2, 1 }, []int32{ 0, 2 },
+
+		[]int32{ 3, 1, 2 }, []uint32{ 0, 3, 4 }, []int32{ 0, 1, 0 },
+		[]float32{ 3, 1, 2 }, []float32{ 1, 2, 3, 4, 5, 6, 7, 8, 9 },
+		zeros32(9), zeros32(9), zeros32(9), zeros32(3),
+		[]float32{ 50, 60, 70 }, zeros32(3), zeros32(3),
+		[]int64{ 1 << 40, 2, 3 }, []int32{ 0, 0, 1 },
+	)
+	if err = writeTestSubfind(fname, values...); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	groups := SubfindGroups([]string{ fname }, config)
+	subs := SubfindSubhalos([]string{ fname }, config)
+
+	gCols := groups.ReadFloat64s([]string{
+		"group_veldisp_crit200", "group_nsubs", "group_firstsub",
+	})
+	expected := [][]float64{ { 100, 200 }, { 2, 1 }, { 0, 2 } }
+	for i := range expected {
+		if !float64sEq(gCols[i], expected[i]) {
+			t.Errorf("Group column %d is %g, not %g.",
+				i, gCols[i], expected[i])
+		}
+	}
+
+	sCols := subs.ReadInts([]string{ "sub_id_most_bound", "sub_grnr" })
+	if !intsEq(sCols[0], []int{ 1 << 40, 2, 3 }) ||
+		!intsEq(sCols[1], []int{ 0, 0, 1 }) {
+		t.Errorf("Read %d from subhalo integer columns.", sCols)
+	}
+	fCols := subs.ReadFloat32Block([]string{ "sub_pos_z", "sub_vmax" }, 0)
+	if !float32sEq(fCols[0], []float32{ 3, 6, 9 }) ||
+		!float32sEq(fCols[1], []float32{ 50, 60, 70 }) {
+		t.Errorf("Read %g from subhalo float columns.", fCols)
+	}
+
+	offset, length := subs.Offsets()
+	if !int64sEq(offset, []int64{ 0, 3, 4 }) ||
+		!int64sEq(length, []int64{ 3, 1, 2 }) {
+		t.Errorf("Read subhalo offsets %d and lengths %d.", offset, length)
+	}
+
+	// The wrong config changes the expected file size.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic for the wrong SubfindConfig.")
+			}
+		}()
+		SubfindSubhalos([]string{ fname })
+	}()
+}
@@ -1,15 +1,22 @@
 package catalogue
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"runtime"
+	"strings"
 )
 
 type textReader struct {
 	rd io.ReadSeeker
 	config TextConfig
 	size int
+	start int // First byte after the skipped lines.
+	// names and lowerNames map the column names found in the file's header
+	// to column indices.
+	names, lowerNames map[string]int
 	blockStarts []int
 	blockEnds []int
 	buf []byte
@@ -23,11 +30,13 @@ func newTextReader(
 ) *textReader {
 	reader := &textReader{ config: DefaultConfig, size: size, rd: rd }
 	if len(config) > 0 { reader.config = config[0] }
-	
+	reader.start = reader.skipLines()
+	reader.readColumnNames()
 
 	// Figure out how many blocks are in the file.
-	blocks := 1 + size / reader.config.MaxBlockSize
-	if (blocks - 1)*reader.config.MaxBlockSize == size { blocks-- }
+	n := size - reader.start
+	blocks := 1 + n / reader.config.MaxBlockSize
+	if (blocks - 1)*reader.config.MaxBlockSize == n { blocks-- }
 
 	reader.blockStarts = make([]int, blocks)
 	reader.blockEnds = make([]int, blocks)
@@ -56,14 +65,55 @@ func newTextReader(
 	return reader
 }
 
+// skipLines returns the index of the first byte after the first
+// config.SkipLines lines of the file.
+func (t *textReader) skipLines() int {
+	if t.config.SkipLines <= 0 { return 0 }
+
+	_, err := t.rd.Seek(0, 0)
+	if err != nil { panic(err.Error()) }
+	rd := bufio.NewReader(t.rd)
+
+	start := 0
+	for i := 0; i < t.config.SkipLines; i++ {
+		line, err := rd.ReadBytes('\n')
+		start += len(line)
+		if err == io.EOF { break }
+		if err != nil { panic(err.Error()) }
+	}
+
+	return start
+}
+
+// readColumnNames finds the names of each column if the first line of the
+// file is a commented header.
+func (t *textReader) readColumnNames() {
+	t.names, t.lowerNames = map[string]int{ }, map[string]int{ }
+
+	_, err := t.rd.Seek(0, 0)
+	if err != nil { panic(err.Error()) }
+	rd := bufio.NewReaderSize(t.rd, t.config.MaxLineSize)
+	line, err := rd.ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		panic(err.Error())
+	}
+
+	names := parseColumnNames(line, t.config.Separator, t.config.Comment)
+	for i, name := range names {
+		lower := strings.ToLower(name)
+		if _, ok := t.names[name]; !ok { t.names[name] = i }
+		if _, ok := t.lowerNames[lower]; !ok { t.lowerNames[lower] = i }
+	}
+}
+
 // blockStart returns the index of the starting byte of the specified byte. It
 // requires a buffer that is large enough to read any line of the catalogue
 // file.
 func (t *textReader) blockStart(block int, buf []byte) int {
-	if block == 0 { return 0 }
+	if block == 0 { return t.start }
 
 	// starting and ending indices of the line surrounding the block break
-	lineEnd := block * t.config.MaxBlockSize
+	lineEnd := t.start + block * t.config.MaxBlockSize
 	if lineEnd > t.size { lineEnd = t.size }
 	lineStart := lineEnd - len(buf)
 
@@ -84,18 +134,28 @@ func (t *textReader) blockStart(block int, buf []byte) int {
 
 // columnIndices converts the generic columns variable into integer indices.
 // If columns is []int, it returns them, if columns is []string, it looks up the
-// corresponding ints.
+// corresponding ints. Names in config.ColumnNames are used first, followed by
+// names in the file's header. Header names are matched case-insensitively if
+// there isn't an exact match.
 func (t *textReader) columnIndices(columns interface{}) []int {
 	if intCols, ok := columns.([]int); ok {
 		return intCols
 	} else if strCols, ok := columns.([]string); ok {
 		idxs := make([]int, len(strCols))
 		for i := range strCols {
-			if idx, ok := t.config.ColumnNames[strCols[i]]; ok {
+			name := strings.Trim(strCols[i], " ")
+			if idx, ok := t.config.ColumnNames[name]; ok {
+				idxs[i] = idx
+			} else if idx, ok := t.names[name]; ok {
 				idxs[i] = idx
+			} else if idx, ok := t.lowerNames[strings.ToLower(name)]; ok {
+				idxs[i] = idx
+			} else {
+				panic(fmt.Sprintf("Name '%s' not in columns.", strCols[i]))
 			}
 		}
-	} 
+		return idxs
+	}
 	panic("Columns argument must be []int or []string.")
 }
 
@@ -0,0 +1,299 @@
+package catalogue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// WriterConfig describes the columns of a catalogue created by a Writer.
+type WriterConfig struct {
+	// Names gives the name of each column. Names are case-insensitive and
+	// can't contain whitespace or commas.
+	Names []string
+	// Header is free-form text, e.g. units or provenance, which is stored
+	// at the start of the catalogue.
+	Header string
+	// Deltas maps the names of float columns to the width used to quantize
+	// them in binh files. Columns without an entry are stored as float32s.
+	// Other formats ignore Deltas.
+	Deltas map[string]float64
+}
+
+// Writer writes a halo catalogue in blocks. WriteBlock is called once for
+// each block and Close is called after the last one.
+type Writer interface {
+	// WriteBlock writes a block of haloes. cols has one element for each
+	// column in the order given by WriterConfig.Names, and each element is
+	// a []int, []float64, or []float32 with one value per halo. A column
+	// must have the same type in every block.
+	WriteBlock(cols []interface{}) error
+	// Close finishes the catalogue and closes the file.
+	Close() error
+}
+
+// writerColumns checks that the blocks passed to a Writer are consistent
+// with its WriterConfig.
+type writerColumns struct {
+	names []string
+	types []ColumnFlag // Int64, Float64, Float32, or -1 if not seen yet.
+	deltas []float64
+}
+
+// newWriterColumns checks the column names and deltas in config.
+func newWriterColumns(config WriterConfig) (*writerColumns, error) {
+	c := &writerColumns{
+		names: config.Names,
+		types: make([]ColumnFlag, len(config.Names)),
+		deltas: make([]float64, len(config.Names)),
+	}
+
+	idx := map[string]int{ }
+	for i, name := range config.Names {
+		if name == "" || strings.ContainsAny(name, ", \t\n\r") {
+			return nil, fmt.Errorf("Column name '%s' is empty or contains " +
+				"whitespace or a comma.", name)
+		}
+		lower := strings.ToLower(name)
+		if _, ok := idx[lower]; ok {
+			return nil, fmt.Errorf("Column name '%s' is used twice.", name)
+		}
+		idx[lower], c.types[i] = i, -1
+	}
+
+	for name, delta := range config.Deltas {
+		i, ok := idx[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("Delta given for '%s', which isn't a " +
+				"column.", name)
+		}
+		c.deltas[i] = delta
+	}
+
+	return c, nil
+}
+
+// check returns the number of haloes in a block after checking that it has
+// the right number of columns and that their types and lengths are
+// consistent.
+func (c *writerColumns) check(cols []interface{}) (int, error) {
+	if len(cols) != len(c.names) {
+		return 0, fmt.Errorf("Block has %d columns, but %d names were given.",
+			len(cols), len(c.names))
+	}
+
+	n := -1
+	for i := range cols {
+		var flag ColumnFlag
+		var length int
+		switch x := cols[i].(type) {
+		case []int: flag, length = Int64, len(x)
+		case []float64: flag, length = Float64, len(x)
+		case []float32: flag, length = Float32, len(x)
+		default:
+			return 0, fmt.Errorf("Column '%s' has type %T, not []int, " +
+				"[]float64, or []float32.", c.names[i], cols[i])
+		}
+
+		if c.types[i] != -1 && c.types[i] != flag {
+			return 0, fmt.Errorf("Column '%s' has type %T, but it had a " +
+				"different type in an earlier block.", c.names[i], cols[i])
+		}
+		if n != -1 && length != n {
+			return 0, fmt.Errorf("Column '%s' has length %d, but column " +
+				"'%s' has length %d.", c.names[i], length, c.names[0], n)
+		}
+		c.types[i], n = flag, length
+	}
+
+	if n == -1 { n = 0 }
+	return n, nil
+}
+
+// headerLines returns the lines of a text header.
+func headerLines(header string) []string {
+	header = strings.TrimRight(header, "\n")
+	if header == "" { return nil }
+	return strings.Split(header, "\n")
+}
+
+//////////////////
+// Text writers //
+//////////////////
+
+type textWriter struct {
+	f *os.File
+	wr *bufio.Writer
+	cols *writerColumns
+	sep byte
+	line []byte
+}
+
+func newTextWriter(
+	fname string, config WriterConfig, textConfig ...TextConfig,
+) (*textWriter, error) {
+	cols, err := newWriterColumns(config)
+	if err != nil { return nil, err }
+
+	tc := DefaultConfig
+	if len(textConfig) > 0 { tc = textConfig[0] }
+
+	f, err := os.Create(fname)
+	if err != nil { return nil, err }
+	w := &textWriter{ f: f, wr: bufio.NewWriter(f), cols: cols,
+		sep: tc.Separator }
+
+	// The column names go on the first line so Reader can find them.
+	w.wr.WriteByte(tc.Comment)
+	w.wr.WriteString(strings.Join(config.Names, string([]byte{ w.sep })))
+	w.wr.WriteByte('\n')
+	for _, line := range headerLines(config.Header) {
+		w.wr.WriteByte(tc.Comment)
+		w.wr.WriteString(" " + line + "\n")
+	}
+
+	return w, nil
+}
+
+func (w *textWriter) WriteBlock(cols []interface{}) error {
+	n, err := w.cols.check(cols)
+	if err != nil { return err }
+
+	for i := 0; i < n; i++ {
+		w.line = w.line[:0]
+		for j := range cols {
+			if j > 0 { w.line = append(w.line, w.sep) }
+			switch x := cols[j].(type) {
+			case []int:
+				w.line = strconv.AppendInt(w.line, int64(x[i]), 10)
+			case []float64:
+				w.line = strconv.AppendFloat(w.line, x[i], 'g', -1, 64)
+			case []float32:
+				w.line = strconv.AppendFloat(
+					w.line, float64(x[i]), 'g', -1, 32,
+				)
+			}
+		}
+		w.line = append(w.line, '\n')
+		if _, err = w.wr.Write(w.line); err != nil { return err }
+	}
+
+	return nil
+}
+
+func (w *textWriter) Close() error {
+	err := w.wr.Flush()
+	if cerr := w.f.Close(); err == nil { err = cerr }
+	return err
+}
+
+//////////////////
+// Binh writers //
+//////////////////
+
+type binhWriter struct {
+	f *os.File
+	wr *bufio.Writer
+	hd BinhFixedWidthHeader
+	cols *writerColumns
+	enc BinhEncoder
+	flags []ColumnFlag
+	keys []int64
+	fbuf []float64
+}
+
+func newBinhWriter(fname string, config WriterConfig) (*binhWriter, error) {
+	cols, err := newWriterColumns(config)
+	if err != nil { return nil, err }
+
+	lower := make([]string, len(config.Names))
+	for i := range lower { lower[i] = strings.ToLower(config.Names[i]) }
+	names := []byte(strings.Join(lower, ","))
+	text := []byte(config.Header)
+
+	f, err := os.Create(fname)
+	if err != nil { return nil, err }
+	w := &binhWriter{
+		f: f, wr: bufio.NewWriter(f), cols: cols,
+		flags: make([]ColumnFlag, len(lower)),
+		keys: make([]int64, len(lower)),
+	}
+
+	// Blocks is filled in by Close. Haloes aren't sorted or cut by mass, so
+	// there's no MassColumn.
+	w.hd = BinhFixedWidthHeader{
+		Version: BinhVersion, Seed: BinhSeed, Columns: int64(len(lower)),
+		MassColumn: -1, TextHeaderLength: int64(len(text)),
+		TextColumnNamesLength: int64(len(names)),
+	}
+	binary.Write(w.wr, binary.LittleEndian, w.hd)
+	binary.Write(w.wr, binary.LittleEndian, cols.deltas)
+	binary.Write(w.wr, binary.LittleEndian, make([]uint8, len(lower)))
+	binary.Write(w.wr, binary.LittleEndian, text)
+	binary.Write(w.wr, binary.LittleEndian, names)
+
+	return w, nil
+}
+
+func (w *binhWriter) WriteBlock(cols []interface{}) error {
+	n, err := w.cols.check(cols)
+	if err != nil { return err }
+
+	// Find column types. Empty columns don't have a range, so they get the
+	// widest type.
+	for i := range cols {
+		switch x := cols[i].(type) {
+		case []int:
+			w.flags[i], w.keys[i] = Int64, 0
+			if n > 0 { w.flags[i], w.keys[i] = intColumnType(x) }
+		default:
+			w.flags[i], w.keys[i] = Float32, 0
+			if n > 0 {
+				w.flags[i], w.keys[i] = float64ColumnType(
+					w.floats(cols[i]), w.cols.deltas[i],
+				)
+			}
+		}
+	}
+
+	binary.Write(w.wr, binary.LittleEndian, int64(n))
+	binary.Write(w.wr, binary.LittleEndian, w.flags)
+	binary.Write(w.wr, binary.LittleEndian, w.keys)
+
+	for i := range cols {
+		if x, ok := cols[i].([]int); ok {
+			w.enc.EncodeInts(w.flags[i], x, w.wr)
+		} else {
+			w.enc.EncodeFloat64s(w.flags[i], w.cols.deltas[i],
+				w.floats(cols[i]), w.wr)
+		}
+	}
+
+	w.hd.Blocks++
+	return nil
+}
+
+// floats returns a float column as a []float64.
+func (w *binhWriter) floats(col interface{}) []float64 {
+	switch x := col.(type) {
+	case []float64:
+		return x
+	case []float32:
+		if cap(w.fbuf) < len(x) { w.fbuf = make([]float64, len(x)) }
+		w.fbuf = w.fbuf[:len(x)]
+		for i := range x { w.fbuf[i] = float64(x[i]) }
+		return w.fbuf
+	}
+	panic("Impossible")
+}
+
+func (w *binhWriter) Close() error {
+	err := w.wr.Flush()
+	if err == nil { _, err = w.f.Seek(0, 0) }
+	if err == nil { err = binary.Write(w.f, binary.LittleEndian, w.hd) }
+	if cerr := w.f.Close(); err == nil { err = cerr }
+	return err
+}
@@ -0,0 +1,163 @@
+package catalogue
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeTestCatalogue writes two blocks of haloes with an int, a float64, and
+// a float32 column.
+func writeTestCatalogue(wr Writer, err error) error {
+	if err != nil { return err }
+	blocks := [][]interface{}{
+		{ []int{ 1, 2, -3 }, []float64{ 1e12, 2.5e11, 3.125 },
+			[]float32{ 0.5, 1.5, 2.5 } },
+		{ []int{ 1 << 40 }, []float64{ -7 }, []float32{ 100.25 } },
+	}
+	for _, block := range blocks {
+		if err = wr.WriteBlock(block); err != nil { return err }
+	}
+	return wr.Close()
+}
+
+func TestWriters(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_writer_data")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	config := WriterConfig{
+		Names: []string{ "ID", "Mvir", "Rvir" },
+		Header: "Units: Msun/h, kpc/h\nCut on Mvir.\n",
+		Deltas: map[string]float64{ "rvir": 0.01 },
+	}
+	id := []int{ 1, 2, -3, 1 << 40 }
+	mvir := []float64{ 1e12, 2.5e11, 3.125, -7 }
+	rvir := []float32{ 0.5, 1.5, 2.5, 100.25 }
+
+	textName := path.Join(dir, "halos.txt")
+	err = writeTestCatalogue(TextWriter(textName, config))
+	if err != nil { t.Fatal(err.Error()) }
+	binhName := path.Join(dir, "halos.binh")
+	err = writeTestCatalogue(BinhWriter(binhName, config))
+	if err != nil { t.Fatal(err.Error()) }
+	colName := path.Join(dir, "halos.col")
+	err = writeTestCatalogue(ColumnarWriter(colName, config))
+	if err != nil { t.Fatal(err.Error()) }
+
+	text, err := ioutil.ReadFile(textName)
+	if err != nil { t.Fatal(err.Error()) }
+	lines := strings.Split(string(text), "\n")
+	if lines[0] != "#ID Mvir Rvir" ||
+		lines[1] != "# Units: Msun/h, kpc/h" || lines[2] != "# Cut on Mvir." {
+		t.Errorf("Text catalogue starts with %q.", lines[:3])
+	}
+
+	col := Columnar(colName)
+	if col.TextHeader() != config.Header || col.Blocks() != 2 ||
+		col.Names()[1] != "Mvir" {
+		t.Errorf("Columnar file has header %q, %d blocks, and names %s.",
+			col.TextHeader(), col.Blocks(), col.Names())
+	}
+
+	readers := []Reader{ TextFile(textName), BinH(binhName), col }
+	for i, rd := range readers {
+		ints := rd.ReadInts([]string{ "id" })
+		if !intsEq(ints[0], id) {
+			t.Errorf("%d) Read IDs %d, not %d.", i, ints[0], id)
+		}
+		floats := rd.ReadFloat64s([]string{ "MVIR" })
+		if !float64sAlmostEq(floats[0], mvir, 1e-6 * 1e12) {
+			t.Errorf("%d) Read Mvir %g, not %g.", i, floats[0], mvir)
+		}
+		f32 := rd.ReadFloat32s([]string{ "Rvir" })
+		if !float32sAlmostEq(f32[0], rvir, 0.01) {
+			t.Errorf("%d) Read Rvir %g, not %g.", i, f32[0], rvir)
+		}
+	}
+
+	// Text and columnar files are lossless.
+	for i, rd := range []Reader{ readers[0], readers[2] } {
+		floats := rd.ReadFloat64s([]string{ "Mvir" })
+		f32 := rd.ReadFloat32s([]string{ "Rvir" })
+		if !float64sEq(floats[0], mvir) || !float32sEq(f32[0], rvir) {
+			t.Errorf("%d) Read %g and %g, not %g and %g.",
+				i, floats[0], f32[0], mvir, rvir)
+		}
+	}
+
+	block := col.ReadIntBlock([]int{ 0 }, 1)[0]
+	if !intsEq(block, []int{ 1 << 40 }) {
+		t.Errorf("Read %d from block 1 of the columnar file.", block)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic when reading floats as ints.")
+			}
+		}()
+		col.ReadInts([]string{ "mvir" })
+	}()
+
+	// Empty files can be written.
+	err = writeEmpty(BinhWriter(binhName, config))
+	if err != nil { t.Fatal(err.Error()) }
+	if n := len(BinH(binhName).ReadInts([]int{ 0 })[0]); n != 0 {
+		t.Errorf("Read %d haloes from an empty binh file.", n)
+	}
+	err = writeEmpty(ColumnarWriter(colName, config))
+	if err != nil { t.Fatal(err.Error()) }
+	if n := len(Columnar(colName).ReadFloat64s([]int{ 1 })[0]); n != 0 {
+		t.Errorf("Read %d haloes from an empty columnar file.", n)
+	}
+}
+
+// writeEmpty closes a Writer without writing any blocks.
+func writeEmpty(wr Writer, err error) error {
+	if err != nil { return err }
+	return wr.Close()
+}
+
+func TestWriterErrors(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_writer_data")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "halos.col")
+
+	configs := []WriterConfig{
+		{ Names: []string{ "ID", "id" } },
+		{ Names: []string{ "ID", "M vir" } },
+		{ Names: []string{ "ID" }, Deltas: map[string]float64{ "x": 1 } },
+	}
+	for i := range configs {
+		if _, err := ColumnarWriter(fname, configs[i]); err == nil {
+			t.Errorf("%d) Expected an error for config %+v.", i, configs[i])
+		}
+	}
+
+	wr, err := ColumnarWriter(fname, WriterConfig{
+		Names: []string{ "ID", "Mvir" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	defer wr.Close()
+
+	blocks := [][]interface{}{
+		{ []int{ 1 } },
+		{ []int{ 1 }, []float64{ 1, 2 } },
+		{ []int{ 1 }, []int64{ 1 } },
+	}
+	for i := range blocks {
+		if err = wr.WriteBlock(blocks[i]); err == nil {
+			t.Errorf("%d) Expected an error for block %v.", i, blocks[i])
+		}
+	}
+
+	err = wr.WriteBlock([]interface{}{ []int{ 1 }, []float64{ 1 } })
+	if err != nil { t.Fatal(err.Error()) }
+	err = wr.WriteBlock([]interface{}{ []int{ 1 }, []float32{ 1 } })
+	if err == nil {
+		t.Errorf("Expected an error when a column changes type.")
+	}
+}
@@ -0,0 +1,672 @@
+package hdf5
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+)
+
+const (
+	classFixed = 0
+	classFloat = 1
+	classString = 3
+
+	layoutCompact = 0
+	layoutContiguous = 1
+	layoutChunked = 2
+
+	chunkIndexSingle = 1
+	chunkIndexImplicit = 2
+
+	filterDeflate = 1
+	filterShuffle = 2
+	filterFletcher32 = 3
+)
+
+// datatype describes the type of the elements of a dataset or attribute.
+type datatype struct {
+	class int
+	size int
+	order binary.ByteOrder
+	signed bool
+}
+
+// filter is a single stage of a dataset's filter pipeline.
+type filter struct {
+	id int
+	values []uint32
+}
+
+// Dataset is a dataset within an HDF5 file.
+type Dataset struct {
+	file *File
+	Name string
+	Shape []uint64 // Size of each dimension. Scalars have no dimensions.
+
+	dtype datatype
+	layout int
+	compact []byte // Raw data of compact datasets.
+	addr, size uint64 // Address and size of contiguous data.
+	chunk []uint64 // Chunk size of each dimension, plus the element size.
+	chunkVersion uint64
+	chunkIndex int // Chunk index type of version 4 layouts.
+	filters []filter
+}
+
+// Attribute is an attribute attached to an HDF5 object.
+type Attribute struct {
+	Name string
+	Shape []uint64
+
+	dtype datatype
+	data []byte
+}
+
+// Dataset returns the dataset at the given path.
+func (file *File) Dataset(path string) (*Dataset, error) {
+	addr, err := file.lookup(path)
+	if err != nil { return nil, err }
+
+	msgs, err := file.readObjectHeader(addr)
+	if err != nil { return nil, err }
+
+	ds := &Dataset{ file: file, Name: path, layout: -1 }
+	hasType, hasSpace := false, false
+
+	for _, msg := range msgs {
+		switch msg.typ {
+		case msgDatatype:
+			ds.dtype, err = file.decodeDatatype(msg.data)
+			hasType = true
+		case msgDataspace:
+			ds.Shape, err = file.decodeDataspace(msg.data)
+			hasSpace = true
+		case msgLayout:
+			err = ds.decodeLayout(msg.data)
+		case msgFilters:
+			ds.filters, err = file.decodeFilters(msg.data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s: %s", path, file.name, err.Error())
+		}
+	}
+
+	if !hasType || !hasSpace || ds.layout == -1 {
+		return nil, fmt.Errorf("%s in %s is not a dataset.", path, file.name)
+	}
+
+	return ds, nil
+}
+
+// Attributes returns all the attributes of the object at the given path.
+func (file *File) Attributes(path string) (map[string]*Attribute, error) {
+	addr, err := file.lookup(path)
+	if err != nil { return nil, err }
+
+	msgs, err := file.readObjectHeader(addr)
+	if err != nil { return nil, err }
+
+	out := map[string]*Attribute{ }
+	for _, msg := range msgs {
+		switch msg.typ {
+		case msgAttribute:
+			attr, err := file.decodeAttribute(msg.data)
+			if err != nil {
+				return nil, fmt.Errorf("%s in %s: %s",
+					path, file.name, err.Error())
+			}
+			out[attr.Name] = attr
+		case msgAttributeInfo:
+			d := file.decoder(msg.data)
+			d.skip(1)
+			flags := d.u8()
+			if flags & 1 != 0 { d.skip(2) }
+			heap := d.offset()
+			if d.err == nil && !file.undefined(heap) {
+				return nil, fmt.Errorf("%s in %s uses dense attribute " +
+					"storage, which is not supported.", path, file.name)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// decodeDatatype decodes a datatype message.
+func (file *File) decodeDatatype(data []byte) (datatype, error) {
+	d := file.decoder(data)
+	classVersion := d.u8()
+	bits := d.u8()
+	d.skip(2)
+	dt := datatype{ class: int(classVersion & 0x0f), size: int(d.u32()) }
+	if d.err != nil { return dt, d.err }
+
+	dt.order = binary.LittleEndian
+	if bits & 1 != 0 { dt.order = binary.BigEndian }
+
+	switch dt.class {
+	case classFixed:
+		dt.signed = bits & 0x08 != 0
+	case classFloat:
+		if bits & 0x40 != 0 {
+			return dt, fmt.Errorf("VAX floating point is not supported.")
+		}
+	}
+
+	return dt, nil
+}
+
+// decodeDataspace decodes a dataspace message.
+func (file *File) decodeDataspace(data []byte) ([]uint64, error) {
+	d := file.decoder(data)
+	version := d.u8()
+	rank := int(d.u8())
+	d.skip(1)
+
+	switch version {
+	case 1:
+		d.skip(5)
+	case 2:
+		if d.u8() == 2 { return nil, fmt.Errorf("Null dataspace.") }
+	default:
+		return nil, fmt.Errorf("Unsupported dataspace version %d.", version)
+	}
+
+	shape := make([]uint64, rank)
+	for i := range shape { shape[i] = d.length() }
+
+	return shape, d.err
+}
+
+// decodeLayout decodes a data layout message.
+func (ds *Dataset) decodeLayout(data []byte) error {
+	d := ds.file.decoder(data)
+	version := d.u8()
+	if version != 3 && version != 4 {
+		return fmt.Errorf("Unsupported data layout version %d.", version)
+	}
+	ds.layout = int(d.u8())
+
+	switch ds.layout {
+	case layoutCompact:
+		n := int(d.u16())
+		ds.compact = d.bytes(n)
+	case layoutContiguous:
+		ds.addr, ds.size = d.offset(), d.length()
+	case layoutChunked:
+		ds.chunkVersion = version
+		if version == 3 {
+			ds.chunk = make([]uint64, d.u8())
+			ds.addr = d.offset()
+			for i := range ds.chunk { ds.chunk[i] = d.u32() }
+			break
+		}
+
+		flags := d.u8()
+		ds.chunk = make([]uint64, d.u8())
+		width := int(d.u8())
+		for i := range ds.chunk { ds.chunk[i] = d.uint(width) }
+
+		// Only the single chunk and implicit indices are supported for
+		// version 4 layouts.
+		switch ds.chunkIndex = int(d.u8()); ds.chunkIndex {
+		case chunkIndexSingle:
+			if flags & 2 != 0 {
+				ds.size = d.length()
+				d.skip(4)
+			}
+			ds.addr = d.offset()
+		case chunkIndexImplicit:
+			ds.addr = d.offset()
+		default:
+			return fmt.Errorf("Unsupported chunk index type %d.",
+				ds.chunkIndex)
+		}
+	default:
+		return fmt.Errorf("Unsupported layout class %d.", ds.layout)
+	}
+
+	return d.err
+}
+
+// decodeFilters decodes a filter pipeline message.
+func (file *File) decodeFilters(data []byte) ([]filter, error) {
+	d := file.decoder(data)
+	version := d.u8()
+	n := int(d.u8())
+	if version == 1 { d.skip(6) }
+
+	filters := make([]filter, n)
+	for i := range filters {
+		filters[i].id = int(d.u16())
+
+		nameLen := 0
+		if version == 1 || filters[i].id >= 256 { nameLen = int(d.u16()) }
+		d.skip(2)
+		nValues := int(d.u16())
+		d.skip(nameLen)
+
+		filters[i].values = make([]uint32, nValues)
+		for j := range filters[i].values {
+			filters[i].values[j] = uint32(d.u32())
+		}
+		if version == 1 && nValues % 2 == 1 { d.skip(4) }
+	}
+
+	return filters, d.err
+}
+
+// decodeAttribute decodes an attribute message.
+func (file *File) decodeAttribute(data []byte) (*Attribute, error) {
+	d := file.decoder(data)
+	version := d.u8()
+	d.skip(1)
+	nameSize, typeSize, spaceSize := int(d.u16()), int(d.u16()), int(d.u16())
+	if version == 3 { d.skip(1) }
+
+	pad := func() {}
+	switch version {
+	case 1:
+		pad = func() { d.align(8) }
+	case 2, 3:
+	default:
+		return nil, fmt.Errorf("Unsupported attribute version %d.", version)
+	}
+
+	name := d.bytes(nameSize)
+	pad()
+	typeData := d.bytes(typeSize)
+	pad()
+	spaceData := d.bytes(spaceSize)
+	pad()
+	if d.err != nil { return nil, d.err }
+
+	if end := bytes.IndexByte(name, 0); end != -1 { name = name[:end] }
+	attr := &Attribute{ Name: string(name) }
+
+	var err error
+	attr.dtype, err = file.decodeDatatype(typeData)
+	if err != nil { return nil, err }
+	attr.Shape, err = file.decodeDataspace(spaceData)
+	if err != nil { return nil, err }
+
+	n := elements(attr.Shape) * uint64(attr.dtype.size)
+	attr.data = d.bytes(int(n))
+	if d.err != nil { return nil, d.err }
+
+	return attr, nil
+}
+
+// elements returns the number of elements in an array with the given shape.
+func elements(shape []uint64) uint64 {
+	n := uint64(1)
+	for _, x := range shape { n *= x }
+	return n
+}
+
+// Len returns the number of elements in the dataset.
+func (ds *Dataset) Len() int {
+	return int(elements(ds.Shape))
+}
+
+// Len returns the number of elements in the attribute.
+func (attr *Attribute) Len() int {
+	return int(elements(attr.Shape))
+}
+
+// raw returns the raw bytes of the entire dataset.
+func (ds *Dataset) raw() ([]byte, error) {
+	n := int(elements(ds.Shape)) * ds.dtype.size
+
+	switch ds.layout {
+	case layoutCompact:
+		if len(ds.compact) < n {
+			return nil, fmt.Errorf("Compact dataset %s in %s is truncated.",
+				ds.Name, ds.file.name)
+		}
+		return ds.compact[:n], nil
+	case layoutContiguous:
+		if ds.file.undefined(ds.addr) { return make([]byte, n), nil }
+		return ds.file.readAt(ds.addr, n)
+	case layoutChunked:
+		if ds.chunkVersion != 4 { return ds.rawChunked(n) }
+		if ds.chunkIndex == chunkIndexImplicit { return ds.rawImplicit(n) }
+		return ds.rawSingleChunk(n)
+	}
+
+	panic("Impossible")
+}
+
+// rawSingleChunk returns the raw bytes of a version 4 dataset whose data is
+// stored in a single chunk.
+func (ds *Dataset) rawSingleChunk(n int) ([]byte, error) {
+	if ds.file.undefined(ds.addr) { return make([]byte, n), nil }
+
+	size := uint64(n)
+	if len(ds.filters) > 0 && ds.size > 0 { size = ds.size }
+	buf, err := ds.file.readAt(ds.addr, int(size))
+	if err != nil { return nil, err }
+
+	buf, err = ds.unfilter(buf, 0)
+	if err != nil { return nil, err }
+	if len(buf) < n {
+		return nil, fmt.Errorf("Chunk of %s in %s is truncated.",
+			ds.Name, ds.file.name)
+	}
+
+	return buf[:n], nil
+}
+
+// rawImplicit returns the raw bytes of a version 4 dataset whose chunks are
+// stored one after another in row-major order, starting at ds.addr. Every
+// chunk has its full size, including chunks on the edge of the dataset.
+func (ds *Dataset) rawImplicit(n int) ([]byte, error) {
+	out := make([]byte, n)
+	if ds.file.undefined(ds.addr) { return out, nil }
+
+	rank := len(ds.chunk) - 1
+	if rank != len(ds.Shape) {
+		return nil, fmt.Errorf("%s in %s has rank %d, but chunks of rank %d.",
+			ds.Name, ds.file.name, len(ds.Shape), rank)
+	} else if len(ds.filters) > 0 {
+		return nil, fmt.Errorf("%s in %s has filters, but its chunks use " +
+			"an implicit index.", ds.Name, ds.file.name)
+	}
+
+	// Number of chunks along each dimension.
+	grid := make([]uint64, rank)
+	for i := range grid {
+		grid[i] = (ds.Shape[i] + ds.chunk[i] - 1) / ds.chunk[i]
+	}
+
+	chunkBytes := elements(ds.chunk)
+	offset := make([]uint64, rank)
+	for c := uint64(0); c < elements(grid); c++ {
+		idx := c
+		for i := rank - 1; i >= 0; i-- {
+			offset[i] = (idx % grid[i]) * ds.chunk[i]
+			idx /= grid[i]
+		}
+
+		buf, err := ds.file.readAt(ds.addr + c*chunkBytes, int(chunkBytes))
+		if err != nil { return nil, err }
+		ds.copyChunk(buf, offset, out)
+	}
+
+	return out, nil
+}
+
+// rawChunked returns the raw bytes of a dataset whose chunks are indexed by a
+// version 1 B-tree.
+func (ds *Dataset) rawChunked(n int) ([]byte, error) {
+	out := make([]byte, n)
+	if ds.file.undefined(ds.addr) { return out, nil }
+
+	rank := len(ds.chunk) - 1
+	if rank != len(ds.Shape) {
+		return nil, fmt.Errorf("%s in %s has rank %d, but chunks of rank %d.",
+			ds.Name, ds.file.name, len(ds.Shape), rank)
+	}
+
+	keySize := 8 + 8*len(ds.chunk)
+	entries, err := ds.file.btreeLeaves(ds.addr, keySize)
+	if err != nil { return nil, err }
+
+	chunkBytes := int(elements(ds.chunk))
+	for _, entry := range entries {
+		d := ds.file.decoder(entry.key)
+		size := d.u32()
+		mask := uint32(d.u32())
+		offset := make([]uint64, rank)
+		for i := range offset { offset[i] = d.u64() }
+
+		buf, err := ds.file.readAt(entry.child, int(size))
+		if err != nil { return nil, err }
+		buf, err = ds.unfilter(buf, mask)
+		if err != nil { return nil, err }
+
+		if len(buf) < chunkBytes {
+			return nil, fmt.Errorf("Chunk of %s in %s has %d bytes, not %d.",
+				ds.Name, ds.file.name, len(buf), chunkBytes)
+		}
+
+		ds.copyChunk(buf, offset, out)
+	}
+
+	return out, nil
+}
+
+// copyChunk copies the contents of a chunk starting at the given offset into
+// the full dataset, out, clipping any parts of the chunk that extend past the
+// edge of the dataset.
+func (ds *Dataset) copyChunk(chunk []byte, offset []uint64, out []byte) {
+	rank := len(ds.Shape)
+	elem := ds.chunk[rank]
+	if rank == 0 {
+		copy(out, chunk[:elem])
+		return
+	}
+
+	// The number of elements in each dimension which are inside the dataset.
+	valid := make([]uint64, rank)
+	for i := range valid {
+		if offset[i] >= ds.Shape[i] { return }
+		valid[i] = ds.chunk[i]
+		if offset[i] + valid[i] > ds.Shape[i] {
+			valid[i] = ds.Shape[i] - offset[i]
+		}
+	}
+
+	// Loop over every row along the last dimension.
+	idx := make([]uint64, rank)
+	for {
+		src, dst := uint64(0), uint64(0)
+		for i := 0; i < rank; i++ {
+			src = src*ds.chunk[i] + idx[i]
+			dst = dst*ds.Shape[i] + offset[i] + idx[i]
+		}
+		rowBytes := valid[rank-1] * elem
+		copy(out[dst*elem: dst*elem + rowBytes], chunk[src*elem:])
+
+		i := rank - 2
+		for ; i >= 0; i-- {
+			idx[i]++
+			if idx[i] < valid[i] { break }
+			idx[i] = 0
+		}
+		if i < 0 { return }
+	}
+}
+
+// unfilter reverses the dataset's filter pipeline on a single chunk. Filters
+// whose bits are set in mask were skipped when the chunk was written.
+func (ds *Dataset) unfilter(buf []byte, mask uint32) ([]byte, error) {
+	for i := len(ds.filters) - 1; i >= 0; i-- {
+		if mask & (1 << uint(i)) != 0 { continue }
+
+		switch f := ds.filters[i]; f.id {
+		case filterDeflate:
+			rd, err := zlib.NewReader(bytes.NewReader(buf))
+			if err != nil { return nil, err }
+			buf, err = ioutil.ReadAll(rd)
+			if err != nil { return nil, err }
+		case filterShuffle:
+			size := ds.dtype.size
+			if len(f.values) > 0 { size = int(f.values[0]) }
+			buf = unshuffle(buf, size)
+		case filterFletcher32:
+			if len(buf) < 4 {
+				return nil, fmt.Errorf("Chunk of %s in %s is too small to " +
+					"have a checksum.", ds.Name, ds.file.name)
+			}
+			buf = buf[:len(buf) - 4]
+		default:
+			return nil, fmt.Errorf("%s in %s uses unsupported filter %d.",
+				ds.Name, ds.file.name, f.id)
+		}
+	}
+
+	return buf, nil
+}
+
+// unshuffle reverses the shuffle filter, which stores the first byte of every
+// element, then the second byte of every element, and so on.
+func unshuffle(buf []byte, size int) []byte {
+	if size <= 1 { return buf }
+
+	n := len(buf) / size
+	out := make([]byte, len(buf))
+	for j := 0; j < size; j++ {
+		for i := 0; i < n; i++ {
+			out[i*size + j] = buf[j*n + i]
+		}
+	}
+	copy(out[n*size:], buf[n*size:])
+
+	return out
+}
+
+// ReadFloat64s reads the entire dataset and converts it to float64s.
+func (ds *Dataset) ReadFloat64s() ([]float64, error) {
+	raw, err := ds.raw()
+	if err != nil { return nil, err }
+	out := make([]float64, ds.Len())
+	return out, toFloat64s(raw, ds.dtype, out)
+}
+
+// ReadFloat32s reads the entire dataset and converts it to float32s.
+func (ds *Dataset) ReadFloat32s() ([]float32, error) {
+	raw, err := ds.raw()
+	if err != nil { return nil, err }
+	out := make([]float32, ds.Len())
+	return out, toFloat32s(raw, ds.dtype, out)
+}
+
+// ReadInt64s reads the entire dataset and converts it to int64s.
+func (ds *Dataset) ReadInt64s() ([]int64, error) {
+	raw, err := ds.raw()
+	if err != nil { return nil, err }
+	out := make([]int64, ds.Len())
+	return out, toInt64s(raw, ds.dtype, out)
+}
+
+// Float64s converts the attribute to float64s.
+func (attr *Attribute) Float64s() ([]float64, error) {
+	out := make([]float64, attr.Len())
+	return out, toFloat64s(attr.data, attr.dtype, out)
+}
+
+// Int64s converts the attribute to int64s.
+func (attr *Attribute) Int64s() ([]int64, error) {
+	out := make([]int64, attr.Len())
+	return out, toInt64s(attr.data, attr.dtype, out)
+}
+
+// String returns the value of a fixed-length string attribute.
+func (attr *Attribute) String() (string, error) {
+	if attr.dtype.class != classString {
+		return "", fmt.Errorf("Attribute %s is not a fixed-length string.",
+			attr.Name)
+	}
+	s := attr.data
+	if end := bytes.IndexByte(s, 0); end != -1 { s = s[:end] }
+	return string(bytes.TrimRight(s, " ")), nil
+}
+
+// checkNumeric returns an error if dt can't be converted to a number.
+func checkNumeric(dt datatype) error {
+	switch {
+	case dt.class == classFixed && (dt.size == 1 || dt.size == 2 ||
+		dt.size == 4 || dt.size == 8):
+		return nil
+	case dt.class == classFloat && (dt.size == 4 || dt.size == 8):
+		return nil
+	}
+	return fmt.Errorf("Datatype with class %d and size %d is not a " +
+		"supported numeric type.", dt.class, dt.size)
+}
+
+// fixedAt returns the integer stored in the i-th element of raw.
+func fixedAt(raw []byte, dt datatype, i int) int64 {
+	b := raw[i*dt.size: (i+1)*dt.size]
+	switch dt.size {
+	case 1:
+		if dt.signed { return int64(int8(b[0])) }
+		return int64(b[0])
+	case 2:
+		x := dt.order.Uint16(b)
+		if dt.signed { return int64(int16(x)) }
+		return int64(x)
+	case 4:
+		x := dt.order.Uint32(b)
+		if dt.signed { return int64(int32(x)) }
+		return int64(x)
+	}
+	return int64(dt.order.Uint64(b))
+}
+
+// floatAt returns the floating point number stored in the i-th element of raw.
+func floatAt(raw []byte, dt datatype, i int) float64 {
+	b := raw[i*dt.size: (i+1)*dt.size]
+	if dt.size == 4 {
+		return float64(math.Float32frombits(dt.order.Uint32(b)))
+	}
+	return math.Float64frombits(dt.order.Uint64(b))
+}
+
+func toFloat64s(raw []byte, dt datatype, out []float64) error {
+	if err := checkNumeric(dt); err != nil { return err }
+	if len(raw) < len(out)*dt.size { return fmt.Errorf("Truncated data.") }
+
+	for i := range out {
+		if dt.class == classFloat {
+			out[i] = floatAt(raw, dt, i)
+		} else if dt.signed {
+			out[i] = float64(fixedAt(raw, dt, i))
+		} else {
+			out[i] = float64(uint64(fixedAt(raw, dt, i)))
+		}
+	}
+	return nil
+}
+
+func toFloat32s(raw []byte, dt datatype, out []float32) error {
+	if err := checkNumeric(dt); err != nil { return err }
+	if len(raw) < len(out)*dt.size { return fmt.Errorf("Truncated data.") }
+
+	// This is the overwhelmingly common case, so don't go through float64s.
+	if dt.class == classFloat && dt.size == 4 {
+		for i := range out {
+			out[i] = math.Float32frombits(dt.order.Uint32(raw[4*i:]))
+		}
+		return nil
+	}
+
+	for i := range out {
+		if dt.class == classFloat {
+			out[i] = float32(floatAt(raw, dt, i))
+		} else if dt.signed {
+			out[i] = float32(fixedAt(raw, dt, i))
+		} else {
+			out[i] = float32(uint64(fixedAt(raw, dt, i)))
+		}
+	}
+	return nil
+}
+
+func toInt64s(raw []byte, dt datatype, out []int64) error {
+	if err := checkNumeric(dt); err != nil { return err }
+	if len(raw) < len(out)*dt.size { return fmt.Errorf("Truncated data.") }
+
+	for i := range out {
+		if dt.class == classFloat {
+			out[i] = int64(floatAt(raw, dt, i))
+		} else {
+			out[i] = fixedAt(raw, dt, i)
+		}
+	}
+	return nil
+}
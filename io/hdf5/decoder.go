@@ -0,0 +1,73 @@
+package hdf5
+
+import (
+	"fmt"
+)
+
+// decoder reads little-endian fields from a buffer. Reading past the end of
+// the buffer sets err and returns zero values instead of panicking, so callers
+// only need to check err once they're done.
+type decoder struct {
+	buf []byte
+	i int
+	offsetSize, lengthSize int
+	err error
+}
+
+func (file *File) decoder(buf []byte) *decoder {
+	return &decoder{
+		buf: buf, offsetSize: file.offsetSize, lengthSize: file.lengthSize,
+	}
+}
+
+// remaining returns the number of unread bytes.
+func (d *decoder) remaining() int {
+	return len(d.buf) - d.i
+}
+
+// bytes returns the next n bytes.
+func (d *decoder) bytes(n int) []byte {
+	if n < 0 || d.i + n > len(d.buf) {
+		if d.err == nil {
+			d.err = fmt.Errorf("Attempted to read %d bytes at byte %d of " +
+				"a %d-byte field.", n, d.i, len(d.buf))
+		}
+		d.i = len(d.buf)
+		return nil
+	}
+
+	out := d.buf[d.i: d.i + n]
+	d.i += n
+	return out
+}
+
+// skip skips over the next n bytes.
+func (d *decoder) skip(n int) {
+	d.bytes(n)
+}
+
+// uint reads an n-byte unsigned integer.
+func (d *decoder) uint(n int) uint64 {
+	b := d.bytes(n)
+	x := uint64(0)
+	for i := len(b) - 1; i >= 0; i-- {
+		x = x << 8 | uint64(b[i])
+	}
+	return x
+}
+
+func (d *decoder) u8() uint64 { return d.uint(1) }
+func (d *decoder) u16() uint64 { return d.uint(2) }
+func (d *decoder) u32() uint64 { return d.uint(4) }
+func (d *decoder) u64() uint64 { return d.uint(8) }
+
+// offset reads an address.
+func (d *decoder) offset() uint64 { return d.uint(d.offsetSize) }
+
+// length reads a length.
+func (d *decoder) length() uint64 { return d.uint(d.lengthSize) }
+
+// align skips to the next multiple of n bytes from the start of the buffer.
+func (d *decoder) align(n int) {
+	if r := d.i % n; r != 0 { d.skip(n - r) }
+}
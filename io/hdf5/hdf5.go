@@ -0,0 +1,465 @@
+/*package hdf5 is a pure-Go reader for the subset of HDF5 written by simulation
+codes like Gadget-4, SWIFT, and AREPO. It supports groups stored as symbol
+tables or compact link messages, attributes stored in object headers, and
+datasets with compact, contiguous, or chunked layouts. Chunked datasets may
+use the deflate, shuffle, and Fletcher32 filters.
+
+Features which these codes don't use (dense link and attribute storage,
+variable-length types, compound types, external links, etc.) are not
+supported and result in errors.*/
+package hdf5
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var signature = []byte{ 0x89, 'H', 'D', 'F', '\r', '\n', 0x1a, '\n' }
+
+const (
+	msgDataspace = 0x0001
+	msgLinkInfo = 0x0002
+	msgDatatype = 0x0003
+	msgLink = 0x0006
+	msgLayout = 0x0008
+	msgFilters = 0x000b
+	msgAttribute = 0x000c
+	msgContinuation = 0x0010
+	msgSymbolTable = 0x0011
+	msgAttributeInfo = 0x0015
+)
+
+// File is an open HDF5 file.
+type File struct {
+	f *os.File
+	name string
+	base uint64 // Base address that all other addresses are relative to.
+	offsetSize, lengthSize int
+	root uint64 // Address of the root group's object header.
+}
+
+// message is a single header message from an object header.
+type message struct {
+	typ int
+	data []byte
+}
+
+// Open opens the HDF5 file with the given name.
+func Open(fname string) (*File, error) {
+	f, err := os.Open(fname)
+	if err != nil { return nil, err }
+
+	file := &File{ f: f, name: fname }
+	if err = file.readSuperblock(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Close closes the file.
+func (file *File) Close() error {
+	return file.f.Close()
+}
+
+// readSuperblock finds and decodes the superblock.
+func (file *File) readSuperblock() error {
+	info, err := file.f.Stat()
+	if err != nil { return err }
+
+	// The superblock may be at byte 0, 512, 1024, 2048, etc.
+	start := int64(-1)
+	sig := make([]byte, len(signature))
+	for loc := int64(0); loc + int64(len(sig)) <= info.Size(); {
+		_, err = file.f.ReadAt(sig, loc)
+		if err != nil { return err }
+		if bytes.Equal(sig, signature) {
+			start = loc
+			break
+		}
+
+		if loc == 0 {
+			loc = 512
+		} else {
+			loc *= 2
+		}
+	}
+
+	if start == -1 {
+		return fmt.Errorf("%s is not an HDF5 file.", file.name)
+	}
+
+	buf := make([]byte, 128)
+	n, _ := file.f.ReadAt(buf, start)
+	buf = buf[:n]
+	if len(buf) < 16 {
+		return fmt.Errorf("%s has a truncated superblock.", file.name)
+	}
+
+	version := buf[8]
+	var d *decoder
+	switch version {
+	case 0, 1:
+		file.offsetSize, file.lengthSize = int(buf[13]), int(buf[14])
+		d = file.decoder(buf)
+		d.skip(24)
+		if version == 1 { d.skip(4) }
+		file.base = d.offset()
+		d.skip(3 * file.offsetSize) // Free-space, EOF, and driver addresses.
+
+		// Root group symbol table entry.
+		d.skip(file.offsetSize)
+		file.root = d.offset()
+	case 2, 3:
+		file.offsetSize, file.lengthSize = int(buf[9]), int(buf[10])
+		d = file.decoder(buf)
+		d.skip(12)
+		file.base = d.offset()
+		d.skip(2 * file.offsetSize) // Extension and EOF addresses.
+		file.root = d.offset()
+	default:
+		return fmt.Errorf("%s has unsupported superblock version %d.",
+			file.name, version)
+	}
+
+	if d.err != nil {
+		return fmt.Errorf("%s has a truncated superblock.", file.name)
+	}
+
+	// Addresses are relative to the base address, which is the start of the
+	// superblock unless specified otherwise.
+	if file.base == 0 { file.base = uint64(start) }
+
+	return nil
+}
+
+// readAt reads n bytes at the given address.
+func (file *File) readAt(addr uint64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := file.f.ReadAt(buf, int64(file.base + addr))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %d bytes at address %d in " +
+			"%s: %s", n, addr, file.name, err.Error())
+	}
+	return buf, nil
+}
+
+// undefined returns true if addr is the undefined address.
+func (file *File) undefined(addr uint64) bool {
+	return addr == ^uint64(0) >> uint(64 - 8*file.offsetSize)
+}
+
+// readObjectHeader returns all the messages in the object header at addr.
+func (file *File) readObjectHeader(addr uint64) ([]message, error) {
+	prefix, err := file.readAt(addr, 16)
+	if err != nil { return nil, err }
+
+	if string(prefix[:4]) == "OHDR" {
+		return file.readObjectHeaderV2(addr)
+	} else if prefix[0] == 1 {
+		return file.readObjectHeaderV1(addr, prefix)
+	}
+
+	return nil, fmt.Errorf("Unrecognized object header at address %d in %s.",
+		addr, file.name)
+}
+
+// readObjectHeaderV1 reads a version 1 object header.
+func (file *File) readObjectHeaderV1(
+	addr uint64, prefix []byte,
+) ([]message, error) {
+	d := file.decoder(prefix)
+	d.skip(2)
+	nMsg := int(d.u16())
+	d.skip(4)
+	size := d.u32()
+
+	msgs := []message{ }
+	blocks := [][2]uint64{ { addr + 16, uint64(size) } }
+
+	for len(blocks) > 0 && len(msgs) < nMsg {
+		buf, err := file.readAt(blocks[0][0], int(blocks[0][1]))
+		if err != nil { return nil, err }
+		blocks = blocks[1:]
+
+		d := file.decoder(buf)
+		for d.remaining() >= 8 && len(msgs) < nMsg {
+			typ := int(d.u16())
+			n := int(d.u16())
+			d.skip(4)
+			data := d.bytes(n)
+			if d.err != nil { break }
+
+			if typ == msgContinuation {
+				cd := file.decoder(data)
+				blocks = append(blocks, [2]uint64{ cd.offset(), cd.length() })
+			}
+			msgs = append(msgs, message{ typ, data })
+		}
+	}
+
+	return msgs, nil
+}
+
+// readObjectHeaderV2 reads a version 2 object header.
+func (file *File) readObjectHeaderV2(addr uint64) ([]message, error) {
+	prefix, err := file.readAt(addr, 6 + 16 + 4 + 8)
+	if err != nil { return nil, err }
+
+	flags := prefix[5]
+	d := file.decoder(prefix)
+	d.skip(6)
+	if flags & 0x20 != 0 { d.skip(16) }
+	if flags & 0x10 != 0 { d.skip(4) }
+	size := d.uint(1 << (flags & 3))
+	start := uint64(d.i)
+
+	hasOrder := flags & 0x04 != 0
+	msgHeader := 4
+	if hasOrder { msgHeader += 2 }
+
+	msgs := []message{ }
+	// Each block is the region between the prefix and the checksum.
+	blocks := [][2]uint64{ { addr + start, size } }
+
+	for len(blocks) > 0 {
+		buf, err := file.readAt(blocks[0][0], int(blocks[0][1]))
+		if err != nil { return nil, err }
+		blocks = blocks[1:]
+
+		d := file.decoder(buf)
+		for d.remaining() >= msgHeader {
+			typ := int(d.u8())
+			n := int(d.u16())
+			d.skip(1)
+			if hasOrder { d.skip(2) }
+			data := d.bytes(n)
+			if d.err != nil { break }
+
+			if typ == msgContinuation {
+				cd := file.decoder(data)
+				cAddr, cLen := cd.offset(), cd.length()
+				// Skip the "OCHK" signature and the checksum.
+				blocks = append(blocks, [2]uint64{ cAddr + 4, cLen - 8 })
+			}
+			msgs = append(msgs, message{ typ, data })
+		}
+	}
+
+	return msgs, nil
+}
+
+// children returns the addresses of the object headers of all the objects
+// in the group whose object header is at addr.
+func (file *File) children(addr uint64) (map[string]uint64, error) {
+	msgs, err := file.readObjectHeader(addr)
+	if err != nil { return nil, err }
+
+	out := map[string]uint64{ }
+	isGroup := false
+
+	for _, msg := range msgs {
+		switch msg.typ {
+		case msgSymbolTable:
+			isGroup = true
+			d := file.decoder(msg.data)
+			btree, heap := d.offset(), d.offset()
+			if d.err != nil { return nil, d.err }
+
+			err = file.readSymbolTable(btree, heap, out)
+			if err != nil { return nil, err }
+		case msgLink:
+			isGroup = true
+			name, target, hard, err := file.decodeLink(msg.data)
+			if err != nil { return nil, err }
+			if hard { out[name] = target }
+		case msgLinkInfo:
+			isGroup = true
+			d := file.decoder(msg.data)
+			d.skip(1)
+			flags := d.u8()
+			if flags & 1 != 0 { d.skip(8) }
+			heap := d.offset()
+			if d.err != nil { return nil, d.err }
+
+			if !file.undefined(heap) {
+				return nil, fmt.Errorf("%s uses dense link storage, which " +
+					"is not supported.", file.name)
+			}
+		}
+	}
+
+	if !isGroup {
+		return nil, fmt.Errorf("Object at address %d in %s is not a group.",
+			addr, file.name)
+	}
+
+	return out, nil
+}
+
+// decodeLink decodes a link message. hard is false for soft and external
+// links, which are ignored.
+func (file *File) decodeLink(
+	data []byte,
+) (name string, target uint64, hard bool, err error) {
+	d := file.decoder(data)
+	d.skip(1)
+	flags := d.u8()
+
+	linkType := uint64(0)
+	if flags & 0x08 != 0 { linkType = d.u8() }
+	if flags & 0x04 != 0 { d.skip(8) }
+	if flags & 0x10 != 0 { d.skip(1) }
+	n := int(d.uint(1 << (flags & 3)))
+	name = string(d.bytes(n))
+
+	if linkType == 0 { target = d.offset() }
+	if d.err != nil {
+		return "", 0, false, fmt.Errorf("Invalid link message in %s.",
+			file.name)
+	}
+
+	return name, target, linkType == 0, nil
+}
+
+// readSymbolTable adds all the entries of the group B-tree at btree to out.
+func (file *File) readSymbolTable(
+	btree, heap uint64, out map[string]uint64,
+) error {
+	heapHd, err := file.readAt(heap, 8 + 2*file.lengthSize + file.offsetSize)
+	if err != nil { return err }
+	if string(heapHd[:4]) != "HEAP" {
+		return fmt.Errorf("Invalid local heap at address %d in %s.",
+			heap, file.name)
+	}
+	d := file.decoder(heapHd)
+	d.skip(8)
+	heapSize := d.length()
+	d.skip(file.lengthSize)
+	heapData, err := file.readAt(d.offset(), int(heapSize))
+	if err != nil { return err }
+
+	nodes, err := file.btreeLeaves(btree, 0)
+	if err != nil { return err }
+
+	entrySize := 2*file.offsetSize + 24
+	for _, node := range nodes {
+		hd, err := file.readAt(node.child, 8)
+		if err != nil { return err }
+		if string(hd[:4]) != "SNOD" {
+			return fmt.Errorf("Invalid symbol table node at address %d " +
+				"in %s.", node.child, file.name)
+		}
+		nSym := int(file.decoder(hd[6:]).u16())
+
+		buf, err := file.readAt(node.child + 8, nSym*entrySize)
+		if err != nil { return err }
+		d := file.decoder(buf)
+
+		for i := 0; i < nSym; i++ {
+			nameOffset := d.offset()
+			addr := d.offset()
+			d.skip(24)
+
+			if nameOffset >= uint64(len(heapData)) {
+				return fmt.Errorf("Invalid symbol table entry at address %d " +
+					"in %s.", node.child, file.name)
+			}
+			name := heapData[nameOffset:]
+			if end := bytes.IndexByte(name, 0); end != -1 {
+				name = name[:end]
+			}
+			out[string(name)] = addr
+		}
+	}
+
+	return nil
+}
+
+// btreeEntry is a leaf entry in a version 1 B-tree.
+type btreeEntry struct {
+	key []byte // The key to the left of this child.
+	child uint64
+}
+
+// btreeLeaves returns the leaf entries of the version 1 B-tree at addr. keySize
+// is the size of each key, or zero for group nodes.
+func (file *File) btreeLeaves(addr uint64, keySize int) ([]btreeEntry, error) {
+	if keySize == 0 { keySize = file.lengthSize }
+
+	hdSize := 8 + 2*file.offsetSize
+	hd, err := file.readAt(addr, hdSize)
+	if err != nil { return nil, err }
+	if string(hd[:4]) != "TREE" {
+		return nil, fmt.Errorf("Invalid B-tree node at address %d in %s.",
+			addr, file.name)
+	}
+
+	level := hd[5]
+	n := int(file.decoder(hd[6:]).u16())
+
+	buf, err := file.readAt(
+		addr + uint64(hdSize), n*(keySize + file.offsetSize) + keySize,
+	)
+	if err != nil { return nil, err }
+	d := file.decoder(buf)
+
+	out := []btreeEntry{ }
+	for i := 0; i < n; i++ {
+		key := d.bytes(keySize)
+		child := d.offset()
+
+		if level == 0 {
+			out = append(out, btreeEntry{ key, child })
+		} else {
+			entries, err := file.btreeLeaves(child, keySize)
+			if err != nil { return nil, err }
+			out = append(out, entries...)
+		}
+	}
+
+	return out, d.err
+}
+
+// lookup returns the address of the object header at the given path.
+func (file *File) lookup(path string) (uint64, error) {
+	addr := file.root
+
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." { continue }
+
+		children, err := file.children(addr)
+		if err != nil { return 0, err }
+
+		var ok bool
+		addr, ok = children[name]
+		if !ok {
+			return 0, fmt.Errorf("%s does not contain the object %s.",
+				file.name, path)
+		}
+	}
+
+	return addr, nil
+}
+
+// Children returns the names of all the objects in the group at path.
+func (file *File) Children(path string) ([]string, error) {
+	addr, err := file.lookup(path)
+	if err != nil { return nil, err }
+
+	children, err := file.children(addr)
+	if err != nil { return nil, err }
+
+	out := []string{ }
+	for name := range children { out = append(out, name) }
+	return out, nil
+}
+
+// Has returns true if there is an object at path.
+func (file *File) Has(path string) bool {
+	_, err := file.lookup(path)
+	return err == nil
+}
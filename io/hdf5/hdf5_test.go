@@ -0,0 +1,253 @@
+package hdf5
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// The files in test_files/ are written by scripts/make_hdf5_fixtures.go and
+// are laid out like a single Gadget-4 snapshot file with five PartType1
+// particles. gadget4.hdf5 uses the default libhdf5 format: Coordinates and
+// ParticleIDs are contiguous, and Velocities are stored in 2x3 chunks with the
+// shuffle and deflate filters, so the last chunk extends past the edge of the
+// dataset. gadget4_latest.hdf5 uses the latest libhdf5 format: version 2
+// object headers, compact links, and version 4 layouts for a big-endian
+// contiguous Coordinates, a single Velocities chunk with the shuffle, deflate,
+// and Fletcher32 filters, implicitly indexed ParticleIDs, and compact Masses.
+
+func TestChildren(t *testing.T) {
+	file, err := Open("test_files/gadget4.hdf5")
+	if err != nil { t.Fatal(err.Error()) }
+	defer file.Close()
+
+	tests := []struct{
+		path string
+		names []string
+	}{
+		{"/", []string{"Header", "Parameters", "PartType1"}},
+		{"/PartType1", []string{"Coordinates", "ParticleIDs", "Velocities"}},
+		{"/Header", []string{}},
+	}
+
+	for i := range tests {
+		names, err := file.Children(tests[i].path)
+		if err != nil { t.Fatalf("test %d) %s", i, err.Error()) }
+		sort.Strings(names)
+
+		if !stringsEq(names, tests[i].names) {
+			t.Errorf("test %d) Children(%s) = %v, not %v",
+				i, tests[i].path, names, tests[i].names)
+		}
+	}
+
+	if file.Has("/PartType0/Coordinates") {
+		t.Errorf("Has() returned true for a missing dataset.")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	file, err := Open("test_files/gadget4.hdf5")
+	if err != nil { t.Fatal(err.Error()) }
+	defer file.Close()
+
+	attrs, err := file.Attributes("/Header")
+	if err != nil { t.Fatal(err.Error()) }
+
+	L, err := attrs["BoxSize"].Float64s()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(L) != 1 || L[0] != 10 {
+		t.Errorf("BoxSize = %g", L)
+	}
+
+	npart, err := attrs["NumPart_Total"].Int64s()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(npart) != 6 || npart[1] != 5 || npart[0] != 0 {
+		t.Errorf("NumPart_Total = %d", npart)
+	}
+
+	nFiles, err := attrs["NumFilesPerSnapshot"].Int64s()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(nFiles) != 1 || nFiles[0] != 1 {
+		t.Errorf("NumFilesPerSnapshot = %d", nFiles)
+	}
+
+	if _, err = attrs["BoxSize"].String(); err == nil {
+		t.Errorf("Expected error when reading a float attribute as a string.")
+	}
+}
+
+func TestDatasets(t *testing.T) {
+	file, err := Open("test_files/gadget4.hdf5")
+	if err != nil { t.Fatal(err.Error()) }
+	defer file.Close()
+
+	for _, name := range []string{ "Coordinates", "Velocities" } {
+		ds, err := file.Dataset("/PartType1/" + name)
+		if err != nil { t.Fatal(err.Error()) }
+		if len(ds.Shape) != 2 || ds.Shape[0] != 5 || ds.Shape[1] != 3 {
+			t.Errorf("%s has shape %d", name, ds.Shape)
+		}
+
+		x, err := ds.ReadFloat32s()
+		if err != nil { t.Fatal(err.Error()) }
+		for i := 0; i < 5; i++ {
+			target := []float32{ float32(i), float32(i) + 0.5, 1 }
+			if name == "Velocities" {
+				target = []float32{ float32(2*i), -float32(i), 3 }
+			}
+
+			for j := 0; j < 3; j++ {
+				if x[3*i + j] != target[j] {
+					t.Errorf("%s[%d] = %g, not %g",
+						name, i, x[3*i: 3*i + 3], target)
+					break
+				}
+			}
+		}
+	}
+
+	ds, err := file.Dataset("/PartType1/ParticleIDs")
+	if err != nil { t.Fatal(err.Error()) }
+	id, err := ds.ReadInt64s()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(id) != 5 || id[0] != 1 || id[4] != 5 {
+		t.Errorf("ParticleIDs = %d", id)
+	}
+
+	if _, err = file.Dataset("/PartType1"); err == nil {
+		t.Errorf("Expected error when opening a group as a dataset.")
+	}
+}
+
+func TestUnshuffle(t *testing.T) {
+	buf := []byte{ 1, 3, 5, 2, 4, 6, 7 }
+	out := unshuffle(buf, 2)
+	target := []byte{ 1, 2, 3, 4, 5, 6, 7 }
+	if string(out) != string(target) {
+		t.Errorf("unshuffle(%d, 2) = %d, not %d", buf, out, target)
+	}
+}
+
+func stringsEq(x, y []string) bool {
+	if len(x) != len(y) { return false }
+	for i := range x {
+		if x[i] != y[i] { return false }
+	}
+	return true
+}
+
+func TestRawImplicit(t *testing.T) {
+	// A 3 x 5 dataset of bytes stored in 2 x 2 chunks, so the chunks on the
+	// edges are partially outside the dataset.
+	chunks := []byte{
+		0, 1, 5, 6, 2, 3, 7, 8, 4, 99, 9, 99,
+		10, 11, 99, 99, 12, 13, 99, 99, 14, 99, 99, 99,
+	}
+	f, err := ioutil.TempFile(".", "test_implicit_data")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.Write(append([]byte{ 99, 99 }, chunks...)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	file := &File{ f: f, name: f.Name(), offsetSize: 8, lengthSize: 8 }
+	ds := &Dataset{
+		file: file, Name: "x", Shape: []uint64{ 3, 5 },
+		dtype: datatype{ class: classFixed, size: 1 },
+		layout: layoutChunked, addr: 2, chunk: []uint64{ 2, 2, 1 },
+		chunkVersion: 4, chunkIndex: chunkIndexImplicit,
+	}
+
+	out, err := ds.raw()
+	if err != nil { t.Fatal(err.Error()) }
+	for i := range out {
+		if out[i] != byte(i) {
+			t.Fatalf("Read %d from an implicitly indexed dataset.", out)
+		}
+	}
+
+	ds.filters = []filter{ { id: filterDeflate } }
+	if _, err = ds.raw(); err == nil {
+		t.Errorf("Expected an error for a filtered implicit index.")
+	}
+}
+
+func TestLatestFormat(t *testing.T) {
+	file, err := Open("test_files/gadget4_latest.hdf5")
+	if err != nil { t.Fatal(err.Error()) }
+	defer file.Close()
+
+	names, err := file.Children("/PartType1")
+	if err != nil { t.Fatal(err.Error()) }
+	sort.Strings(names)
+	target := []string{ "Coordinates", "Masses", "ParticleIDs", "Velocities" }
+	if !stringsEq(names, target) {
+		t.Errorf("Children(/PartType1) = %v, not %v", names, target)
+	}
+
+	attrs, err := file.Attributes("/Header")
+	if err != nil { t.Fatal(err.Error()) }
+	npart, err := attrs["NumPart_ThisFile"].Int64s()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(npart) != 6 || npart[1] != 5 {
+		t.Errorf("NumPart_ThisFile = %d", npart)
+	}
+
+	// These attributes are stored in a continuation block.
+	attrs, err = file.Attributes("/Parameters")
+	if err != nil { t.Fatal(err.Error()) }
+	h, err := attrs["HubbleParam"].Float64s()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(h) != 1 || h[0] != 0.7 {
+		t.Errorf("HubbleParam = %g", h)
+	}
+	outputDir, err := attrs["OutputDir"].String()
+	if err != nil { t.Fatal(err.Error()) }
+	if outputDir != "./output" {
+		t.Errorf("OutputDir = %q", outputDir)
+	}
+
+	ds, err := file.Dataset("/PartType1/Coordinates")
+	if err != nil { t.Fatal(err.Error()) }
+	x, err := ds.ReadFloat64s()
+	if err != nil { t.Fatal(err.Error()) }
+	ds, err = file.Dataset("/PartType1/Velocities")
+	if err != nil { t.Fatal(err.Error()) }
+	v, err := ds.ReadFloat32s()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(x) != 15 || len(v) != 15 {
+		t.Fatalf("Read %d positions and %d velocities.", len(x), len(v))
+	}
+	for i := 0; i < 5; i++ {
+		xTarget := []float64{ float64(i), float64(i) + 0.5, 1 }
+		vTarget := []float32{ float32(2*i), -float32(i), 3 }
+		for j := 0; j < 3; j++ {
+			if x[3*i + j] != xTarget[j] || v[3*i + j] != vTarget[j] {
+				t.Errorf("x[%d] = %g and v[%d] = %g, not %g and %g",
+					i, x[3*i: 3*i + 3], i, v[3*i: 3*i + 3], xTarget, vTarget)
+				break
+			}
+		}
+	}
+
+	ds, err = file.Dataset("/PartType1/ParticleIDs")
+	if err != nil { t.Fatal(err.Error()) }
+	id, err := ds.ReadInt64s()
+	if err != nil { t.Fatal(err.Error()) }
+	ds, err = file.Dataset("/PartType1/Masses")
+	if err != nil { t.Fatal(err.Error()) }
+	mp, err := ds.ReadFloat32s()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(id) != 5 || len(mp) != 5 {
+		t.Fatalf("Read %d IDs and %d masses.", len(id), len(mp))
+	}
+	for i := range id {
+		if id[i] != int64(i + 1) || mp[i] != 2 {
+			t.Errorf("ParticleIDs = %d and Masses = %g", id, mp)
+			break
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/phil-mansfield/nbody-utils/cosmo"
+)
+
+const (
+	// abacusPosScale converts the top 20 bits of an RVint word to box units.
+	abacusPosScale = 1.0 / (1 << 12) / 1e6
+	// abacusVelScale converts the bottom 12 bits of an RVint word to km/s.
+	abacusVelScale = 6000.0 / 2048
+	// abacusPIDMask selects the Lagrangian index from a packed PID.
+	abacusPIDMask = 0x7fff
+)
+
+type abacusSnapshot struct {
+	hd Header
+	rvNames, pidNames []string
+	header []byte
+
+	xBuf, vBuf [][3]float32
+	mpBuf []float32
+	idBuf []int64
+	rvBuf []int32
+	pidBuf []int64
+}
+
+// AbacusContext specifies which parts of an Abacus output should be read.
+type AbacusContext struct {
+	// Subsamples is the set of subsamples to read, "A", "B", or "AB".
+	Subsamples string
+}
+
+var defaultAbacusContext = AbacusContext{ Subsamples: "AB" }
+
+// Abacus returns a snapshot for a directory of packed Abacus particle files.
+// dir must contain an Abacus "header" file of "Key = value" lines. Every file
+// below dir whose name contains "_rv_A" or "_rv_B" is a file of RVint packed
+// particles and must be accompanied by a file with "rv" replaced by "pid"
+// which contains packed particle IDs. Each such file is one file of the
+// snapshot, with all A files coming before all B files.
+//
+// Because subsamples contain only a fraction of all particles, NTotal is the
+// number of particles in the chosen subsamples, while NSide is the number of
+// particles on one side of the full Lagrangian grid. IDs are Lagrangian
+// indices on that grid. XGrid and ConvertToLVec need every particle on the
+// grid, so they return an error unless the chosen subsamples contain all
+// NSide^3 particles.
+func Abacus(dir string, context ...AbacusContext) (Snapshot, error) {
+	ctx := defaultAbacusContext
+	if len(context) > 0 { ctx = context[0] }
+
+	snap := &abacusSnapshot{ }
+
+	var err error
+	snap.header, err = ioutil.ReadFile(path.Join(dir, "header"))
+	if err != nil { return nil, err }
+	fields, err := parseAbacusHeader(snap.header)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s",
+			path.Join(dir, "header"), err.Error())
+	}
+
+	for _, set := range []string{ "A", "B" } {
+		if !strings.Contains(ctx.Subsamples, set) { continue }
+		rvNames, pidNames, err := findAbacusFiles(dir, set)
+		if err != nil { return nil, err }
+		snap.rvNames = append(snap.rvNames, rvNames...)
+		snap.pidNames = append(snap.pidNames, pidNames...)
+	}
+
+	if len(snap.rvNames) == 0 {
+		return nil, fmt.Errorf("No RVint files for subsamples '%s' in " +
+			"directory %s.", ctx.Subsamples, dir)
+	}
+
+	nTotal := int64(0)
+	for i := range snap.rvNames {
+		n, err := snap.particles(i)
+		if err != nil { return nil, err }
+		nTotal += int64(n)
+	}
+
+	hd := &snap.hd
+	if err = fields.header(hd); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s",
+			path.Join(dir, "header"), err.Error())
+	}
+	hd.NTotal = nTotal
+	hd.NPart[DarkMatter] = nTotal
+
+	return snap, nil
+}
+
+// abacusFields are the fields of an Abacus header file.
+type abacusFields map[string]string
+
+// parseAbacusHeader parses "Key = value" lines, ignoring comments and
+// stripping quotes from string values.
+func parseAbacusHeader(text []byte) (abacusFields, error) {
+	fields := abacusFields{ }
+
+	scanner := bufio.NewScanner(strings.NewReader(string(text)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 { line = line[:i] }
+		if strings.TrimSpace(line) == "" { continue }
+
+		tok := strings.SplitN(line, "=", 2)
+		if len(tok) != 2 {
+			return nil, fmt.Errorf("The line '%s' is not an assignment.", line)
+		}
+
+		key := strings.TrimSpace(tok[0])
+		fields[key] = strings.Trim(strings.TrimSpace(tok[1]), "\"")
+	}
+
+	return fields, scanner.Err()
+}
+
+// float returns the first of the given keys which is in the header.
+func (fields abacusFields) float(keys ...string) (float64, error) {
+	for _, key := range keys {
+		if val, ok := fields[key]; ok {
+			x, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%s has the invalid value '%s'.", key, val)
+			}
+			return x, nil
+		}
+	}
+	return 0, fmt.Errorf("None of the fields %v are in the header.", keys)
+}
+
+// header sets all the fields of hd except NTotal.
+func (fields abacusFields) header(hd *Header) error {
+	var err error
+	if hd.L, err = fields.float("BoxSize"); err != nil { return err }
+	if hd.OmegaM, err = fields.float("Omega_M"); err != nil { return err }
+	if hd.OmegaL, err = fields.float("Omega_DE", "Omega_L"); err != nil {
+		return err
+	}
+
+	H0, err := fields.float("H0")
+	if err != nil { return err }
+	hd.H100 = H0 / 100
+
+	if hd.Scale, err = fields.float("ScaleFactor"); err == nil {
+		hd.Z = 1/hd.Scale - 1
+	} else if hd.Z, err = fields.float("Redshift"); err == nil {
+		hd.Scale = 1 / (1 + hd.Z)
+	} else {
+		return err
+	}
+
+	ppd, err := fields.float("ppd")
+	if err != nil { return err }
+	hd.NSide = int64(math.Round(ppd))
+
+	if hd.UniformMp, err = fields.float("ParticleMassHMsun"); err != nil {
+		rhoM0 := cosmo.RhoAverage(hd.H100*100, hd.OmegaM, hd.OmegaL, 0)
+		nSide := float64(hd.NSide)
+		hd.UniformMp = (hd.L * hd.L * hd.L) * rhoM0 / (nSide * nSide * nSide)
+	}
+
+	if hd.Epsilon, err = fields.float("SofteningLength"); err != nil {
+		hd.Epsilon = 0
+	}
+
+	return nil
+}
+
+// findAbacusFiles returns the sorted RVint files for the subsample set below
+// dir and their corresponding PID files.
+func findAbacusFiles(dir, set string) (rvNames, pidNames []string, err error) {
+	walk := func(name string, info os.FileInfo, err error) error {
+		if err != nil { return err }
+		if info.IsDir() { return nil }
+
+		base := filepath.Base(name)
+		if !strings.Contains(base, "_rv_" + set) { return nil }
+
+		rvNames = append(rvNames, name)
+		return nil
+	}
+	if err = filepath.Walk(dir, walk); err != nil { return nil, nil, err }
+
+	sort.Strings(rvNames)
+	for _, name := range rvNames {
+		rvDir, base := filepath.Split(name)
+		pidBase := strings.Replace(base, "_rv_" + set, "_pid_" + set, 1)
+		pidDir := strings.Replace(rvDir, "_rv_" + set, "_pid_" + set, 1)
+		pidNames = append(pidNames, filepath.Join(pidDir, pidBase))
+	}
+
+	return rvNames, pidNames, nil
+}
+
+// particles returns the number of particles in file i.
+func (snap *abacusSnapshot) particles(i int) (int, error) {
+	rvInfo, err := os.Stat(snap.rvNames[i])
+	if err != nil { return 0, err }
+	pidInfo, err := os.Stat(snap.pidNames[i])
+	if err != nil { return 0, err }
+
+	n := int(rvInfo.Size() / 12)
+	if rvInfo.Size() % 12 != 0 || pidInfo.Size() != int64(8*n) {
+		return 0, fmt.Errorf("%s has %d bytes and %s has %d bytes, which " +
+			"aren't consistent with RVint and PID files.", snap.rvNames[i],
+			rvInfo.Size(), snap.pidNames[i], pidInfo.Size())
+	}
+
+	return n, nil
+}
+
+// readRV reads the packed positions and velocities of file i.
+func (snap *abacusSnapshot) readRV(i int) ([]int32, error) {
+	n, err := snap.particles(i)
+	if err != nil { return nil, err }
+
+	if cap(snap.rvBuf) < 3*n { snap.rvBuf = make([]int32, 3*n) }
+	snap.rvBuf = snap.rvBuf[:3*n]
+	if n == 0 { return snap.rvBuf, nil }
+
+	f, err := os.Open(snap.rvNames[i])
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	err = readInt32AsByte(f, binary.LittleEndian, snap.rvBuf)
+	if err != nil { return nil, err }
+
+	return snap.rvBuf, nil
+}
+
+func (snap *abacusSnapshot) Files() int {
+	return len(snap.rvNames)
+}
+
+func (snap *abacusSnapshot) Header() *Header {
+	return &snap.hd
+}
+
+// RawHeader returns the text of the Abacus header file.
+func (snap *abacusSnapshot) RawHeader(i int) []byte {
+	return snap.header
+}
+
+func (snap *abacusSnapshot) UpdateHeader(hd *Header) {
+	snap.hd = *hd
+}
+
+// UniformMass returns true, since Abacus simulations only contain dark matter.
+func (snap *abacusSnapshot) UniformMass() bool {
+	return true
+}
+
+func (snap *abacusSnapshot) ReadX(i int) ([][3]float32, error) {
+	rv, err := snap.readRV(i)
+	if err != nil { return nil, err }
+	snap.xBuf = expandVectors(snap.xBuf[:0], len(rv) / 3)
+
+	L := float32(snap.hd.L)
+	scale := snap.hd.L * abacusPosScale
+	for j := range snap.xBuf {
+		for k := 0; k < 3; k++ {
+			// Positions are stored in [-L/2, L/2).
+			x := float32(float64(rv[3*j + k] & -4096) * scale) + L/2
+			if x < 0 {
+				x += L
+			} else if x >= L {
+				x -= L
+			}
+
+			if x < 0 || x >= L {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.rvNames[i],
+				)
+			}
+
+			snap.xBuf[j][k] = x
+		}
+	}
+
+	return snap.xBuf, nil
+}
+
+func (snap *abacusSnapshot) ReadV(i int) ([][3]float32, error) {
+	rv, err := snap.readRV(i)
+	if err != nil { return nil, err }
+	snap.vBuf = expandVectors(snap.vBuf[:0], len(rv) / 3)
+
+	for j := range snap.vBuf {
+		for k := 0; k < 3; k++ {
+			iv := rv[3*j + k] & 0xfff
+			snap.vBuf[j][k] = float32(float64(iv - 2048) * abacusVelScale)
+		}
+	}
+
+	return snap.vBuf, nil
+}
+
+// ReadID returns IDs of the form 1 + ix + iy*NSide + iz*NSide^2, where
+// (ix, iy, iz) is the Lagrangian index packed into each Abacus PID.
+func (snap *abacusSnapshot) ReadID(i int) ([]int64, error) {
+	n, err := snap.particles(i)
+	if err != nil { return nil, err }
+	snap.idBuf = expandInts(snap.idBuf[:0], n)
+	if n == 0 { return snap.idBuf, nil }
+
+	if cap(snap.pidBuf) < n { snap.pidBuf = make([]int64, n) }
+	snap.pidBuf = snap.pidBuf[:n]
+
+	f, err := os.Open(snap.pidNames[i])
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	err = readInt64AsByte(f, binary.LittleEndian, snap.pidBuf)
+	if err != nil { return nil, err }
+
+	nSide := snap.hd.NSide
+	for j, pid := range snap.pidBuf {
+		ix := pid & abacusPIDMask
+		iy := (pid >> 16) & abacusPIDMask
+		iz := (pid >> 32) & abacusPIDMask
+
+		if ix >= nSide || iy >= nSide || iz >= nSide {
+			return nil, fmt.Errorf("%s contains the PID %x, which is not " +
+				"on a grid with ppd = %d.", snap.pidNames[i], pid, nSide)
+		}
+
+		snap.idBuf[j] = 1 + ix + iy*nSide + iz*nSide*nSide
+	}
+
+	return snap.idBuf, nil
+}
+
+func (snap *abacusSnapshot) ReadMp(i int) ([]float32, error) {
+	n, err := snap.particles(i)
+	if err != nil { return nil, err }
+	snap.mpBuf = expandScalars(snap.mpBuf[:0], n)
+
+	for j := range snap.mpBuf { snap.mpBuf[j] = float32(snap.hd.UniformMp) }
+
+	return snap.mpBuf, nil
+}
+
+func (snap *abacusSnapshot) ReadXSpecies(i, species int) ([][3]float32, error) {
+	return readXDarkMatter(snap, i, species)
+}
+
+func (snap *abacusSnapshot) ReadVSpecies(i, species int) ([][3]float32, error) {
+	return readVDarkMatter(snap, i, species)
+}
+
+func (snap *abacusSnapshot) ReadIDSpecies(i, species int) ([]int64, error) {
+	return readIDDarkMatter(snap, i, species)
+}
+
+func (snap *abacusSnapshot) ReadMpSpecies(i, species int) ([]float32, error) {
+	return readMpDarkMatter(snap, i, species)
+}
@@ -0,0 +1,210 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+// packTestRVint packs a position in [-0.5, 0.5) box units and a velocity in
+// km/s into an RVint word.
+func packTestRVint(x, v float64) int32 {
+	ix := int32(math.Floor(x*1e6 + 0.5))
+	iv := int32(math.Floor(v/abacusVelScale + 0.5)) + 2048
+	return ix << 12 | iv
+}
+
+// writeTestAbacusFile writes the RVint and PID files for a set of particles.
+func writeTestAbacusFile(
+	dir, set string, x [][3]float64, v [][3]float64, idx [][3]int64,
+) {
+	rvDir := path.Join(dir, "field_rv_" + set)
+	pidDir := path.Join(dir, "field_pid_" + set)
+	for _, d := range []string{ rvDir, pidDir } {
+		if err := os.MkdirAll(d, 0755); err != nil { panic(err.Error()) }
+	}
+
+	rv := make([]int32, 3*len(x))
+	pid := make([]int64, len(x))
+	for i := range x {
+		for k := 0; k < 3; k++ { rv[3*i + k] = packTestRVint(x[i][k], v[i][k]) }
+		// Set density bits above the Lagrangian index to check masking.
+		pid[i] = idx[i][0] | idx[i][1] << 16 | idx[i][2] << 32 | 1 << 48
+	}
+
+	for _, out := range []struct{
+		fname string
+		data interface{}
+	}{
+		{path.Join(rvDir, "field_rv_" + set + "_000.dat"), rv},
+		{path.Join(pidDir, "field_pid_" + set + "_000.dat"), pid},
+	} {
+		f, err := os.Create(out.fname)
+		if err != nil { panic(err.Error()) }
+		err = binary.Write(f, binary.LittleEndian, out.data)
+		if err != nil { panic(err.Error()) }
+		f.Close()
+	}
+}
+
+// writeTestAbacusHeader writes the header file of an Abacus output with ppd
+// particles on a side.
+func writeTestAbacusHeader(dir string, ppd int) {
+	header := fmt.Sprintf(`# Abacus header
+SimName = "test"
+BoxSize = 100
+ppd = %d.0
+H0 = 70
+Omega_M = 0.3
+Omega_DE = 0.7
+ScaleFactor = 0.5
+ParticleMassHMsun = 2e12
+`, ppd)
+	err := ioutil.WriteFile(path.Join(dir, "header"), []byte(header), 0644)
+	if err != nil { panic(err.Error()) }
+}
+
+func TestAbacus(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_abacus_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	writeTestAbacusHeader(dir, 4)
+
+	writeTestAbacusFile(dir, "A",
+		[][3]float64{ {-0.5, 0, 0.25}, {0.4, -0.25, 0} },
+		[][3]float64{ {0, 300, -600}, {6, -6, 0} },
+		[][3]int64{ {0, 0, 0}, {3, 2, 1} },
+	)
+	writeTestAbacusFile(dir, "B",
+		[][3]float64{ {0.1, 0.1, 0.1} },
+		[][3]float64{ {-3000, 3000, 0} },
+		[][3]int64{ {1, 1, 1} },
+	)
+
+	snap, err := Abacus(dir)
+	if err != nil { t.Fatal(err.Error()) }
+
+	hd := snap.Header()
+	if snap.Files() != 2 || hd.NTotal != 3 || hd.NSide != 4 || hd.L != 100 ||
+		hd.Scale != 0.5 || hd.H100 != 0.7 || hd.UniformMp != 2e12 {
+		t.Fatalf("Header = %v, Files() = %d", hd, snap.Files())
+	}
+
+	x, err := snap.ReadX(0)
+	if err != nil { t.Fatal(err.Error()) }
+	xExp := [][3]float32{ {0, 50, 75}, {90, 25, 50} }
+	for i := range xExp {
+		if len(x) != 2 || !vecEq(x[i], xExp[i], 1e-3) {
+			t.Errorf("Expected x = %v, got %v", xExp, x)
+			break
+		}
+	}
+
+	v, err := snap.ReadV(0)
+	if err != nil { t.Fatal(err.Error()) }
+	vExp := [][3]float32{ {0, 300, -600}, {6, -6, 0} }
+	for i := range vExp {
+		if len(v) != 2 || !vecEq(v[i], vExp[i], abacusVelScale) {
+			t.Errorf("Expected v = %v, got %v", vExp, v)
+			break
+		}
+	}
+
+	id, err := snap.ReadID(0)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(id) != 2 || id[0] != 1 || id[1] != 1 + 3 + 2*4 + 1*16 {
+		t.Errorf("Expected id = [1 28], got %v", id)
+	}
+
+	id, err = snap.ReadID(1)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(id) != 1 || id[0] != 1 + 1 + 4 + 16 {
+		t.Errorf("Expected id = [22], got %v", id)
+	}
+
+	snapA, err := Abacus(dir, AbacusContext{ Subsamples: "A" })
+	if err != nil { t.Fatal(err.Error()) }
+	if snapA.Files() != 1 || snapA.Header().NTotal != 2 {
+		t.Errorf("Subsample A has %d files and %d particles.",
+			snapA.Files(), snapA.Header().NTotal)
+	}
+}
+
+func TestAbacusLVec(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_abacus_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+	outDir := path.Join(dir, "lvec")
+	if err = os.Mkdir(outDir, 0755); err != nil { panic(err.Error()) }
+
+	// Subsample A is missing most of the grid.
+	writeTestAbacusHeader(dir, 2)
+	writeTestAbacusFile(dir, "A",
+		[][3]float64{ {0, 0, 0} }, [][3]float64{ {0, 0, 0} },
+		[][3]int64{ {1, 1, 1} },
+	)
+
+	snap, err := Abacus(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, err = XGrid(snap, 1); err == nil {
+		t.Errorf("Expected an error from XGrid on a subsample.")
+	}
+	err = ConvertToLVec(snap, 1, 1, 0.1, 0.01, outDir, "test.%s.%d.lvec")
+	if err == nil {
+		t.Errorf("Expected an error from ConvertToLVec on a subsample.")
+	}
+
+	// Subsample A contains the full grid, displaced by 1/8 of a grid cell.
+	x, v, idx := [][3]float64{ }, [][3]float64{ }, [][3]int64{ }
+	for iz := int64(0); iz < 2; iz++ {
+		for iy := int64(0); iy < 2; iy++ {
+			for ix := int64(0); ix < 2; ix++ {
+				x = append(x, [3]float64{
+					float64(ix)/2 - 0.5 + 0.0625,
+					float64(iy)/2 - 0.5 + 0.0625,
+					float64(iz)/2 - 0.5 + 0.0625,
+				})
+				v = append(v, [3]float64{ 100, 0, -100 })
+				idx = append(idx, [3]int64{ ix, iy, iz })
+			}
+		}
+	}
+	writeTestAbacusFile(dir, "A", x, v, idx)
+
+	snap, err = Abacus(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	grid, err := XGrid(snap, 1)
+	if err != nil { t.Fatal(err.Error()) }
+	err = ConvertToLVec(snap, 1, 1, 0.1, 0.01, outDir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	lvec, err := LVec(outDir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	lx, err := lvec.ReadX(0)
+	if err != nil { t.Fatal(err.Error()) }
+	lid, err := lvec.ReadID(0)
+	if err != nil { t.Fatal(err.Error()) }
+
+	if len(lx) != 8 {
+		t.Fatalf("%d particles were converted, not 8.", len(lx))
+	}
+	for j := range lid {
+		// LVec IDs start at zero.
+		xTarget := [3]float32{
+			50*float32(lid[j] % 2) + 6.25, 50*float32((lid[j] / 2) % 2) + 6.25,
+			50*float32(lid[j] / 4) + 6.25,
+		}
+		if !vecEq(grid.Cells[0][lid[j]], xTarget, 1e-3) {
+			t.Errorf("XGrid has x = %g for ID %d, not %g.",
+				grid.Cells[0][lid[j]], lid[j] + 1, xTarget)
+		}
+		if !vecEq(lx[j], xTarget, 0.2) {
+			t.Errorf("LVec particle with ID %d has x = %g, not %g.",
+				lid[j], lx[j], xTarget)
+		}
+	}
+}
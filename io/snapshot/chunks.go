@@ -0,0 +1,123 @@
+package snapshot
+
+import (
+	"io"
+)
+
+// ChunkedSnapshot is a Snapshot which can read files in pieces, so that only
+// a bounded buffer needs to be kept in memory at once. The chunks returned by
+// ReadXChunks, ReadVChunks, and ReadIDChunks for the same file list particles
+// in the same order, but this may be different from the order used by ReadX.
+// Formats which store particles in blocks may round chunk sizes up so that
+// blocks aren't split.
+type ChunkedSnapshot interface {
+	Snapshot
+
+	// ReadXChunks returns an iterator over the positions in file i. Chunks
+	// contain at most chunkSize particles.
+	ReadXChunks(i, chunkSize int) (VectorChunks, error)
+	// ReadVChunks returns an iterator over the velocities in file i. Chunks
+	// contain at most chunkSize particles.
+	ReadVChunks(i, chunkSize int) (VectorChunks, error)
+	// ReadIDChunks returns an iterator over the IDs in file i. Chunks contain
+	// at most chunkSize particles.
+	ReadIDChunks(i, chunkSize int) (IntChunks, error)
+}
+
+// VectorChunks iterates over the vectors in a file.
+type VectorChunks interface {
+	// Next returns the next chunk of vectors. It returns io.EOF once every
+	// chunk has been read. The returned slice is an internal buffer which
+	// will be overwritten by the next call to Next.
+	Next() ([][3]float32, error)
+	// Close releases any resources held by the iterator. It only needs to be
+	// called if iteration stops before Next returns an error.
+	Close() error
+}
+
+// IntChunks iterates over the integers in a file.
+type IntChunks interface {
+	// Next returns the next chunk of integers. It returns io.EOF once every
+	// chunk has been read. The returned slice is an internal buffer which
+	// will be overwritten by the next call to Next.
+	Next() ([]int64, error)
+	// Close releases any resources held by the iterator. It only needs to be
+	// called if iteration stops before Next returns an error.
+	Close() error
+}
+
+// ReadXChunks returns an iterator over the positions in file i of snap. If
+// snap isn't a ChunkedSnapshot, the whole file is read at once and then split
+// into chunks.
+func ReadXChunks(snap Snapshot, i, chunkSize int) (VectorChunks, error) {
+	if cSnap, ok := snap.(ChunkedSnapshot); ok {
+		return cSnap.ReadXChunks(i, chunkSize)
+	}
+	x, err := snap.ReadX(i)
+	if err != nil { return nil, err }
+	return &sliceVectorChunks{ x, chunkSize }, nil
+}
+
+// ReadVChunks returns an iterator over the velocities in file i of snap. If
+// snap isn't a ChunkedSnapshot, the whole file is read at once and then split
+// into chunks.
+func ReadVChunks(snap Snapshot, i, chunkSize int) (VectorChunks, error) {
+	if cSnap, ok := snap.(ChunkedSnapshot); ok {
+		return cSnap.ReadVChunks(i, chunkSize)
+	}
+	v, err := snap.ReadV(i)
+	if err != nil { return nil, err }
+	return &sliceVectorChunks{ v, chunkSize }, nil
+}
+
+// ReadIDChunks returns an iterator over the IDs in file i of snap. If snap
+// isn't a ChunkedSnapshot, the whole file is read at once and then split into
+// chunks.
+func ReadIDChunks(snap Snapshot, i, chunkSize int) (IntChunks, error) {
+	if cSnap, ok := snap.(ChunkedSnapshot); ok {
+		return cSnap.ReadIDChunks(i, chunkSize)
+	}
+	id, err := snap.ReadID(i)
+	if err != nil { return nil, err }
+	return &sliceIntChunks{ id, chunkSize }, nil
+}
+
+// sliceVectorChunks splits an in-memory slice into chunks.
+type sliceVectorChunks struct {
+	vecs [][3]float32
+	chunkSize int
+}
+
+func (c *sliceVectorChunks) Next() ([][3]float32, error) {
+	if len(c.vecs) == 0 { return nil, io.EOF }
+	n := chunkLen(len(c.vecs), c.chunkSize)
+	out := c.vecs[:n]
+	c.vecs = c.vecs[n:]
+	return out, nil
+}
+
+func (c *sliceVectorChunks) Close() error { return nil }
+
+// sliceIntChunks splits an in-memory slice into chunks.
+type sliceIntChunks struct {
+	ints []int64
+	chunkSize int
+}
+
+func (c *sliceIntChunks) Next() ([]int64, error) {
+	if len(c.ints) == 0 { return nil, io.EOF }
+	n := chunkLen(len(c.ints), c.chunkSize)
+	out := c.ints[:n]
+	c.ints = c.ints[n:]
+	return out, nil
+}
+
+func (c *sliceIntChunks) Close() error { return nil }
+
+// chunkLen returns the length of the next chunk when left elements remain.
+// Non-positive chunk sizes are treated as 1.
+func chunkLen(left, chunkSize int) int {
+	if chunkSize < 1 { chunkSize = 1 }
+	if left < chunkSize { return left }
+	return chunkSize
+}
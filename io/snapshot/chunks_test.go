@@ -0,0 +1,173 @@
+package snapshot
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// readAllVectorChunks concatenates every chunk in it and returns the result
+// along with the length of each chunk.
+func readAllVectorChunks(it VectorChunks) ([][3]float32, []int, error) {
+	out, lens := [][3]float32{ }, []int{ }
+	for {
+		chunk, err := it.Next()
+		if err == io.EOF { return out, lens, nil }
+		if err != nil { return nil, nil, err }
+		out = append(out, chunk...)
+		lens = append(lens, len(chunk))
+	}
+}
+
+// readAllIntChunks concatenates every chunk in it and returns the result
+// along with the length of each chunk.
+func readAllIntChunks(it IntChunks) ([]int64, []int, error) {
+	out, lens := []int64{ }, []int{ }
+	for {
+		chunk, err := it.Next()
+		if err == io.EOF { return out, lens, nil }
+		if err != nil { return nil, nil, err }
+		out = append(out, chunk...)
+		lens = append(lens, len(chunk))
+	}
+}
+
+func intsEq(x, y []int) bool {
+	if len(x) != len(y) { return false }
+	for i := range x {
+		if x[i] != y[i] { return false }
+	}
+	return true
+}
+
+func TestLGadget2Chunks(t *testing.T) {
+	dir := t.TempDir()
+	err := Convert(newTestMockSnapshot(), LGadget2Writer(dir, "test.%03d"))
+	if err != nil { t.Fatal(err.Error()) }
+	snap, err := LGadget2(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := snap.(ChunkedSnapshot); !ok {
+		t.Fatalf("LGadget2 snapshots aren't ChunkedSnapshots.")
+	}
+
+	lensTarget := []int{ 300, 300, 300, 100 }
+
+	xIt, err := ReadXChunks(snap, 0, 300)
+	if err != nil { t.Fatal(err.Error()) }
+	xChunks, lens, err := readAllVectorChunks(xIt)
+	if err != nil { t.Fatal(err.Error()) }
+	if !intsEq(lens, lensTarget) {
+		t.Errorf("X chunk lengths = %d, not %d", lens, lensTarget)
+	}
+	x, err := snap.ReadX(0)
+	if err != nil { t.Fatal(err.Error()) }
+	for i := range x {
+		if len(xChunks) != len(x) || xChunks[i] != x[i] {
+			t.Fatalf("X chunks differ from ReadX at index %d.", i)
+		}
+	}
+
+	vIt, err := ReadVChunks(snap, 0, 300)
+	if err != nil { t.Fatal(err.Error()) }
+	vChunks, _, err := readAllVectorChunks(vIt)
+	if err != nil { t.Fatal(err.Error()) }
+	v, err := snap.ReadV(0)
+	if err != nil { t.Fatal(err.Error()) }
+	for i := range v {
+		if len(vChunks) != len(v) || vChunks[i] != v[i] {
+			t.Fatalf("V chunks differ from ReadV at index %d.", i)
+		}
+	}
+
+	idIt, err := ReadIDChunks(snap, 0, 300)
+	if err != nil { t.Fatal(err.Error()) }
+	idChunks, lens, err := readAllIntChunks(idIt)
+	if err != nil { t.Fatal(err.Error()) }
+	if !intsEq(lens, lensTarget) {
+		t.Errorf("ID chunk lengths = %d, not %d", lens, lensTarget)
+	}
+	id, err := snap.ReadID(0)
+	if err != nil { t.Fatal(err.Error()) }
+	for i := range id {
+		if len(idChunks) != len(id) || idChunks[i] != id[i] {
+			t.Fatalf("ID chunks differ from ReadID at index %d.", i)
+		}
+	}
+}
+
+func TestLVecChunks(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_lvec_chunks_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	err = ConvertToLVec(newTestMockSnapshot(), 1, 2, 0.1, 0.01,
+		dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	snap, err := LVec(dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+
+	// Each sub-cell has 125 particles, so two fit in a chunk.
+	lensTarget := []int{ 250, 250, 250, 250 }
+
+	xIt, err := ReadXChunks(snap, 0, 300)
+	if err != nil { t.Fatal(err.Error()) }
+	x, lens, err := readAllVectorChunks(xIt)
+	if err != nil { t.Fatal(err.Error()) }
+	if !intsEq(lens, lensTarget) {
+		t.Errorf("X chunk lengths = %d, not %d", lens, lensTarget)
+	}
+
+	vIt, err := ReadVChunks(snap, 0, 300)
+	if err != nil { t.Fatal(err.Error()) }
+	v, _, err := readAllVectorChunks(vIt)
+	if err != nil { t.Fatal(err.Error()) }
+
+	idIt, err := ReadIDChunks(snap, 0, 300)
+	if err != nil { t.Fatal(err.Error()) }
+	id, lens, err := readAllIntChunks(idIt)
+	if err != nil { t.Fatal(err.Error()) }
+	if !intsEq(lens, lensTarget) {
+		t.Errorf("ID chunk lengths = %d, not %d", lens, lensTarget)
+	}
+
+	if len(x) != 1000 || len(v) != 1000 || len(id) != 1000 {
+		t.Fatalf("Read %d, %d, %d particles, not 1000.", len(x), len(v),
+			len(id))
+	}
+
+	seen := make([]bool, 1000)
+	for i := range id {
+		ix, iy, iz := id[i] % 10, (id[i] / 10) % 10, id[i] / 100
+		if seen[id[i]] {
+			t.Fatalf("ID %d appears twice.", id[i])
+		}
+		seen[id[i]] = true
+
+		xTarget := [3]float32{ float32(ix), float32(iy), float32(iz) }
+		vTarget := [3]float32{ -float32(ix), float32(iy), -float32(iz) }
+		if !vecEq(x[i], xTarget, 0.2) || !vecEq(v[i], vTarget, 0.02) {
+			t.Fatalf("Particle %d with ID %d has x = %g, v = %g.",
+				i, id[i], x[i], v[i])
+		}
+	}
+}
+
+func TestSliceChunks(t *testing.T) {
+	snap := newTestMockSnapshot()
+
+	xIt, err := ReadXChunks(snap, 0, 400)
+	if err != nil { t.Fatal(err.Error()) }
+	x, lens, err := readAllVectorChunks(xIt)
+	if err != nil { t.Fatal(err.Error()) }
+	if lensTarget := []int{ 400, 400, 200 }; !intsEq(lens, lensTarget) {
+		t.Errorf("X chunk lengths = %d, not %d", lens, lensTarget)
+	}
+
+	xTarget, _ := snap.ReadX(0)
+	for i := range xTarget {
+		if len(x) != len(xTarget) || x[i] != xTarget[i] {
+			t.Fatalf("X chunks differ from ReadX at index %d.", i)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// fortranReader reads the records of a Fortran unformatted sequential file.
+// Each record is enclosed by a header and footer giving its size in bytes.
+type fortranReader struct {
+	rd io.ReadSeeker
+	order binary.ByteOrder
+	fname string
+}
+
+func newFortranReader(
+	rd io.ReadSeeker, order binary.ByteOrder, fname string,
+) *fortranReader {
+	return &fortranReader{ rd: rd, order: order, fname: fname }
+}
+
+// begin reads the header of the next record and returns its size.
+func (fr *fortranReader) begin() (int32, error) {
+	var head int32
+	err := binary.Read(fr.rd, fr.order, &head)
+	return head, err
+}
+
+// end reads the footer of the current record and checks it against the header.
+func (fr *fortranReader) end(head int32, n int, blockName string) error {
+	var foot int32
+	if err := binary.Read(fr.rd, fr.order, &foot); err != nil { return err }
+
+	err := fortranRecordCheck([2]int32{ head, foot }, n, blockName)
+	if err != nil {
+		return fmt.Errorf("Corruption detected in the file %s: %s",
+			fr.fname, err.Error())
+	}
+	return nil
+}
+
+// read reads the next record into data, which must have the same size as the
+// record.
+func (fr *fortranReader) read(data interface{}, blockName string) error {
+	head, err := fr.begin()
+	if err != nil { return err }
+	if int(head) == binary.Size(data) {
+		err = binary.Read(fr.rd, fr.order, data)
+		if err != nil { return err }
+	} else {
+		// Let end report the mismatch.
+		_, err = fr.rd.Seek(int64(head), 1)
+		if err != nil { return err }
+	}
+	return fr.end(head, binary.Size(data), blockName)
+}
+
+// skip skips over the next record.
+func (fr *fortranReader) skip(blockName string) error {
+	head, err := fr.begin()
+	if err != nil { return err }
+	_, err = fr.rd.Seek(int64(head), 1)
+	if err != nil { return err }
+	return fr.end(head, int(head), blockName)
+}
@@ -0,0 +1,611 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Gadget2Types is the number of particle types in a Gadget-2 file: gas, halo,
+// disk, bulge, stars, and boundary particles, in that order.
+const Gadget2Types = MaxSpecies
+
+// gadget2Format1Blocks lists the blocks that a Gadget-2 file without block
+// labels (SnapFormat = 1) starts with. MASS is only written if some particle
+// type isn't in the mass table, and the SPH blocks are only written if there
+// are gas particles. NE and NH are only written by runs with cooling. Blocks
+// after HSML depend on compile-time flags and can't be identified.
+var gadget2Format1Blocks = []string{
+	"HEAD", "POS", "VEL", "ID", "MASS", "U", "RHO", "NE", "NH", "HSML",
+}
+
+// Gadget2Snapshot is a Snapshot which can also read the SPH blocks associated
+// with gas particles and any other block by name. Like Snapshot's Read*
+// methods, all these methods return internal buffers. Gadget-2 particle types
+// are read with the Read*Species methods, since species and particle types
+// are the same.
+//
+// Both unlabelled files (SnapFormat = 1) and files where each block is
+// preceded by a 4-character label (SnapFormat = 2) are supported. Only the
+// latter can contain reordered or optional blocks like POT, ACCE, and TSTP.
+type Gadget2Snapshot interface {
+	Snapshot
+
+	// NPart returns the number of particles of each type in file i.
+	NPart(i int) ([Gadget2Types]int64, error)
+
+	ReadU(i int) ([]float32, error) // Internal energy of gas particles.
+	ReadRho(i int) ([]float32, error) // Density of gas particles.
+	ReadHsml(i int) ([]float32, error) // Smoothing length of gas particles.
+
+	// Blocks returns the names of the blocks in file i, without trailing
+	// spaces (e.g. "POS", "ID", "ACCE").
+	Blocks(i int) ([]string, error)
+	// ReadFloat32Block and ReadVecBlock read the named block from file i.
+	ReadFloat32Block(i int, name string) ([]float32, error)
+	ReadVecBlock(i int, name string) ([][3]float32, error)
+}
+
+type gadget2Snapshot struct {
+	hd Header
+	uniform bool
+	context Gadget2Context
+	filenames []string
+
+	xBuf, vBuf [][3]float32
+	mpBuf, blockBuf []float32
+	vecBlockBuf [][3]float32
+	idBuf []int64
+	id32Buf []int32
+}
+
+// Gadget2Context contains optional information about how a Gadget-2 snapshot
+// was written.
+type Gadget2Context struct {
+	Order binary.ByteOrder
+	MassUnit float64 // Msun/h per Gadget mass unit.
+}
+
+var defaultGadget2Context = Gadget2Context{
+	Order: binary.LittleEndian,
+	MassUnit: 1e10,
+}
+
+// gadget2Block is the location of the body of a single Fortran record.
+type gadget2Block struct {
+	offset, size int64
+}
+
+// gadget2Layout describes the contents of a single Gadget-2 file.
+type gadget2Layout struct {
+	gh lGadget2Header
+	npart [Gadget2Types]int64
+	names []string
+	blocks map[string]gadget2Block
+	idBytes int64
+}
+
+// Gadget2 returns a snapshot for the full, multi-species Gadget-2 files in a
+// given directory. Additional information may be optionally offered in the
+// form of a Gadget2Context instance.
+func Gadget2(
+	dir string, context ...Gadget2Context,
+) (Gadget2Snapshot, error) {
+	snap := &gadget2Snapshot{ }
+	var err error
+
+	snap.context = defaultGadget2Context
+	if len(context) > 0 { snap.context = context[0] }
+
+	snap.filenames, err = getFilenames(dir)
+	if err != nil { return nil, err }
+	if len(snap.filenames) == 0 {
+		return nil, fmt.Errorf("No files in directory %s", dir)
+	}
+
+	layout, err := snap.layout(0)
+	if err != nil { return nil, err }
+	gh := &layout.gh
+
+	total := gadget2TotalParticles(gh, snap.context.Order)
+	nTotal, nTypes := int64(0), 0
+	for typ := range total {
+		nTotal += total[typ]
+		if total[typ] > 0 { nTypes++ }
+	}
+
+	snap.hd = *gh.convertWithTotal(nTotal)
+	snap.hd.NPart = total
+
+	for typ := range total {
+		if total[typ] > 0 && nTypes == 1 && gh.Mass[typ] > 0 {
+			snap.uniform = true
+			snap.hd.UniformMp = gh.Mass[typ] * snap.context.MassUnit
+		}
+	}
+
+	return snap, nil
+}
+
+// gadget2TotalParticles returns the total number of particles of each type
+// across all files, including the high words used by runs with more than
+// 2^32 particles of a single type.
+func gadget2TotalParticles(
+	gh *lGadget2Header, order binary.ByteOrder,
+) [Gadget2Types]int64 {
+	out := [Gadget2Types]int64{ }
+	for typ := range out {
+		high := order.Uint32(gh.Padding[4*typ: 4*typ + 4])
+		out[typ] = int64(gh.NPartTotal[typ]) + int64(high) << 32
+	}
+	return out
+}
+
+// layout scans the Fortran records in file idx and returns the location of
+// each block.
+func (snap *gadget2Snapshot) layout(idx int) (*gadget2Layout, error) {
+	f, err := os.Open(snap.filenames[idx])
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	return readGadget2Layout(f, snap.filenames[idx], snap.context.Order)
+}
+
+// verifyRecords checks the Fortran record markers and block layout of file
+// idx.
+func (snap *gadget2Snapshot) verifyRecords(idx int) error {
+	_, err := snap.layout(idx)
+	return err
+}
+
+func readGadget2Layout(
+	f *os.File, fname string, order binary.ByteOrder,
+) (*gadget2Layout, error) {
+	layout := &gadget2Layout{ blocks: map[string]gadget2Block{ } }
+
+	records, err := readFortranRecords(f, fname, order)
+	if err != nil { return nil, err }
+
+	labelled, err := isGadget2Format2(f, records)
+	if err != nil { return nil, err }
+
+	var data []gadget2Block
+	if labelled {
+		// Every block is preceded by an 8-byte block containing its label and
+		// the size of the next block.
+		for i := 0; i + 1 < len(records); i += 2 {
+			label := make([]byte, 4)
+			_, err = f.Seek(records[i].offset, 0)
+			if err != nil { return nil, err }
+			_, err = io.ReadFull(f, label)
+			if err != nil { return nil, err }
+
+			name := strings.TrimRight(string(label), " ")
+			layout.names = append(layout.names, name)
+			data = append(data, records[i+1])
+		}
+	} else {
+		data = records
+	}
+
+	if len(data) == 0 || (labelled && layout.names[0] != "HEAD") {
+		return nil, fmt.Errorf("The file %s does not start with a header.",
+			fname)
+	}
+
+	hdBlock := data[0]
+	if hdBlock.size != int64(binary.Size(&layout.gh)) {
+		return nil, fmt.Errorf("The header of the file %s has %d bytes.",
+			fname, hdBlock.size)
+	}
+	_, err = f.Seek(hdBlock.offset, 0)
+	if err != nil { return nil, err }
+	err = binary.Read(f, order, &layout.gh)
+	if err != nil { return nil, err }
+
+	n := int64(0)
+	for typ := range layout.npart {
+		layout.npart[typ] = int64(layout.gh.NPart[typ])
+		n += layout.npart[typ]
+	}
+
+	if !labelled { layout.names = layout.format1Names(len(data)) }
+	for i := range layout.names {
+		layout.blocks[layout.names[i]] = data[i]
+	}
+
+	for _, name := range []string{ "POS", "VEL", "ID" } {
+		if _, ok := layout.blocks[name]; !ok {
+			return nil, fmt.Errorf("The file %s does not contain a %s block.",
+				fname, name)
+		}
+	}
+
+	idBlock := layout.blocks["ID"]
+	layout.idBytes = 4
+	if n > 0 {
+		layout.idBytes = idBlock.size / n
+	}
+	if layout.idBytes != 4 && layout.idBytes != 8 {
+		return nil, fmt.Errorf("The ID block of the file %s has %d bytes " +
+			"for %d particles.", fname, idBlock.size, n)
+	}
+
+	return layout, nil
+}
+
+// readFortranRecords returns the location of every Fortran record in f.
+func readFortranRecords(
+	f *os.File, fname string, order binary.ByteOrder,
+) ([]gadget2Block, error) {
+	records := []gadget2Block{ }
+
+	for offset := int64(0); ; {
+		var head, foot int32
+		err := binary.Read(f, order, &head)
+		if err == io.EOF { break }
+		if err != nil { return nil, err }
+
+		_, err = f.Seek(int64(head), 1)
+		if err != nil { return nil, err }
+		err = binary.Read(f, order, &foot)
+		if err != nil { return nil, err }
+
+		if head != foot || head < 0 {
+			return nil, fmt.Errorf(
+				"Block %d in the file %s has Fortran header %d and footer %d.",
+				len(records), fname, head, foot,
+			)
+		}
+
+		records = append(records, gadget2Block{ offset + 4, int64(head) })
+		offset += int64(head) + 8
+	}
+
+	return records, nil
+}
+
+// isGadget2Format2 returns true if the records of f start with a "HEAD"
+// label block.
+func isGadget2Format2(f *os.File, records []gadget2Block) (bool, error) {
+	if len(records) == 0 || records[0].size != 8 { return false, nil }
+
+	label := make([]byte, 4)
+	_, err := f.Seek(records[0].offset, 0)
+	if err != nil { return false, err }
+	_, err = io.ReadFull(f, label)
+	if err != nil { return false, err }
+
+	return string(label) == "HEAD", nil
+}
+
+// format1Names returns the names of the first n blocks of an unlabelled file.
+func (layout *gadget2Layout) format1Names(n int) []string {
+	names := []string{ }
+	for _, name := range gadget2Format1Blocks {
+		switch name {
+		case "MASS":
+			if !layout.hasMassBlock() { continue }
+		case "U", "RHO", "HSML":
+			if layout.npart[0] == 0 { continue }
+		case "NE", "NH":
+			if layout.npart[0] == 0 || layout.gh.FlagCooling == 0 { continue }
+		}
+
+		if len(names) == n { break }
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// typeRange returns the index of the first particle of type typ within the
+// file and the number of particles of that type. A negative typ corresponds
+// to all particles.
+func (layout *gadget2Layout) typeRange(typ int) (start, n int64) {
+	if typ < 0 {
+		for t := range layout.npart { n += layout.npart[t] }
+		return 0, n
+	}
+
+	for t := 0; t < typ; t++ { start += layout.npart[t] }
+	return start, layout.npart[typ]
+}
+
+// hasMassBlock returns true if some particle type doesn't have its mass stored
+// in the header's mass table.
+func (layout *gadget2Layout) hasMassBlock() bool {
+	for typ := range layout.npart {
+		if layout.npart[typ] > 0 && layout.gh.Mass[typ] == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// openBlock opens file idx and seeks to the element start of the named block,
+// assuming each element has the given size in bytes.
+func (snap *gadget2Snapshot) openBlock(
+	idx int, layout *gadget2Layout, name string, start, size int64,
+) (*os.File, error) {
+	block, ok := layout.blocks[name]
+	if !ok {
+		return nil, fmt.Errorf("The file %s does not contain a %s block.",
+			snap.filenames[idx], name)
+	}
+
+	f, err := os.Open(snap.filenames[idx])
+	if err != nil { return nil, err }
+
+	_, err = f.Seek(block.offset + start*size, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (snap *gadget2Snapshot) Files() int {
+	return len(snap.filenames)
+}
+
+func (snap *gadget2Snapshot) Header() *Header {
+	return &snap.hd
+}
+
+func (snap *gadget2Snapshot) RawHeader(idx int) []byte {
+	layout, err := snap.layout(idx)
+	if err != nil { panic(err.Error()) }
+
+	buf := &bytes.Buffer{ }
+	err = binary.Write(buf, snap.context.Order, &layout.gh)
+	if err != nil { panic(err.Error()) }
+
+	return buf.Bytes()
+}
+
+func (snap *gadget2Snapshot) UpdateHeader(hd *Header) {
+	snap.hd = *hd
+}
+
+// UniformMass returns true if the snapshot only contains a single particle
+// type and that type's mass is stored in the header's mass table.
+func (snap *gadget2Snapshot) UniformMass() bool {
+	return snap.uniform
+}
+
+func (snap *gadget2Snapshot) NPart(idx int) ([Gadget2Types]int64, error) {
+	layout, err := snap.layout(idx)
+	if err != nil { return [Gadget2Types]int64{ }, err }
+	return layout.npart, nil
+}
+
+func (snap *gadget2Snapshot) ReadX(idx int) ([][3]float32, error) {
+	return snap.ReadXSpecies(idx, -1)
+}
+
+func (snap *gadget2Snapshot) ReadV(idx int) ([][3]float32, error) {
+	return snap.ReadVSpecies(idx, -1)
+}
+
+func (snap *gadget2Snapshot) ReadID(idx int) ([]int64, error) {
+	return snap.ReadIDSpecies(idx, -1)
+}
+
+func (snap *gadget2Snapshot) ReadMp(idx int) ([]float32, error) {
+	return snap.ReadMpSpecies(idx, -1)
+}
+
+func (snap *gadget2Snapshot) ReadXSpecies(idx, typ int) ([][3]float32, error) {
+	if err := checkSpecies(typ); err != nil { return nil, err }
+	layout, err := snap.layout(idx)
+	if err != nil { return nil, err }
+
+	start, n := layout.typeRange(typ)
+	snap.xBuf = expandVectors(snap.xBuf[:0], int(n))
+
+	f, err := snap.openBlock(idx, layout, "POS", start, 12)
+	if err != nil { return nil, err }
+	defer f.Close()
+	err = readVecAsByte(f, snap.context.Order, snap.xBuf)
+	if err != nil { return nil, err }
+
+	L := float32(layout.gh.BoxSize)
+	for i := range snap.xBuf {
+		for j := 0; j < 3; j++ {
+			x := snap.xBuf[i][j]
+
+			if x < 0 {
+				x += L
+			} else if x >= L {
+				x -= L
+			}
+
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
+				x < 0 || x >= L {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.filenames[idx],
+				)
+			}
+
+			snap.xBuf[i][j] = x
+		}
+	}
+
+	return snap.xBuf, nil
+}
+
+func (snap *gadget2Snapshot) ReadVSpecies(idx, typ int) ([][3]float32, error) {
+	if err := checkSpecies(typ); err != nil { return nil, err }
+	layout, err := snap.layout(idx)
+	if err != nil { return nil, err }
+
+	start, n := layout.typeRange(typ)
+	snap.vBuf = expandVectors(snap.vBuf[:0], int(n))
+
+	f, err := snap.openBlock(idx, layout, "VEL", start, 12)
+	if err != nil { return nil, err }
+	defer f.Close()
+	err = readVecAsByte(f, snap.context.Order, snap.vBuf)
+	if err != nil { return nil, err }
+
+	rootA := float32(math.Sqrt(float64(layout.gh.Time)))
+
+	for i := range snap.vBuf {
+		for j := 0; j < 3; j++ {
+			v := snap.vBuf[i][j] * rootA
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.filenames[idx],
+				)
+			}
+			snap.vBuf[i][j] = v
+		}
+	}
+
+	return snap.vBuf, nil
+}
+
+func (snap *gadget2Snapshot) ReadIDSpecies(idx, typ int) ([]int64, error) {
+	if err := checkSpecies(typ); err != nil { return nil, err }
+	layout, err := snap.layout(idx)
+	if err != nil { return nil, err }
+
+	start, n := layout.typeRange(typ)
+	snap.idBuf = expandInts(snap.idBuf[:0], int(n))
+
+	f, err := snap.openBlock(idx, layout, "ID", start, layout.idBytes)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	if layout.idBytes == 8 {
+		err = readInt64AsByte(f, snap.context.Order, snap.idBuf)
+		if err != nil { return nil, err }
+		return snap.idBuf, nil
+	}
+
+	if int64(cap(snap.id32Buf)) < n {
+		snap.id32Buf = make([]int32, n)
+	}
+	snap.id32Buf = snap.id32Buf[:n]
+
+	err = readInt32AsByte(f, snap.context.Order, snap.id32Buf)
+	if err != nil { return nil, err }
+	for i := range snap.idBuf {
+		snap.idBuf[i] = int64(uint32(snap.id32Buf[i]))
+	}
+
+	return snap.idBuf, nil
+}
+
+func (snap *gadget2Snapshot) ReadMpSpecies(idx, typ int) ([]float32, error) {
+	if err := checkSpecies(typ); err != nil { return nil, err }
+	layout, err := snap.layout(idx)
+	if err != nil { return nil, err }
+
+	_, n := layout.typeRange(typ)
+	snap.mpBuf = expandScalars(snap.mpBuf[:0], int(n))
+
+	var f *os.File
+	if layout.hasMassBlock() {
+		f, err = snap.openBlock(idx, layout, "MASS", 0, 4)
+		if err != nil { return nil, err }
+		defer f.Close()
+	}
+
+	// Types with entries in the mass table are skipped in the mass block.
+	blockStart, j := int64(0), 0
+	mu := float32(snap.context.MassUnit)
+	for t := 0; t < Gadget2Types; t++ {
+		nt := layout.npart[t]
+		inBlock := nt > 0 && layout.gh.Mass[t] == 0
+
+		if typ < 0 || t == typ {
+			buf := snap.mpBuf[j: j + int(nt)]
+			if inBlock {
+				offset := layout.blocks["MASS"].offset + 4*blockStart
+				_, err = f.Seek(offset, 0)
+				if err != nil { return nil, err }
+				err = readFloat32AsByte(f, snap.context.Order, buf)
+				if err != nil { return nil, err }
+			} else {
+				for k := range buf { buf[k] = float32(layout.gh.Mass[t]) }
+			}
+
+			for k := range buf { buf[k] *= mu }
+			j += int(nt)
+		}
+
+		if inBlock { blockStart += nt }
+	}
+
+	return snap.mpBuf, nil
+}
+
+// ReadU returns the internal energy per unit mass of the gas particles in
+// file idx.
+func (snap *gadget2Snapshot) ReadU(idx int) ([]float32, error) {
+	return snap.ReadFloat32Block(idx, "U")
+}
+
+// ReadRho returns the density of the gas particles in file idx.
+func (snap *gadget2Snapshot) ReadRho(idx int) ([]float32, error) {
+	return snap.ReadFloat32Block(idx, "RHO")
+}
+
+// ReadHsml returns the SPH smoothing length of the gas particles in file idx.
+func (snap *gadget2Snapshot) ReadHsml(idx int) ([]float32, error) {
+	return snap.ReadFloat32Block(idx, "HSML")
+}
+
+// Blocks returns the names of the blocks in file idx.
+func (snap *gadget2Snapshot) Blocks(idx int) ([]string, error) {
+	layout, err := snap.layout(idx)
+	if err != nil { return nil, err }
+	return layout.names, nil
+}
+
+// ReadFloat32Block reads the named block of file idx as a sequence of float32
+// values.
+func (snap *gadget2Snapshot) ReadFloat32Block(
+	idx int, name string,
+) ([]float32, error) {
+	layout, err := snap.layout(idx)
+	if err != nil { return nil, err }
+
+	f, err := snap.openBlock(idx, layout, name, 0, 4)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	n := layout.blocks[name].size / 4
+	snap.blockBuf = expandScalars(snap.blockBuf[:0], int(n))
+	err = readFloat32AsByte(f, snap.context.Order, snap.blockBuf)
+	if err != nil { return nil, err }
+
+	return snap.blockBuf, nil
+}
+
+// ReadVecBlock reads the named block of file idx as a sequence of float32
+// vectors.
+func (snap *gadget2Snapshot) ReadVecBlock(
+	idx int, name string,
+) ([][3]float32, error) {
+	layout, err := snap.layout(idx)
+	if err != nil { return nil, err }
+
+	f, err := snap.openBlock(idx, layout, name, 0, 12)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	n := layout.blocks[name].size / 12
+	snap.vecBlockBuf = expandVectors(snap.vecBlockBuf[:0], int(n))
+	err = readVecAsByte(f, snap.context.Order, snap.vecBlockBuf)
+	if err != nil { return nil, err }
+
+	return snap.vecBlockBuf, nil
+}
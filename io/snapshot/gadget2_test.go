@@ -0,0 +1,218 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeTestRecord writes data to f as a single Fortran record.
+func writeTestRecord(f *os.File, data interface{}) {
+	size := int32(binary.Size(data))
+	writeInt32(f, binary.LittleEndian, size)
+	if err := binary.Write(f, binary.LittleEndian, data); err != nil {
+		panic(err.Error())
+	}
+	writeInt32(f, binary.LittleEndian, size)
+}
+
+// writeTestGadget2Snapshot writes a snapshot with two gas particles, three
+// halo particles whose masses are in the mass table, and two disk particles
+// whose masses are in the mass block.
+func writeTestGadget2Snapshot(dir string) {
+	gh := &lGadget2Header{
+		NPart: [6]uint32{2, 3, 2, 0, 0, 0},
+		NPartTotal: [6]uint32{2, 3, 2, 0, 0, 0},
+		Mass: [6]float64{0, 2, 0, 0, 0, 0},
+		Time: 0.25, Redshift: 3, NumFiles: 1,
+		BoxSize: 10, Omega0: 0.3, OmegaLambda: 0.7, HubbleParam: 0.7,
+	}
+
+	x := make([][3]float32, 7)
+	v := make([][3]float32, 7)
+	id := make([]uint32, 7)
+	for i := range x {
+		x[i] = [3]float32{ float32(i), 1, 2 }
+		v[i] = [3]float32{ float32(2*i), 0, 0 }
+		id[i] = uint32(i + 100)
+	}
+
+	f, err := os.Create(path.Join(dir, "snap.0"))
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+
+	writeTestRecord(f, gh)
+	writeTestRecord(f, x)
+	writeTestRecord(f, v)
+	writeTestRecord(f, id)
+	writeTestRecord(f, []float32{ 1, 1, 3, 4 }) // gas and disk masses
+	writeTestRecord(f, []float32{ 5, 6 }) // U
+	writeTestRecord(f, []float32{ 7, 8 }) // RHO
+}
+
+func TestGadget2(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_gadget2_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	writeTestGadget2Snapshot(dir)
+
+	snap, err := Gadget2(dir)
+	if err != nil { t.Fatalf("Gadget2 returned error: %s", err.Error()) }
+
+	if hd := snap.Header(); hd.NTotal != 7 || hd.L != 10 ||
+		hd.Scale != 0.25 || hd.NPart != [MaxSpecies]int64{2, 3, 2, 0, 0, 0} {
+		t.Errorf("Header = %v", hd)
+	}
+	if snap.UniformMass() {
+		t.Errorf("UniformMass() = true for a multi-species snapshot.")
+	}
+
+	npart, err := snap.NPart(0)
+	if err != nil { t.Fatal(err.Error()) }
+	if npart != [Gadget2Types]int64{2, 3, 2, 0, 0, 0} {
+		t.Errorf("NPart(0) = %d", npart)
+	}
+
+	x, err := snap.ReadXSpecies(0, 1)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(x) != 3 || x[0][0] != 2 || x[2][0] != 4 {
+		t.Errorf("ReadXSpecies(0, 1) = %g", x)
+	}
+
+	v, err := snap.ReadV(0)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(v) != 7 || v[3][0] != 3 {
+		t.Errorf("ReadV(0) = %g", v)
+	}
+
+	id, err := snap.ReadIDSpecies(0, 2)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(id) != 2 || id[0] != 105 || id[1] != 106 {
+		t.Errorf("ReadIDSpecies(0, 2) = %d", id)
+	}
+
+	mp, err := snap.ReadMp(0)
+	if err != nil { t.Fatal(err.Error()) }
+	mpTarget := []float32{ 1e10, 1e10, 2e10, 2e10, 2e10, 3e10, 4e10 }
+	for i := range mpTarget {
+		if len(mp) != len(mpTarget) || !floatEq(mp[i], mpTarget[i], 1e4) {
+			t.Fatalf("ReadMp(0) = %g, not %g", mp, mpTarget)
+		}
+	}
+
+	mp, err = snap.ReadMpSpecies(0, 2)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(mp) != 2 || !floatEq(mp[1], 4e10, 1e4) {
+		t.Errorf("ReadMpSpecies(0, 2) = %g", mp)
+	}
+
+	u, err := snap.ReadU(0)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(u) != 2 || u[0] != 5 || u[1] != 6 {
+		t.Errorf("ReadU(0) = %g", u)
+	}
+
+	rho, err := snap.ReadRho(0)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(rho) != 2 || rho[0] != 7 || rho[1] != 8 {
+		t.Errorf("ReadRho(0) = %g", rho)
+	}
+
+	if _, err = snap.ReadHsml(0); err == nil {
+		t.Errorf("Expected error from ReadHsml(0) on a file with no HSML block.")
+	}
+}
+
+// writeTestLabelledRecord writes data to f as a SnapFormat = 2 block with the
+// given label.
+func writeTestLabelledRecord(f *os.File, label string, data interface{}) {
+	labelBlock := struct {
+		Label [4]byte
+		Size int32
+	}{ Size: int32(binary.Size(data)) + 8 }
+	copy(labelBlock.Label[:], label)
+
+	writeTestRecord(f, &labelBlock)
+	writeTestRecord(f, data)
+}
+
+func TestGadget2Format2(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_gadget2_format2_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	gh := &lGadget2Header{
+		NPart: [6]uint32{0, 3, 0, 0, 0, 0},
+		NPartTotal: [6]uint32{0, 3, 0, 0, 0, 0},
+		Mass: [6]float64{0, 2, 0, 0, 0, 0},
+		Time: 0.25, Redshift: 3, NumFiles: 1,
+		BoxSize: 10, Omega0: 0.3, OmegaLambda: 0.7, HubbleParam: 0.7,
+	}
+
+	f, err := os.Create(path.Join(dir, "snap.0"))
+	if err != nil { panic(err.Error()) }
+
+	// Blocks are intentionally out of the standard order.
+	writeTestLabelledRecord(f, "HEAD", gh)
+	writeTestLabelledRecord(f, "POS ", [][3]float32{ {1, 1, 1}, {2, 2, 2},
+		{3, 3, 3} })
+	writeTestLabelledRecord(f, "ID  ", []int64{ 7, 8, 9 })
+	writeTestLabelledRecord(f, "POT ", []float32{ -1, -2, -3 })
+	writeTestLabelledRecord(f, "VEL ", [][3]float32{ {4, 0, 0}, {6, 0, 0},
+		{8, 0, 0} })
+	writeTestLabelledRecord(f, "ACCE", [][3]float32{ {0, 1, 0}, {0, 2, 0},
+		{0, 3, 0} })
+	f.Close()
+
+	snap, err := Gadget2(dir)
+	if err != nil { t.Fatalf("Gadget2 returned error: %s", err.Error()) }
+
+	if !snap.UniformMass() || !floatEq(float32(snap.Header().UniformMp),
+		2e10, 1e4) {
+		t.Errorf("UniformMass() = %v, UniformMp = %g", snap.UniformMass(),
+			snap.Header().UniformMp)
+	}
+
+	names, err := snap.Blocks(0)
+	if err != nil { t.Fatal(err.Error()) }
+	namesTarget := []string{ "HEAD", "POS", "ID", "POT", "VEL", "ACCE" }
+	if len(names) != len(namesTarget) {
+		t.Fatalf("Blocks(0) = %v, not %v", names, namesTarget)
+	}
+	for i := range names {
+		if names[i] != namesTarget[i] {
+			t.Fatalf("Blocks(0) = %v, not %v", names, namesTarget)
+		}
+	}
+
+	v, err := snap.ReadV(0)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(v) != 3 || v[0][0] != 2 || v[2][0] != 4 {
+		t.Errorf("ReadV(0) = %g", v)
+	}
+
+	id, err := snap.ReadID(0)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(id) != 3 || id[0] != 7 || id[2] != 9 {
+		t.Errorf("ReadID(0) = %d", id)
+	}
+
+	pot, err := snap.ReadFloat32Block(0, "POT")
+	if err != nil { t.Fatal(err.Error()) }
+	if len(pot) != 3 || pot[1] != -2 {
+		t.Errorf("ReadFloat32Block(0, \"POT\") = %g", pot)
+	}
+
+	acc, err := snap.ReadVecBlock(0, "ACCE")
+	if err != nil { t.Fatal(err.Error()) }
+	if len(acc) != 3 || acc[2][1] != 3 {
+		t.Errorf("ReadVecBlock(0, \"ACCE\") = %g", acc)
+	}
+
+	if _, err = snap.ReadFloat32Block(0, "TSTP"); err == nil {
+		t.Errorf("Expected error when reading a missing TSTP block.")
+	}
+}
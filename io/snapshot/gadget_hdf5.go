@@ -0,0 +1,436 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/phil-mansfield/nbody-utils/io/hdf5"
+)
+
+type gadgetHDF5Snapshot struct {
+	hd Header
+	uniform bool
+	context GadgetHDF5Context
+	filenames []string
+
+	xBuf, vBuf [][3]float32
+	mpBuf []float32
+	idBuf []int64
+}
+
+// GadgetHDF5Context contains optional information about how an HDF5 snapshot
+// was written.
+type GadgetHDF5Context struct {
+	MassUnit float64 // Msun/h per mass unit.
+	// RootAVelocities is true if velocities are stored as sqrt(a) times the
+	// peculiar velocity, as Gadget and AREPO do, and false if they're stored
+	// as peculiar velocities, as SWIFT does.
+	RootAVelocities bool
+}
+
+var defaultGadgetHDF5Context = GadgetHDF5Context{
+	MassUnit: 1e10,
+	RootAVelocities: true,
+}
+
+// gadgetHDF5Groups are the groups which are searched for header attributes,
+// in order.
+var gadgetHDF5Groups = []string{ "/Header", "/Cosmology", "/Parameters" }
+
+// GadgetHDF5 returns a snapshot for the Gadget-4, SWIFT, or AREPO HDF5 files
+// in a given directory. Particles of all types are read together, with the
+// same type ordering as Gadget-2 files, unless a single species is selected.
+// Additional information may be optionally offered in the form of a
+// GadgetHDF5Context instance.
+func GadgetHDF5(
+	dir string, context ...GadgetHDF5Context,
+) (Snapshot, error) {
+	snap := &gadgetHDF5Snapshot{ }
+	var err error
+
+	snap.context = defaultGadgetHDF5Context
+	if len(context) > 0 { snap.context = context[0] }
+
+	snap.filenames, err = getFilenames(dir)
+	if err != nil { return nil, err }
+	if len(snap.filenames) == 0 {
+		return nil, fmt.Errorf("No files in directory %s", dir)
+	}
+
+	gh, err := snap.readHeader(0)
+	if err != nil { return nil, err }
+
+	total := gadget2TotalParticles(gh, binary.LittleEndian)
+	nTotal, nTypes := int64(0), 0
+	for typ := range total {
+		nTotal += total[typ]
+		if total[typ] > 0 { nTypes++ }
+	}
+
+	snap.hd = *gh.convertWithTotal(nTotal)
+	snap.hd.NPart = total
+
+	for typ := range total {
+		if total[typ] > 0 && nTypes == 1 && gh.Mass[typ] > 0 {
+			snap.uniform = true
+			snap.hd.UniformMp = gh.Mass[typ] * snap.context.MassUnit
+		}
+	}
+
+	return snap, nil
+}
+
+// readHeader converts the header attributes of file idx into a Gadget-2
+// header.
+func (snap *gadgetHDF5Snapshot) readHeader(idx int) (*lGadget2Header, error) {
+	file, err := hdf5.Open(snap.filenames[idx])
+	if err != nil { return nil, err }
+	defer file.Close()
+
+	attrs := map[string]*hdf5.Attribute{ }
+	for i := len(gadgetHDF5Groups) - 1; i >= 0; i-- {
+		if !file.Has(gadgetHDF5Groups[i]) { continue }
+		groupAttrs, err := file.Attributes(gadgetHDF5Groups[i])
+		if err != nil { return nil, err }
+		for name, attr := range groupAttrs { attrs[name] = attr }
+	}
+
+	gh := &lGadget2Header{ }
+	f := &gadgetHDF5Fields{ attrs: attrs, fname: snap.filenames[idx] }
+
+	npart := f.ints("NumPart_ThisFile")
+	nTotal := f.ints("NumPart_Total")
+	nTotalHigh := f.ints("NumPart_Total_HighWord")
+	mass := f.floats("MassTable")
+	for typ := 0; typ < Gadget2Types; typ++ {
+		if typ < len(npart) { gh.NPart[typ] = uint32(npart[typ]) }
+		if typ < len(mass) { gh.Mass[typ] = mass[typ] }
+
+		if typ < len(nTotal) {
+			// Gadget-4 stores 64-bit totals and no high words.
+			n := uint64(nTotal[typ])
+			if typ < len(nTotalHigh) { n += uint64(nTotalHigh[typ]) << 32 }
+			gh.NPartTotal[typ] = uint32(n)
+			binary.LittleEndian.PutUint32(
+				gh.Padding[4*typ: 4*typ + 4], uint32(n >> 32),
+			)
+		}
+	}
+
+	gh.Time = f.float("Time", "Scale-factor")
+	gh.Redshift = f.float("Redshift")
+	gh.BoxSize = f.float("BoxSize")
+	gh.Omega0 = f.float("Omega0", "Omega_m")
+	gh.OmegaLambda = f.float("OmegaLambda", "Omega_lambda")
+	gh.HubbleParam = f.float("HubbleParam", "h")
+	if nFiles := f.ints("NumFilesPerSnapshot"); len(nFiles) > 0 {
+		gh.NumFiles = int32(nFiles[0])
+	}
+
+	if f.err != nil { return nil, f.err }
+
+	return gh, nil
+}
+
+// gadgetHDF5Fields looks up header fields which may be stored under several
+// different names. The first error encountered is stored in err.
+type gadgetHDF5Fields struct {
+	attrs map[string]*hdf5.Attribute
+	fname string
+	err error
+}
+
+// float returns the first element of the first attribute in names which
+// exists. If none exist, err is set.
+func (f *gadgetHDF5Fields) float(names ...string) float64 {
+	for _, name := range names {
+		attr, ok := f.attrs[name]
+		if !ok { continue }
+
+		x, err := attr.Float64s()
+		if err == nil && len(x) == 0 {
+			err = fmt.Errorf("The attribute %s in %s is empty.", name, f.fname)
+		}
+		if err != nil {
+			if f.err == nil { f.err = err }
+			return 0
+		}
+		return x[0]
+	}
+
+	if f.err == nil {
+		f.err = fmt.Errorf("The file %s does not have a %s attribute.",
+			f.fname, names[0])
+	}
+	return 0
+}
+
+// floats returns the attribute name as a float array or nil if it doesn't
+// exist.
+func (f *gadgetHDF5Fields) floats(name string) []float64 {
+	attr, ok := f.attrs[name]
+	if !ok { return nil }
+
+	x, err := attr.Float64s()
+	if err != nil && f.err == nil { f.err = err }
+	return x
+}
+
+// ints returns the attribute name as an integer array or nil if it doesn't
+// exist.
+func (f *gadgetHDF5Fields) ints(name string) []int64 {
+	attr, ok := f.attrs[name]
+	if !ok { return nil }
+
+	x, err := attr.Int64s()
+	if err != nil && f.err == nil { f.err = err }
+	return x
+}
+
+func (snap *gadgetHDF5Snapshot) Files() int {
+	return len(snap.filenames)
+}
+
+func (snap *gadgetHDF5Snapshot) Header() *Header {
+	return &snap.hd
+}
+
+// RawHeader returns the header of file idx converted to the Gadget-2 format.
+func (snap *gadgetHDF5Snapshot) RawHeader(idx int) []byte {
+	gh, err := snap.readHeader(idx)
+	if err != nil { panic(err.Error()) }
+
+	buf := &bytes.Buffer{ }
+	err = binary.Write(buf, binary.LittleEndian, gh)
+	if err != nil { panic(err.Error()) }
+
+	return buf.Bytes()
+}
+
+func (snap *gadgetHDF5Snapshot) UpdateHeader(hd *Header) {
+	snap.hd = *hd
+}
+
+// UniformMass returns true if the snapshot only contains a single particle
+// type and that type's mass is stored in the header's mass table.
+func (snap *gadgetHDF5Snapshot) UniformMass() bool {
+	return snap.uniform
+}
+
+// speciesCount returns the number of particles of the given species in a
+// file. A negative species selects every particle.
+func speciesCount(gh *lGadget2Header, species int) int {
+	if species >= 0 { return int(gh.NPart[species]) }
+
+	n := 0
+	for typ := range gh.NPart { n += int(gh.NPart[typ]) }
+	return n
+}
+
+// readField reads the dataset with the given name from each particle type in
+// file idx which matches species and passes it to the callback along with the
+// type and the index of its first particle. A negative species selects every
+// type.
+func (snap *gadgetHDF5Snapshot) readField(
+	idx int, name string, gh *lGadget2Header, species int,
+	callback func(ds *hdf5.Dataset, typ, start int) error,
+) error {
+	file, err := hdf5.Open(snap.filenames[idx])
+	if err != nil { return err }
+	defer file.Close()
+
+	start := 0
+	for typ := 0; typ < Gadget2Types; typ++ {
+		n := int(gh.NPart[typ])
+		if n == 0 || (species >= 0 && typ != species) { continue }
+
+		var ds *hdf5.Dataset
+		path := fmt.Sprintf("/PartType%d/%s", typ, name)
+		if file.Has(path) {
+			ds, err = file.Dataset(path)
+			if err != nil { return err }
+
+			if ds.Len() != n && ds.Len() != 3*n {
+				return fmt.Errorf("%s in %s has %d elements, but there are " +
+					"%d particles.", path, snap.filenames[idx], ds.Len(), n)
+			}
+		}
+
+		err = callback(ds, typ, start)
+		if err != nil { return err }
+		start += n
+	}
+
+	return nil
+}
+
+// readVectors reads the vector field name of a species from file idx into
+// buf.
+func (snap *gadgetHDF5Snapshot) readVectors(
+	idx int, name string, species int, buf [][3]float32,
+) ([][3]float32, *lGadget2Header, error) {
+	if err := checkSpecies(species); err != nil { return nil, nil, err }
+	gh, err := snap.readHeader(idx)
+	if err != nil { return nil, nil, err }
+
+	buf = expandVectors(buf[:0], speciesCount(gh, species))
+
+	err = snap.readField(idx, name, gh, species,
+		func(ds *hdf5.Dataset, typ, start int) error {
+			if ds == nil {
+				return fmt.Errorf("The file %s does not contain " +
+					"PartType%d/%s.", snap.filenames[idx], typ, name)
+			}
+
+			x, err := ds.ReadFloat32s()
+			if err != nil { return err }
+			for i := 0; i < len(x) / 3; i++ {
+				buf[start + i] = [3]float32{ x[3*i], x[3*i+1], x[3*i+2] }
+			}
+			return nil
+		})
+
+	return buf, gh, err
+}
+
+func (snap *gadgetHDF5Snapshot) ReadX(idx int) ([][3]float32, error) {
+	return snap.ReadXSpecies(idx, -1)
+}
+
+func (snap *gadgetHDF5Snapshot) ReadV(idx int) ([][3]float32, error) {
+	return snap.ReadVSpecies(idx, -1)
+}
+
+func (snap *gadgetHDF5Snapshot) ReadID(idx int) ([]int64, error) {
+	return snap.ReadIDSpecies(idx, -1)
+}
+
+func (snap *gadgetHDF5Snapshot) ReadMp(idx int) ([]float32, error) {
+	return snap.ReadMpSpecies(idx, -1)
+}
+
+func (snap *gadgetHDF5Snapshot) ReadXSpecies(
+	idx, species int,
+) ([][3]float32, error) {
+	var gh *lGadget2Header
+	var err error
+	snap.xBuf, gh, err = snap.readVectors(
+		idx, "Coordinates", species, snap.xBuf,
+	)
+	if err != nil { return nil, err }
+
+	L := float32(gh.BoxSize)
+	for i := range snap.xBuf {
+		for j := 0; j < 3; j++ {
+			x := snap.xBuf[i][j]
+
+			if x < 0 {
+				x += L
+			} else if x >= L {
+				x -= L
+			}
+
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
+				x < 0 || x >= L {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.filenames[idx],
+				)
+			}
+
+			snap.xBuf[i][j] = x
+		}
+	}
+
+	return snap.xBuf, nil
+}
+
+func (snap *gadgetHDF5Snapshot) ReadVSpecies(
+	idx, species int,
+) ([][3]float32, error) {
+	var gh *lGadget2Header
+	var err error
+	snap.vBuf, gh, err = snap.readVectors(
+		idx, "Velocities", species, snap.vBuf,
+	)
+	if err != nil { return nil, err }
+
+	rootA := float32(1)
+	if snap.context.RootAVelocities {
+		rootA = float32(math.Sqrt(float64(gh.Time)))
+	}
+
+	for i := range snap.vBuf {
+		for j := 0; j < 3; j++ {
+			v := snap.vBuf[i][j] * rootA
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.filenames[idx],
+				)
+			}
+			snap.vBuf[i][j] = v
+		}
+	}
+
+	return snap.vBuf, nil
+}
+
+func (snap *gadgetHDF5Snapshot) ReadIDSpecies(
+	idx, species int,
+) ([]int64, error) {
+	if err := checkSpecies(species); err != nil { return nil, err }
+	gh, err := snap.readHeader(idx)
+	if err != nil { return nil, err }
+
+	snap.idBuf = expandInts(snap.idBuf[:0], speciesCount(gh, species))
+
+	err = snap.readField(idx, "ParticleIDs", gh, species,
+		func(ds *hdf5.Dataset, typ, start int) error {
+			if ds == nil {
+				return fmt.Errorf("The file %s does not contain " +
+					"PartType%d/ParticleIDs.", snap.filenames[idx], typ)
+			}
+
+			id, err := ds.ReadInt64s()
+			if err != nil { return err }
+			copy(snap.idBuf[start:], id)
+			return nil
+		})
+	if err != nil { return nil, err }
+
+	return snap.idBuf, nil
+}
+
+func (snap *gadgetHDF5Snapshot) ReadMpSpecies(
+	idx, species int,
+) ([]float32, error) {
+	if err := checkSpecies(species); err != nil { return nil, err }
+	gh, err := snap.readHeader(idx)
+	if err != nil { return nil, err }
+
+	snap.mpBuf = expandScalars(snap.mpBuf[:0], speciesCount(gh, species))
+	mu := float32(snap.context.MassUnit)
+
+	err = snap.readField(idx, "Masses", gh, species,
+		func(ds *hdf5.Dataset, typ, start int) error {
+			buf := snap.mpBuf[start: start + int(gh.NPart[typ])]
+
+			if gh.Mass[typ] > 0 {
+				for i := range buf { buf[i] = float32(gh.Mass[typ]) * mu }
+				return nil
+			} else if ds == nil {
+				return fmt.Errorf("The file %s has no mass for PartType%d " +
+					"in MassTable and does not contain PartType%d/Masses.",
+					snap.filenames[idx], typ, typ)
+			}
+
+			mp, err := ds.ReadFloat32s()
+			if err != nil { return err }
+			for i := range buf { buf[i] = mp[i] * mu }
+			return nil
+		})
+	if err != nil { return nil, err }
+
+	return snap.mpBuf, nil
+}
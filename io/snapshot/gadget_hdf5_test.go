@@ -0,0 +1,78 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path"
+	"testing"
+)
+
+func TestGadgetHDF5(t *testing.T) {
+	snap, err := GadgetHDF5("test_files/gadget_hdf5")
+	if err != nil { t.Fatalf("GadgetHDF5 returned error: %s", err.Error()) }
+
+	hd := snap.Header()
+	if hd.NTotal != 5 || hd.L != 10 || hd.Scale != 0.25 || hd.Z != 3 ||
+		hd.OmegaM != 0.3 || hd.OmegaL != 0.7 || hd.H100 != 0.7 {
+		t.Errorf("Header = %v", hd)
+	}
+	if !snap.UniformMass() || hd.UniformMp != 2e10 {
+		t.Errorf("UniformMass() = %v, UniformMp = %g",
+			snap.UniformMass(), hd.UniformMp)
+	}
+
+	x, err := snap.ReadX(0)
+	if err != nil { t.Fatal(err.Error()) }
+	v, err := snap.ReadV(0)
+	if err != nil { t.Fatal(err.Error()) }
+	id, err := snap.ReadID(0)
+	if err != nil { t.Fatal(err.Error()) }
+	mp, err := snap.ReadMp(0)
+	if err != nil { t.Fatal(err.Error()) }
+
+	if len(x) != 5 || len(v) != 5 || len(id) != 5 || len(mp) != 5 {
+		t.Fatalf("len(x) = %d, len(v) = %d, len(id) = %d, len(mp) = %d",
+			len(x), len(v), len(id), len(mp))
+	}
+
+	for i := 0; i < 5; i++ {
+		fi := float32(i)
+		if !vecEq(x[i], [3]float32{ fi, fi + 0.5, 1 }, 1e-6) {
+			t.Errorf("x[%d] = %g", i, x[i])
+		}
+		// Velocities are multiplied by sqrt(a) = 0.5.
+		if !vecEq(v[i], [3]float32{ fi, -fi / 2, 1.5 }, 1e-6) {
+			t.Errorf("v[%d] = %g", i, v[i])
+		}
+		if id[i] != int64(i + 1) {
+			t.Errorf("id[%d] = %d", i, id[i])
+		}
+		if mp[i] != 2e10 {
+			t.Errorf("mp[%d] = %g", i, mp[i])
+		}
+	}
+}
+
+func TestGadgetHDF5MissingMasses(t *testing.T) {
+	data, err := ioutil.ReadFile("test_files/gadget_hdf5/snap.0.hdf5")
+	if err != nil { t.Fatal(err.Error()) }
+
+	// Zero MassTable[1]. The file doesn't have a Masses dataset.
+	target := make([]byte, 48)
+	binary.LittleEndian.PutUint64(target[8:], math.Float64bits(2))
+	i := bytes.Index(data, target)
+	if i == -1 { t.Fatal("Couldn't find MassTable in the test file.") }
+	binary.LittleEndian.PutUint64(data[i + 8:], 0)
+
+	dir := t.TempDir()
+	err = ioutil.WriteFile(path.Join(dir, "snap.0.hdf5"), data, 0644)
+	if err != nil { t.Fatal(err.Error()) }
+
+	snap, err := GadgetHDF5(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, err = snap.ReadMp(0); err == nil {
+		t.Errorf("Expected an error for a species without masses.")
+	}
+}
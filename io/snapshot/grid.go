@@ -121,19 +121,44 @@ func NewVectorGrid(cells, nSideTot int) *VectorGrid {
 	return vg
 }
 
-// XGrid creates a VectorGrid of the position vectors in a snapshot.
-func XGrid(snap Snapshot, cells int) (*VectorGrid, error) {
+// checkFullGrid returns an error if the particles in a snapshot don't fill
+// its Lagrangian grid, e.g. if it only contains a subsample of particles.
+func checkFullGrid(hd *Header) error {
+	if hd.NTotal != hd.NSide*hd.NSide*hd.NSide {
+		return fmt.Errorf("The snapshot has %d particles, which don't fill " +
+			"a Lagrangian grid with NSide = %d.", hd.NTotal, hd.NSide)
+	}
+	return nil
+}
+
+// gridSpecies returns the species and number of particles on one side of the
+// Lagrangian grid used by XGrid and VGrid.
+func gridSpecies(hd *Header, species []int) (int, int64, error) {
+	if len(species) == 0 || species[0] < 0 {
+		if err := checkFullGrid(hd); err != nil { return 0, 0, err }
+		return -1, hd.NSide, nil
+	}
+
+	if err := checkSpecies(species[0]); err != nil { return 0, 0, err }
+	return species[0], intCubeRoot(hd.NPart[species[0]]), nil
+}
+
+// XGrid creates a VectorGrid of the position vectors in a snapshot. If a
+// species is given, only particles of that species are used.
+func XGrid(snap Snapshot, cells int, species ...int) (*VectorGrid, error) {
 	hd := snap.Header()
 	files := snap.Files()
 
-	grid := NewVectorGrid(cells, int(hd.NSide))
+	s, nSide, err := gridSpecies(hd, species)
+	if err != nil { return nil, err }
+	grid := NewVectorGrid(cells, int(nSide))
 
 	for i := 0; i < files; i++ {
 		runtime.GC()
 
-		x, err := snap.ReadX(i)
+		x, err := snap.ReadXSpecies(i, s)
 		if err != nil { return nil, err }
-		id, err := snap.ReadID(i)
+		id, err := snap.ReadIDSpecies(i, s)
 		if err != nil { return nil, err }
 
 		for j := range x { grid.Insert(id[j] - 1, x[j]) }
@@ -142,19 +167,22 @@ func XGrid(snap Snapshot, cells int) (*VectorGrid, error) {
 	return grid, nil
 }
 
-// VGrid creates a VectorGrid of the velocity vectors in a snapshot.
-func VGrid(snap Snapshot, cells int) (*VectorGrid, error) {
+// VGrid creates a VectorGrid of the velocity vectors in a snapshot. If a
+// species is given, only particles of that species are used.
+func VGrid(snap Snapshot, cells int, species ...int) (*VectorGrid, error) {
 	hd := snap.Header()
 	files := snap.Files()
 
-	grid := NewVectorGrid(cells, int(hd.NSide))
+	s, nSide, err := gridSpecies(hd, species)
+	if err != nil { return nil, err }
+	grid := NewVectorGrid(cells, int(nSide))
 
 	for i := 0; i < files; i++ {
 		runtime.GC()
 
-		v, err := snap.ReadV(i)
+		v, err := snap.ReadVSpecies(i, s)
 		if err != nil { return nil, err }
-		id, err := snap.ReadID(i)
+		id, err := snap.ReadIDSpecies(i, s)
 		if err != nil { return nil, err }
 		for j := range v { grid.Insert(id[j] - 1, v[j]) }
 	}
@@ -162,6 +190,32 @@ func VGrid(snap Snapshot, cells int) (*VectorGrid, error) {
 	return grid, nil
 }
 
+// MpGrid creates a VectorGrid of the particle masses in a snapshot. Each mass
+// is stored in every component of its vector. If a species is given, only
+// particles of that species are used.
+func MpGrid(snap Snapshot, cells int, species ...int) (*VectorGrid, error) {
+	hd := snap.Header()
+	files := snap.Files()
+
+	s, nSide, err := gridSpecies(hd, species)
+	if err != nil { return nil, err }
+	grid := NewVectorGrid(cells, int(nSide))
+
+	for i := 0; i < files; i++ {
+		runtime.GC()
+
+		mp, err := snap.ReadMpSpecies(i, s)
+		if err != nil { return nil, err }
+		id, err := snap.ReadIDSpecies(i, s)
+		if err != nil { return nil, err }
+		for j := range mp {
+			grid.Insert(id[j] - 1, [3]float32{ mp[j], mp[j], mp[j] })
+		}
+	}
+
+	return grid, nil
+}
+
 // Insert inserts a vector into a VectorGrid.
 func (vg *VectorGrid) Insert(id int64, v [3]float32) {
 	c, i := vg.Index(id)
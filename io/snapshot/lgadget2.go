@@ -22,11 +22,19 @@ type lGadget2Snapshot struct {
 	xBuf, vBuf [][3]float32
 	mpBuf []float32
 	idBuf []int64	
+
+	maps [][]byte
 }
 
 type LGadget2Context struct {
 	NPartNum int
 	Order binary.ByteOrder
+	// Mmap makes reads go through memory-mapped files. When Order is the
+	// system's byte order, ReadX returns slices which point directly into
+	// the mapped file instead of copies. Otherwise the normal copying reads
+	// are used. The returned Snapshot also implements io.Closer, and Close
+	// must be called to unmap the files.
+	Mmap bool
 }
 
 var defaultLGadget2Context = LGadget2Context{
@@ -83,11 +91,18 @@ func readLGadget2Header(
 	defer f.Close()
 
 	_ = readInt32(f, order)
-	err = binary.Read(f, binary.LittleEndian, out)
+	err = binary.Read(f, order, out)
 	return out, err
 }
 
 func (gh *lGadget2Header) convert(nPartNum int) *Header {
+	return gh.convertWithTotal(lgadgetParticleNum(gh.NPartTotal, gh, nPartNum))
+}
+
+// convertWithTotal converts a Gadget header into a Header which has nTotal
+// particles. This lets readers which count particles differently share the
+// rest of the conversion.
+func (gh *lGadget2Header) convertWithTotal(nTotal int64) *Header {
 	// Assumes the catalog has already been checked for corruption.
 	
 	hd := &Header{ }
@@ -99,8 +114,9 @@ func (gh *lGadget2Header) convert(nPartNum int) *Header {
 	hd.OmegaL = gh.OmegaLambda
 	hd.H100 = gh.HubbleParam
 
-	hd.NTotal = lgadgetParticleNum(gh.NPartTotal, gh, nPartNum)
+	hd.NTotal = nTotal
 	hd.NSide = intCubeRoot(hd.NTotal)
+	hd.NPart[DarkMatter] = nTotal
 
 	hd.calcUniformMass()
 
@@ -178,7 +194,56 @@ func (snap *lGadget2Snapshot) UpdateHeader(hd *Header) {
 	snap.hd = *hd
 }
 
+// RewriteHeader writes hd to the header of every file and updates the
+// snapshot's header. Memory-mapped snapshots should be reopened afterwards.
+func (snap *lGadget2Snapshot) RewriteHeader(hd *Header) error {
+	if hd.NTotal != snap.hd.NTotal {
+		return fmt.Errorf("NTotal can't be changed from %d to %d.",
+			snap.hd.NTotal, hd.NTotal)
+	}
+
+	order := snap.context.Order
+	for _, fname := range snap.filenames {
+		gh, err := readLGadget2Header(fname, order)
+		if err != nil { return err }
+
+		gh.Time, gh.Redshift = hd.Scale, hd.Z
+		gh.BoxSize, gh.HubbleParam = hd.L, hd.H100
+		gh.Omega0, gh.OmegaLambda = hd.OmegaM, hd.OmegaL
+		gh.Mass[1] = hd.UniformMp / 1e10
+
+		f, err := os.OpenFile(fname, os.O_WRONLY, 0644)
+		if err != nil { return err }
+		if err = writeRecordAt(f, 0, order, gh); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil { return err }
+	}
+
+	snap.hd = *hd
+	return nil
+}
+
+// Provenance returns the provenance metadata stored after the particle blocks
+// of the first file, or nil if there isn't any.
+func (snap *lGadget2Snapshot) Provenance() (*Provenance, error) {
+	fname, order := snap.filenames[0], snap.context.Order
+	gh, err := readLGadget2Header(fname, order)
+	if err != nil { return nil, err }
+	count := lgadgetParticleNum(gh.NPart, gh, snap.context.NPartNum)
+	return readProvenanceRecord(fname, lGadget2DataBytes(count), order)
+}
+
+// lGadget2DataBytes returns the size of the header, position, velocity, and
+// ID blocks of a file with count particles.
+func lGadget2DataBytes(count int64) int64 {
+	return lGadget2HeaderBytes + 2*(12*count + 8) + 8*count + 8
+}
+
 func (snap *lGadget2Snapshot) ReadX(idx int) ([][3]float32, error) {
+	if snap.useMmap() { return snap.mmapReadX(idx) }
+
 	f, err := os.Open(snap.filenames[idx])
 	if err != nil { return nil, err }
 	defer f.Close()
@@ -214,7 +279,7 @@ func (snap *lGadget2Snapshot) ReadX(idx int) ([][3]float32, error) {
 			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
 				x < 0 || x >= L {
 				return nil, fmt.Errorf(
-					"Corruption detected in the file %s.", snap.filenames[i],
+					"Corruption detected in the file %s.", snap.filenames[idx],
 				)
 			}
 
@@ -227,7 +292,45 @@ func (snap *lGadget2Snapshot) ReadX(idx int) ([][3]float32, error) {
 
 func (snap *lGadget2Snapshot) UniformMass() bool { return true }
 
+// verifyRecords checks the Fortran record markers of file idx and the sizes
+// of its particle blocks.
+func (snap *lGadget2Snapshot) verifyRecords(idx int) error {
+	fname := snap.filenames[idx]
+	f, err := os.Open(fname)
+	if err != nil { return err }
+	defer f.Close()
+
+	order := snap.context.Order
+	records, err := readFortranRecords(f, fname, order)
+	if err != nil { return err }
+	if len(records) < 4 {
+		return fmt.Errorf("The file %s has %d Fortran records, but needs " +
+			"at least 4.", fname, len(records))
+	}
+
+	gh := &lGadget2Header{ }
+	_, err = f.Seek(records[0].offset, 0)
+	if err != nil { return err }
+	err = binary.Read(f, order, gh)
+	if err != nil { return err }
+	count := lgadgetParticleNum(gh.NPart, gh, snap.context.NPartNum)
+
+	sizes := []int64{ lGadget2HeaderBytes - 8, 12*count, 12*count, 8*count }
+	names := []string{ "Header", "X", "V", "ID" }
+	for i := range sizes {
+		if records[i].size != sizes[i] {
+			return fmt.Errorf("%s block in the file %s has size %d, but " +
+				"should have size %d.", names[i], fname, records[i].size,
+				sizes[i])
+		}
+	}
+
+	return nil
+}
+
 func (snap *lGadget2Snapshot) ReadV(idx int) ([][3]float32, error) {
+	if snap.useMmap() { return snap.mmapReadV(idx) }
+
 	f, err := os.Open(snap.filenames[idx])
 	if err != nil { return nil, err }
 	defer f.Close()
@@ -260,7 +363,7 @@ func (snap *lGadget2Snapshot) ReadV(idx int) ([][3]float32, error) {
 			v := snap.vBuf[i][j] * rootA
 			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
 				return nil, fmt.Errorf(
-					"Corruption detected in the file %s.", snap.filenames[i],
+					"Corruption detected in the file %s.", snap.filenames[idx],
 				)
 			}
 			snap.vBuf[i][j] = v
@@ -271,6 +374,8 @@ func (snap *lGadget2Snapshot) ReadV(idx int) ([][3]float32, error) {
 }
 
 func (snap *lGadget2Snapshot) ReadID(idx int) ([]int64, error) {
+	if snap.useMmap() { return snap.mmapReadID(idx) }
+
 	f, err := os.Open(snap.filenames[idx])
 	if err != nil { return nil, err }
 	defer f.Close()
@@ -321,6 +426,302 @@ func (snap *lGadget2Snapshot) ReadMp(idx int) ([]float32, error) {
 	return snap.mpBuf, nil
 }
 
+// useMmap returns true if reads should go through memory-mapped files. Files
+// which need to be byte-swapped use the normal reads, since they would need
+// to be copied anyway.
+func (snap *lGadget2Snapshot) useMmap() bool {
+	return snap.context.Mmap && IsSysOrder(snap.context.Order)
+}
+
+// mmapBlock maps file idx into memory if it hasn't been already and returns
+// the data of its block-th particle block (0 for positions, 1 for velocities,
+// and 2 for IDs) along with the file's header and number of particles.
+func (snap *lGadget2Snapshot) mmapBlock(
+	idx, block int, elemSize int64,
+) ([]byte, *lGadget2Header, int, error) {
+	if snap.maps == nil { snap.maps = make([][]byte, len(snap.filenames)) }
+	if snap.maps[idx] == nil {
+		data, err := mmapFile(snap.filenames[idx])
+		if err != nil { return nil, nil, 0, err }
+		snap.maps[idx] = data
+	}
+	data := snap.maps[idx]
+
+	if int64(len(data)) < lGadget2HeaderBytes {
+		return nil, nil, 0, fmt.Errorf("Corruption detected in the file %s.",
+			snap.filenames[idx])
+	}
+
+	gh := &lGadget2Header{ }
+	err := binary.Read(bytes.NewReader(data[4:]), snap.context.Order, gh)
+	if err != nil { return nil, nil, 0, err }
+	count := lgadgetParticleNum(gh.NPart, gh, snap.context.NPartNum)
+
+	start := lGadget2HeaderBytes + int64(block)*(12*count + 8) + 4
+	end := start + elemSize*count
+	if end + 4 > int64(len(data)) ||
+		int64(int32(snap.context.Order.Uint32(data[start-4:]))) !=
+		elemSize*count {
+		return nil, nil, 0, fmt.Errorf("Corruption detected in the file %s.",
+			snap.filenames[idx])
+	}
+
+	return data[start: end], gh, int(count), nil
+}
+
+func (snap *lGadget2Snapshot) mmapReadX(idx int) ([][3]float32, error) {
+	data, gh, count, err := snap.mmapBlock(idx, 0, 12)
+	if err != nil { return nil, err }
+	x := bytesAsVectors(data, count)
+
+	// The mapping is private, so wrapping positions into the box doesn't
+	// change the file. Only pages which are written to get copied.
+	L := float32(gh.BoxSize)
+	for i := range x {
+		for j := 0; j < 3; j++ {
+			xj := x[i][j]
+			if xj < 0 {
+				x[i][j] = xj + L
+			} else if xj >= L {
+				x[i][j] = xj - L
+			}
+
+			xj = x[i][j]
+			if math.IsNaN(float64(xj)) || math.IsInf(float64(xj), 0) ||
+				xj < 0 || xj >= L {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.filenames[idx],
+				)
+			}
+		}
+	}
+
+	return x, nil
+}
+
+// mmapReadV copies velocities out of the mapped file, since they need to be
+// rescaled.
+func (snap *lGadget2Snapshot) mmapReadV(idx int) ([][3]float32, error) {
+	data, gh, count, err := snap.mmapBlock(idx, 1, 12)
+	if err != nil { return nil, err }
+	snap.vBuf = expandVectors(snap.vBuf[:0], count)
+	copy(snap.vBuf, bytesAsVectors(data, count))
+
+	rootA := float32(math.Sqrt(gh.Time))
+	for i := range snap.vBuf {
+		for j := 0; j < 3; j++ {
+			v := snap.vBuf[i][j] * rootA
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.filenames[idx],
+				)
+			}
+			snap.vBuf[i][j] = v
+		}
+	}
+
+	return snap.vBuf, nil
+}
+
+// mmapReadID copies IDs out of the mapped file. The ID block starts 4 bytes
+// past a multiple of 8, so the IDs can't be used in place.
+func (snap *lGadget2Snapshot) mmapReadID(idx int) ([]int64, error) {
+	data, _, count, err := snap.mmapBlock(idx, 2, 8)
+	if err != nil { return nil, err }
+	snap.idBuf = expandInts(snap.idBuf[:0], count)
+	for i := range snap.idBuf {
+		snap.idBuf[i] = int64(snap.context.Order.Uint64(data[8*i:]))
+	}
+	return snap.idBuf, nil
+}
+
+// Close unmaps any files which were mapped into memory. Slices returned by
+// earlier reads must not be used after Close is called.
+func (snap *lGadget2Snapshot) Close() error {
+	var err error
+	for i := range snap.maps {
+		if snap.maps[i] == nil { continue }
+		if e := munmapFile(snap.maps[i]); e != nil && err == nil { err = e }
+		snap.maps[i] = nil
+	}
+	return err
+}
+
+// openBlock opens file idx and seeks to the start of the data in its
+// block-th particle block (0 for positions, 1 for velocities, and 2 for IDs).
+// It returns the file along with its header and number of particles.
+func (snap *lGadget2Snapshot) openBlock(
+	idx, block int,
+) (*os.File, *lGadget2Header, int, error) {
+	f, err := os.Open(snap.filenames[idx])
+	if err != nil { return nil, nil, 0, err }
+
+	gh := &lGadget2Header{ }
+	order := snap.context.Order
+	_ = readInt32(f, order)
+	if err = binary.Read(f, order, gh); err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	count := lgadgetParticleNum(gh.NPart, gh, snap.context.NPartNum)
+
+	start := lGadget2HeaderBytes + int64(block)*(12*count + 8) + 4
+	if _, err = f.Seek(start, 0); err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+
+	return f, gh, int(count), nil
+}
+
+// lGadget2VectorChunks iterates over the positions or velocities in a
+// LGadget-2 file.
+type lGadget2VectorChunks struct {
+	f *os.File
+	fname string
+	order binary.ByteOrder
+	left, chunkSize int
+	buf [][3]float32
+
+	isX bool
+	L, rootA float32
+}
+
+func (snap *lGadget2Snapshot) ReadXChunks(
+	idx, chunkSize int,
+) (VectorChunks, error) {
+	f, gh, count, err := snap.openBlock(idx, 0)
+	if err != nil { return nil, err }
+	return &lGadget2VectorChunks{
+		f: f, fname: snap.filenames[idx], order: snap.context.Order,
+		left: count, chunkSize: chunkSize,
+		isX: true, L: float32(gh.BoxSize),
+	}, nil
+}
+
+func (snap *lGadget2Snapshot) ReadVChunks(
+	idx, chunkSize int,
+) (VectorChunks, error) {
+	f, gh, count, err := snap.openBlock(idx, 1)
+	if err != nil { return nil, err }
+	return &lGadget2VectorChunks{
+		f: f, fname: snap.filenames[idx], order: snap.context.Order,
+		left: count, chunkSize: chunkSize,
+		rootA: float32(math.Sqrt(gh.Time)),
+	}, nil
+}
+
+func (c *lGadget2VectorChunks) Next() ([][3]float32, error) {
+	if c.left == 0 {
+		c.Close()
+		return nil, io.EOF
+	}
+
+	n := chunkLen(c.left, c.chunkSize)
+	c.buf = expandVectors(c.buf[:0], n)
+	if err := readVecAsByte(c.f, c.order, c.buf); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.left -= n
+
+	for i := range c.buf {
+		for j := 0; j < 3; j++ {
+			x := c.buf[i][j]
+			if c.isX {
+				if x < 0 {
+					x += c.L
+				} else if x >= c.L {
+					x -= c.L
+				}
+			} else {
+				x *= c.rootA
+			}
+
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
+				(c.isX && (x < 0 || x >= c.L)) {
+				c.Close()
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", c.fname,
+				)
+			}
+
+			c.buf[i][j] = x
+		}
+	}
+
+	return c.buf, nil
+}
+
+func (c *lGadget2VectorChunks) Close() error {
+	if c.f == nil { return nil }
+	err := c.f.Close()
+	c.f, c.left = nil, 0
+	return err
+}
+
+// lGadget2IDChunks iterates over the IDs in a LGadget-2 file.
+type lGadget2IDChunks struct {
+	f *os.File
+	order binary.ByteOrder
+	left, chunkSize int
+	buf []int64
+}
+
+func (snap *lGadget2Snapshot) ReadIDChunks(
+	idx, chunkSize int,
+) (IntChunks, error) {
+	f, _, count, err := snap.openBlock(idx, 2)
+	if err != nil { return nil, err }
+	return &lGadget2IDChunks{
+		f: f, order: snap.context.Order, left: count, chunkSize: chunkSize,
+	}, nil
+}
+
+func (c *lGadget2IDChunks) Next() ([]int64, error) {
+	if c.left == 0 {
+		c.Close()
+		return nil, io.EOF
+	}
+
+	n := chunkLen(c.left, c.chunkSize)
+	c.buf = expandInts(c.buf[:0], n)
+	if err := readInt64AsByte(c.f, c.order, c.buf); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.left -= n
+
+	return c.buf, nil
+}
+
+func (c *lGadget2IDChunks) Close() error {
+	if c.f == nil { return nil }
+	err := c.f.Close()
+	c.f, c.left = nil, 0
+	return err
+}
+
+func (snap *lGadget2Snapshot) ReadXSpecies(
+	i, species int,
+) ([][3]float32, error) {
+	return readXDarkMatter(snap, i, species)
+}
+
+func (snap *lGadget2Snapshot) ReadVSpecies(
+	i, species int,
+) ([][3]float32, error) {
+	return readVDarkMatter(snap, i, species)
+}
+
+func (snap *lGadget2Snapshot) ReadIDSpecies(i, species int) ([]int64, error) {
+	return readIDDarkMatter(snap, i, species)
+}
+
+func (snap *lGadget2Snapshot) ReadMpSpecies(i, species int) ([]float32, error) {
+	return readMpDarkMatter(snap, i, species)
+}
+
 // gadgetHeader is the formatting for meta-information used by Gadget 2.
 type lGadget2Header struct {
 	NPart                                     [6]uint32
@@ -444,3 +845,188 @@ func WriteLGadget2(
 
 	return nil
 }
+
+// lGadget2HeaderBytes is the size of a LGadget-2 header block, including its
+// Fortran header and footer.
+const lGadget2HeaderBytes = int64(unsafe.Sizeof(lGadget2Header{})) + 8
+
+type lGadget2Writer struct {
+	dir, fnameFmt string
+	context LGadget2Context
+	files map[int]*lGadget2WriterFile
+}
+
+// lGadget2WriterFile is a file which has been started but not finished.
+type lGadget2WriterFile struct {
+	f *os.File
+	n int
+	blocks int
+	rootA, mp float32
+}
+
+// LGadget2Writer returns a Writer which writes LGadget-2 files to dir. File
+// names are generated by passing the file index to the format string
+// fnameFmt. All particles are written as halo particles and must have the
+// same mass. Additional information may be optionally offered in the form of
+// an LGadget2Context instance.
+func LGadget2Writer(
+	dir, fnameFmt string, context ...LGadget2Context,
+) Writer {
+	wr := &lGadget2Writer{
+		dir: dir, fnameFmt: fnameFmt,
+		context: defaultLGadget2Context,
+		files: map[int]*lGadget2WriterFile{ },
+	}
+	if len(context) > 0 { wr.context = context[0] }
+	return wr
+}
+
+// newLGadget2Header creates the header for a file with n particles out of a
+// snapshot described by hd.
+func newLGadget2Header(hd *Header, files, n, nPartNum int) *lGadget2Header {
+	gh := &lGadget2Header{
+		Time: hd.Scale, Redshift: hd.Z, NumFiles: int32(files),
+		BoxSize: hd.L, Omega0: hd.OmegaM, OmegaLambda: hd.OmegaL,
+		HubbleParam: hd.H100,
+	}
+	gh.Mass[1] = hd.UniformMp / 1e10
+
+	if nPartNum == 2 {
+		gh.NPart[0], gh.NPart[1] = uint32(int64(n) >> 32), uint32(n)
+		gh.NPartTotal[0] = uint32(hd.NTotal >> 32)
+		gh.NPartTotal[1] = uint32(hd.NTotal)
+	} else {
+		gh.NPart[0], gh.NPartTotal[0] = uint32(n), uint32(hd.NTotal)
+	}
+
+	return gh
+}
+
+// writeRecordAt writes data to f as a Fortran record starting at off.
+func writeRecordAt(
+	f *os.File, off int64, order binary.ByteOrder, data interface{},
+) error {
+	buf := &bytes.Buffer{ }
+	size := int32(binary.Size(data))
+	writeInt32(buf, order, size)
+	if err := binary.Write(buf, order, data); err != nil { return err }
+	writeInt32(buf, order, size)
+
+	_, err := f.WriteAt(buf.Bytes(), off)
+	return err
+}
+
+// writeProvenance stores p after the particle blocks of the first file.
+func (wr *lGadget2Writer) writeProvenance(p *Provenance) error {
+	fname := path.Join(wr.dir, fmt.Sprintf(wr.fnameFmt, 0))
+	gh, err := readLGadget2Header(fname, wr.context.Order)
+	if err != nil { return err }
+	count := lgadgetParticleNum(gh.NPart, gh, wr.context.NPartNum)
+	return writeProvenanceRecord(fname, lGadget2DataBytes(count),
+		wr.context.Order, p)
+}
+
+func (wr *lGadget2Writer) WriteHeader(
+	i, files, n int, hd *Header, rawHd []byte,
+) error {
+	f, err := os.Create(path.Join(wr.dir, fmt.Sprintf(wr.fnameFmt, i)))
+	if err != nil { return err }
+
+	gh := newLGadget2Header(hd, files, n, wr.context.NPartNum)
+	if err = writeRecordAt(f, 0, wr.context.Order, gh); err != nil {
+		f.Close()
+		return err
+	}
+
+	wr.files[i] = &lGadget2WriterFile{
+		f: f, n: n, rootA: float32(math.Sqrt(hd.Scale)),
+		mp: float32(hd.UniformMp),
+	}
+	return nil
+}
+
+// file returns the unfinished file i after checking that it has n particles.
+func (wr *lGadget2Writer) file(i, n int) (*lGadget2WriterFile, error) {
+	file, ok := wr.files[i]
+	if !ok {
+		return nil, fmt.Errorf("File %d was written to before its header " +
+			"was written.", i)
+	} else if file.n != n {
+		return nil, fmt.Errorf("File %d has %d particles, but a block with " +
+			"%d particles was written to it.", i, file.n, n)
+	}
+	return file, nil
+}
+
+// finishBlock closes file i once all of its blocks have been written.
+func (wr *lGadget2Writer) finishBlock(i int) error {
+	file := wr.files[i]
+	file.blocks++
+	if file.blocks < 4 { return nil }
+
+	delete(wr.files, i)
+	return file.f.Close()
+}
+
+func (wr *lGadget2Writer) WriteX(i int, x [][3]float32) error {
+	file, err := wr.file(i, len(x))
+	if err != nil { return err }
+
+	err = writeRecordAt(file.f, lGadget2HeaderBytes, wr.context.Order, x)
+	if err != nil { return err }
+	return wr.finishBlock(i)
+}
+
+func (wr *lGadget2Writer) WriteV(i int, v [][3]float32) error {
+	file, err := wr.file(i, len(v))
+	if err != nil { return err }
+
+	buf := make([][3]float32, len(v))
+	for j := range v {
+		for k := 0; k < 3; k++ { buf[j][k] = v[j][k] / file.rootA }
+	}
+
+	off := lGadget2HeaderBytes + int64(12*file.n + 8)
+	err = writeRecordAt(file.f, off, wr.context.Order, buf)
+	if err != nil { return err }
+	return wr.finishBlock(i)
+}
+
+func (wr *lGadget2Writer) WriteID(i int, id []int64) error {
+	file, err := wr.file(i, len(id))
+	if err != nil { return err }
+
+	off := lGadget2HeaderBytes + 2*int64(12*file.n + 8)
+	err = writeRecordAt(file.f, off, wr.context.Order, id)
+	if err != nil { return err }
+	return wr.finishBlock(i)
+}
+
+// WriteMp checks that every particle has the mass given by the header, since
+// LGadget-2 files can't store per-particle masses.
+func (wr *lGadget2Writer) WriteMp(i int, mp []float32) error {
+	file, err := wr.file(i, len(mp))
+	if err != nil { return err }
+
+	for j := range mp {
+		if math.Abs(float64(mp[j]/file.mp) - 1) > 1e-5 {
+			return fmt.Errorf("Particle %d of file %d has mass %g, but " +
+				"LGadget-2 files require all particles to have mass %g.",
+				j, i, mp[j], file.mp)
+		}
+	}
+
+	return wr.finishBlock(i)
+}
+
+// Close closes any files which haven't had all their blocks written and
+// returns an error if there were any.
+func (wr *lGadget2Writer) Close() error {
+	var err error
+	for i, file := range wr.files {
+		file.f.Close()
+		delete(wr.files, i)
+		err = fmt.Errorf("Not every block of file %d was written.", i)
+	}
+	return err
+}
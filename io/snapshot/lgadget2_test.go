@@ -1,7 +1,12 @@
 package snapshot
 
 import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
 	"testing"
+	"unsafe"
 )
 
 func newTestMockSnapshot() Snapshot {
@@ -88,6 +93,58 @@ func TestReadWriteLGadget2(t *testing.T) {
 	}
 }
 
+func TestLGadget2Mmap(t *testing.T) {
+	snap := newTestMockSnapshot()
+	id, _ := snap.ReadID(0)
+	x, _ := snap.ReadX(0)
+	v, _ := snap.ReadV(0)
+
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	for _, order := range orders {
+		dir, err := ioutil.TempDir(".", "test_lgadget2_mmap_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(dir)
+
+		ctx := LGadget2Context{ Order: order, NPartNum: 2, Mmap: true }
+		err = Convert(snap, LGadget2Writer(dir, "test.%03d", ctx))
+		if err != nil { t.Fatal(err.Error()) }
+
+		lsnap, err := LGadget2(dir, ctx)
+		if err != nil { t.Fatal(err.Error()) }
+
+		lx, err := lsnap.ReadX(0)
+		if err != nil { t.Fatal(err.Error()) }
+		lv, err := lsnap.ReadV(0)
+		if err != nil { t.Fatal(err.Error()) }
+		lid, err := lsnap.ReadID(0)
+		if err != nil { t.Fatal(err.Error()) }
+
+		if len(lx) != len(x) || len(lv) != len(v) || len(lid) != len(id) {
+			t.Fatalf("%v: read %d, %d, %d particles, not %d.", order,
+				len(lx), len(lv), len(lid), len(id))
+		}
+		for i := range x {
+			if !vecEq(lx[i], x[i], 1e-4) || !vecEq(lv[i], v[i], 1e-4) ||
+				lid[i] != id[i] {
+				t.Fatalf("%v: particle %d = (%g, %g, %d), not (%g, %g, %d).",
+					order, i, lx[i], lv[i], lid[i], x[i], v[i], id[i])
+			}
+		}
+
+		maps := lsnap.(*lGadget2Snapshot).maps
+		aliased := len(maps) > 0 && maps[0] != nil && unsafe.Pointer(&lx[0]) ==
+			unsafe.Pointer(&maps[0][lGadget2HeaderBytes + 4])
+		if aliased != IsSysOrder(order) {
+			t.Errorf("%v: positions aliased onto the file = %v.",
+				order, aliased)
+		}
+
+		if err := lsnap.(io.Closer).Close(); err != nil {
+			t.Errorf("%v: Close returned error: %s", order, err.Error())
+		}
+	}
+}
+
 func vecEq(x, y [3]float32, eps float32) bool {
 	return floatEq(x[0], y[0], eps) &&
 		floatEq(x[1], y[1], eps) &&
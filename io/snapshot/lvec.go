@@ -11,20 +11,93 @@ import (
 	"runtime"
 
 	"github.com/phil-mansfield/nbody-utils/container"
+	"github.com/phil-mansfield/nbody-utils/thread"
 
 	"unsafe"
 )
 
 const (
 	LVecMagicNumber = 0xbadf00d
-	LVecVersion = 1
+	LVecVersion = 2
 
 	lvecBoxMethod= iota
 
 	lvecX = iota
 	lvecV
+	lvecMp
+	lvecLogMp
 )
 
+// Dequantization modes. Each quantized value represents a range of values,
+// and the mode determines where in that range the value is placed when it's
+// read.
+const (
+	// LVecRandom places values randomly within their range using the global
+	// random number generator. Repeated reads give different results.
+	LVecRandom = iota
+	// LVecCellCenter places values at the center of their range.
+	LVecCellCenter
+	// LVecIDJitter places values at pseudo-random points within their range
+	// which only depend on the particle's ID. Repeated reads give the same
+	// results.
+	LVecIDJitter
+)
+
+// LVecContext contains optional parameters for ConvertToLVec, LVecWriter, and
+// LVec.
+type LVecContext struct {
+	// DMp is the accuracy that particle masses are stored to. If LogMp is
+	// set, it's in dex. Masses are only stored if they aren't uniform, and
+	// DMp only needs to be set if they're stored.
+	DMp float64
+	// LogMp stores the base-10 logarithm of particle masses instead of the
+	// masses themselves.
+	LogMp bool
+	// Dequantize is the dequantization mode used when reading files. It must
+	// be LVecRandom, LVecCellCenter, or LVecIDJitter. Writers record it in
+	// the files, and LVec uses the recorded mode if no context is given.
+	Dequantize int
+	// Compress delta-encodes the quantized data and compresses it with
+	// DEFLATE. This is slower but gives smaller files.
+	Compress bool
+	// Version is the version of the LVec format which is written. If zero,
+	// LVecVersion is used. Version 1 files don't have checksums and can't be
+	// compressed.
+	Version int
+
+	// Workers is the number of files which are quantized and written at the
+	// same time. If zero, files are written one at a time.
+	Workers int
+	// MemoryBudget is the approximate number of bytes that workers may use
+	// in addition to the memory needed to hold the snapshot. The number of
+	// workers is reduced to fit within it. If zero, it isn't limited.
+	MemoryBudget int64
+	// Resume skips files which already exist and pass validation, so that a
+	// conversion which was interrupted can be continued. If every file for
+	// a variable is valid, that variable's grid isn't built at all.
+	Resume bool
+
+	// OutOfCore converts the snapshot without holding its full grid in
+	// memory. Particles are first sorted into a spill file for each output
+	// file, and then each output file is written from its spill file.
+	// MemoryBudget also limits the size of the buffers used while sorting.
+	OutOfCore bool
+	// SpillDir is the directory that spill files are written to. They go
+	// in a temporary subdirectory which is removed when the conversion
+	// finishes. If empty, the output directory is used.
+	SpillDir string
+
+	// Provenance is stored in the snapshot written by ConvertToLVec if it's
+	// non-nil. The conversion parameters are added to it, and its time is
+	// set if it's zero.
+	Provenance *Provenance
+}
+
+var defaultLVecContext = LVecContext{
+	DMp: 1e-3,
+	LogMp: true,
+}
+
 type lvecHeader struct {
 	Magic   uint64 // Magic number confirming that this file is a .lvec file
 	Version uint64 // Version number of the code that generated this file.
@@ -58,43 +131,149 @@ type lvecHeader struct {
 	                  // block, respetively. This isn't neccessary, but it sure
 	                  // is convenient.
 
-	Hd Header // The header for the simulation.
+	Hd lvecSimHeader // The header for the simulation.
+}
+
+// dims returns the number of components stored for each particle in files
+// with this header.
+func (hd *lvecHeader) dims() uint64 {
+	if hd.VarType == lvecMp || hd.VarType == lvecLogMp { return 1 }
+	return 3
+}
+
+// lvecSimHeader is the layout of Header within LVec files. It's separate from
+// Header so that adding fields to Header doesn't change the file format.
+type lvecSimHeader struct {
+	Z, Scale float64
+	OmegaM, OmegaL, H100 float64
+	L, Epsilon float64
+	NSide, NTotal int64
+	UniformMp float64
+}
+
+// newLVecSimHeader converts a Header to its LVec layout.
+func newLVecSimHeader(hd *Header) lvecSimHeader {
+	return lvecSimHeader{
+		Z: hd.Z, Scale: hd.Scale,
+		OmegaM: hd.OmegaM, OmegaL: hd.OmegaL, H100: hd.H100,
+		L: hd.L, Epsilon: hd.Epsilon,
+		NSide: hd.NSide, NTotal: hd.NTotal,
+		UniformMp: hd.UniformMp,
+	}
+}
+
+// header converts an LVec header to a Header. LVec files only contain dark
+// matter.
+func (hd *lvecSimHeader) header() *Header {
+	out := &Header{
+		Z: hd.Z, Scale: hd.Scale,
+		OmegaM: hd.OmegaM, OmegaL: hd.OmegaL, H100: hd.H100,
+		L: hd.L, Epsilon: hd.Epsilon,
+		NSide: hd.NSide, NTotal: hd.NTotal,
+		UniformMp: hd.UniformMp,
+	}
+	out.NPart[DarkMatter] = hd.NTotal
+	return out
 }
 
 type lvecSnapshot struct {
 	hd lvecHeader
-	xNames, vNames []string
+	header Header
+	context LVecContext
+	xNames, vNames, mpNames []string
 
 	xBuf, vBuf [][3]float32
 	mpBuf []float32
 	idBuf []int64
 
 	quantBuf, subCellBuf []uint64
+	cellIDBuf []int64
+}
+
+// LagrangianBoxSnapshot is a Snapshot which can read the particles in a box
+// of Lagrangian indices without reading every file. The Snapshots returned by
+// LVec implement it.
+type LagrangianBoxSnapshot interface {
+	Snapshot
+
+	// ReadXBox returns the positions and IDs of every particle whose
+	// Lagrangian indices are within the box [lo, hi).
+	ReadXBox(lo, hi [3]int64) ([][3]float32, []int64, error)
+	// ReadVBox returns the velocities and IDs of every particle whose
+	// Lagrangian indices are within the box [lo, hi).
+	ReadVBox(lo, hi [3]int64) ([][3]float32, []int64, error)
+	// LagrangianCells returns the number of cells along each side of the
+	// Lagrangian grid. Each cell is stored in its own file, so a box within
+	// a single cell only reads one file.
+	LagrangianCells() int64
 }
 
 // getLVecHeader returns the header of a .lvec file.
 func getLVecHeader(fname string) (*lvecHeader, error) {
+	hd, _, err := getLVecHeaders(fname)
+	return hd, err
+}
+
+// getLVecHeaders returns the header and extended header of a .lvec file. The
+// extended header is nil for version 1 files.
+func getLVecHeaders(fname string) (*lvecHeader, *lvecExtHeader, error) {
 	f, err := os.Open(fname)
+	if err != nil { return nil, nil, err }
 	defer f.Close()
-	if err != nil { return nil, err }
-	return readHeaderBlock(f)
+	return readHeaderBlocks(f)
+}
+
+// readHeaderBlocks reads the header block and, for files with a version
+// greater than 1, the extended header block. The extended header is nil for
+// version 1 files.
+func readHeaderBlocks(f *os.File) (*lvecHeader, *lvecExtHeader, error) {
+	hd, err := readHeaderBlock(f)
+	if err != nil { return nil, nil, err }
+	if hd.Version < 2 { return hd, nil, nil }
+
+	ext, err := readExtHeaderBlock(f, hd)
+	if err != nil { return nil, nil, err }
+	err = checksumCheck(ext, 0, headerBytes(hd), "header", f.Name())
+	if err != nil { return nil, nil, err }
+
+	return hd, ext, nil
 }
 
 // NewLVecSnapshot returns a Snapshot corresponding to the files in dir which
 // can be created with the format string, fnameFormat. The format string should
-// contain one string verb and one int verb (e.g. "Bolshoi.%s.%03d.lvec")
-func LVec(dir, fnameFormat string) (Snapshot, error) {
+// contain one string verb and one int verb (e.g. "Bolshoi.%s.%03d.lvec").
+// If the directory contains mass files, particles have non-uniform masses.
+// Additional information may be optionally offered in the form of an
+// LVecContext instance. Otherwise, the dequantization mode recorded in the
+// files is used.
+func LVec(
+	dir, fnameFormat string, context ...LVecContext,
+) (Snapshot, error) {
 	fnames, err := getFilenames(dir)
 	if err != nil { return nil, err }
-	hd, err := getLVecHeader(fnames[0])
+	hd, ext, err := getLVecHeaders(fnames[0])
 	if err != nil { return nil, err }
 
-	nFiles := len(fnames) / 2
+	ctx := defaultLVecContext
+	if len(context) > 0 {
+		ctx = context[0]
+	} else if ext != nil {
+		ctx.Dequantize = int(ext.Dequantize)
+	}
+	if ctx.Dequantize < LVecRandom || ctx.Dequantize > LVecIDJitter {
+		return nil, fmt.Errorf("Unrecognized dequantization mode, %d.",
+			ctx.Dequantize)
+	}
+
+	nFiles := hd.Cells*hd.Cells*hd.Cells
 	xNames, vNames := make([]string, nFiles), make([]string, nFiles)
+	mpNames := make([]string, nFiles)
 	for i := range xNames {
 		xNames[i] = path.Join(dir, fmt.Sprintf(fnameFormat, "X", i))
 		vNames[i] = path.Join(dir, fmt.Sprintf(fnameFormat, "V", i))
+		mpNames[i] = path.Join(dir, fmt.Sprintf(fnameFormat, "Mp", i))
 	}
+	if _, err := os.Stat(mpNames[0]); os.IsNotExist(err) { mpNames = nil }
 	
 	nCellSide := uint64(hd.Hd.NSide) / hd.Cells
 	nElem := uint64(hd.Hd.NSide) / (hd.Cells * hd.SubCells)
@@ -102,12 +281,13 @@ func LVec(dir, fnameFormat string) (Snapshot, error) {
 	nCellSide3 := nCellSide*nCellSide*nCellSide
 
 	return &lvecSnapshot{ 
-		hd: *hd,
-		xNames: xNames, vNames: vNames,
+		hd: *hd, header: *hd.Hd.header(), context: ctx,
+		xNames: xNames, vNames: vNames, mpNames: mpNames,
 		xBuf: make([][3]float32, nCellSide3),
 		vBuf: make([][3]float32, nCellSide3),
 		mpBuf: make([]float32, nCellSide3),
 		idBuf: make([]int64, nCellSide3),
+		cellIDBuf: make([]int64, nCellSide3),
 		quantBuf: make([]uint64, nCellSide3),
 		subCellBuf: make([]uint64, nElem3),
 	}, nil
@@ -121,13 +301,14 @@ func (snap *lvecSnapshot) Files() int {
 
 // Header returns the header for the snapshot.
 func (snap *lvecSnapshot) Header() *Header {
-	return &snap.hd.Hd
+	return &snap.header
 }
 
 func (snap *lvecSnapshot) RawHeader(idx int) []byte {
 	f, err := os.Open(snap.xNames[idx])	
 	if err != nil { panic(err.Error()) }
-	_, err = f.Seek(int64(snap.hd.Offsets[1]), 0)
+	defer f.Close()
+	_, err = f.Seek(int64(snap.hd.Offsets[0]), 0)
 	if err != nil { panic(err.Error()) }
 
 	buf, err := readRawHeaderBlock(f, &snap.hd)
@@ -137,17 +318,103 @@ func (snap *lvecSnapshot) RawHeader(idx int) []byte {
 }
 
 // UpdateHeader replaces the snapshot's header with new values. This does not
-// change the value on disk.
+// change the value on disk, but RewriteHeader does.
 func (snap *lvecSnapshot) UpdateHeader(hd *Header) {
-	snap.hd.Hd = *hd
+	snap.header = *hd
+}
+
+// RewriteHeader writes hd to the header of every file and updates the
+// snapshot's header.
+func (snap *lvecSnapshot) RewriteHeader(hd *Header) error {
+	if hd.NTotal != snap.header.NTotal || hd.NSide != snap.header.NSide {
+		return fmt.Errorf("NTotal and NSide can't be changed from %d and " +
+			"%d to %d and %d.", snap.header.NTotal, snap.header.NSide,
+			hd.NTotal, hd.NSide)
+	}
+
+	fnames := append(append([]string{ }, snap.xNames...), snap.vNames...)
+	fnames = append(fnames, snap.mpNames...)
+	for _, fname := range fnames {
+		if err := rewriteLVecHeader(fname, hd); err != nil { return err }
+	}
+
+	snap.hd.Hd = newLVecSimHeader(hd)
+	snap.header = *hd
+	return nil
+}
+
+// rewriteLVecHeader writes hd to the header of a single file and updates its
+// checksum.
+func rewriteLVecHeader(fname string, hd *Header) error {
+	f, err := os.OpenFile(fname, os.O_RDWR, 0644)
+	if err != nil { return err }
+	defer f.Close()
+
+	lvHd, ext, err := readHeaderBlocks(f)
+	if err != nil { return err }
+	lvHd.Hd = newLVecSimHeader(hd)
+
+	if _, err = f.Seek(0, 0); err != nil { return err }
+	if err = writeHeaderBlock(f, lvHd); err != nil { return err }
+	if ext != nil {
+		ext.Checksums[0] = lvecChecksum(headerBytes(lvHd))
+		err = writeExtHeaderBlock(f, lvHd, ext)
+		if err != nil { return err }
+	}
+
+	return f.Close()
+}
+
+// Provenance returns the provenance metadata stored after the blocks of the
+// first position file, or nil if there isn't any.
+func (snap *lvecSnapshot) Provenance() (*Provenance, error) {
+	hd, err := getLVecHeader(snap.xNames[0])
+	if err != nil { return nil, err }
+	return readProvenanceRecord(snap.xNames[0], int64(hd.Offsets[4]),
+		binary.LittleEndian)
+}
+
+// writeLVecProvenance stores p after the blocks of the first position file.
+func writeLVecProvenance(p *Provenance, dir, fnameFormat string) error {
+	fname := path.Join(dir, fmt.Sprintf(fnameFormat, "X", 0))
+	hd, err := getLVecHeader(fname)
+	if err != nil { return err }
+	return writeProvenanceRecord(fname, int64(hd.Offsets[4]),
+		binary.LittleEndian, p)
 }
 
 // UniformMass returns true if all particles have the same mass and false
 // otherwise.
 func (snap *lvecSnapshot) UniformMass() bool {
-	return true
+	return snap.mpNames == nil
 }
 
+// verifyRecords checks the Fortran record markers and checksums of every file
+// in cell i.
+func (snap *lvecSnapshot) verifyRecords(i int) (err error) {
+	fnames := []string{ snap.xNames[i], snap.vNames[i] }
+	if snap.mpNames != nil { fnames = append(fnames, snap.mpNames[i]) }
+
+	for _, fname := range fnames {
+		// Some corruption checks panic.
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("Corruption detected in the file %s: %v",
+						fname, r)
+				}
+			}()
+			_, _, _, err = readLVecFile(fname)
+		}()
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+// zeroIndexedIDs marks that LVec IDs start at zero.
+func (snap *lvecSnapshot) zeroIndexedIDs() { }
+
 // ReadX returns the position vectors associated with the file at index i. The
 // returned array is an internal buffer, so don't append to it or assume it will
 // stick around after the next call to ReadX.
@@ -155,6 +422,7 @@ func (snap *lvecSnapshot) ReadX(i int) ([][3]float32, error) {
 	hd, vecArray, arrays, err := readLVecFile(snap.xNames[i])
 	if err != nil { return nil, err }
 	snap.hd = *hd
+	snap.loadCellIDs(uint64(i))
 
 	vecs := make([]uint64, 3 * hd.SubCells*hd.SubCells*hd.SubCells)
 	loadArray(hd.Pix, hd.SubCellVectorsMin, vecArray, vecs)
@@ -174,6 +442,7 @@ func (snap *lvecSnapshot) ReadV(i int) ([][3]float32, error) {
 	hd, vecArray, arrays, err := readLVecFile(snap.vNames[i])
 	if err != nil { return nil, err }
 	snap.hd = *hd
+	snap.loadCellIDs(uint64(i))
 
 	vecs := make([]uint64, 3 * hd.SubCells*hd.SubCells*hd.SubCells)
 	loadArray(hd.Pix, hd.SubCellVectorsMin, vecArray, vecs)
@@ -186,53 +455,181 @@ func (snap *lvecSnapshot) ReadV(i int) ([][3]float32, error) {
 	return snap.xBuf, nil
 }
 
-// ReadV returns the IDs associated with the file at index i. The returned
-// array is an internal buffer, so don't append to it or assume it will stick
-// around after the next call to ReadV.
+// ReadID returns the IDs associated with the file at index i. IDs are in the
+// same order as the vectors returned by ReadX and ReadV. The returned array is
+// an internal buffer, so don't append to it or assume it will stick around
+// after the next call to ReadID.
 func (snap *lvecSnapshot) ReadID(i int) ([]int64, error) {
 	hd, err := getLVecHeader(snap.xNames[i])
 	if err != nil { return nil, err }
-
-	nElem := uint64(hd.Hd.NSide) / hd.Cells
-	cx := nElem * (hd.Idx % hd.Cells)
-	cy := nElem * ((hd.Idx / hd.Cells)% hd.Cells)
-	cz := nElem * (hd.Idx / (hd.Cells * hd.Cells))
-
-	j := 0
-	for iz := cx; iz < cz + nElem; iz++ {
-		for iy := cy; iy < cy + nElem; iy++ {
-			for ix := cz; ix < cx + nElem; ix++ {
-				snap.idBuf[j] = int64(
-					ix + iy*uint64(hd.Hd.NSide) +
-						iz*uint64(hd.Hd.NSide*hd.Hd.NSide))
-				j++
-			}
-		}
-	}
-
+	lvecCellIDs(hd, uint64(i), snap.idBuf)
 	return snap.idBuf, nil
 }
 
 // ReadMp returns the particle masses associated with the file at index i. The
 // returned array is an internal buffer, so don't append to it or assume it will
-// stick around after the next call to ReadV.
+// stick around after the next call to ReadMp.
 func (snap *lvecSnapshot) ReadMp(i int) ([]float32, error) {
-	for j := range snap.mpBuf {
-		snap.mpBuf[j] = float32(snap.hd.Hd.UniformMp)
+	if snap.mpNames == nil {
+		for j := range snap.mpBuf {
+			snap.mpBuf[j] = float32(snap.header.UniformMp)
+		}
+		return snap.mpBuf, nil
 	}
 
+	hd, vecArray, arrays, err := readLVecFile(snap.mpNames[i])
+	if err != nil { return nil, err }
+	snap.hd = *hd
+	snap.loadCellIDs(uint64(i))
+
+	vecs := make([]uint64, hd.SubCells*hd.SubCells*hd.SubCells)
+	loadArray(hd.Pix, hd.SubCellVectorsMin, vecArray, vecs)
+	snap.loadCell(vecs, arrays, 0)
+	lvecDequantizeScalars(hd, snap.context.Dequantize, snap.quantBuf,
+		snap.cellIDBuf, snap.mpBuf)
+
 	return snap.mpBuf, nil
 }
 
+func (snap *lvecSnapshot) ReadXSpecies(i, species int) ([][3]float32, error) {
+	return readXDarkMatter(snap, i, species)
+}
+
+func (snap *lvecSnapshot) ReadVSpecies(i, species int) ([][3]float32, error) {
+	return readVDarkMatter(snap, i, species)
+}
+
+func (snap *lvecSnapshot) ReadIDSpecies(i, species int) ([]int64, error) {
+	return readIDDarkMatter(snap, i, species)
+}
+
+func (snap *lvecSnapshot) ReadMpSpecies(i, species int) ([]float32, error) {
+	return readMpDarkMatter(snap, i, species)
+}
+
+// ReadXBox returns the positions and IDs of every particle whose Lagrangian
+// indices are within the box [lo, hi). The box is periodic, so lo may be
+// negative and hi may be larger than NSide, but it can't be wider than NSide.
+// Only the files and sub-cells which overlap the box are decoded. IDs follow
+// the same convention as ReadID. The returned slices are newly allocated.
+func (snap *lvecSnapshot) ReadXBox(
+	lo, hi [3]int64,
+) ([][3]float32, []int64, error) {
+	return snap.readBox(snap.xNames, lo, hi)
+}
+
+// LagrangianCells returns the number of cells along each side of the
+// Lagrangian grid.
+func (snap *lvecSnapshot) LagrangianCells() int64 {
+	return int64(snap.hd.Cells)
+}
+
+// ReadVBox returns the velocities and IDs of every particle whose Lagrangian
+// indices are within the box [lo, hi). The box follows the same rules as in
+// ReadXBox.
+func (snap *lvecSnapshot) ReadVBox(
+	lo, hi [3]int64,
+) ([][3]float32, []int64, error) {
+	return snap.readBox(snap.vNames, lo, hi)
+}
+
+// readBox reads the particles within the Lagrangian box [lo, hi) from the
+// files in fnames.
+func (snap *lvecSnapshot) readBox(
+	fnames []string, lo, hi [3]int64,
+) ([][3]float32, []int64, error) {
+	cells, subCells := snap.hd.Cells, snap.hd.SubCells
+	nSide := uint64(snap.hd.Hd.NSide)
+	nElem := nSide / (cells*subCells)
+	nElem3 := nElem*nElem*nElem
+
+	// inBox and subCellInBox flag the Lagrangian indices and sub-cell indices
+	// along each dimension which overlap the box.
+	inBox, subCellInBox := [3][]bool{ }, [3][]bool{ }
+	for k := 0; k < 3; k++ {
+		if hi[k] < lo[k] || hi[k] - lo[k] > int64(nSide) {
+			return nil, nil, fmt.Errorf("The box [%d, %d) is not a valid " +
+				"Lagrangian box for NSide = %d.", lo, hi, nSide)
+		}
+
+		inBox[k] = make([]bool, nSide)
+		subCellInBox[k] = make([]bool, cells*subCells)
+		for i := lo[k]; i < hi[k]; i++ {
+			idx := uint64((i % int64(nSide) + int64(nSide)) % int64(nSide))
+			inBox[k][idx] = true
+			subCellInBox[k][idx / nElem] = true
+		}
+	}
+
+	x, id := [][3]float32{ }, []int64{ }
+	quant := make([]uint64, nElem3)
+	buf := make([][3]float32, nElem3)
+	subCellID := make([]int64, nElem3)
+	nSub := subCells*subCells*subCells
+	mode := snap.context.Dequantize
+
+	for c := uint64(0); c < cells*cells*cells; c++ {
+		cIdx := [3]uint64{ c % cells, (c / cells) % cells, c / (cells*cells) }
+
+		subs := []uint64{ }
+		for s := uint64(0); s < nSub; s++ {
+			sIdx := [3]uint64{
+				s % subCells, (s / subCells) % subCells,
+				s / (subCells*subCells),
+			}
+			overlaps := true
+			for k := 0; k < 3; k++ {
+				overlaps = overlaps &&
+					subCellInBox[k][cIdx[k]*subCells + sIdx[k]]
+			}
+			if overlaps { subs = append(subs, s) }
+		}
+		if len(subs) == 0 { continue }
+
+		hd, vecArray, arrays, err := readLVecFile(fnames[c])
+		if err != nil { return nil, nil, err }
+		vecs := make([]uint64, 3*nSub)
+		loadArray(hd.Pix, hd.SubCellVectorsMin, vecArray, vecs)
+
+		for _, s := range subs {
+			lvecSubCellIDs(hd, lvecOrigin(hd, c), s, subCellID)
+			for dim := uint64(0); dim < 3; dim++ {
+				loadArray(hd.Pix, vecs[3*s + dim], arrays[3*s + dim], quant)
+				lvecDequantize(hd, mode, quant, subCellID, buf, dim)
+			}
+
+			sx := (cIdx[0]*subCells + s % subCells) * nElem
+			sy := (cIdx[1]*subCells + (s / subCells) % subCells) * nElem
+			sz := (cIdx[2]*subCells + s / (subCells*subCells)) * nElem
+
+			j := 0
+			for iz := sz; iz < sz + nElem; iz++ {
+				for iy := sy; iy < sy + nElem; iy++ {
+					for ix := sx; ix < sx + nElem; ix++ {
+						if inBox[0][ix] && inBox[1][iy] && inBox[2][iz] {
+							x = append(x, buf[j])
+							id = append(id, subCellID[j])
+						}
+						j++
+					}
+				}
+			}
+		}
+	}
+
+	return x, id, nil
+}
+
 // loadCell loads the subcell data from arrays corresponding to offsets given by
 // vecs at the dimension dim into the quantBuf.
 func (snap *lvecSnapshot) loadCell(
 	vecs []uint64, arrays []*container.DenseArray, dim uint64,
 ) {
 	nSubCell3 := snap.hd.SubCells*snap.hd.SubCells*snap.hd.SubCells
+	dims := snap.hd.dims()
 
 	for i := uint64(0); i < nSubCell3; i++ {
-		snap.loadSubCell(i, vecs[3*i + dim], arrays[3*i + dim])
+		snap.loadSubCell(i, vecs[dims*i + dim], arrays[dims*i + dim])
 	}
 }
 
@@ -261,13 +658,252 @@ func (snap *lvecSnapshot) loadSubCell(
 	}
 }
 
+// loadCellIDs loads the IDs of the particles in file c into cellIDBuf in the
+// same order as quantBuf if they're needed for dequantization.
+func (snap *lvecSnapshot) loadCellIDs(c uint64) {
+	if snap.context.Dequantize != LVecIDJitter { return }
+	lvecCellIDs(&snap.hd, c, snap.cellIDBuf)
+}
+
+// lvecCellIDs writes the IDs of the particles in file c to out in the order
+// that loadCell stores them, with x varying fastest across the whole file.
+func lvecCellIDs(hd *lvecHeader, c uint64, out []int64) {
+	nSide := uint64(hd.Hd.NSide)
+	nCellElem := nSide / hd.Cells
+	origin := lvecOrigin(hd, c)
+
+	j := 0
+	for iz := origin[2]; iz < origin[2] + nCellElem; iz++ {
+		for iy := origin[1]; iy < origin[1] + nCellElem; iy++ {
+			for ix := origin[0]; ix < origin[0] + nCellElem; ix++ {
+				out[j] = int64(ix + iy*nSide + iz*nSide*nSide)
+				j++
+			}
+		}
+	}
+}
+
 // dequantize dequantizes the quantBuf into the buffer out at dimension dim.
 func (snap *lvecSnapshot) dequantize(out [][3]float32, dim uint64) {
-	delta := (snap.hd.Limits[1] - snap.hd.Limits[0]) / float64(snap.hd.Pix)
-	for i := range snap.quantBuf {
-		x := rand.Float64() + float64(snap.quantBuf[i])
-		out[i][dim] = float32(x*delta + snap.hd.Limits[0])
+	lvecDequantize(&snap.hd, snap.context.Dequantize, snap.quantBuf,
+		snap.cellIDBuf, out, dim)
+}
+
+// lvecDequantize dequantizes quant into the buffer out at dimension dim using
+// the quantization grid described by hd and the given dequantization mode.
+// id contains the IDs of the quantized particles and is only used by
+// LVecIDJitter.
+func lvecDequantize(
+	hd *lvecHeader, mode int, quant []uint64, id []int64,
+	out [][3]float32, dim uint64,
+) {
+	delta := (hd.Limits[1] - hd.Limits[0]) / float64(hd.Pix)
+	for i := range quant {
+		x := lvecOffset(mode, id, i, dim) + float64(quant[i])
+		out[i][dim] = float32(x*delta + hd.Limits[0])
+	}
+}
+
+// lvecDequantizeScalars dequantizes quant into the mass buffer out using the
+// quantization grid described by hd and the given dequantization mode.
+func lvecDequantizeScalars(
+	hd *lvecHeader, mode int, quant []uint64, id []int64, out []float32,
+) {
+	delta := (hd.Limits[1] - hd.Limits[0]) / float64(hd.Pix)
+	for i := range quant {
+		x := lvecOffset(mode, id, i, 3) + float64(quant[i])
+		x = x*delta + hd.Limits[0]
+		if hd.VarType == lvecLogMp { x = math.Pow(10, x) }
+		out[i] = float32(x)
+	}
+}
+
+// lvecOffset returns the position within its quantization pixel of
+// component dim of particle i for the given dequantization mode, in units of
+// the pixel width.
+func lvecOffset(mode int, id []int64, i int, dim uint64) float64 {
+	switch mode {
+	case LVecCellCenter:
+		return 0.5
+	case LVecIDJitter:
+		// splitmix64 finalizer.
+		z := uint64(id[i])*4 + dim + 0x9e3779b97f4a7c15
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z ^= z >> 31
+		return float64(z >> 11) / (1 << 53)
+	default:
+		return rand.Float64()
+	}
+}
+
+// lvecOrigin returns the Lagrangian indices of the corner of file c.
+func lvecOrigin(hd *lvecHeader, c uint64) [3]uint64 {
+	cells := hd.Cells
+	nCellElem := uint64(hd.Hd.NSide) / cells
+	return [3]uint64{
+		c % cells * nCellElem,
+		(c / cells) % cells * nCellElem,
+		c / (cells*cells) * nCellElem,
+	}
+}
+
+// lvecSubCellIDs writes the IDs of the particles in sub-cell s of the file
+// with its corner at origin to out, in the order they're stored. IDs follow
+// the same convention as ReadID.
+func lvecSubCellIDs(hd *lvecHeader, origin [3]uint64, s uint64, out []int64) {
+	subCells, nSide := hd.SubCells, uint64(hd.Hd.NSide)
+	nElem := nSide / (hd.Cells*subCells)
+
+	sx := origin[0] + s % subCells * nElem
+	sy := origin[1] + (s / subCells) % subCells * nElem
+	sz := origin[2] + s / (subCells*subCells) * nElem
+
+	j := 0
+	for iz := sz; iz < sz + nElem; iz++ {
+		for iy := sy; iy < sy + nElem; iy++ {
+			for ix := sx; ix < sx + nElem; ix++ {
+				out[j] = int64(ix + iy*nSide + iz*nSide*nSide)
+				j++
+			}
+		}
+	}
+}
+
+// lvecVectorChunks iterates over the vectors in an LVec file one group of
+// sub-cells at a time. Only the sub-cells in the current chunk are
+// decompressed.
+type lvecVectorChunks struct {
+	hd *lvecHeader
+	mode int
+	origin [3]uint64
+	vecs []uint64
+	arrays []*container.DenseArray
+
+	next, nSub, perChunk, nElem3 uint64
+	quant []uint64
+	id []int64
+	buf [][3]float32
+}
+
+// ReadXChunks returns an iterator over the positions in file i. Each chunk
+// contains as many whole sub-cells as fit in chunkSize particles, and at
+// least one sub-cell.
+func (snap *lvecSnapshot) ReadXChunks(i, chunkSize int) (VectorChunks, error) {
+	return snap.newVectorChunks(snap.xNames[i], i, chunkSize)
+}
+
+// ReadVChunks returns an iterator over the velocities in file i. Each chunk
+// contains as many whole sub-cells as fit in chunkSize particles, and at
+// least one sub-cell.
+func (snap *lvecSnapshot) ReadVChunks(i, chunkSize int) (VectorChunks, error) {
+	return snap.newVectorChunks(snap.vNames[i], i, chunkSize)
+}
+
+// newVectorChunks returns an iterator over the vectors in fname, which is
+// file i.
+func (snap *lvecSnapshot) newVectorChunks(
+	fname string, i, chunkSize int,
+) (VectorChunks, error) {
+	hd, vecArray, arrays, err := readLVecFile(fname)
+	if err != nil { return nil, err }
+
+	nSub := hd.SubCells*hd.SubCells*hd.SubCells
+	vecs := make([]uint64, 3*nSub)
+	loadArray(hd.Pix, hd.SubCellVectorsMin, vecArray, vecs)
+
+	nElem := uint64(hd.Hd.NSide) / (hd.Cells*hd.SubCells)
+	nElem3 := nElem*nElem*nElem
+
+	return &lvecVectorChunks{
+		hd: hd, mode: snap.context.Dequantize,
+		origin: lvecOrigin(hd, uint64(i)), vecs: vecs, arrays: arrays,
+		nSub: nSub, nElem3: nElem3,
+		perChunk: lvecSubCellsPerChunk(chunkSize, nElem3),
+		quant: make([]uint64, nElem3), id: make([]int64, nElem3),
+	}, nil
+}
+
+// lvecSubCellsPerChunk returns the number of sub-cells with nElem3 particles
+// which are read in each chunk.
+func lvecSubCellsPerChunk(chunkSize int, nElem3 uint64) uint64 {
+	if chunkSize < 1 { return 1 }
+	perChunk := uint64(chunkSize) / nElem3
+	if perChunk == 0 { return 1 }
+	return perChunk
+}
+
+func (c *lvecVectorChunks) Next() ([][3]float32, error) {
+	if c.next >= c.nSub { return nil, io.EOF }
+	end := c.next + c.perChunk
+	if end > c.nSub { end = c.nSub }
+
+	c.buf = expandVectors(c.buf[:0], int((end - c.next)*c.nElem3))
+	for s := c.next; s < end; s++ {
+		out := c.buf[(s - c.next)*c.nElem3: (s - c.next + 1)*c.nElem3]
+		if c.mode == LVecIDJitter { lvecSubCellIDs(c.hd, c.origin, s, c.id) }
+		for dim := uint64(0); dim < 3; dim++ {
+			loadArray(c.hd.Pix, c.vecs[3*s + dim], c.arrays[3*s + dim],
+				c.quant)
+			lvecDequantize(c.hd, c.mode, c.quant, c.id, out, dim)
+		}
 	}
+	c.next = end
+
+	return c.buf, nil
+}
+
+func (c *lvecVectorChunks) Close() error {
+	c.next, c.arrays = c.nSub, nil
+	return nil
+}
+
+// lvecIDChunks iterates over the IDs in an LVec file one group of sub-cells
+// at a time. IDs follow the same convention as ReadID.
+type lvecIDChunks struct {
+	hd *lvecHeader
+	origin [3]uint64
+
+	next, nSub, perChunk, nElem3 uint64
+	buf []int64
+}
+
+// ReadIDChunks returns an iterator over the IDs in file i. Each chunk
+// contains as many whole sub-cells as fit in chunkSize particles, and at
+// least one sub-cell.
+func (snap *lvecSnapshot) ReadIDChunks(i, chunkSize int) (IntChunks, error) {
+	hd, err := getLVecHeader(snap.xNames[i])
+	if err != nil { return nil, err }
+
+	subCells := hd.SubCells
+	nElem := uint64(hd.Hd.NSide) / (hd.Cells*subCells)
+	nElem3 := nElem*nElem*nElem
+
+	return &lvecIDChunks{
+		hd: hd, origin: lvecOrigin(hd, uint64(i)),
+		nSub: subCells*subCells*subCells, nElem3: nElem3,
+		perChunk: lvecSubCellsPerChunk(chunkSize, nElem3),
+	}, nil
+}
+
+func (c *lvecIDChunks) Next() ([]int64, error) {
+	if c.next >= c.nSub { return nil, io.EOF }
+	end := c.next + c.perChunk
+	if end > c.nSub { end = c.nSub }
+
+	c.buf = expandInts(c.buf[:0], int((end - c.next)*c.nElem3))
+	for s := c.next; s < end; s++ {
+		out := c.buf[(s - c.next)*c.nElem3: (s - c.next + 1)*c.nElem3]
+		lvecSubCellIDs(c.hd, c.origin, s, out)
+	}
+	c.next = end
+
+	return c.buf, nil
+}
+
+func (c *lvecIDChunks) Close() error {
+	c.next = c.nSub
+	return nil
 }
 
 func bound(x []uint64) (origin, width uint64) {
@@ -351,107 +987,544 @@ func periodicUnbound(pix, origin uint64, x []uint64) {
 // on one side, dx and dy are the accuracy parameters for distance and velocity,
 // respectively, dir is the directory that the files will be wirtten to, and
 // fnameFormat is the printf format string used to generate file names and must
-// contain a %s verb followed by a %d verb.
+// contain a %s verb followed by a %d verb. If the snapshot doesn't have uniform
+// masses, masses are written to a third set of files. Additional information
+// may be optionally offered in the form of an LVecContext instance.
 func ConvertToLVec(
 	snap Snapshot,
 	cells, subCells uint64,
 	dx, dv float64,
 	dir, fnameFormat string,
+	context ...LVecContext,
 ) error {
 	hd := snap.Header()
+	ctx := defaultLVecContext
+	if len(context) > 0 { ctx = context[0] }
 
 	if hd.NSide % int64(cells*subCells) != 0 {
 		panic(fmt.Sprintf("cells = %d, subCells = %d, but hd.NSide = %d",
 			cells, subCells, hd.NSide))
-	} else if !snap.UniformMass() {
-		panic("Currently, non-uniform masses aren't implemented.")
 	} else if _, err := os.Stat(dir); os.IsNotExist(err) {
 		panic(fmt.Sprintf("Driectory %s does not exist", dir))
 	}
 
-	lvHeader := &lvecHeader{
+	if err := checkFullGrid(hd); err != nil { return err }
+	if !snap.UniformMass() {
+		if err := checkDMp(ctx); err != nil { return err }
+	}
+
+	rawHd := snap.RawHeader(0)
+	lvHeader := newLVecHeader(hd, cells, subCells, rawHd)
+
+	var err error
+	if ctx.OutOfCore {
+		err = convertToLVecOutOfCore(snap, lvHeader, rawHd, dx, dv,
+			ctx, dir, fnameFormat)
+	} else {
+		err = convertToLVecInCore(snap, lvHeader, rawHd, dx, dv,
+			ctx, dir, fnameFormat)
+	}
+	if err != nil || ctx.Provenance == nil { return err }
+
+	p := newProvenance(ctx.Provenance, map[string]float64{
+		"dx": dx, "dv": dv, "dMp": ctx.DMp,
+		"cells": float64(cells), "subCells": float64(subCells),
+	})
+	return writeLVecProvenance(p, dir, fnameFormat)
+}
+
+// convertToLVecInCore is the implementation of ConvertToLVec which holds the
+// full grid of each variable in memory.
+func convertToLVecInCore(
+	snap Snapshot,
+	lvHeader *lvecHeader,
+	rawHd []byte,
+	dx, dv float64,
+	ctx LVecContext,
+	dir, fnameFormat string,
+) error {
+	cells, subCells := lvHeader.Cells, lvHeader.SubCells
+	xLimits := [2]float64{0, snap.Header().L}
+
+	if !lvecVarComplete(lvHeader, lvecX, xLimits, dx, ctx, dir, fnameFormat) {
+		grid, err := XGrid(snap, int(cells*subCells))
+		if err != nil { return err }
+		err = writeLVecVar(lvHeader, rawHd, grid, lvecX, xLimits, dx,
+			ctx, dir, fnameFormat)
+		if err != nil { return err }
+	}
+
+	runtime.GC()
+
+	noLimits := [2]float64{ }
+	if !lvecVarComplete(lvHeader, lvecV, noLimits, dv, ctx, dir, fnameFormat) {
+		grid, err := VGrid(snap, int(cells*subCells))
+		if err != nil { return err }
+		err = writeLVecVar(lvHeader, rawHd, grid, lvecV, grid.Limits(), dv,
+			ctx, dir, fnameFormat)
+		if err != nil { return err }
+	}
+
+	if snap.UniformMass() { return nil }
+
+	runtime.GC()
+
+	mpType := uint64(lvecMp)
+	if ctx.LogMp { mpType = lvecLogMp }
+	if lvecVarComplete(lvHeader, mpType, noLimits, ctx.DMp,
+		ctx, dir, fnameFormat) {
+		return nil
+	}
+
+	grid, err := MpGrid(snap, int(cells*subCells))
+	if err != nil { return err }
+	return writeLVecMp(lvHeader, rawHd, grid, ctx, dir, fnameFormat)
+}
+
+// newLVecHeader returns the parts of an LVec header which are shared by every
+// file in the snapshot.
+func newLVecHeader(
+	hd *Header, cells, subCells uint64, rawHd []byte,
+) *lvecHeader {
+	return &lvecHeader{
 		Magic: LVecMagicNumber,
 		Version: LVecVersion,
 		Cells: cells,
 		SubCells: subCells,
 		Method: lvecBoxMethod,
-		Hd: *hd,
+		RawHeaderBytes: uint64(len(rawHd)),
+		Hd: newLVecSimHeader(hd),
 	}
-	
-	rawHd := snap.RawHeader(0)
-	lvHeader.RawHeaderBytes = uint64(len(rawHd))
+}
+
+// writeLVecVar writes the LVec files for a single variable, which is stored
+// in grid and lies within limits. Each component will be stored to at least
+// an accuracy of delta.
+func writeLVecVar(
+	hd *lvecHeader,
+	rawHd []byte,
+	grid *VectorGrid,
+	varType uint64,
+	limits [2]float64,
+	delta float64,
+	ctx LVecContext,
+	dir, fnameFormat string,
+) error {
+	hd.Limits = limits
+	hd.VarType = varType
+	hd.Delta = delta
+	hd.Pix = minPix(hd.Limits, hd.Delta)
+
+	return generateLVec(hd, rawHd, grid, ctx, dir, fnameFormat)
+}
+
+// checkDMp returns an error if ctx.DMp can't be used to quantize particle
+// masses.
+func checkDMp(ctx LVecContext) error {
+	if ctx.DMp <= 0 {
+		return fmt.Errorf("DMp = %g, but it must be positive.", ctx.DMp)
+	}
+	return nil
+}
+
+// writeLVecMp writes the LVec files for particle masses, which are stored in
+// grid as described by MpGrid. The grid is modified if masses are stored
+// logarithmically.
+func writeLVecMp(
+	hd *lvecHeader,
+	rawHd []byte,
+	grid *VectorGrid,
+	ctx LVecContext,
+	dir, fnameFormat string,
+) error {
+	varType := uint64(lvecMp)
+	if ctx.LogMp {
+		varType = lvecLogMp
+		for _, cell := range grid.Cells {
+			for j := range cell {
+				if cell[j][0] <= 0 {
+					return fmt.Errorf("A particle has mass %g, so masses " +
+						"can't be stored logarithmically.", cell[j][0])
+				}
+				mp := float32(math.Log10(float64(cell[j][0])))
+				cell[j] = [3]float32{ mp, mp, mp }
+			}
+		}
+	}
+
+	// The quantization grid needs a non-zero width.
+	limits := grid.Limits()
+	if limits[1] - limits[0] < ctx.DMp { limits[1] = limits[0] + ctx.DMp }
+
+	return writeLVecVar(hd, rawHd, grid, varType, limits, ctx.DMp,
+		ctx, dir, fnameFormat)
+}
+
+type lvecWriter struct {
+	dir, fnameFormat string
+	cells, subCells uint64
+	dx, dv float64
+	context LVecContext
+
+	hd Header
+	rawHd []byte
+	xGrid, vGrid, mpGrid *VectorGrid
+	uniformMp bool
+	files map[int]*lvecWriterFile
+}
+
+// lvecWriterFile holds the vectors of a file which can't be inserted into the
+// grids until the file's IDs are known.
+type lvecWriterFile struct {
+	n int
+	x, v [][3]float32
+	mp []float32
+	id []int64
+	hasX, hasV, hasMp bool
+}
+
+// LVecWriter returns a Writer which writes LVec files to dir. The parameters
+// are the same as those of ConvertToLVec. Because LVec files are split up by
+// Lagrangian cells, the number of files written is always cells^3, regardless
+// of how many files are passed to the Writer. Every particle is held in
+// memory until Close is called, so this uses about three times as much memory
+// as ConvertToLVec.
+func LVecWriter(
+	dir, fnameFormat string, cells, subCells uint64, dx, dv float64,
+	context ...LVecContext,
+) Writer {
+	wr := &lvecWriter{
+		dir: dir, fnameFormat: fnameFormat,
+		cells: cells, subCells: subCells, dx: dx, dv: dv,
+		context: defaultLVecContext, uniformMp: true,
+		files: map[int]*lvecWriterFile{ },
+	}
+	if len(context) > 0 { wr.context = context[0] }
+	return wr
+}
 
-	grid, err := XGrid(snap, int(cells*subCells))
-	lvHeader.Limits = [2]float64{0, hd.L}
-	lvHeader.VarType = lvecX
-	lvHeader.Delta = dx
-	lvHeader.Pix = minPix(lvHeader.Limits, lvHeader.Delta)
+func (wr *lvecWriter) WriteHeader(
+	i, files, n int, hd *Header, rawHd []byte,
+) error {
+	if wr.xGrid == nil {
+		if hd.NSide % int64(wr.cells*wr.subCells) != 0 {
+			return fmt.Errorf("cells = %d, subCells = %d, but hd.NSide = %d",
+				wr.cells, wr.subCells, hd.NSide)
+		} else if _, err := os.Stat(wr.dir); os.IsNotExist(err) {
+			return fmt.Errorf("Directory %s does not exist", wr.dir)
+		}
+
+		wr.hd = *hd
+		wr.rawHd = append([]byte{ }, rawHd...)
+		wr.xGrid = NewVectorGrid(int(wr.cells*wr.subCells), int(hd.NSide))
+		wr.vGrid = NewVectorGrid(int(wr.cells*wr.subCells), int(hd.NSide))
+		wr.mpGrid = NewVectorGrid(int(wr.cells*wr.subCells), int(hd.NSide))
+	}
+
+	wr.files[i] = &lvecWriterFile{ n: n }
+	return nil
+}
+
+// file returns the unfinished file i after checking that it has n particles.
+func (wr *lvecWriter) file(i, n int) (*lvecWriterFile, error) {
+	file, ok := wr.files[i]
+	if !ok {
+		return nil, fmt.Errorf("File %d was written to before its header " +
+			"was written.", i)
+	} else if file.n != n {
+		return nil, fmt.Errorf("File %d has %d particles, but a block with " +
+			"%d particles was written to it.", i, file.n, n)
+	}
+	return file, nil
+}
+
+// insert inserts any vectors in file i which can be inserted into the grids.
+func (wr *lvecWriter) insert(i int) {
+	file := wr.files[i]
+	if file.id == nil { return }
+
+	if file.x != nil {
+		for j := range file.x { wr.xGrid.Insert(file.id[j] - 1, file.x[j]) }
+		file.x, file.hasX = nil, true
+	}
+	if file.v != nil {
+		for j := range file.v { wr.vGrid.Insert(file.id[j] - 1, file.v[j]) }
+		file.v, file.hasV = nil, true
+	}
+	if file.mp != nil {
+		for j, mp := range file.mp {
+			wr.mpGrid.Insert(file.id[j] - 1, [3]float32{ mp, mp, mp })
+		}
+		file.mp, file.hasMp = nil, true
+	}
 
-	err = generateLVec(lvHeader, rawHd, grid, dir, fnameFormat)
+	if file.hasX && file.hasV && file.hasMp { delete(wr.files, i) }
+}
+
+func (wr *lvecWriter) WriteX(i int, x [][3]float32) error {
+	file, err := wr.file(i, len(x))
 	if err != nil { return err }
+	file.x = append([][3]float32{ }, x...)
+	wr.insert(i)
+	return nil
+}
 
-	runtime.GC()
+func (wr *lvecWriter) WriteV(i int, v [][3]float32) error {
+	file, err := wr.file(i, len(v))
+	if err != nil { return err }
+	file.v = append([][3]float32{ }, v...)
+	wr.insert(i)
+	return nil
+}
 
-	grid, err = VGrid(snap, int(cells*subCells))
-	lvHeader.Limits = grid.Limits()
-	lvHeader.VarType = lvecV
-	lvHeader.Delta = dv
-	lvHeader.Pix = minPix(lvHeader.Limits, lvHeader.Delta)
+func (wr *lvecWriter) WriteID(i int, id []int64) error {
+	file, err := wr.file(i, len(id))
+	if err != nil { return err }
 
-	err = generateLVec(lvHeader, rawHd, grid, dir, fnameFormat)
+	nSide := wr.hd.NSide
+	for j := range id {
+		if id[j] < 1 || id[j] > nSide*nSide*nSide {
+			return fmt.Errorf("ID %d of file %d is %d, which isn't on a " +
+				"Lagrangian grid with NSide = %d.", j, i, id[j], nSide)
+		}
+	}
+
+	file.id = append([]int64{ }, id...)
+	wr.insert(i)
+	return nil
+}
+
+// WriteMp writes the masses of file i. Masses are only written to disk if
+// some particle's mass is different from the header's.
+func (wr *lvecWriter) WriteMp(i int, mp []float32) error {
+	file, err := wr.file(i, len(mp))
 	if err != nil { return err }
 
+	for j := range mp {
+		if math.Abs(float64(mp[j])/wr.hd.UniformMp - 1) > 1e-5 {
+			wr.uniformMp = false
+		}
+	}
+
+	if !wr.uniformMp {
+		if err := checkDMp(wr.context); err != nil { return err }
+	}
+
+	file.mp = append([]float32{ }, mp...)
+	wr.insert(i)
 	return nil
 }
 
+// writeProvenance stores p in the snapshot after the conversion parameters
+// have been added to it.
+func (wr *lvecWriter) writeProvenance(p *Provenance) error {
+	p = newProvenance(p, map[string]float64{
+		"dx": wr.dx, "dv": wr.dv, "dMp": wr.context.DMp,
+		"cells": float64(wr.cells), "subCells": float64(wr.subCells),
+	})
+	return writeLVecProvenance(p, wr.dir, wr.fnameFormat)
+}
+
+// Close writes the LVec files.
+func (wr *lvecWriter) Close() error {
+	for i := range wr.files {
+		return fmt.Errorf("Not every block of file %d was written.", i)
+	}
+	if wr.xGrid == nil { return fmt.Errorf("No files were written.") }
+
+	lvHeader := newLVecHeader(&wr.hd, wr.cells, wr.subCells, wr.rawHd)
+
+	err := writeLVecVar(lvHeader, wr.rawHd, wr.xGrid, lvecX,
+		[2]float64{0, wr.hd.L}, wr.dx, wr.context, wr.dir, wr.fnameFormat)
+	if err != nil { return err }
+	wr.xGrid = nil
+
+	runtime.GC()
+
+	err = writeLVecVar(lvHeader, wr.rawHd, wr.vGrid, lvecV,
+		wr.vGrid.Limits(), wr.dv, wr.context, wr.dir, wr.fnameFormat)
+	if err != nil { return err }
+	wr.vGrid = nil
+
+	if wr.uniformMp {
+		wr.mpGrid = nil
+		return nil
+	}
+
+	runtime.GC()
+
+	err = writeLVecMp(lvHeader, wr.rawHd, wr.mpGrid, wr.context,
+		wr.dir, wr.fnameFormat)
+	wr.mpGrid = nil
+	return err
+}
+
 // generateLVec generates all the LVec files associated with the data in grid.
+// Files are written in parallel by ctx.Workers workers.
 func generateLVec(
 	hd *lvecHeader,
 	rawHd []byte,
 	grid *VectorGrid,
+	ctx LVecContext,
 	dir, fnameFormat string,
 ) error {
-	cells, sCells := hd.Cells, hd.SubCells
-	nSub := hd.SubCells*hd.SubCells*hd.SubCells
-
-	subCellVecs := make([]uint64, 3*nSub)
-	bits := make([]uint64, 3*nSub)
-	arrays := make([]*container.DenseArray, 3*nSub)
-
+	nCells := int(hd.Cells*hd.Cells*hd.Cells)
 	fnames := fnameList(hd, dir, fnameFormat)
-	quant := grid.IntBuffer()
-
-	grid.SuperCellLoop(cells, func(c uint64, cIdx [3]uint64) {
-		runtime.GC()
-
-		grid.SubCellLoop(cells, sCells, cIdx, func(i,s uint64, sIdx [3]uint64) {
-			grid.Quantize(int(i), hd.Pix, hd.Limits, quant)
-			
-			for j := uint64(0); j < 3; j++ {
-				k := 3*s + j
-				bits[k], subCellVecs[k], arrays[k] = toArray(
-					quant[j], hd.Pix, hd.VarType == lvecX,
-				)
-			}
-		})
 
-		var bitsArray, subCellVecsArray *container.DenseArray
-		hd.BitsBits, hd.BitsMin, bitsArray = toArray(
-			bits, 0, false,
-		)
-		hd.SubCellVectorsBits, hd.SubCellVectorsMin, subCellVecsArray = toArray(
-			subCellVecs, 0, false,
-		)
+	workers := lvecWorkers(hd, ctx)
+	encoders := make([]*lvecEncoder, workers)
+	errs := make([]error, nCells)
 
-		err := writeLVecFile(
-			fnames[c], hd, rawHd, subCellVecsArray, bitsArray, arrays,
+	thread.WorkerQueue(workers, nCells, func(worker, c int) {
+		if ctx.Resume {
+			if _, ok := validLVecFile(fnames[c], hd, ctx); ok { return }
+		}
+
+		if encoders[worker] == nil { encoders[worker] = newLVecEncoder(hd) }
+		fileHd := *hd
+		errs[c] = encoders[worker].encode(
+			&fileHd, rawHd, grid, uint64(c), ctx, fnames[c],
 		)
-		if err != nil { panic(err.Error()) } // .___.
 	})
 
+	for _, err := range errs {
+		if err != nil { return err }
+	}
 	return nil
 }
 
+// lvecWorkers returns the number of workers used to write the files
+// described by hd.
+func lvecWorkers(hd *lvecHeader, ctx LVecContext) int {
+	workers := ctx.Workers
+	if workers < 1 { workers = 1 }
+
+	if ctx.MemoryBudget > 0 {
+		// Quantized values and the arrays made from them both take at most
+		// eight bytes per component.
+		nCellElem := uint64(hd.Hd.NSide) / hd.Cells
+		perWorker := int64(16 * hd.dims() * nCellElem*nCellElem*nCellElem)
+		if max := int(ctx.MemoryBudget / perWorker); max < workers {
+			workers = max
+		}
+		if workers < 1 { workers = 1 }
+	}
+
+	return workers
+}
+
+// lvecEncoder holds the buffers used by a single worker to write LVec files.
+type lvecEncoder struct {
+	subCellVecs, bits []uint64
+	arrays []*container.DenseArray
+	quant [3][]uint64
+}
+
+func newLVecEncoder(hd *lvecHeader) *lvecEncoder {
+	nSub := hd.SubCells*hd.SubCells*hd.SubCells
+	dims := hd.dims()
+	nElem := uint64(hd.Hd.NSide) / (hd.Cells*hd.SubCells)
+
+	enc := &lvecEncoder{
+		subCellVecs: make([]uint64, dims*nSub),
+		bits: make([]uint64, dims*nSub),
+		arrays: make([]*container.DenseArray, dims*nSub),
+	}
+	for i := range enc.quant {
+		enc.quant[i] = make([]uint64, nElem*nElem*nElem)
+	}
+
+	return enc
+}
+
+// encode quantizes file c of grid and writes it to fname.
+func (enc *lvecEncoder) encode(
+	hd *lvecHeader, rawHd []byte, grid *VectorGrid, c uint64,
+	ctx LVecContext, fname string,
+) error {
+	cells, sCells := hd.Cells, hd.SubCells
+	dims := hd.dims()
+	cIdx := [3]uint64{ c % cells, (c / cells) % cells, c / (cells*cells) }
+
+	grid.SubCellLoop(cells, sCells, cIdx, func(i,s uint64, sIdx [3]uint64) {
+		grid.Quantize(int(i), hd.Pix, hd.Limits, enc.quant)
+		
+		for j := uint64(0); j < dims; j++ {
+			k := dims*s + j
+			enc.bits[k], enc.subCellVecs[k], enc.arrays[k] = toArray(
+				enc.quant[j], hd.Pix, hd.VarType == lvecX,
+			)
+		}
+	})
+
+	var bitsArray, subCellVecsArray *container.DenseArray
+	hd.BitsBits, hd.BitsMin, bitsArray = toArray(
+		enc.bits, 0, false,
+	)
+	hd.SubCellVectorsBits, hd.SubCellVectorsMin, subCellVecsArray = toArray(
+		enc.subCellVecs, 0, false,
+	)
+
+	return writeLVecFile(
+		fname, hd, rawHd, subCellVecsArray, bitsArray, enc.arrays, ctx,
+	)
+}
+
+// validLVecFile returns true if fname exists and is a valid LVec file with
+// the layout described by want. If want.Pix is zero, the quantization grid
+// isn't checked. The file's header is also returned.
+func validLVecFile(
+	fname string, want *lvecHeader, ctx LVecContext,
+) (hd *lvecHeader, ok bool) {
+	if _, err := os.Stat(fname); err != nil { return nil, false }
+
+	// Some corruption checks panic.
+	defer func() {
+		if recover() != nil { hd, ok = nil, false }
+	}()
+
+	hd, _, _, err := readLVecFile(fname)
+	if err != nil { return nil, false }
+
+	version := uint64(ctx.Version)
+	if version == 0 { version = LVecVersion }
+
+	ok = hd.Version == version && hd.VarType == want.VarType &&
+		hd.Cells == want.Cells && hd.SubCells == want.SubCells &&
+		hd.Delta == want.Delta && hd.Hd == want.Hd &&
+		(want.Pix == 0 || hd.Pix == want.Pix && hd.Limits == want.Limits)
+	return hd, ok
+}
+
+// lvecVarComplete returns true if resuming is enabled and every file for the
+// given variable already exists and is valid. If limits are zero, they
+// aren't checked, but every file must use the same limits.
+func lvecVarComplete(
+	hd *lvecHeader, varType uint64, limits [2]float64, delta float64,
+	ctx LVecContext, dir, fnameFormat string,
+) bool {
+	if !ctx.Resume { return false }
+
+	want := *hd
+	want.VarType, want.Limits, want.Delta = varType, limits, delta
+	want.Pix = 0
+	if limits != [2]float64{ } { want.Pix = minPix(limits, delta) }
+
+	var firstLimits [2]float64
+	for i, fname := range fnameList(&want, dir, fnameFormat) {
+		fileHd, ok := validLVecFile(fname, &want, ctx)
+		if !ok { return false }
+
+		if i == 0 {
+			firstLimits = fileHd.Limits
+		} else if fileHd.Limits != firstLimits {
+			return false
+		}
+	}
+
+	return true
+}
+
 // toArray compresses an array of integers into a DenseArray and returns the
 // information neccessary to decode this array, the minimum value of the
 // data and the number of bits in the DenseArray.
@@ -484,7 +1557,7 @@ func loadArray(
 	}
 }
 
-// writeLVecFile writes an LVec file to disk
+// writeLVecFile writes a version 2 LVec file to disk
 func writeLVecFile(
 	fname string,
 	hd *lvecHeader,
@@ -492,14 +1565,78 @@ func writeLVecFile(
 	subCellVecs *container.DenseArray,
 	bits *container.DenseArray, 
 	arrays []*container.DenseArray,
+	ctx LVecContext,
 ) error {
+	switch ctx.Version {
+	case 0, LVecVersion:
+	case 1:
+		return writeLVecV1File(fname, hd, rawHd, subCellVecs, bits, arrays)
+	default:
+		return fmt.Errorf("Can't write LVec version %d.", ctx.Version)
+	}
+
 	f, err := os.Create(fname)
+	if err != nil { return err }
 	defer f.Close()
+
+	ext := &lvecExtHeader{ Dequantize: uint64(ctx.Dequantize) }
+	if ctx.Compress { ext.Coding = lvecDeltaFlateCoding }
+	arrayData, err := encodeLVecArrays(ext, arrays)
+	if err != nil { return err }
+
+	hd.Version = LVecVersion
+	hd.Offsets[0] = uint64(unsafe.Sizeof(*hd) + unsafe.Sizeof(*ext)) + 16
+	hd.Offsets[1] = uint64(len(rawHd)) + 8 + hd.Offsets[0]
+	hd.Offsets[2] = uint64(len(subCellVecs.Data)) + 8 + hd.Offsets[1]
+	hd.Offsets[3] = uint64(len(bits.Data)) + 8 + hd.Offsets[2]
+	hd.Offsets[4] = uint64(len(arrayData)) + 8 + hd.Offsets[3]
+
+	fortranCheck(hd.Offsets)
+
+	ext.Checksums = [5]uint32{
+		lvecChecksum(headerBytes(hd)), lvecChecksum(rawHd),
+		lvecChecksum(subCellVecs.Data), lvecChecksum(bits.Data),
+		lvecChecksum(arrayData),
+	}
+
+	err = writeHeaderBlock(f, hd)
+	if err != nil { return err }
+
+	err = writeExtHeaderBlock(f, hd, ext)
+	if err != nil { return err }
+
+	err = writeRawHeaderBlock(f, hd, rawHd)
+	if err != nil { return err }
+
+	err = writeSubCellVecsBlock(f, hd, subCellVecs)
+	if err != nil { return err }
+
+	err = writeBitsBlock(f, hd, bits)
 	if err != nil { return err }
 
+	err = writeCodedArraysBlock(f, hd, arrayData)
+	if err != nil { return err }
+
+	return nil
+}
+
+// writeLVecV1File writes a version 1 LVec file to disk.
+func writeLVecV1File(
+	fname string,
+	hd *lvecHeader,
+	rawHd []byte,
+	subCellVecs *container.DenseArray,
+	bits *container.DenseArray, 
+	arrays []*container.DenseArray,
+) error {
+	f, err := os.Create(fname)
+	if err != nil { return err }
+	defer f.Close()
+
 	totalArrayData := uint64(0)
 	for _, a := range arrays { totalArrayData += uint64(len(a.Data)) }
 
+	hd.Version = 1
 	hd.Offsets[0] = uint64(unsafe.Sizeof(*hd)) + 8
 	hd.Offsets[1] = uint64(len(rawHd)) + 8 + hd.Offsets[0]
 	hd.Offsets[2] = uint64(len(subCellVecs.Data)) + 8 + hd.Offsets[1]
@@ -526,18 +1663,20 @@ func writeLVecFile(
 	return nil
 }
 
+// readLVecFile reads an LVec file of any version. The checksums of version 2
+// files are checked.
 func readLVecFile(fname string) (
 	hd *lvecHeader, subCellVecs *container.DenseArray,
 	arrays []*container.DenseArray, err error,
 ) {
 	f, err := os.Open(fname)
-	defer f.Close()
 	if err != nil { return nil, nil, nil, err }
+	defer f.Close()
 
-	hd, err = readHeaderBlock(f)
+	hd, ext, err := readHeaderBlocks(f)
 	if err != nil { return nil, nil, nil, err }
 
-	_, err = readRawHeaderBlock(f, hd)
+	rawHd, err := readRawHeaderBlock(f, hd)
 	if err != nil { return nil, nil, nil, err }
 
 	subCellVecs, err = readSubCellVecsBlock(f, hd)
@@ -548,7 +1687,23 @@ func readLVecFile(fname string) (
 	bits := make([]uint64, bitsArray.Length)
 	loadArray(0, hd.BitsMin, bitsArray, bits)
 
-	arrays, err = readArraysBlock(f, hd, bits)
+	if ext == nil {
+		arrays, err = readArraysBlock(f, hd, bits)
+		if err != nil { return nil, nil, nil, err }
+		return hd, subCellVecs, arrays, nil
+	}
+
+	arrayData, err := readCodedArraysBlock(f, hd)
+	if err != nil { return nil, nil, nil, err }
+
+	blocks := [][]byte{ rawHd, subCellVecs.Data, bitsArray.Data, arrayData }
+	names := []string{ "raw header", "vector", "bits", "array" }
+	for i := range blocks {
+		err = checksumCheck(ext, i + 1, blocks[i], names[i], fname)
+		if err != nil { return nil, nil, nil, err }
+	}
+
+	arrays, err = decodeLVecArrays(hd, ext, arrayData, bits)
 	if err != nil { return nil, nil, nil, err }
 	return hd, subCellVecs, arrays, nil
 }
@@ -582,7 +1737,15 @@ func readHeaderBlock(f *os.File) (*lvecHeader, error) {
 	if err != nil { return nil, err }
 
 	fortranHeaderCheck(fortran, int(unsafe.Sizeof(*hd)), "header")
-	offsetCheck(f, hd.Offsets[0], "header", "end")
+	if hd.Magic != LVecMagicNumber {
+		return nil, fmt.Errorf("%s is not an LVec file.", f.Name())
+	} else if hd.Version > LVecVersion {
+		return nil, fmt.Errorf("%s has LVec version %d, but only versions " +
+			"up to %d are supported.", f.Name(), hd.Version, LVecVersion)
+	}
+
+	// Later versions have an extended header block before the raw header.
+	if hd.Version < 2 { offsetCheck(f, hd.Offsets[0], "header", "end") }
 
 	return hd, nil
 }
@@ -649,7 +1812,7 @@ func readSubCellVecsBlock(
 
 	fortran := [2]int32{ }
 	nSub := hd.SubCells*hd.SubCells*hd.SubCells
-	array := createDenseArray(3*nSub, hd.SubCellVectorsBits)
+	array := createDenseArray(hd.dims()*nSub, hd.SubCellVectorsBits)
 
 	err := binary.Read(f, binary.LittleEndian, &fortran[0])
 	if err != nil { return nil, err }
@@ -690,7 +1853,7 @@ func readBitsBlock(
 
 	fortran := [2]int32{ }
 	nSub := hd.SubCells*hd.SubCells*hd.SubCells
-	array := createDenseArray(3*nSub, hd.BitsBits)
+	array := createDenseArray(hd.dims()*nSub, hd.BitsBits)
 
 	err := binary.Read(f, binary.LittleEndian, &fortran[0])
 	if err != nil { return nil, err }
@@ -742,10 +1905,11 @@ func readArraysBlock(
 	if err != nil { return nil, err }
 
 	nCells := int(hd.SubCells*hd.SubCells*hd.SubCells)
-	arrays := make([]*container.DenseArray, 3*nCells)
+	dims := int(hd.dims())
+	arrays := make([]*container.DenseArray, dims*nCells)
 	nSubCellSide := uint64(hd.Hd.NSide) / (hd.Cells*hd.SubCells)
 	nSubCellSide3 := nSubCellSide*nSubCellSide*nSubCellSide
-	for i := 0; i < 3*nCells; i++ {
+	for i := 0; i < dims*nCells; i++ {
 		arrays[i] = createDenseArray(nSubCellSide3, bits[i])
 		_, err = io.ReadFull(f, arrays[i].Data)
 		if err != nil { return nil, err }
@@ -789,11 +1953,22 @@ func fortranCheck(offsets [5]uint64) {
 // fortranHeaderCheck panics if the fortran header/footers are different
 // sizes than the block that they enclose.
 func fortranHeaderCheck(fortranHeaders [2]int32, n int, blockName string) {
+	if err := fortranRecordCheck(fortranHeaders, n, blockName); err != nil {
+		panic("Internal I/O error: " + err.Error())
+	}
+}
+
+// fortranRecordCheck returns an error if the fortran header/footers are
+// different sizes than the block that they enclose.
+func fortranRecordCheck(
+	fortranHeaders [2]int32, n int, blockName string,
+) error {
 	if fortranHeaders[0] != int32(n) || fortranHeaders[1] != int32(n) {
-		panic(fmt.Sprintf("Internal I/O error: %s block has size %d, " + 
+		return fmt.Errorf("%s block has size %d, " + 
 			"but the fortran header and footer are (%d, %d)",
-			blockName, n, fortranHeaders[0], fortranHeaders[1]))
+			blockName, n, fortranHeaders[0], fortranHeaders[1])
 	}
+	return nil
 }
 
 // offsetCheck panics if a block does not start/end at the given offset from
@@ -824,6 +1999,7 @@ func fnameList(hd *lvecHeader, dir, fnameFormat string) []string {
 		switch hd.VarType {
 		case lvecX: typeName = "X"
 		case lvecV: typeName = "V"
+		case lvecMp, lvecLogMp: typeName = "Mp"
 		default:
 			panic("Unrecognized lvecVarType")
 		}
@@ -0,0 +1,336 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path"
+
+	"github.com/phil-mansfield/nbody-utils/thread"
+)
+
+// lvecSpillRecord is a single particle in a spill file.
+type lvecSpillRecord struct {
+	ID int64
+	X, V [3]float32
+	Mp float32
+}
+
+const (
+	lvecSpillRecordBytes = 36
+	// lvecDefaultSpillBuffer is the number of particles buffered for each
+	// spill file if no memory budget is given.
+	lvecDefaultSpillBuffer = 1 << 12
+	// lvecMinSpillBuffer is the smallest number of particles buffered for
+	// each spill file.
+	lvecMinSpillBuffer = 64
+)
+
+// lvecSpill sorts the particles in a snapshot into a spill file for each LVec
+// file and tracks the velocity and mass limits of the snapshot.
+type lvecSpill struct {
+	Grid
+	dir string
+	fnames []string
+	bufs [][]lvecSpillRecord
+	bufSize int
+
+	masses, logMp bool
+	vLimits, mpLimits [2]float64
+}
+
+// newLVecSpill creates a new lvecSpill for the LVec files described by hd.
+// The spill files are written to a new temporary directory inside
+// ctx.SpillDir, so conversions which share a SpillDir don't overwrite each
+// other's spill files. Close must be called to remove the directory.
+func newLVecSpill(
+	hd *lvecHeader, masses bool, ctx LVecContext, dir string,
+) (*lvecSpill, error) {
+	nCells := int(hd.Cells*hd.Cells*hd.Cells)
+	sp := &lvecSpill{
+		Grid: Grid{
+			NCell: int64(hd.Cells), NSide: hd.Hd.NSide / int64(hd.Cells),
+		},
+		fnames: make([]string, nCells),
+		bufs: make([][]lvecSpillRecord, nCells),
+		bufSize: lvecDefaultSpillBuffer,
+		masses: masses, logMp: ctx.LogMp,
+		vLimits: [2]float64{ math.Inf(+1), math.Inf(-1) },
+		mpLimits: [2]float64{ math.Inf(+1), math.Inf(-1) },
+	}
+
+	if ctx.MemoryBudget > 0 {
+		sp.bufSize = int(ctx.MemoryBudget /
+			int64(lvecSpillRecordBytes*nCells))
+		if sp.bufSize < lvecMinSpillBuffer { sp.bufSize = lvecMinSpillBuffer }
+	}
+
+	spillDir := ctx.SpillDir
+	if spillDir == "" { spillDir = dir }
+	var err error
+	sp.dir, err = os.MkdirTemp(spillDir, "lvec_spill")
+	if err != nil { return nil, err }
+	for c := range sp.fnames {
+		sp.fnames[c] = path.Join(sp.dir, fmt.Sprintf("lvec_spill.%d", c))
+	}
+
+	return sp, nil
+}
+
+// Add sorts the particles in file i of snap into spill files.
+func (sp *lvecSpill) Add(snap Snapshot, i int) error {
+	x, err := snap.ReadX(i)
+	if err != nil { return err }
+	x = append([][3]float32{ }, x...)
+	v, err := snap.ReadV(i)
+	if err != nil { return err }
+	v = append([][3]float32{ }, v...)
+	var mp []float32
+	if sp.masses {
+		mp, err = snap.ReadMp(i)
+		if err != nil { return err }
+		mp = append([]float32{ }, mp...)
+	}
+	id, err := snap.ReadID(i)
+	if err != nil { return err }
+
+	for j := range id {
+		rec := lvecSpillRecord{ ID: id[j], X: x[j], V: v[j] }
+		for k := 0; k < 3; k++ {
+			sp.vLimits = extendLimits(sp.vLimits, v[j][k])
+		}
+
+		if sp.masses {
+			rec.Mp = mp[j]
+			if sp.logMp {
+				if rec.Mp <= 0 {
+					return fmt.Errorf("A particle has mass %g, so masses " +
+						"can't be stored logarithmically.", rec.Mp)
+				}
+				rec.Mp = float32(math.Log10(float64(rec.Mp)))
+			}
+			sp.mpLimits = extendLimits(sp.mpLimits, rec.Mp)
+		}
+
+		c, _ := sp.Index(id[j] - 1)
+		if sp.bufs[c] == nil {
+			sp.bufs[c] = make([]lvecSpillRecord, 0, sp.bufSize)
+		}
+		sp.bufs[c] = append(sp.bufs[c], rec)
+		if len(sp.bufs[c]) == sp.bufSize {
+			if err := sp.flush(int(c)); err != nil { return err }
+		}
+	}
+
+	return nil
+}
+
+func extendLimits(limits [2]float64, x float32) [2]float64 {
+	if float64(x) < limits[0] { limits[0] = float64(x) }
+	if float64(x) > limits[1] { limits[1] = float64(x) }
+	return limits
+}
+
+// flush appends the buffered particles of cell c to its spill file.
+func (sp *lvecSpill) flush(c int) error {
+	if len(sp.bufs[c]) == 0 { return nil }
+
+	f, err := os.OpenFile(sp.fnames[c],
+		os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil { return err }
+	err = binary.Write(f, binary.LittleEndian, sp.bufs[c])
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	sp.bufs[c] = sp.bufs[c][:0]
+	return f.Close()
+}
+
+// Flush flushes every buffer and frees them.
+func (sp *lvecSpill) Flush() error {
+	for c := range sp.bufs {
+		if err := sp.flush(c); err != nil { return err }
+		sp.bufs[c] = nil
+	}
+	return nil
+}
+
+// Read reads the particles in the spill file of cell c.
+func (sp *lvecSpill) Read(c int) ([]lvecSpillRecord, error) {
+	info, err := os.Stat(sp.fnames[c])
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(sp.fnames[c])
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	if info.Size() % lvecSpillRecordBytes != 0 {
+		return nil, fmt.Errorf("Corruption detected in the file %s.",
+			sp.fnames[c])
+	}
+
+	recs := make([]lvecSpillRecord, info.Size() / lvecSpillRecordBytes)
+	err = binary.Read(f, binary.LittleEndian, recs)
+	if err != nil { return nil, err }
+	return recs, nil
+}
+
+// Close removes the spill directory and every spill file in it.
+func (sp *lvecSpill) Close() error {
+	return os.RemoveAll(sp.dir)
+}
+
+// lvecSpillVar is a single variable which is written from spill files.
+type lvecSpillVar struct {
+	hd lvecHeader
+	fnames []string
+	value func(rec *lvecSpillRecord) [3]float32
+}
+
+// convertToLVecOutOfCore is the implementation of ConvertToLVec used when
+// ctx.OutOfCore is set. The first pass over the snapshot sorts particles into
+// spill files and the second pass writes every LVec file from its spill file.
+// The output is identical to the output of the in-memory conversion.
+func convertToLVecOutOfCore(
+	snap Snapshot,
+	hd *lvecHeader,
+	rawHd []byte,
+	dx, dv float64,
+	ctx LVecContext,
+	dir, fnameFormat string,
+) error {
+	masses := !snap.UniformMass()
+	mpType := uint64(lvecMp)
+	if ctx.LogMp { mpType = lvecLogMp }
+
+	noLimits := [2]float64{ }
+	xLimits := [2]float64{ 0, snap.Header().L }
+	if lvecVarComplete(hd, lvecX, xLimits, dx, ctx, dir, fnameFormat) &&
+		lvecVarComplete(hd, lvecV, noLimits, dv, ctx, dir, fnameFormat) &&
+		(!masses || lvecVarComplete(hd, mpType, noLimits, ctx.DMp,
+			ctx, dir, fnameFormat)) {
+		return nil
+	}
+
+	sp, err := newLVecSpill(hd, masses, ctx, dir)
+	if err != nil { return err }
+	defer sp.Close()
+
+	for i := 0; i < snap.Files(); i++ {
+		if err := sp.Add(snap, i); err != nil { return err }
+	}
+	if err := sp.Flush(); err != nil { return err }
+
+	vars := []*lvecSpillVar{
+		newLVecSpillVar(hd, lvecX, xLimits, dx, dir, fnameFormat,
+			func(rec *lvecSpillRecord) [3]float32 { return rec.X }),
+		newLVecSpillVar(hd, lvecV, sp.vLimits, dv, dir, fnameFormat,
+			func(rec *lvecSpillRecord) [3]float32 { return rec.V }),
+	}
+	if masses {
+		// The quantization grid needs a non-zero width.
+		limits := sp.mpLimits
+		if limits[1] - limits[0] < ctx.DMp { limits[1] = limits[0] + ctx.DMp }
+
+		vars = append(vars, newLVecSpillVar(hd, mpType, limits, ctx.DMp,
+			dir, fnameFormat, func(rec *lvecSpillRecord) [3]float32 {
+				return [3]float32{ rec.Mp, rec.Mp, rec.Mp }
+			}))
+	}
+
+	nCells := int(hd.Cells*hd.Cells*hd.Cells)
+	workers := lvecWorkers(hd, ctx)
+	encoders := make([][]*lvecEncoder, workers)
+	errs := make([]error, nCells)
+
+	thread.WorkerQueue(workers, nCells, func(worker, c int) {
+		if encoders[worker] == nil {
+			encoders[worker] = make([]*lvecEncoder, len(vars))
+		}
+		errs[c] = writeLVecSpillCell(
+			sp, vars, encoders[worker], rawHd, c, ctx,
+		)
+	})
+
+	for _, err := range errs {
+		if err != nil { return err }
+	}
+	return nil
+}
+
+func newLVecSpillVar(
+	hd *lvecHeader, varType uint64, limits [2]float64, delta float64,
+	dir, fnameFormat string, value func(rec *lvecSpillRecord) [3]float32,
+) *lvecSpillVar {
+	v := &lvecSpillVar{ hd: *hd, value: value }
+	v.hd.VarType, v.hd.Limits, v.hd.Delta = varType, limits, delta
+	v.hd.Pix = minPix(limits, delta)
+	v.fnames = fnameList(&v.hd, dir, fnameFormat)
+	return v
+}
+
+// writeLVecSpillCell writes the LVec files of every variable in cell c from
+// its spill file. encoders holds the worker's encoder for each variable.
+func writeLVecSpillCell(
+	sp *lvecSpill, vars []*lvecSpillVar, encoders []*lvecEncoder,
+	rawHd []byte, c int, ctx LVecContext,
+) error {
+	var recs []lvecSpillRecord
+	var grid *VectorGrid
+
+	for j, v := range vars {
+		if ctx.Resume {
+			if _, ok := validLVecFile(v.fnames[c], &v.hd, ctx); ok { continue }
+		}
+
+		if grid == nil {
+			var err error
+			recs, err = sp.Read(c)
+			if err != nil { return err }
+			grid = newLVecCellGrid(&v.hd, uint64(c))
+			if n := sp.NSide*sp.NSide*sp.NSide; int64(len(recs)) != n {
+				return fmt.Errorf("Cell %d of the Lagrangian grid has %d " +
+					"particles, but should have %d.", c, len(recs), n)
+			}
+		}
+
+		for k := range recs {
+			grid.Insert(recs[k].ID - 1, v.value(&recs[k]))
+		}
+
+		if encoders[j] == nil { encoders[j] = newLVecEncoder(&v.hd) }
+		fileHd := v.hd
+		err := encoders[j].encode(&fileHd, rawHd, grid, uint64(c), ctx,
+			v.fnames[c])
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+// newLVecCellGrid returns a VectorGrid with the sub-cells of every LVec file
+// where only the sub-cells of file c are allocated.
+func newLVecCellGrid(hd *lvecHeader, c uint64) *VectorGrid {
+	cells, sCells := hd.Cells, hd.SubCells
+	nSide := hd.Hd.NSide / int64(cells*sCells)
+	nAll := cells*sCells
+
+	grid := &VectorGrid{
+		Grid: Grid{ NCell: int64(nAll), NSide: nSide },
+		Cells: make([][][3]float32, nAll*nAll*nAll),
+	}
+
+	cIdx := [3]uint64{ c % cells, (c / cells) % cells, c / (cells*cells) }
+	grid.SubCellLoop(cells, sCells, cIdx, func(i, _ uint64, _ [3]uint64) {
+		grid.Cells[i] = make([][3]float32, nSide*nSide*nSide)
+	})
+
+	return grid
+}
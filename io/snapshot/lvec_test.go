@@ -5,7 +5,9 @@ import (
 	"io/ioutil"
 	"math"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/phil-mansfield/nbody-utils/container"
 	
@@ -29,7 +31,7 @@ var testHeader = &lvecHeader{
 	Limits: [2]float64{0, 50},
 	Delta: 1.0,
 	Offsets: [5]uint64{8 + uint64(unsafe.Sizeof(lvecHeader{})), 0, 0, 0},
-	Hd: Header{ 1, 2, 3, 4, 5, 6, 7, 8, 9, 10 },
+	Hd: lvecSimHeader{ 1, 2, 3, 4, 5, 6, 7, 8, 9, 10 },
 }
 
 func lvecHeaderEq(hd1, hd2 *lvecHeader) bool {
@@ -53,7 +55,7 @@ func lvecHeaderEq(hd1, hd2 *lvecHeader) bool {
 		hd1.Offsets[2] == hd2.Offsets[2] &&
 		hd1.Offsets[3] == hd2.Offsets[3] &&
 		hd1.Offsets[4] == hd2.Offsets[4] &&
-		headerEq(&hd1.Hd, &hd2.Hd)
+		headerEq(hd1.Hd.header(), hd2.Hd.header())
 }
 
 func headerEq(hd1, hd2 *Header) bool {
@@ -512,3 +514,502 @@ func TestGadgetToLVecToGadget(t *testing.T) {
 func floatEq(x, y, eps float32) bool {
 	return x - eps < y && x + eps > y
 }
+
+func TestLVecBox(t *testing.T) {
+	tests := []struct {
+		cells, subCells uint64
+		lo, hi [3]int64
+	}{
+		{ 1, 2, [3]int64{ 0, 0, 0 }, [3]int64{ 10, 10, 10 } },
+		{ 1, 2, [3]int64{ 2, 3, 4 }, [3]int64{ 4, 5, 9 } },
+		{ 2, 1, [3]int64{ -2, 3, 4 }, [3]int64{ 2, 5, 9 } },
+		{ 2, 1, [3]int64{ 7, 0, 9 }, [3]int64{ 12, 1, 11 } },
+		{ 2, 1, [3]int64{ 3, 3, 3 }, [3]int64{ 3, 5, 5 } },
+	}
+
+	for i, test := range tests {
+		dir, err := ioutil.TempDir(".", "test_lvec_box_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(dir)
+
+		err = ConvertToLVec(newTestMockSnapshot(), test.cells, test.subCells,
+			0.1, 0.01, dir, "test.%s.%d.lvec")
+		if err != nil { t.Fatal(err.Error()) }
+		snap, err := LVec(dir, "test.%s.%d.lvec")
+		if err != nil { t.Fatal(err.Error()) }
+
+		x, id, err := snap.(LagrangianBoxSnapshot).ReadXBox(test.lo, test.hi)
+		if err != nil { t.Fatal(err.Error()) }
+
+		_, _, err = snap.(LagrangianBoxSnapshot).ReadXBox(
+			[3]int64{ 0, 0, 0 }, [3]int64{ 11, 1, 1 })
+		if err == nil {
+			t.Errorf("%d) Expected error for a box wider than NSide.", i)
+		}
+
+		n := 1
+		for k := 0; k < 3; k++ { n *= int(test.hi[k] - test.lo[k]) }
+		if len(x) != n || len(id) != n {
+			t.Errorf("%d) read %d positions and %d IDs, not %d.",
+				i, len(x), len(id), n)
+			continue
+		}
+
+		for j := range id {
+			idx := [3]int64{ id[j] % 10, (id[j] / 10) % 10, id[j] / 100 }
+			for k := 0; k < 3; k++ {
+				inBox := false
+				for l := test.lo[k]; l < test.hi[k]; l++ {
+					inBox = inBox || (l + 10) % 10 == idx[k]
+				}
+				if !inBox {
+					t.Fatalf("%d) ID %d isn't in the box.", i, id[j])
+				}
+			}
+
+			xTarget := [3]float32{
+				float32(idx[0]), float32(idx[1]), float32(idx[2]),
+			}
+			if !vecEq(x[j], xTarget, 0.2) {
+				t.Fatalf("%d) particle with ID %d has x = %g.", i, id[j], x[j])
+			}
+		}
+
+		v, vID, err := snap.(LagrangianBoxSnapshot).ReadVBox(test.lo, test.hi)
+		if err != nil { t.Fatal(err.Error()) }
+		for j := range vID {
+			if len(v) != n || vID[j] != id[j] {
+				t.Fatalf("%d) ReadVBox and ReadXBox disagree on IDs.", i)
+			}
+		}
+	}
+}
+
+func TestLVecMp(t *testing.T) {
+	contexts := []LVecContext{
+		{ DMp: 1e-3, LogMp: true },
+		{ DMp: 1e7, LogMp: false },
+	}
+
+	for i, ctx := range contexts {
+		dir, err := ioutil.TempDir(".", "test_lvec_mp_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(dir)
+
+		snap := newTestMockSnapshot().(*mockSnapshot)
+		for j := range snap.mp[0] {
+			snap.mp[0][j] = 1e10 * float32(1 + snap.id[0][j] % 7)
+		}
+
+		err = ConvertToLVec(snap, 1, 2, 0.1, 0.01, dir, "test.%s.%d.lvec", ctx)
+		if err != nil { t.Fatal(err.Error()) }
+		lvec, err := LVec(dir, "test.%s.%d.lvec")
+		if err != nil { t.Fatal(err.Error()) }
+
+		if lvec.UniformMass() {
+			t.Errorf("%d) UniformMass() = true for non-uniform masses.", i)
+		}
+
+		// LVec IDs start at zero.
+		id, err := lvec.ReadID(0)
+		if err != nil { t.Fatal(err.Error()) }
+		id = append([]int64{ }, id...)
+		mp, err := lvec.ReadMp(0)
+		if err != nil { t.Fatal(err.Error()) }
+
+		for j := range mp {
+			mpTarget := 1e10 * float32(1 + (id[j] + 1) % 7)
+			if !floatEq(mp[j], mpTarget, 0.005*mpTarget) {
+				t.Fatalf("%d) particle %d has mass %g, not %g.",
+					i, j, mp[j], mpTarget)
+			}
+		}
+	}
+}
+
+func TestLVecNoDMp(t *testing.T) {
+	// DMp isn't needed when masses are uniform.
+	contexts := []LVecContext{
+		{ Workers: 2 }, { Dequantize: LVecCellCenter }, { OutOfCore: true },
+	}
+
+	for i, ctx := range contexts {
+		dir, err := ioutil.TempDir(".", "test_lvec_no_dmp_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(dir)
+
+		err = ConvertToLVec(newTestMockSnapshot(), 2, 1, 0.1, 0.01,
+			dir, "test.%s.%d.lvec", ctx)
+		if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		snap, err := LVec(dir, "test.%s.%d.lvec", ctx)
+		if err != nil { t.Fatal(err.Error()) }
+		checkTestLVecPositions(snap, t)
+	}
+
+	dir, err := ioutil.TempDir(".", "test_lvec_no_dmp_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	snap := newTestMockSnapshot().(*mockSnapshot)
+	snap.mp[0][0] *= 2
+	err = ConvertToLVec(snap, 2, 1, 0.1, 0.01, dir, "test.%s.%d.lvec",
+		LVecContext{ })
+	if err == nil {
+		t.Errorf("Expected an error from ConvertToLVec without DMp.")
+	}
+	err = Convert(snap, LVecWriter(dir, "test.%s.%d.lvec", 2, 1, 0.1, 0.01,
+		LVecContext{ }))
+	if err == nil {
+		t.Errorf("Expected an error from LVecWriter without DMp.")
+	}
+}
+
+func TestLVecDequantizeModes(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_lvec_modes_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	err = ConvertToLVec(newTestMockSnapshot(), 1, 2, 0.1, 0.01,
+		dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+
+	modes := []int{ LVecRandom, LVecCellCenter, LVecIDJitter }
+	for _, mode := range modes {
+		snap, err := LVec(dir, "test.%s.%d.lvec",
+			LVecContext{ Dequantize: mode })
+		if err != nil { t.Fatal(err.Error()) }
+
+		x1, err := snap.ReadX(0)
+		if err != nil { t.Fatal(err.Error()) }
+		x1 = append([][3]float32{ }, x1...)
+		x2, err := snap.ReadX(0)
+		if err != nil { t.Fatal(err.Error()) }
+
+		same := true
+		for i := range x1 { same = same && x1[i] == x2[i] }
+		if same != (mode != LVecRandom) {
+			t.Errorf("mode %d) repeated reads give identical results: %v",
+				mode, same)
+		}
+
+		// Box reads and chunked reads need to agree with ReadX. ReadX and
+		// ReadXBox use the same order for a single sub-cell.
+		if mode == LVecRandom { continue }
+
+		xBox, idBox, err := snap.(LagrangianBoxSnapshot).ReadXBox(
+			[3]int64{ 0, 0, 0 }, [3]int64{ 10, 10, 10 })
+		if err != nil { t.Fatal(err.Error()) }
+		for i := range idBox {
+			if xBox[i] != x1[idBox[i]] {
+				t.Fatalf("mode %d) ReadXBox gives x = %g for ID %d, but " +
+					"ReadX gives %g.", mode, xBox[i], idBox[i], x1[idBox[i]])
+			}
+		}
+
+		xIt, err := ReadXChunks(snap, 0, 100)
+		if err != nil { t.Fatal(err.Error()) }
+		xChunks, _, err := readAllVectorChunks(xIt)
+		if err != nil { t.Fatal(err.Error()) }
+		idIt, err := ReadIDChunks(snap, 0, 100)
+		if err != nil { t.Fatal(err.Error()) }
+		idChunks, _, err := readAllIntChunks(idIt)
+		if err != nil { t.Fatal(err.Error()) }
+		for i := range idChunks {
+			if xChunks[i] != x1[idChunks[i]] {
+				t.Fatalf("mode %d) ReadXChunks gives x = %g for ID %d, but " +
+					"ReadX gives %g.", mode, xChunks[i], idChunks[i],
+					x1[idChunks[i]])
+			}
+		}
+	}
+
+	if _, err := LVec(dir, "test.%s.%d.lvec",
+		LVecContext{ Dequantize: 3 }); err == nil {
+		t.Errorf("Expected error for an unrecognized dequantization mode.")
+	}
+}
+
+func TestLVecVersions(t *testing.T) {
+	contexts := []LVecContext{
+		{ DMp: 1e-3, Version: 1 },
+		{ DMp: 1e-3 },
+		{ DMp: 1e-3, Compress: true, Dequantize: LVecIDJitter },
+	}
+
+	for i, ctx := range contexts {
+		dir, err := ioutil.TempDir(".", "test_lvec_version_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(dir)
+
+		err = ConvertToLVec(newTestMockSnapshot(), 1, 2, 0.1, 0.01,
+			dir, "test.%s.%d.lvec", ctx)
+		if err != nil { t.Fatal(err.Error()) }
+
+		hd, err := getLVecHeader(path.Join(dir, "test.X.0.lvec"))
+		if err != nil { t.Fatal(err.Error()) }
+		version := uint64(ctx.Version)
+		if version == 0 { version = LVecVersion }
+		if hd.Version != version {
+			t.Errorf("%d) file has version %d, not %d.",
+				i, hd.Version, version)
+		}
+
+		snap, err := LVec(dir, "test.%s.%d.lvec")
+		if err != nil { t.Fatal(err.Error()) }
+		checkTestQuantizedSnapshot(snap, t)
+
+		if mode := snap.(*lvecSnapshot).context.Dequantize;
+			mode != ctx.Dequantize {
+			t.Errorf("%d) dequantization mode %d was read, not %d.",
+				i, mode, ctx.Dequantize)
+		}
+	}
+}
+
+func TestLVecDeltas(t *testing.T) {
+	n := 1000
+	ramp, noise := make([]uint64, n), make([]uint64, n)
+	for i := range ramp {
+		ramp[i] = uint64(5000 + i/3)
+		noise[i] = uint64((i*7919 + 13) % 32)
+	}
+	arrays := []*container.DenseArray{
+		container.NewDenseArray(16, ramp), createDenseArray(uint64(n), 0),
+		container.NewDenseArray(5, noise),
+	}
+	bits := []uint64{ 16, 0, 5 }
+
+	ext := &lvecExtHeader{ Coding: lvecDeltaFlateCoding }
+	data, err := encodeLVecArrays(ext, arrays)
+	if err != nil { t.Fatal(err.Error()) }
+	if raw := 2*n + 5*n/8; len(data) >= raw {
+		t.Errorf("Coded arrays are %d bytes, but packed arrays are %d.",
+			len(data), raw)
+	}
+
+	hd := &lvecHeader{ Cells: 1, SubCells: 1 }
+	hd.Hd.NSide = 10
+	out, err := decodeLVecArrays(hd, ext, data, bits)
+	if err != nil { t.Fatal(err.Error()) }
+	for i := range arrays {
+		if !bytes.Equal(out[i].Data, arrays[i].Data) ||
+			out[i].Bits != arrays[i].Bits {
+			t.Errorf("%d) Array wasn't decoded correctly.", i)
+		}
+	}
+
+	if _, err = decodeLVecArrays(hd, ext, data, bits[:2]); err == nil {
+		t.Errorf("Expected an error when the array block is too long.")
+	}
+}
+
+func TestLVecChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_lvec_checksum_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	err = ConvertToLVec(newTestMockSnapshot(), 1, 2, 0.1, 0.01,
+		dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+
+	// Flip a bit in the last byte of the array block.
+	fname := path.Join(dir, "test.V.0.lvec")
+	data, err := ioutil.ReadFile(fname)
+	if err != nil { t.Fatal(err.Error()) }
+	data[len(data) - 5] ^= 1
+	if err = ioutil.WriteFile(fname, data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap, err := LVec(dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	if _, err = snap.ReadX(0); err != nil {
+		t.Errorf("ReadX(0) returned error: %s", err.Error())
+	}
+	if _, err = snap.ReadV(0); err == nil {
+		t.Errorf("Expected checksum error from ReadV(0).")
+	}
+}
+
+// checkTestLVecPositions checks the positions of a multi-file LVec snapshot
+// converted from newTestMockSnapshot.
+func checkTestLVecPositions(snap Snapshot, t *testing.T) {
+	x, id, err := snap.(LagrangianBoxSnapshot).ReadXBox(
+		[3]int64{ 0, 0, 0 }, [3]int64{ 10, 10, 10 })
+	if err != nil { t.Fatal(err.Error()) }
+	if len(x) != 1000 { t.Fatalf("%d positions were read, not 1000.", len(x)) }
+
+	for j := range id {
+		xTarget := [3]float32{
+			float32(id[j] % 10), float32((id[j] / 10) % 10),
+			float32(id[j] / 100),
+		}
+		if !vecEq(x[j], xTarget, 0.2) {
+			t.Fatalf("particle with ID %d has x = %g.", id[j], x[j])
+		}
+	}
+}
+
+// readTestLVecFiles returns the contents of every file in dir.
+func readTestLVecFiles(dir string) map[string][]byte {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil { panic(err.Error()) }
+
+	out := map[string][]byte{ }
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(path.Join(dir, info.Name()))
+		if err != nil { panic(err.Error()) }
+		out[info.Name()] = data
+	}
+	return out
+}
+
+func TestLVecParallel(t *testing.T) {
+	contexts := []LVecContext{
+		{ DMp: 1e-3 },
+		{ DMp: 1e-3, Workers: 4 },
+		{ DMp: 1e-3, Workers: 4, MemoryBudget: 1 },
+		{ DMp: 1e-3, Workers: 3, Compress: true },
+	}
+
+	var serial map[string][]byte
+	for i, ctx := range contexts {
+		dir, err := ioutil.TempDir(".", "test_lvec_parallel_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(dir)
+
+		err = ConvertToLVec(newTestMockSnapshot(), 2, 1, 0.1, 0.01,
+			dir, "test.%s.%d.lvec", ctx)
+		if err != nil { t.Fatal(err.Error()) }
+
+		snap, err := LVec(dir, "test.%s.%d.lvec")
+		if err != nil { t.Fatal(err.Error()) }
+		checkTestLVecPositions(snap, t)
+
+		files := readTestLVecFiles(dir)
+		if i == 0 {
+			serial = files
+			continue
+		} else if ctx.Compress {
+			continue
+		}
+
+		if len(files) != len(serial) {
+			t.Errorf("%d) %d files were written, not %d.",
+				i, len(files), len(serial))
+		}
+		for name, data := range serial {
+			if !bytes.Equal(files[name], data) {
+				t.Errorf("%d) %s differs from the serial conversion.", i, name)
+			}
+		}
+	}
+}
+
+func TestLVecResume(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_lvec_resume_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	ctx := LVecContext{ DMp: 1e-3, Workers: 2, Resume: true }
+	err = ConvertToLVec(newTestMockSnapshot(), 2, 1, 0.1, 0.01,
+		dir, "test.%s.%d.lvec", ctx)
+	if err != nil { t.Fatal(err.Error()) }
+	target := readTestLVecFiles(dir)
+
+	// Date every file so that rewritten files can be found.
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name := range target {
+		if err = os.Chtimes(path.Join(dir, name), old, old); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	truncated := path.Join(dir, "test.X.3.lvec")
+	if err = os.Truncate(truncated, 100); err != nil { t.Fatal(err.Error()) }
+	missing := path.Join(dir, "test.V.5.lvec")
+	if err = os.Remove(missing); err != nil { t.Fatal(err.Error()) }
+
+	err = ConvertToLVec(newTestMockSnapshot(), 2, 1, 0.1, 0.01,
+		dir, "test.%s.%d.lvec", ctx)
+	if err != nil { t.Fatal(err.Error()) }
+
+	files := readTestLVecFiles(dir)
+	for name, data := range target {
+		if !bytes.Equal(files[name], data) {
+			t.Errorf("%s wasn't restored by the resumed conversion.", name)
+		}
+
+		info, err := os.Stat(path.Join(dir, name))
+		if err != nil { t.Fatal(err.Error()) }
+		fname := path.Join(dir, name)
+		rewritten := !info.ModTime().Equal(old)
+		if rewritten != (fname == truncated || fname == missing) {
+			t.Errorf("%s: rewritten = %v.", name, rewritten)
+		}
+	}
+
+	snap, err := LVec(dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	checkTestLVecPositions(snap, t)
+}
+
+func TestLVecOutOfCore(t *testing.T) {
+	tests := []struct {
+		cells, subCells uint64
+		masses bool
+		ctx LVecContext
+	}{
+		{ 1, 2, false, LVecContext{ DMp: 1e-3, LogMp: true } },
+		{ 2, 1, false, LVecContext{ DMp: 1e-3, Workers: 3 } },
+		{ 2, 1, true, LVecContext{ DMp: 1e-3, LogMp: true, MemoryBudget: 1 } },
+		{ 2, 1, true, LVecContext{ DMp: 1e7, Workers: 2 } },
+	}
+
+	for i, test := range tests {
+		inDir, err := ioutil.TempDir(".", "test_lvec_in_core_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(inDir)
+		outDir, err := ioutil.TempDir(".", "test_lvec_out_of_core_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(outDir)
+		spillDir, err := ioutil.TempDir(".", "test_lvec_spill_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(spillDir)
+
+		snap := newTestMockSnapshot().(*mockSnapshot)
+		if test.masses {
+			for j := range snap.mp[0] {
+				snap.mp[0][j] = 1e10 * float32(1 + snap.id[0][j] % 7)
+			}
+		}
+
+		err = ConvertToLVec(snap, test.cells, test.subCells, 0.1, 0.01,
+			inDir, "test.%s.%d.lvec", test.ctx)
+		if err != nil { t.Fatal(err.Error()) }
+
+		ctx := test.ctx
+		ctx.OutOfCore, ctx.SpillDir = true, spillDir
+		err = ConvertToLVec(snap, test.cells, test.subCells, 0.1, 0.01,
+			outDir, "test.%s.%d.lvec", ctx)
+		if err != nil { t.Fatal(err.Error()) }
+
+		inFiles, outFiles := readTestLVecFiles(inDir), readTestLVecFiles(outDir)
+		if len(outFiles) != len(inFiles) {
+			t.Errorf("%d) %d files were written, not %d.",
+				i, len(outFiles), len(inFiles))
+		}
+		for name, data := range inFiles {
+			if !bytes.Equal(outFiles[name], data) {
+				t.Errorf("%d) %s differs from the in-memory conversion.",
+					i, name)
+			}
+		}
+
+		spill, err := ioutil.ReadDir(spillDir)
+		if err != nil { t.Fatal(err.Error()) }
+		if len(spill) != 0 {
+			t.Errorf("%d) %d spill files weren't removed.", i, len(spill))
+		}
+	}
+}
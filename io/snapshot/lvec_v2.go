@@ -0,0 +1,256 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/phil-mansfield/nbody-utils/container"
+)
+
+// Entropy coding flags used by version 2 LVec files. lvecDeltaFlateCoding
+// replaces each quantized value with its difference from the previous value
+// in the same array. Neighbouring particles in Lagrangian order have similar
+// displacements, so the differences are small. They're zig-zag encoded and
+// stored as varints, and the result is compressed with DEFLATE.
+const (
+	lvecNoCoding = iota
+	lvecDeltaFlateCoding
+)
+
+// lvecExtHeader contains the header fields added in version 2 of the LVec
+// format. It's stored in its own block directly after the header block, so
+// the header block has the same layout in every version.
+type lvecExtHeader struct {
+	Coding     uint64 // Flag showing the entropy coding used in the array
+	                  // block.
+	Dequantize uint64 // The dequantization mode recommended by the writer.
+	ArrayBytes uint64 // Size of the array block's data before DEFLATE.
+
+	Checksums [5]uint32 // CRC32C checksums of the header, raw header,
+	                    // sub-cell vector, bits, and array blocks,
+	                    // respectively.
+	Padding uint32
+}
+
+var lvecCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// lvecChecksum returns the CRC32C checksum of data.
+func lvecChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, lvecCRCTable)
+}
+
+// headerBytes returns the data in the header block.
+func headerBytes(hd *lvecHeader) []byte {
+	buf := &bytes.Buffer{ }
+	binary.Write(buf, binary.LittleEndian, hd)
+	return buf.Bytes()
+}
+
+// checksumCheck returns an error if data doesn't have the checksum of the
+// given block.
+func checksumCheck(
+	ext *lvecExtHeader, block int, data []byte, blockName, fname string,
+) error {
+	if lvecChecksum(data) != ext.Checksums[block] {
+		return fmt.Errorf("The %s block of the file %s doesn't match its " +
+			"checksum.", blockName, fname)
+	}
+	return nil
+}
+
+// encodeLVecArrays returns the data in the array block of a version 2 file
+// after it's been entropy coded as specified by ext. ext.ArrayBytes is set.
+func encodeLVecArrays(
+	ext *lvecExtHeader, arrays []*container.DenseArray,
+) ([]byte, error) {
+	buf := &bytes.Buffer{ }
+	switch ext.Coding {
+	case lvecNoCoding:
+		for _, a := range arrays { buf.Write(a.Data) }
+		ext.ArrayBytes = uint64(buf.Len())
+		return buf.Bytes(), nil
+	case lvecDeltaFlateCoding:
+		writeLVecDeltas(buf, arrays)
+		ext.ArrayBytes = uint64(buf.Len())
+
+		out := &bytes.Buffer{ }
+		w, err := flate.NewWriter(out, flate.BestCompression)
+		if err != nil { return nil, err }
+		if _, err = w.Write(buf.Bytes()); err != nil { return nil, err }
+		if err = w.Close(); err != nil { return nil, err }
+		return out.Bytes(), nil
+	}
+	return nil, fmt.Errorf("Unrecognized LVec coding flag, %d.", ext.Coding)
+}
+
+// decodeLVecArrays reverses encodeLVecArrays. bits gives the number of bits
+// used by each array.
+func decodeLVecArrays(
+	hd *lvecHeader, ext *lvecExtHeader, data []byte, bits []uint64,
+) ([]*container.DenseArray, error) {
+	nSubCellSide := uint64(hd.Hd.NSide) / (hd.Cells*hd.SubCells)
+	nSubCellSide3 := nSubCellSide*nSubCellSide*nSubCellSide
+
+	switch ext.Coding {
+	case lvecNoCoding:
+	case lvecDeltaFlateCoding:
+		raw := make([]byte, ext.ArrayBytes)
+		rd := flate.NewReader(bytes.NewReader(data))
+		defer rd.Close()
+		if _, err := io.ReadFull(rd, raw); err != nil { return nil, err }
+		return readLVecDeltas(raw, nSubCellSide3, bits)
+	default:
+		return nil, fmt.Errorf("Unrecognized LVec coding flag, %d.",
+			ext.Coding)
+	}
+
+	arrays := make([]*container.DenseArray, len(bits))
+	for i := range arrays {
+		arrays[i] = createDenseArray(nSubCellSide3, bits[i])
+		if len(data) < len(arrays[i].Data) {
+			return nil, fmt.Errorf("The array block is too short.")
+		}
+		n := copy(arrays[i].Data, data)
+		data = data[n:]
+	}
+
+	return arrays, nil
+}
+
+// writeLVecDeltas writes the zig-zag encoded differences between consecutive
+// values in each array to buf as varints.
+func writeLVecDeltas(buf *bytes.Buffer, arrays []*container.DenseArray) {
+	var vals []uint64
+	varint := make([]byte, binary.MaxVarintLen64)
+	for _, a := range arrays {
+		if cap(vals) < a.Length { vals = make([]uint64, a.Length) }
+		vals = vals[:a.Length]
+		if a.Bits == 0 {
+			for j := range vals { vals[j] = 0 }
+		} else {
+			a.Slice(vals)
+		}
+
+		prev := uint64(0)
+		for _, x := range vals {
+			n := binary.PutVarint(varint, int64(x - prev))
+			buf.Write(varint[:n])
+			prev = x
+		}
+	}
+}
+
+// readLVecDeltas reverses writeLVecDeltas for arrays with n elements. bits
+// gives the number of bits used by each array.
+func readLVecDeltas(
+	data []byte, n uint64, bits []uint64,
+) ([]*container.DenseArray, error) {
+	vals := make([]uint64, n)
+	arrays := make([]*container.DenseArray, len(bits))
+	for i := range arrays {
+		prev := uint64(0)
+		for j := range vals {
+			delta, k := binary.Varint(data)
+			if k <= 0 {
+				return nil, fmt.Errorf("The array block is corrupted.")
+			}
+			data = data[k:]
+			prev += uint64(delta)
+			vals[j] = prev
+		}
+
+		if bits[i] == 0 {
+			arrays[i] = createDenseArray(n, 0)
+		} else {
+			arrays[i] = container.NewDenseArray(int(bits[i]), vals)
+		}
+	}
+
+	if len(data) != 0 {
+		return nil, fmt.Errorf("The array block is corrupted.")
+	}
+	return arrays, nil
+}
+
+// writeExtHeaderBlock writes the extended header block of a version 2 file.
+func writeExtHeaderBlock(f *os.File, hd *lvecHeader, ext *lvecExtHeader) error {
+	offsetCheck(f, uint64(unsafe.Sizeof(*hd)) + 8, "extended header", "start")
+
+	err := binary.Write(f, binary.LittleEndian, int32(unsafe.Sizeof(*ext)))
+	if err != nil { return err }
+	err = binary.Write(f, binary.LittleEndian, ext)
+	if err != nil { return err }
+	err = binary.Write(f, binary.LittleEndian, int32(unsafe.Sizeof(*ext)))
+	if err != nil { return err }
+
+	offsetCheck(f, hd.Offsets[0], "extended header", "end")
+
+	return nil
+}
+
+// readExtHeaderBlock reads the extended header block of a version 2 file.
+func readExtHeaderBlock(f *os.File, hd *lvecHeader) (*lvecExtHeader, error) {
+	offsetCheck(f, uint64(unsafe.Sizeof(*hd)) + 8, "extended header", "start")
+
+	fortran := [2]int32{ }
+	ext := &lvecExtHeader{ }
+
+	err := binary.Read(f, binary.LittleEndian, &fortran[0])
+	if err != nil { return nil, err }
+	err = binary.Read(f, binary.LittleEndian, ext)
+	if err != nil { return nil, err }
+	err = binary.Read(f, binary.LittleEndian, &fortran[1])
+	if err != nil { return nil, err }
+
+	err = fortranRecordCheck(fortran, int(unsafe.Sizeof(*ext)),
+		"extended header")
+	if err != nil { return nil, err }
+	offsetCheck(f, hd.Offsets[0], "extended header", "end")
+
+	return ext, nil
+}
+
+// writeCodedArraysBlock writes the array block of a version 2 file, which
+// contains data returned by encodeLVecArrays.
+func writeCodedArraysBlock(f *os.File, hd *lvecHeader, data []byte) error {
+	offsetCheck(f, hd.Offsets[3], "array", "start")
+
+	err := binary.Write(f, binary.LittleEndian, int32(len(data)))
+	if err != nil { return err }
+	_, err = f.Write(data)
+	if err != nil { return err }
+	err = binary.Write(f, binary.LittleEndian, int32(len(data)))
+	if err != nil { return err }
+
+	offsetCheck(f, hd.Offsets[4], "array", "end")
+
+	return nil
+}
+
+// readCodedArraysBlock reads the array block of a version 2 file and returns
+// its undecoded data.
+func readCodedArraysBlock(f *os.File, hd *lvecHeader) ([]byte, error) {
+	offsetCheck(f, hd.Offsets[3], "array", "start")
+
+	fortran := [2]int32{ }
+	data := make([]byte, hd.Offsets[4] - hd.Offsets[3] - 8)
+
+	err := binary.Read(f, binary.LittleEndian, &fortran[0])
+	if err != nil { return nil, err }
+	_, err = io.ReadFull(f, data)
+	if err != nil { return nil, err }
+	err = binary.Read(f, binary.LittleEndian, &fortran[1])
+	if err != nil { return nil, err }
+
+	err = fortranRecordCheck(fortran, len(data), "array")
+	if err != nil { return nil, err }
+	offsetCheck(f, hd.Offsets[4], "array", "end")
+
+	return data, nil
+}
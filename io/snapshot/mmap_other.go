@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package snapshot
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func mmapFile(fname string) ([]byte, error) {
+	return nil, fmt.Errorf("Memory-mapped reads are not supported on %s.",
+		runtime.GOOS)
+}
+
+func munmapFile(data []byte) error { return nil }
@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package snapshot
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the file fname into memory. The mapping is private, so
+// writing to it changes the returned slice without changing the file. The
+// slice must be released with munmapFile.
+func mmapFile(fname string) ([]byte, error) {
+	f, err := os.Open(fname)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil { return nil, err }
+	if info.Size() == 0 { return []byte{ }, nil }
+
+	return syscall.Mmap(int(f.Fd()), 0, int(info.Size()),
+		syscall.PROT_READ | syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+}
+
+// munmapFile releases a slice returned by mmapFile.
+func munmapFile(data []byte) error {
+	if len(data) == 0 { return nil }
+	return syscall.Munmap(data)
+}
@@ -8,9 +8,13 @@ type mockSnapshot struct {
 }
 
 func NewMockSnapshot(hd *Header, x, v [][][3]float32, id [][]int64) Snapshot {
+	hdCopy := *hd
+	hd = &hdCopy
+	if hd.NPart == [MaxSpecies]int64{ } { hd.NPart[DarkMatter] = hd.NTotal }
+
 	mp := make([][]float32, len(x))
 	for i := range mp {
-		mp[i] = make([]float32, len(x[0]))
+		mp[i] = make([]float32, len(x[i]))
 		for j := range mp[i] { mp[i][j] = float32(hd.UniformMp) }
 	}
 
@@ -34,6 +38,16 @@ func (snap *mockSnapshot) UpdateHeader(hd *Header) {
 	snap.hd = hd
 }
 func (snap *mockSnapshot) UniformMass() bool {
+	first, found := float32(0), false
+	for i := range snap.mp {
+		for j := range snap.mp[i] {
+			if !found {
+				first, found = snap.mp[i][j], true
+			} else if snap.mp[i][j] != first {
+				return false
+			}
+		}
+	}
 	return true
 }
 func (snap *mockSnapshot) ReadX(i int) ([][3]float32, error) {
@@ -48,3 +62,19 @@ func (snap *mockSnapshot) ReadID(i int) ([]int64, error) {
 func (snap *mockSnapshot) ReadMp(i int) ([]float32, error) {
 	return snap.mp[i], nil
 }
+
+func (snap *mockSnapshot) ReadXSpecies(i, species int) ([][3]float32, error) {
+	return readXDarkMatter(snap, i, species)
+}
+
+func (snap *mockSnapshot) ReadVSpecies(i, species int) ([][3]float32, error) {
+	return readVDarkMatter(snap, i, species)
+}
+
+func (snap *mockSnapshot) ReadIDSpecies(i, species int) ([]int64, error) {
+	return readIDDarkMatter(snap, i, species)
+}
+
+func (snap *mockSnapshot) ReadMpSpecies(i, species int) ([]float32, error) {
+	return readMpDarkMatter(snap, i, species)
+}
@@ -0,0 +1,166 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// Provenance describes how a snapshot was made. It's stored by snapshots
+// written by ConvertToLVec and by Convert when a Provenance is supplied.
+type Provenance struct {
+	Source string // Path to the snapshot which was converted.
+	// Tool is the name and version of the tool which did the conversion. If
+	// it's empty, it's filled in from the running program's build
+	// information.
+	Tool string
+	Time time.Time // When the conversion finished.
+	// Parameters are the numeric conversion parameters, e.g. "dx", "dv",
+	// and "cells".
+	Parameters map[string]float64
+}
+
+// ProvenanceSnapshot is a Snapshot which can store provenance metadata. The
+// Snapshots returned by LGadget2 and LVec implement it.
+type ProvenanceSnapshot interface {
+	Snapshot
+
+	// Provenance returns the snapshot's provenance metadata, or nil if it
+	// doesn't have any.
+	Provenance() (*Provenance, error)
+}
+
+// HeaderRewriter is a Snapshot whose header can be changed on disk. The
+// Snapshots returned by LGadget2 and LVec implement it.
+type HeaderRewriter interface {
+	Snapshot
+
+	// RewriteHeader writes hd to the header of every file and updates the
+	// snapshot's header. Particle counts can't be changed, and fields which
+	// the format doesn't store are ignored. Particle data isn't changed, so
+	// changing L doesn't rescale positions.
+	RewriteHeader(hd *Header) error
+}
+
+// ReadProvenance returns the provenance metadata of a snapshot, or nil if it
+// doesn't have any.
+func ReadProvenance(snap Snapshot) (*Provenance, error) {
+	ps, ok := snap.(ProvenanceSnapshot)
+	if !ok {
+		return nil, fmt.Errorf("The snapshot's format doesn't store " +
+			"provenance metadata.")
+	}
+	return ps.Provenance()
+}
+
+// RewriteHeader writes hd to the header of every file in a snapshot. See
+// HeaderRewriter for details.
+func RewriteHeader(snap Snapshot, hd *Header) error {
+	hr, ok := snap.(HeaderRewriter)
+	if !ok {
+		return fmt.Errorf("The snapshot's format doesn't support " +
+			"rewriting headers.")
+	}
+	return hr.RewriteHeader(hd)
+}
+
+// provenanceWriter is implemented by Writers which can store provenance
+// metadata once they've been closed.
+type provenanceWriter interface {
+	writeProvenance(p *Provenance) error
+}
+
+// provenanceMagic starts the Fortran record which holds provenance metadata.
+const provenanceMagic = "NBUPROV1"
+
+// newProvenance returns a copy of p with additional parameters. The time is
+// set to now if it's zero and the tool is set by defaultTool if it's empty.
+func newProvenance(p *Provenance, params map[string]float64) *Provenance {
+	out := *p
+	out.Parameters = map[string]float64{ }
+	for key, val := range p.Parameters { out.Parameters[key] = val }
+	for key, val := range params { out.Parameters[key] = val }
+	if out.Time.IsZero() { out.Time = time.Now().UTC() }
+	if out.Tool == "" { out.Tool = defaultTool() }
+	return &out
+}
+
+// defaultTool returns the path and version of the running program, e.g.
+// "github.com/user/convert v1.2.0 (go1.22.1)". The VCS revision is used as
+// the version if the program was built from a checkout.
+func defaultTool() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok { return "unknown" }
+
+	path, version := info.Path, info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" { version = setting.Value }
+	}
+	if path == "" { path = "unknown" }
+	if version == "" { version = "(devel)" }
+
+	return fmt.Sprintf("%s %s (%s)", path, version, info.GoVersion)
+}
+
+// writeProvenanceRecord writes p to the Fortran record which starts at byte
+// end of a file, after the file's normal blocks. Anything already after end
+// is replaced.
+func writeProvenanceRecord(
+	fname string, end int64, order binary.ByteOrder, p *Provenance,
+) error {
+	data, err := json.Marshal(p)
+	if err != nil { return err }
+	data = append([]byte(provenanceMagic), data...)
+
+	f, err := os.OpenFile(fname, os.O_RDWR, 0644)
+	if err != nil { return err }
+
+	if err = f.Truncate(end); err != nil {
+		f.Close()
+		return err
+	}
+	if err = writeRecordAt(f, end, order, data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// readProvenanceRecord reads provenance metadata from the Fortran record
+// which starts at byte end of a file. nil is returned if there isn't one.
+func readProvenanceRecord(
+	fname string, end int64, order binary.ByteOrder,
+) (*Provenance, error) {
+	f, err := os.Open(fname)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil { return nil, err }
+	if info.Size() <= end { return nil, nil }
+
+	if _, err = f.Seek(end, 0); err != nil { return nil, err }
+	var head, foot int32
+	if err = binary.Read(f, order, &head); err != nil { return nil, err }
+	if head < int32(len(provenanceMagic)) ||
+		int64(head) + 8 + end != info.Size() {
+		return nil, fmt.Errorf("Corruption detected in the file %s.", fname)
+	}
+
+	data := make([]byte, head)
+	if _, err = io.ReadFull(f, data); err != nil { return nil, err }
+	if err = binary.Read(f, order, &foot); err != nil { return nil, err }
+	if foot != head || string(data[:len(provenanceMagic)]) != provenanceMagic {
+		return nil, fmt.Errorf("Corruption detected in the file %s.", fname)
+	}
+
+	p := &Provenance{ }
+	err = json.Unmarshal(data[len(provenanceMagic):], p)
+	if err != nil { return nil, err }
+	return p, nil
+}
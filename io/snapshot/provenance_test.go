@@ -0,0 +1,135 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLGadget2Provenance(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_lgadget2_provenance_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	p := &Provenance{
+		Source: "mock", Tool: "test 1.0",
+		Parameters: map[string]float64{ "files": 7, "extra": 3 },
+	}
+	err = Convert(newTestMockSnapshot(), LGadget2Writer(dir, "test.%03d"),
+		ConvertContext{ Files: 2, Provenance: p })
+	if err != nil { t.Fatal(err.Error()) }
+
+	snap, err := LGadget2(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	out, err := ReadProvenance(snap)
+	if err != nil { t.Fatal(err.Error()) }
+	if out == nil || out.Source != "mock" || out.Tool != "test 1.0" ||
+		out.Time.IsZero() || out.Parameters["files"] != 2 ||
+		out.Parameters["subsample"] != 1 || out.Parameters["extra"] != 3 {
+		t.Errorf("Provenance = %v", out)
+	}
+	if p.Parameters["files"] != 7 || !p.Time.IsZero() {
+		t.Errorf("Convert modified its Provenance.")
+	}
+
+	if r, err := Verify(snap); err != nil || !r.OK() {
+		t.Errorf("Provenance broke the snapshot: %v %s", err, r)
+	}
+
+	hd := *snap.Header()
+	hd.Z, hd.Scale, hd.H100 = 3, 0.25, 0.5
+	if err = RewriteHeader(snap, &hd); err != nil { t.Fatal(err.Error()) }
+
+	snap, err = LGadget2(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	if out := snap.Header(); out.Z != 3 || out.Scale != 0.25 ||
+		out.H100 != 0.5 || out.NTotal != 1000 {
+		t.Errorf("Header after RewriteHeader = %v", out)
+	}
+	if out, err := ReadProvenance(snap); err != nil || out == nil {
+		t.Errorf("Provenance was lost after RewriteHeader: %v", err)
+	}
+	checkTestLGadget2Positions(snap, t)
+
+	hd.NTotal++
+	if err = RewriteHeader(snap, &hd); err == nil {
+		t.Errorf("Expected error when changing NTotal.")
+	}
+
+	if _, err = ReadProvenance(newTestMockSnapshot()); err == nil {
+		t.Errorf("Expected error from ReadProvenance on a mock snapshot.")
+	}
+}
+
+// checkTestLGadget2Positions checks that the positions of a snapshot
+// converted from newTestMockSnapshot haven't changed.
+func checkTestLGadget2Positions(snap Snapshot, t *testing.T) {
+	for i := 0; i < snap.Files(); i++ {
+		x, err := snap.ReadX(i)
+		if err != nil { t.Fatal(err.Error()) }
+		id, err := snap.ReadID(i)
+		if err != nil { t.Fatal(err.Error()) }
+
+		for j := range id {
+			idx := id[j] - 1
+			xTarget := [3]float32{
+				float32(idx % 10), float32((idx / 10) % 10),
+				float32(idx / 100),
+			}
+			if !vecEq(x[j], xTarget, 1e-5) {
+				t.Fatalf("particle with ID %d has x = %g.", id[j], x[j])
+			}
+		}
+	}
+}
+
+func TestLVecProvenance(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	contexts := []LVecContext{
+		{ DMp: 1e-3, Version: 1 },
+		{ DMp: 1e-3, Resume: true },
+		{ DMp: 1e-3, OutOfCore: true },
+	}
+
+	for i, ctx := range contexts {
+		dir, err := ioutil.TempDir(".", "test_lvec_provenance_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(dir)
+
+		ctx.Provenance = &Provenance{ Source: "mock", Time: now }
+		for j := 0; j < 2; j++ {
+			err = ConvertToLVec(newTestMockSnapshot(), 2, 1, 0.1, 0.01,
+				dir, "test.%s.%d.lvec", ctx)
+			if err != nil { t.Fatal(err.Error()) }
+		}
+
+		snap, err := LVec(dir, "test.%s.%d.lvec")
+		if err != nil { t.Fatal(err.Error()) }
+		p, err := ReadProvenance(snap)
+		if err != nil { t.Fatal(err.Error()) }
+		if p == nil || p.Source != "mock" || !p.Time.Equal(now) ||
+			p.Parameters["dx"] != 0.1 || p.Parameters["dv"] != 0.01 ||
+			p.Parameters["cells"] != 2 || p.Parameters["subCells"] != 1 {
+			t.Errorf("%d) Provenance = %v", i, p)
+		}
+		if p.Tool == "" {
+			t.Errorf("%d) Tool wasn't filled in automatically.", i)
+		}
+
+		hd := *snap.Header()
+		hd.Z, hd.Scale, hd.Epsilon = 3, 0.25, 0.5
+		if err = RewriteHeader(snap, &hd); err != nil { t.Fatal(err.Error()) }
+
+		snap, err = LVec(dir, "test.%s.%d.lvec")
+		if err != nil { t.Fatal(err.Error()) }
+		if out := snap.Header(); out.Z != 3 || out.Scale != 0.25 ||
+			out.Epsilon != 0.5 || out.NTotal != 1000 {
+			t.Errorf("%d) Header after RewriteHeader = %v", i, out)
+		}
+		checkTestLVecPositions(snap, t)
+		if p, err := ReadProvenance(snap); err != nil || p == nil {
+			t.Errorf("%d) Provenance was lost after RewriteHeader: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/phil-mansfield/nbody-utils/cosmo"
+)
+
+// ramsesPartHeader is the set of header records at the start of every
+// part_XXXXX.outYYYYY file.
+type ramsesPartHeader struct {
+	NCPU, NDim, NPart int32
+	LocalSeed [4]int32
+	NStarTot int32
+	MStarTot, MStarLost float64
+	NSink int32
+}
+
+// ramsesInfo contains the fields of info_XXXXX.txt which are needed to
+// convert from code units.
+type ramsesInfo struct {
+	NCPU, NDim int
+	BoxLen, AExp, H0, OmegaM, OmegaL float64
+	UnitL, UnitD, UnitT float64
+}
+
+type ramsesSnapshot struct {
+	hd Header
+	info ramsesInfo
+	uniform bool
+	filenames []string
+
+	xBuf, vBuf [][3]float32
+	mpBuf []float32
+	idBuf []int64
+	f64Buf []float64
+	i32Buf []int32
+}
+
+// Ramses returns a snapshot for the particles in a RAMSES output directory,
+// output_XXXXX. Each part_XXXXX.outYYYYY file in the directory is one file of
+// the snapshot. Positions are converted to comoving Mpc/h, velocities to
+// peculiar km/s, and masses to Msun/h using the units in info_XXXXX.txt.
+// Every particle, including any star particles, is reported as DarkMatter.
+func Ramses(dir string) (Snapshot, error) {
+	snap := &ramsesSnapshot{ }
+
+	names, err := getFilenames(dir)
+	if err != nil { return nil, err }
+
+	infoName := ""
+	for _, name := range names {
+		base := path.Base(name)
+		if strings.HasPrefix(base, "info_") && strings.HasSuffix(base, ".txt") {
+			infoName = name
+		} else if strings.HasPrefix(base, "part_") &&
+			strings.Contains(base, ".out") {
+			snap.filenames = append(snap.filenames, name)
+		}
+	}
+
+	if infoName == "" {
+		return nil, fmt.Errorf("No info_XXXXX.txt file in directory %s", dir)
+	} else if len(snap.filenames) == 0 {
+		return nil, fmt.Errorf("No part_XXXXX.outYYYYY files in directory %s",
+			dir)
+	}
+
+	snap.info, err = readRamsesInfo(infoName)
+	if err != nil { return nil, err }
+	if snap.info.NDim != 3 {
+		return nil, fmt.Errorf("%s describes a %d-dimensional simulation.",
+			infoName, snap.info.NDim)
+	}
+	if snap.info.NCPU != len(snap.filenames) {
+		return nil, fmt.Errorf("%s describes %d CPUs, but there are %d " +
+			"part files in %s.", infoName, snap.info.NCPU,
+			len(snap.filenames), dir)
+	}
+
+	nTotal, nStar := int64(0), int32(0)
+	for i := range snap.filenames {
+		ph, err := snap.readPartHeader(i)
+		if err != nil { return nil, err }
+		nTotal += int64(ph.NPart)
+		nStar = ph.NStarTot
+	}
+
+	info := &snap.info
+	hd := &snap.hd
+	hd.Scale = info.AExp
+	hd.Z = 1/info.AExp - 1
+	hd.OmegaM = info.OmegaM
+	hd.OmegaL = info.OmegaL
+	hd.H100 = info.H0 / 100
+	hd.L = info.BoxLen * snap.lengthUnit()
+	hd.NTotal = nTotal
+	hd.NSide = intCubeRoot(nTotal)
+	hd.NPart[DarkMatter] = nTotal
+	hd.calcUniformMass()
+
+	// Star particles and zoom-in runs have non-uniform masses. Every file
+	// is checked for the latter, since a single CPU domain of a zoom-in run
+	// may only contain one particle mass.
+	if nStar == 0 {
+		mp0, err := snap.uniformMass()
+		if err != nil { return nil, err }
+		snap.uniform = mp0 > 0
+		if snap.uniform { hd.UniformMp = float64(mp0) }
+	}
+
+	return snap, nil
+}
+
+// uniformMass returns the mass shared by every particle in the snapshot, or
+// zero if particles have different masses or there are no particles.
+func (snap *ramsesSnapshot) uniformMass() (float32, error) {
+	mp0, found := float32(0), false
+	for i := range snap.filenames {
+		mp, err := snap.ReadMp(i)
+		if err != nil { return 0, err }
+
+		for j := range mp {
+			if !found {
+				mp0, found = mp[j], true
+			} else if mp[j] != mp0 {
+				return 0, nil
+			}
+		}
+	}
+	return mp0, nil
+}
+
+// readRamsesInfo reads the "key = value" lines of an info_XXXXX.txt file.
+func readRamsesInfo(fname string) (ramsesInfo, error) {
+	info := ramsesInfo{ }
+
+	f, err := os.Open(fname)
+	if err != nil { return info, err }
+	defer f.Close()
+
+	values := map[string]string{ }
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		tok := strings.SplitN(scanner.Text(), "=", 2)
+		if len(tok) != 2 { continue }
+		values[strings.TrimSpace(tok[0])] = strings.TrimSpace(tok[1])
+	}
+	if err = scanner.Err(); err != nil { return info, err }
+
+	ints := map[string]*int{ "ncpu": &info.NCPU, "ndim": &info.NDim }
+	floats := map[string]*float64{
+		"boxlen": &info.BoxLen, "aexp": &info.AExp, "H0": &info.H0,
+		"omega_m": &info.OmegaM, "omega_l": &info.OmegaL,
+		"unit_l": &info.UnitL, "unit_d": &info.UnitD, "unit_t": &info.UnitT,
+	}
+
+	for key, ptr := range ints {
+		val, ok := values[key]
+		if !ok {
+			return info, fmt.Errorf("%s does not contain %s.", fname, key)
+		}
+		*ptr, err = strconv.Atoi(val)
+		if err != nil {
+			return info, fmt.Errorf("%s has invalid %s, '%s'.", fname, key, val)
+		}
+	}
+
+	for key, ptr := range floats {
+		val, ok := values[key]
+		if !ok {
+			return info, fmt.Errorf("%s does not contain %s.", fname, key)
+		}
+		*ptr, err = strconv.ParseFloat(val, 64)
+		if err != nil {
+			return info, fmt.Errorf("%s has invalid %s, '%s'.", fname, key, val)
+		}
+	}
+
+	return info, nil
+}
+
+// lengthUnit returns comoving Mpc/h per code length unit.
+func (snap *ramsesSnapshot) lengthUnit() float64 {
+	mpcCm := cosmo.MpcMks * 100
+	return snap.info.UnitL / snap.info.AExp / mpcCm * (snap.info.H0 / 100)
+}
+
+// velocityUnit returns km/s per code velocity unit.
+func (snap *ramsesSnapshot) velocityUnit() float64 {
+	return snap.info.UnitL / snap.info.UnitT / 1e5
+}
+
+// massUnit returns Msun/h per code mass unit.
+func (snap *ramsesSnapshot) massUnit() float64 {
+	mSunG := cosmo.MSunMks * 1000
+	uL := snap.info.UnitL
+	return snap.info.UnitD * uL*uL*uL / mSunG * (snap.info.H0 / 100)
+}
+
+// open opens file idx, reads its header records, and returns a reader
+// positioned at the start of the particle records.
+func (snap *ramsesSnapshot) open(
+	idx int,
+) (*os.File, *fortranReader, *ramsesPartHeader, error) {
+	f, err := os.Open(snap.filenames[idx])
+	if err != nil { return nil, nil, nil, err }
+
+	fr := newFortranReader(f, binary.LittleEndian, snap.filenames[idx])
+	ph := &ramsesPartHeader{ }
+
+	fields := []struct{
+		data interface{}
+		name string
+	}{
+		{&ph.NCPU, "ncpu"}, {&ph.NDim, "ndim"}, {&ph.NPart, "npart"},
+		{&ph.LocalSeed, "localseed"}, {&ph.NStarTot, "nstar_tot"},
+		{&ph.MStarTot, "mstar_tot"}, {&ph.MStarLost, "mstar_lost"},
+		{&ph.NSink, "nsink"},
+	}
+
+	for _, field := range fields {
+		if err = fr.read(field.data, field.name); err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+	}
+
+	if ph.NDim != 3 {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("%s has ndim = %d.",
+			snap.filenames[idx], ph.NDim)
+	}
+
+	return f, fr, ph, nil
+}
+
+func (snap *ramsesSnapshot) readPartHeader(idx int) (*ramsesPartHeader, error) {
+	f, _, ph, err := snap.open(idx)
+	if err != nil { return nil, err }
+	f.Close()
+	return ph, nil
+}
+
+// readFloat64Records skips the first skip particle records of file idx and
+// then reads n float64 records, calling callback on each one.
+func (snap *ramsesSnapshot) readFloat64Records(
+	idx, skip, n int, callback func(k int, x []float64),
+) (int, error) {
+	f, fr, ph, err := snap.open(idx)
+	if err != nil { return 0, err }
+	defer f.Close()
+
+	for k := 0; k < skip; k++ {
+		if err = fr.skip("particle"); err != nil { return 0, err }
+	}
+
+	if cap(snap.f64Buf) < int(ph.NPart) {
+		snap.f64Buf = make([]float64, ph.NPart)
+	}
+	snap.f64Buf = snap.f64Buf[:ph.NPart]
+
+	for k := 0; k < n; k++ {
+		if err = fr.read(snap.f64Buf, "particle"); err != nil { return 0, err }
+		callback(k, snap.f64Buf)
+	}
+
+	return int(ph.NPart), nil
+}
+
+func (snap *ramsesSnapshot) Files() int {
+	return len(snap.filenames)
+}
+
+func (snap *ramsesSnapshot) Header() *Header {
+	return &snap.hd
+}
+
+// RawHeader returns the bytes of the header records of file idx, without
+// their Fortran headers and footers.
+func (snap *ramsesSnapshot) RawHeader(idx int) []byte {
+	ph, err := snap.readPartHeader(idx)
+	if err != nil { panic(err.Error()) }
+
+	buf := &bytes.Buffer{ }
+	err = binary.Write(buf, binary.LittleEndian, ph)
+	if err != nil { panic(err.Error()) }
+
+	return buf.Bytes()
+}
+
+func (snap *ramsesSnapshot) UpdateHeader(hd *Header) {
+	snap.hd = *hd
+}
+
+// UniformMass returns true if there are no star particles and every particle
+// has the same mass.
+func (snap *ramsesSnapshot) UniformMass() bool {
+	return snap.uniform
+}
+
+func (snap *ramsesSnapshot) ReadX(idx int) ([][3]float32, error) {
+	ph, err := snap.readPartHeader(idx)
+	if err != nil { return nil, err }
+	snap.xBuf = expandVectors(snap.xBuf[:0], int(ph.NPart))
+
+	unit := snap.lengthUnit()
+	L := float32(snap.hd.L)
+
+	_, err = snap.readFloat64Records(idx, 0, 3, func(k int, x []float64) {
+		for i := range x { snap.xBuf[i][k] = float32(x[i] * unit) }
+	})
+	if err != nil { return nil, err }
+
+	for i := range snap.xBuf {
+		for k := 0; k < 3; k++ {
+			x := snap.xBuf[i][k]
+
+			if x < 0 {
+				x += L
+			} else if x >= L {
+				x -= L
+			}
+
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
+				x < 0 || x >= L {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.filenames[idx],
+				)
+			}
+
+			snap.xBuf[i][k] = x
+		}
+	}
+
+	return snap.xBuf, nil
+}
+
+func (snap *ramsesSnapshot) ReadV(idx int) ([][3]float32, error) {
+	ph, err := snap.readPartHeader(idx)
+	if err != nil { return nil, err }
+	snap.vBuf = expandVectors(snap.vBuf[:0], int(ph.NPart))
+
+	unit := snap.velocityUnit()
+
+	_, err = snap.readFloat64Records(idx, 3, 3, func(k int, v []float64) {
+		for i := range v { snap.vBuf[i][k] = float32(v[i] * unit) }
+	})
+	if err != nil { return nil, err }
+
+	for i := range snap.vBuf {
+		for k := 0; k < 3; k++ {
+			v := float64(snap.vBuf[i][k])
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.filenames[idx],
+				)
+			}
+		}
+	}
+
+	return snap.vBuf, nil
+}
+
+func (snap *ramsesSnapshot) ReadMp(idx int) ([]float32, error) {
+	ph, err := snap.readPartHeader(idx)
+	if err != nil { return nil, err }
+	snap.mpBuf = expandScalars(snap.mpBuf[:0], int(ph.NPart))
+
+	unit := snap.massUnit()
+
+	_, err = snap.readFloat64Records(idx, 6, 1, func(k int, mp []float64) {
+		for i := range mp { snap.mpBuf[i] = float32(mp[i] * unit) }
+	})
+	if err != nil { return nil, err }
+
+	return snap.mpBuf, nil
+}
+
+// ReadID reads particle IDs, which may be stored as either 4- or 8-byte
+// integers depending on how RAMSES was compiled.
+func (snap *ramsesSnapshot) ReadID(idx int) ([]int64, error) {
+	f, fr, ph, err := snap.open(idx)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	for k := 0; k < 7; k++ {
+		if err = fr.skip("particle"); err != nil { return nil, err }
+	}
+
+	n := int(ph.NPart)
+	snap.idBuf = expandInts(snap.idBuf[:0], n)
+
+	head, err := fr.begin()
+	if err != nil { return nil, err }
+
+	switch int(head) {
+	case 8*n:
+		err = readInt64AsByte(f, binary.LittleEndian, snap.idBuf)
+		if err != nil && n > 0 { return nil, err }
+	case 4*n:
+		if cap(snap.i32Buf) < n { snap.i32Buf = make([]int32, n) }
+		snap.i32Buf = snap.i32Buf[:n]
+		err = readInt32AsByte(f, binary.LittleEndian, snap.i32Buf)
+		if err != nil && n > 0 { return nil, err }
+		for i := range snap.i32Buf { snap.idBuf[i] = int64(snap.i32Buf[i]) }
+	default:
+		return nil, fmt.Errorf("The ID block of %s has %d bytes for %d " +
+			"particles.", snap.filenames[idx], head, n)
+	}
+
+	if err = fr.end(head, int(head), "id"); err != nil { return nil, err }
+
+	return snap.idBuf, nil
+}
+
+func (snap *ramsesSnapshot) ReadXSpecies(i, species int) ([][3]float32, error) {
+	return readXDarkMatter(snap, i, species)
+}
+
+func (snap *ramsesSnapshot) ReadVSpecies(i, species int) ([][3]float32, error) {
+	return readVDarkMatter(snap, i, species)
+}
+
+func (snap *ramsesSnapshot) ReadIDSpecies(i, species int) ([]int64, error) {
+	return readIDDarkMatter(snap, i, species)
+}
+
+func (snap *ramsesSnapshot) ReadMpSpecies(i, species int) ([]float32, error) {
+	return readMpDarkMatter(snap, i, species)
+}
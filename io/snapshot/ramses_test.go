@@ -0,0 +1,150 @@
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/nbody-utils/cosmo"
+)
+
+// writeTestRamsesOutput writes an output directory with two part files. Units
+// are chosen so that code lengths are 1 Mpc/h, code velocities are 1 km/s, and
+// code masses are 1e10 Msun/h. The first file uses 4-byte IDs and the second
+// uses 8-byte IDs. Every particle has a mass of 3 code units except for the
+// first particle in the second file, which has a mass of mp1.
+func writeTestRamsesOutput(dir string, mp1 float64) {
+	aexp, h := 0.5, 0.7
+	unitL := aexp * cosmo.MpcMks * 100 / h
+	unitT := unitL / 1e5
+	unitD := 1e10 * cosmo.MSunMks * 1000 / h / (unitL*unitL*unitL)
+
+	info := fmt.Sprintf(`ncpu        =          2
+ndim        =          3
+levelmin    =          7
+boxlen      =  0.100000000000000E+02
+time        = -0.215416305757465E+01
+aexp        =  %.15E
+H0          =  0.700000000000000E+02
+omega_m     =  0.300000000000000E+00
+omega_l     =  0.700000000000000E+00
+unit_l      =  %.15E
+unit_d      =  %.15E
+unit_t      =  %.15E
+
+ordering type=hilbert
+`, aexp, unitL, unitD, unitT)
+	err := ioutil.WriteFile(path.Join(dir, "info_00001.txt"), []byte(info), 0644)
+	if err != nil { panic(err.Error()) }
+
+	for file := 0; file < 2; file++ {
+		fname := path.Join(dir, fmt.Sprintf("part_00001.out%05d", file + 1))
+		f, err := os.Create(fname)
+		if err != nil { panic(err.Error()) }
+
+		writeTestRecord(f, int32(2))
+		writeTestRecord(f, int32(3))
+		writeTestRecord(f, int32(2))
+		writeTestRecord(f, [4]int32{ 1, 2, 3, 4 })
+		writeTestRecord(f, int32(0))
+		writeTestRecord(f, float64(0))
+		writeTestRecord(f, float64(0))
+		writeTestRecord(f, int32(0))
+
+		i0 := float64(2*file)
+		writeTestRecord(f, []float64{ i0, i0 + 1 })
+		writeTestRecord(f, []float64{ 0.5, 10.5 })
+		writeTestRecord(f, []float64{ 1, 1 })
+		writeTestRecord(f, []float64{ 1, -1 })
+		writeTestRecord(f, []float64{ 0, 0 })
+		writeTestRecord(f, []float64{ i0, i0 })
+		if file == 0 {
+			writeTestRecord(f, []float64{ 3, 3 })
+		} else {
+			writeTestRecord(f, []float64{ mp1, 3 })
+		}
+		if file == 0 {
+			writeTestRecord(f, []int32{ 1, 2 })
+		} else {
+			writeTestRecord(f, []int64{ 3, 4 })
+		}
+		writeTestRecord(f, []int32{ 7, 7 })
+
+		f.Close()
+	}
+}
+
+func TestRamses(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_ramses_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+	writeTestRamsesOutput(dir, 3)
+
+	snap, err := Ramses(dir)
+	if err != nil { t.Fatal(err.Error()) }
+
+	hd := snap.Header()
+	if snap.Files() != 2 || hd.NTotal != 4 || hd.Scale != 0.5 ||
+		math.Abs(hd.L - 10) > 1e-6 || hd.H100 != 0.7 || hd.OmegaM != 0.3 {
+		t.Fatalf("Header = %v, Files() = %d", hd, snap.Files())
+	}
+	if !snap.UniformMass() || math.Abs(hd.UniformMp/3e10 - 1) > 1e-6 {
+		t.Errorf("UniformMass() = %v, UniformMp = %g", snap.UniformMass(),
+			hd.UniformMp)
+	}
+
+	for file := 0; file < 2; file++ {
+		i0 := float32(2*file)
+
+		x, err := snap.ReadX(file)
+		if err != nil { t.Fatal(err.Error()) }
+		xExp := [][3]float32{ {i0, 0.5, 1}, {i0 + 1, 0.5, 1} }
+		for i := range xExp {
+			if len(x) != len(xExp) || !vecEq(x[i], xExp[i], 1e-4) {
+				t.Errorf("%d) Expected x = %v, got %v", file, xExp, x)
+				break
+			}
+		}
+
+		v, err := snap.ReadV(file)
+		if err != nil { t.Fatal(err.Error()) }
+		vExp := [][3]float32{ {1, 0, i0}, {-1, 0, i0} }
+		for i := range vExp {
+			if len(v) != len(vExp) || !vecEq(v[i], vExp[i], 1e-4) {
+				t.Errorf("%d) Expected v = %v, got %v", file, vExp, v)
+				break
+			}
+		}
+
+		id, err := snap.ReadID(file)
+		if err != nil { t.Fatal(err.Error()) }
+		idExp := []int64{ int64(i0) + 1, int64(i0) + 2 }
+		if len(id) != 2 || id[0] != idExp[0] || id[1] != idExp[1] {
+			t.Errorf("%d) Expected id = %v, got %v", file, idExp, id)
+		}
+	}
+}
+
+func TestRamsesZoomIn(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_ramses_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	// Only the second file has a particle with a different mass.
+	writeTestRamsesOutput(dir, 24)
+
+	snap, err := Ramses(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	if snap.UniformMass() {
+		t.Errorf("UniformMass() = true for non-uniform masses.")
+	}
+
+	mp, err := snap.ReadMp(1)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(mp) != 2 || math.Abs(float64(mp[0])/24e10 - 1) > 1e-6 {
+		t.Errorf("Expected mp = [2.4e11 3e10], got %g", mp)
+	}
+}
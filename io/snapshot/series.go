@@ -0,0 +1,258 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Series is a collection of snapshots of a single simulation, ordered by
+// scale factor. Snapshots are only opened when they're needed.
+type Series struct {
+	paths []string
+	scales []float64
+	open func(path string) (Snapshot, error)
+}
+
+// OpenSeries indexes the outputs in dir whose names match the glob pattern
+// (e.g. "snapdir_*"). An empty pattern matches every output. open opens the
+// snapshot at the given path, e.g. a function which calls LGadget2. Every
+// output is opened once to read its scale factor.
+func OpenSeries(
+	dir, pattern string, open func(path string) (Snapshot, error),
+) (*Series, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil { return nil, err }
+
+	s := &Series{ open: open }
+	for _, info := range infos {
+		if pattern != "" {
+			ok, err := filepath.Match(pattern, info.Name())
+			if err != nil { return nil, err }
+			if !ok { continue }
+		}
+
+		p := path.Join(dir, info.Name())
+		snap, err := open(p)
+		if err != nil { return nil, err }
+		s.paths = append(s.paths, p)
+		s.scales = append(s.scales, snap.Header().Scale)
+		if err = closeSnapshot(snap); err != nil { return nil, err }
+	}
+
+	if len(s.paths) == 0 {
+		return nil, fmt.Errorf("No outputs in the directory %s match '%s'.",
+			dir, pattern)
+	}
+
+	sort.Sort(seriesByScale{ s })
+	return s, nil
+}
+
+// seriesByScale sorts the outputs of a Series by scale factor.
+type seriesByScale struct{ *Series }
+
+func (s seriesByScale) Len() int { return len(s.paths) }
+func (s seriesByScale) Less(i, j int) bool {
+	return s.scales[i] < s.scales[j]
+}
+func (s seriesByScale) Swap(i, j int) {
+	s.paths[i], s.paths[j] = s.paths[j], s.paths[i]
+	s.scales[i], s.scales[j] = s.scales[j], s.scales[i]
+}
+
+// closeSnapshot closes a Snapshot if it needs to be closed.
+func closeSnapshot(snap Snapshot) error {
+	if c, ok := snap.(io.Closer); ok { return c.Close() }
+	return nil
+}
+
+// Len returns the number of outputs in the series.
+func (s *Series) Len() int { return len(s.paths) }
+
+// Scale returns the scale factor of output i.
+func (s *Series) Scale(i int) float64 { return s.scales[i] }
+
+// Path returns the path of output i.
+func (s *Series) Path(i int) string { return s.paths[i] }
+
+// Snapshot opens output i. If the returned Snapshot implements io.Closer,
+// the caller should close it.
+func (s *Series) Snapshot(i int) (Snapshot, error) {
+	return s.open(s.paths[i])
+}
+
+// Nearest returns the index of the output whose scale factor is closest to a.
+func (s *Series) Nearest(a float64) int {
+	j := sort.SearchFloat64s(s.scales, a)
+	if j == len(s.scales) { return j - 1 }
+	if j > 0 && a - s.scales[j-1] < s.scales[j] - a { return j - 1 }
+	return j
+}
+
+// Trajectories holds the positions and velocities of a set of particles in
+// every output of a Series.
+type Trajectories struct {
+	IDs []int64 // IDs of the tracked particles.
+	Scales []float64 // Scale factor of each output.
+	// X[i][j] and V[i][j] are the position and velocity of particle
+	// IDs[j] in output i.
+	X, V [][][3]float32
+}
+
+// Trajectories returns the positions and velocities of the particles with
+// the given IDs in every output. See FindParticles for details.
+func (s *Series) Trajectories(ids []int64) (*Trajectories, error) {
+	if err := checkUniqueIDs(ids); err != nil { return nil, err }
+
+	tr := &Trajectories{
+		IDs: append([]int64{ }, ids...),
+		Scales: append([]float64{ }, s.scales...),
+		X: make([][][3]float32, s.Len()),
+		V: make([][][3]float32, s.Len()),
+	}
+
+	for i := range s.paths {
+		snap, err := s.Snapshot(i)
+		if err != nil { return nil, err }
+
+		tr.X[i], tr.V[i], err = FindParticles(snap, ids)
+		if err != nil {
+			closeSnapshot(snap)
+			return nil, fmt.Errorf("Output %s: %s",
+				s.paths[i], err.Error())
+		}
+
+		if err = closeSnapshot(snap); err != nil { return nil, err }
+	}
+
+	return tr, nil
+}
+
+// FindParticles returns the positions and velocities of the particles with
+// the given IDs, e.g. the member particles of a halo. IDs follow the
+// convention of the snapshot's ReadID. LagrangianBoxSnapshots, like LVec
+// snapshots, only decode the sub-cells which contain the particles, and
+// other snapshots only read the positions and velocities of files which
+// contain the particles.
+func FindParticles(snap Snapshot, ids []int64) (x, v [][3]float32, err error) {
+	if err = checkUniqueIDs(ids); err != nil { return nil, nil, err }
+
+	x, v = make([][3]float32, len(ids)), make([][3]float32, len(ids))
+	if box, ok := snap.(LagrangianBoxSnapshot); ok {
+		err = boxTrajectories(box, ids, x, v)
+	} else {
+		err = scanTrajectories(snap, ids, x, v)
+	}
+	if err != nil { return nil, nil, err }
+
+	return x, v, nil
+}
+
+// checkUniqueIDs returns an error if an ID appears more than once.
+func checkUniqueIDs(ids []int64) error {
+	seen := map[int64]bool{ }
+	for _, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("The ID %d is tracked more than once.", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// scanTrajectories finds the particles with the given IDs by reading the IDs
+// of every file in snap.
+func scanTrajectories(
+	snap Snapshot, ids []int64, x, v [][3]float32,
+) error {
+	index := map[int64]int{ }
+	for k, id := range ids { index[id] = k }
+	found := 0
+
+	// Locations of the tracked particles in a single file.
+	var fileIdx, trIdx []int
+
+	for i := 0; i < snap.Files() && found < len(ids); i++ {
+		fileID, err := snap.ReadID(i)
+		if err != nil { return err }
+
+		fileIdx, trIdx = fileIdx[:0], trIdx[:0]
+		for j, id := range fileID {
+			if k, ok := index[id]; ok {
+				fileIdx, trIdx = append(fileIdx, j), append(trIdx, k)
+				delete(index, id)
+			}
+		}
+		if len(fileIdx) == 0 { continue }
+		found += len(fileIdx)
+
+		fileX, err := snap.ReadX(i)
+		if err != nil { return err }
+		for n, j := range fileIdx { x[trIdx[n]] = fileX[j] }
+		fileV, err := snap.ReadV(i)
+		if err != nil { return err }
+		for n, j := range fileIdx { v[trIdx[n]] = fileV[j] }
+	}
+
+	for id := range index {
+		return fmt.Errorf("The particle with ID %d wasn't found.", id)
+	}
+	return nil
+}
+
+// boxTrajectories finds the particles with the given IDs by reading one
+// Lagrangian box from each cell which contains them, so every file is only
+// decoded once.
+func boxTrajectories(
+	snap LagrangianBoxSnapshot, ids []int64, x, v [][3]float32,
+) error {
+	nSide := snap.Header().NSide
+	nElem := nSide / snap.LagrangianCells()
+
+	// Find the bounding box of the particles in each cell.
+	type cellBox struct {
+		lo, hi [3]int64
+		index map[int64]int
+	}
+	cells := map[[3]int64]*cellBox{ }
+	for k, id := range ids {
+		if id < 0 || id >= nSide*nSide*nSide {
+			return fmt.Errorf("The particle with ID %d wasn't found.", id)
+		}
+
+		idx := [3]int64{ id % nSide, (id / nSide) % nSide, id / (nSide*nSide) }
+		c := [3]int64{ idx[0] / nElem, idx[1] / nElem, idx[2] / nElem }
+		box, ok := cells[c]
+		if !ok {
+			box = &cellBox{ lo: idx, hi: idx, index: map[int64]int{ } }
+			cells[c] = box
+		}
+		for dim := 0; dim < 3; dim++ {
+			if idx[dim] < box.lo[dim] { box.lo[dim] = idx[dim] }
+			if idx[dim] > box.hi[dim] { box.hi[dim] = idx[dim] }
+		}
+		box.index[id] = k
+	}
+
+	for _, box := range cells {
+		hi := [3]int64{ box.hi[0] + 1, box.hi[1] + 1, box.hi[2] + 1 }
+
+		boxX, boxID, err := snap.ReadXBox(box.lo, hi)
+		if err != nil { return err }
+		for j, id := range boxID {
+			if k, ok := box.index[id]; ok { x[k] = boxX[j] }
+		}
+
+		boxV, boxID, err := snap.ReadVBox(box.lo, hi)
+		if err != nil { return err }
+		for j, id := range boxID {
+			if k, ok := box.index[id]; ok { v[k] = boxV[j] }
+		}
+	}
+
+	return nil
+}
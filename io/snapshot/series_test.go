@@ -0,0 +1,191 @@
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeTestSeries writes three snapshots converted from newTestMockSnapshot
+// to subdirectories of dir with write. Output k has scale factor 0.25*(k+1)
+// and its positions are shifted by k in the x direction.
+func writeTestSeries(dir string, write func(snap Snapshot, dir string) error) {
+	for _, k := range []int{ 2, 0, 1 } {
+		snap := newTestMockSnapshot().(*mockSnapshot)
+		snap.hd.Scale = 0.25*float64(k + 1)
+		snap.hd.Z = 1/snap.hd.Scale - 1
+		for j := range snap.x[0] {
+			snap.x[0][j][0] = float32((int(snap.x[0][j][0]) + k) % 10)
+		}
+
+		out := path.Join(dir, fmt.Sprintf("snap_%d", k))
+		if err := os.Mkdir(out, 0755); err != nil { panic(err.Error()) }
+		if err := write(snap, out); err != nil { panic(err.Error()) }
+	}
+
+	err := ioutil.WriteFile(path.Join(dir, "log.txt"), []byte("log"), 0644)
+	if err != nil { panic(err.Error()) }
+}
+
+func TestSeries(t *testing.T) {
+	tests := []struct {
+		write func(snap Snapshot, dir string) error
+		open func(dir string) (Snapshot, error)
+		ids []int64
+		xEps, vEps float32
+	}{
+		{
+			func(snap Snapshot, dir string) error {
+				return Convert(snap, LGadget2Writer(dir, "test.%03d"),
+					ConvertContext{ Files: 3 })
+			},
+			func(dir string) (Snapshot, error) { return LGadget2(dir) },
+			[]int64{ 1000, 1, 457 }, 1e-5, 1e-4,
+		},
+		{
+			func(snap Snapshot, dir string) error {
+				return ConvertToLVec(snap, 2, 1, 0.1, 0.01,
+					dir, "test.%s.%d.lvec")
+			},
+			func(dir string) (Snapshot, error) {
+				return LVec(dir, "test.%s.%d.lvec")
+			},
+			[]int64{ 999, 0, 456 }, 0.2, 0.02,
+		},
+	}
+
+	for i, test := range tests {
+		dir, err := ioutil.TempDir(".", "test_series_data")
+		if err != nil { panic(err.Error()) }
+		defer os.RemoveAll(dir)
+
+		writeTestSeries(dir, test.write)
+		s, err := OpenSeries(dir, "snap_*", test.open)
+		if err != nil { t.Fatal(err.Error()) }
+
+		if s.Len() != 3 || s.Scale(0) != 0.25 || s.Scale(2) != 0.75 ||
+			s.Path(1) != path.Join(dir, "snap_1") {
+			t.Errorf("%d) Series has paths %v and scales %v.",
+				i, s.paths, s.scales)
+		}
+		if s.Nearest(0.1) != 0 || s.Nearest(0.55) != 1 ||
+			s.Nearest(0.65) != 2 || s.Nearest(2) != 2 {
+			t.Errorf("%d) Nearest() gave the wrong outputs.", i)
+		}
+
+		tr, err := s.Trajectories(test.ids)
+		if err != nil { t.Fatal(err.Error()) }
+
+		for k := range tr.X {
+			for j, id := range test.ids {
+				idx := id
+				if i == 0 { idx-- }
+				xTarget := [3]float32{
+					float32((idx % 10 + int64(k)) % 10),
+					float32((idx / 10) % 10), float32(idx / 100),
+				}
+				vTarget := [3]float32{
+					-float32(idx % 10), float32((idx / 10) % 10),
+					-float32(idx / 100),
+				}
+				if !vecEq(tr.X[k][j], xTarget, test.xEps) {
+					t.Errorf("%d) x of ID %d in output %d is %g, not %g.",
+						i, id, k, tr.X[k][j], xTarget)
+				}
+				if !vecEq(tr.V[k][j], vTarget, test.vEps) {
+					t.Errorf("%d) v of ID %d in output %d is %g, not %g.",
+						i, id, k, tr.V[k][j], vTarget)
+				}
+			}
+		}
+
+		if _, err = s.Trajectories([]int64{ 5000 }); err == nil {
+			t.Errorf("%d) Expected error for a missing ID.", i)
+		}
+		if _, err = s.Trajectories([]int64{ 5, 5 }); err == nil {
+			t.Errorf("%d) Expected error for a duplicated ID.", i)
+		}
+	}
+}
+
+func TestFindParticles(t *testing.T) {
+	snap := newTestMockSnapshot()
+	ids := []int64{ 457, 1, 1000 }
+	x, v, err := FindParticles(snap, ids)
+	if err != nil { t.Fatal(err.Error()) }
+
+	for j, id := range ids {
+		idx := id - 1
+		xTarget := [3]float32{
+			float32(idx % 10), float32((idx / 10) % 10), float32(idx / 100),
+		}
+		vTarget := [3]float32{
+			-float32(idx % 10), float32((idx / 10) % 10),
+			-float32(idx / 100),
+		}
+		if x[j] != xTarget || v[j] != vTarget {
+			t.Errorf("ID %d has x = %g and v = %g, not %g and %g.",
+				id, x[j], v[j], xTarget, vTarget)
+		}
+	}
+
+	if _, _, err = FindParticles(snap, []int64{ 0 }); err == nil {
+		t.Errorf("Expected error for a missing ID.")
+	}
+}
+
+// countingBoxSnapshot wraps a LagrangianBoxSnapshot and counts its box reads.
+type countingBoxSnapshot struct {
+	LagrangianBoxSnapshot
+	xReads, vReads int
+}
+
+func (snap *countingBoxSnapshot) ReadXBox(
+	lo, hi [3]int64,
+) ([][3]float32, []int64, error) {
+	snap.xReads++
+	return snap.LagrangianBoxSnapshot.ReadXBox(lo, hi)
+}
+
+func (snap *countingBoxSnapshot) ReadVBox(
+	lo, hi [3]int64,
+) ([][3]float32, []int64, error) {
+	snap.vReads++
+	return snap.LagrangianBoxSnapshot.ReadVBox(lo, hi)
+}
+
+func TestFindParticlesBox(t *testing.T) {
+	dir := t.TempDir()
+	err := ConvertToLVec(newTestMockSnapshot(), 2, 5, 0.1, 0.01,
+		dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	lvec, err := LVec(dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	snap := &countingBoxSnapshot{
+		LagrangianBoxSnapshot: lvec.(LagrangianBoxSnapshot),
+	}
+
+	// Three particles in different sub-cells of cell 0 and one in cell 7.
+	ids := []int64{ 0, 4, 444, 999 }
+	x, v, err := FindParticles(snap, ids)
+	if err != nil { t.Fatal(err.Error()) }
+	if snap.xReads != 2 || snap.vReads != 2 {
+		t.Errorf("Expected one box read per cell, got %d and %d.",
+			snap.xReads, snap.vReads)
+	}
+
+	for j, id := range ids {
+		xTarget := [3]float32{
+			float32(id % 10), float32((id / 10) % 10), float32(id / 100),
+		}
+		vTarget := [3]float32{
+			-float32(id % 10), float32((id / 10) % 10), -float32(id / 100),
+		}
+		if !vecEq(x[j], xTarget, 0.2) || !vecEq(v[j], vTarget, 0.02) {
+			t.Errorf("ID %d has x = %g and v = %g, not %g and %g.",
+				id, x[j], v[j], xTarget, vTarget)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package snapshot
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"reflect"
 
@@ -23,8 +24,28 @@ type Snapshot interface {
 	ReadV(i int) ([][3]float32, error) // Read velocities for file i.
 	ReadID(i int) ([]int64, error) // Read IDs for file i.
 	ReadMp(i int) ([]float32, error) // Read particle masses for file i.
+
+	// These read only the particles of a single species in file i. A
+	// negative species reads every particle, the same as the methods above.
+	ReadXSpecies(i, species int) ([][3]float32, error)
+	ReadVSpecies(i, species int) ([][3]float32, error)
+	ReadIDSpecies(i, species int) ([]int64, error)
+	ReadMpSpecies(i, species int) ([]float32, error)
 }
 
+// Particle species. These follow the Gadget particle types, so zoom-in
+// simulations usually store their low-resolution dark matter as Disk and
+// Bulge particles. Snapshots with only one species store it as DarkMatter.
+const (
+	Gas = iota
+	DarkMatter
+	Disk
+	Bulge
+	Stars
+	Boundary
+	MaxSpecies // The number of species.
+)
+
 // Header is a struct containing basic information about the snapshot. Not all
 // simulation headers provide all information: the user is responsible for
 // supplying that information afterwards in these cases.
@@ -34,6 +55,7 @@ type Header struct {
 	L, Epsilon float64 // Box size, force softening
 	NSide, NTotal int64 // Particles on one size, total particles
 	UniformMp float64 // If all particle masses are the same, this is m_p.
+	NPart [MaxSpecies]int64 // Total particles of each species.
 }
 
 
@@ -43,6 +65,47 @@ func (hd *Header) calcUniformMass() {
 	hd.UniformMp =  mTot / float64(hd.NTotal)
 }
 
+// checkSpecies returns an error if species isn't a valid species. Negative
+// species refer to every particle.
+func checkSpecies(species int) error {
+	if species >= MaxSpecies {
+		return fmt.Errorf("Particle species %d is not in the range " +
+			"[0, %d).", species, MaxSpecies)
+	}
+	return nil
+}
+
+// darkMatterOnly is used by the read*DarkMatter functions. It returns true if
+// species refers to the snapshot's particles and false if it refers to a
+// species with no particles.
+func darkMatterOnly(species int) (bool, error) {
+	if err := checkSpecies(species); err != nil { return false, err }
+	return species < 0 || species == DarkMatter, nil
+}
+
+// readXDarkMatter, readVDarkMatter, readIDDarkMatter, and readMpDarkMatter
+// implement the Read*Species methods of snapshots which only contain dark
+// matter. Other species have no particles.
+func readXDarkMatter(snap Snapshot, i, species int) ([][3]float32, error) {
+	if ok, err := darkMatterOnly(species); !ok { return nil, err }
+	return snap.ReadX(i)
+}
+
+func readVDarkMatter(snap Snapshot, i, species int) ([][3]float32, error) {
+	if ok, err := darkMatterOnly(species); !ok { return nil, err }
+	return snap.ReadV(i)
+}
+
+func readIDDarkMatter(snap Snapshot, i, species int) ([]int64, error) {
+	if ok, err := darkMatterOnly(species); !ok { return nil, err }
+	return snap.ReadID(i)
+}
+
+func readMpDarkMatter(snap Snapshot, i, species int) ([]float32, error) {
+	if ok, err := darkMatterOnly(species); !ok { return nil, err }
+	return snap.ReadMp(i)
+}
+
 func readVecAsByte(rd io.Reader, end binary.ByteOrder, buf [][3]float32) error {
 	bufLen := len(buf)
 
@@ -154,6 +217,12 @@ func readFloat32AsByte(rd io.Reader, end binary.ByteOrder, buf []float32) error
 	return nil
 }
 
+// bytesAsVectors returns a slice of n vectors which shares memory with data.
+func bytesAsVectors(data []byte, n int) [][3]float32 {
+	if n == 0 { return [][3]float32{ } }
+	return unsafe.Slice((*[3]float32)(unsafe.Pointer(&data[0])), n)
+}
+
 func IsSysOrder(end binary.ByteOrder) bool {
 	buf32 := []int32{1}
 
@@ -0,0 +1,486 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	tipsyGasFloats = 12 // mass, pos[3], vel[3], rho, temp, hsmooth, metals, phi
+	tipsyDarkFloats = 9 // mass, pos[3], vel[3], eps, phi
+	tipsyStarFloats = 11 // mass, pos[3], vel[3], metals, tform, eps, phi
+)
+
+// tipsyHeader is the header of a TIPSY file. Pad is included in both the
+// standard (XDR) and native files written by ChaNGa and PKDGRAV.
+type tipsyHeader struct {
+	Time float64
+	NBodies, NDim, NSph, NDark, NStar, Pad int32
+}
+
+type tipsySnapshot struct {
+	hd Header
+	th tipsyHeader
+	uniform bool
+	context TipsyContext
+	fname string
+
+	xBuf, vBuf [][3]float32
+	mpBuf []float32
+	idBuf []int64
+}
+
+// TipsyContext contains the information needed to convert a TIPSY file from
+// code units. TIPSY headers don't contain cosmological parameters or units,
+// so these usually need to be supplied by the user.
+type TipsyContext struct {
+	Order binary.ByteOrder // BigEndian for standard files.
+	OmegaM, OmegaL, H100 float64
+
+	L float64 // Box size in comoving Mpc/h. Code positions are in [-L/2, L/2).
+	VelocityUnit float64 // km/s per code velocity unit.
+	MassUnit float64 // Msun/h per code mass unit.
+}
+
+var defaultTipsyContext = TipsyContext{
+	Order: binary.BigEndian,
+	OmegaM: 0.27, OmegaL: 0.73, H100: 0.7,
+	L: 1, VelocityUnit: 1, MassUnit: 1,
+}
+
+// Tipsy returns a snapshot for a single TIPSY file. Gas, dark matter, and star
+// particles are read together, in that order, and particles are assigned IDs
+// starting at 1 in the order they appear in the file. Additional information
+// may be optionally offered in the form of a TipsyContext instance.
+func Tipsy(fname string, context ...TipsyContext) (Snapshot, error) {
+	snap := &tipsySnapshot{ fname: fname }
+
+	snap.context = defaultTipsyContext
+	if len(context) > 0 { snap.context = context[0] }
+
+	f, err := os.Open(fname)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	err = binary.Read(f, snap.context.Order, &snap.th)
+	if err != nil { return nil, err }
+
+	th := &snap.th
+	if th.NDim != 3 || th.NSph < 0 || th.NDark < 0 || th.NStar < 0 ||
+		th.NBodies != th.NSph + th.NDark + th.NStar {
+		return nil, fmt.Errorf("The file %s has an invalid TIPSY header, %v. " +
+			"It might have the wrong byte order.", fname, *th)
+	}
+
+	hd := &snap.hd
+	hd.Scale = th.Time
+	hd.Z = 1/th.Time - 1
+	hd.L = snap.context.L
+	hd.OmegaM = snap.context.OmegaM
+	hd.OmegaL = snap.context.OmegaL
+	hd.H100 = snap.context.H100
+	hd.NTotal = int64(th.NBodies)
+	hd.NSide = intCubeRoot(hd.NTotal)
+	hd.NPart[Gas] = int64(th.NSph)
+	hd.NPart[DarkMatter] = int64(th.NDark)
+	hd.NPart[Stars] = int64(th.NStar)
+	hd.calcUniformMass()
+
+	// Only dark matter runs where every particle has the same mass have
+	// uniform masses.
+	if th.NSph == 0 && th.NStar == 0 && th.NDark > 0 {
+		mp, err := snap.ReadMp(0)
+		if err != nil { return nil, err }
+
+		snap.uniform = true
+		for i := range mp {
+			if mp[i] != mp[0] {
+				snap.uniform = false
+				break
+			}
+		}
+		if snap.uniform { hd.UniformMp = float64(mp[0]) }
+	}
+
+	return snap, nil
+}
+
+// tipsyChunk is the number of particle records read at once.
+const tipsyChunk = 1 << 16
+
+// tipsySpecies are the species of the gas, dark matter, and star particles in
+// a TIPSY file.
+var tipsySpecies = []int{ Gas, DarkMatter, Stars }
+
+// readParticles calls callback on every particle of the given species in the
+// file, in order. A negative species selects every particle. i is the index
+// of the particle within the selected species and rec is the raw record for
+// the particle, which will have tipsyGasFloats, tipsyDarkFloats, or
+// tipsyStarFloats elements.
+func (snap *tipsySnapshot) readParticles(
+	species int, callback func(i int, rec []float32),
+) error {
+	f, err := os.Open(snap.fname)
+	if err != nil { return err }
+	defer f.Close()
+
+	counts := []int{
+		int(snap.th.NSph), int(snap.th.NDark), int(snap.th.NStar),
+	}
+	sizes := []int{ tipsyGasFloats, tipsyDarkFloats, tipsyStarFloats }
+	buf := make([]float32, tipsyChunk*tipsyGasFloats)
+
+	offset := int64(binary.Size(&snap.th))
+	i := 0
+	for k := range counts {
+		if species >= 0 && tipsySpecies[k] != species {
+			offset += int64(4*counts[k]*sizes[k])
+			continue
+		}
+
+		_, err = f.Seek(offset, 0)
+		if err != nil { return err }
+		offset += int64(4*counts[k]*sizes[k])
+
+		for start := 0; start < counts[k]; start += tipsyChunk {
+			n := counts[k] - start
+			if n > tipsyChunk { n = tipsyChunk }
+
+			recs := buf[:n*sizes[k]]
+			err = readFloat32AsByte(f, snap.context.Order, recs)
+			if err != nil { return err }
+
+			for j := 0; j < n; j++ {
+				callback(i, recs[j*sizes[k]: (j+1)*sizes[k]])
+				i++
+			}
+		}
+	}
+
+	return nil
+}
+
+// speciesRange returns the index of the first particle of the given species
+// and the number of particles of that species. A negative species selects
+// every particle.
+func (snap *tipsySnapshot) speciesRange(species int) (start, n int) {
+	th := &snap.th
+	switch {
+	case species < 0: return 0, int(th.NBodies)
+	case species == Gas: return 0, int(th.NSph)
+	case species == DarkMatter: return int(th.NSph), int(th.NDark)
+	case species == Stars: return int(th.NSph + th.NDark), int(th.NStar)
+	}
+	return 0, 0
+}
+
+// Files returns the number of files in the snapshot, which is always 1.
+func (snap *tipsySnapshot) Files() int {
+	return 1
+}
+
+func (snap *tipsySnapshot) Header() *Header {
+	return &snap.hd
+}
+
+// RawHeader returns the bytes of the TIPSY header.
+func (snap *tipsySnapshot) RawHeader(i int) []byte {
+	f, err := os.Open(snap.fname)
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+
+	buf := make([]byte, binary.Size(&snap.th))
+	_, err = f.Read(buf)
+	if err != nil { panic(err.Error()) }
+
+	return buf
+}
+
+func (snap *tipsySnapshot) UpdateHeader(hd *Header) {
+	snap.hd = *hd
+}
+
+// UniformMass returns true if the file only contains dark matter particles and
+// all of them have the same mass.
+func (snap *tipsySnapshot) UniformMass() bool {
+	return snap.uniform
+}
+
+func (snap *tipsySnapshot) ReadX(i int) ([][3]float32, error) {
+	return snap.ReadXSpecies(i, -1)
+}
+
+func (snap *tipsySnapshot) ReadV(i int) ([][3]float32, error) {
+	return snap.ReadVSpecies(i, -1)
+}
+
+// ReadID returns particle IDs. TIPSY files don't store IDs, so these are the
+// indices of each particle in the file plus one.
+func (snap *tipsySnapshot) ReadID(i int) ([]int64, error) {
+	return snap.ReadIDSpecies(i, -1)
+}
+
+func (snap *tipsySnapshot) ReadMp(i int) ([]float32, error) {
+	return snap.ReadMpSpecies(i, -1)
+}
+
+func (snap *tipsySnapshot) ReadXSpecies(
+	i, species int,
+) ([][3]float32, error) {
+	if err := checkSpecies(species); err != nil { return nil, err }
+	_, n := snap.speciesRange(species)
+	snap.xBuf = expandVectors(snap.xBuf[:0], n)
+
+	L := float32(snap.context.L)
+	err := snap.readParticles(species, func(j int, rec []float32) {
+		for k := 0; k < 3; k++ {
+			x := (rec[1 + k] + 0.5) * L
+			if x < 0 {
+				x += L
+			} else if x >= L {
+				x -= L
+			}
+			snap.xBuf[j][k] = x
+		}
+	})
+	if err != nil { return nil, err }
+
+	for j := range snap.xBuf {
+		for k := 0; k < 3; k++ {
+			x := snap.xBuf[j][k]
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
+				x < 0 || x >= L {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.fname,
+				)
+			}
+		}
+	}
+
+	return snap.xBuf, nil
+}
+
+func (snap *tipsySnapshot) ReadVSpecies(
+	i, species int,
+) ([][3]float32, error) {
+	if err := checkSpecies(species); err != nil { return nil, err }
+	_, n := snap.speciesRange(species)
+	snap.vBuf = expandVectors(snap.vBuf[:0], n)
+
+	vu := float32(snap.context.VelocityUnit)
+	err := snap.readParticles(species, func(j int, rec []float32) {
+		for k := 0; k < 3; k++ { snap.vBuf[j][k] = rec[4 + k] * vu }
+	})
+	if err != nil { return nil, err }
+
+	for j := range snap.vBuf {
+		for k := 0; k < 3; k++ {
+			v := float64(snap.vBuf[j][k])
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf(
+					"Corruption detected in the file %s.", snap.fname,
+				)
+			}
+		}
+	}
+
+	return snap.vBuf, nil
+}
+
+// ReadIDSpecies returns the IDs of a single species. IDs are the same as
+// those returned by ReadID.
+func (snap *tipsySnapshot) ReadIDSpecies(i, species int) ([]int64, error) {
+	if err := checkSpecies(species); err != nil { return nil, err }
+	start, n := snap.speciesRange(species)
+	snap.idBuf = expandInts(snap.idBuf[:0], n)
+
+	for j := range snap.idBuf { snap.idBuf[j] = int64(start + j + 1) }
+	return snap.idBuf, nil
+}
+
+func (snap *tipsySnapshot) ReadMpSpecies(i, species int) ([]float32, error) {
+	if err := checkSpecies(species); err != nil { return nil, err }
+	_, n := snap.speciesRange(species)
+	snap.mpBuf = expandScalars(snap.mpBuf[:0], n)
+
+	mu := float32(snap.context.MassUnit)
+	err := snap.readParticles(species, func(j int, rec []float32) {
+		snap.mpBuf[j] = rec[0] * mu
+	})
+	if err != nil { return nil, err }
+
+	return snap.mpBuf, nil
+}
+
+// WriteTipsy writes the particles in snap to a single TIPSY file as dark
+// matter particles. Units and byte order are set by context, which should be
+// the same context that will be used to read the file back in. Particles are
+// written in the order they're read, so IDs are only preserved if snap
+// stores particles in ID order.
+func WriteTipsy(fname string, snap Snapshot, context ...TipsyContext) error {
+	return Convert(snap, TipsyWriter(fname, context...))
+}
+
+type tipsyWriter struct {
+	fname string
+	context TipsyContext
+	f *os.File
+
+	nBodies, next int64
+	nextFile int
+	eps float32
+	files map[int]*tipsyWriterFile
+}
+
+// tipsyWriterFile holds the records of a file until all its blocks have been
+// written.
+type tipsyWriterFile struct {
+	start int64
+	recs []float32
+	blocks int
+}
+
+// TipsyWriter returns a Writer which writes every file of a snapshot into a
+// single TIPSY file as dark matter particles. Headers must be written in
+// order of increasing file index. Units and byte order are set by context.
+func TipsyWriter(fname string, context ...TipsyContext) Writer {
+	wr := &tipsyWriter{
+		fname: fname, context: defaultTipsyContext,
+		files: map[int]*tipsyWriterFile{ },
+	}
+	if len(context) > 0 { wr.context = context[0] }
+	return wr
+}
+
+func (wr *tipsyWriter) WriteHeader(
+	i, files, n int, hd *Header, rawHd []byte,
+) error {
+	if wr.f == nil {
+		f, err := os.Create(wr.fname)
+		if err != nil { return err }
+		wr.f = f
+
+		th := &tipsyHeader{
+			Time: hd.Scale, NBodies: int32(hd.NTotal), NDim: 3,
+			NDark: int32(hd.NTotal),
+		}
+		err = binary.Write(f, wr.context.Order, th)
+		if err != nil { return err }
+
+		wr.nBodies = hd.NTotal
+		wr.eps = float32(hd.Epsilon / wr.context.L)
+	}
+
+	if i != wr.nextFile {
+		return fmt.Errorf("The header of file %d was written after the " +
+			"header of file %d.", i, wr.nextFile - 1)
+	}
+
+	file := &tipsyWriterFile{
+		start: wr.next, recs: make([]float32, tipsyDarkFloats*n),
+	}
+	for j := 0; j < n; j++ { file.recs[j*tipsyDarkFloats + 7] = wr.eps }
+
+	wr.files[i] = file
+	wr.next += int64(n)
+	wr.nextFile++
+
+	return nil
+}
+
+// file returns the unfinished file i after checking that it has n particles.
+func (wr *tipsyWriter) file(i, n int) (*tipsyWriterFile, error) {
+	file, ok := wr.files[i]
+	if !ok {
+		return nil, fmt.Errorf("File %d was written to before its header " +
+			"was written.", i)
+	} else if len(file.recs) != n*tipsyDarkFloats {
+		return nil, fmt.Errorf("File %d has %d particles, but a block with " +
+			"%d particles was written to it.", i,
+			len(file.recs) / tipsyDarkFloats, n)
+	}
+	return file, nil
+}
+
+// finishBlock writes the records of file i once all of its blocks have been
+// written.
+func (wr *tipsyWriter) finishBlock(i int) error {
+	file := wr.files[i]
+	file.blocks++
+	if file.blocks < 4 { return nil }
+
+	delete(wr.files, i)
+
+	buf := &bytes.Buffer{ }
+	err := binary.Write(buf, wr.context.Order, file.recs)
+	if err != nil { return err }
+
+	off := int64(binary.Size(&tipsyHeader{ })) +
+		file.start*tipsyDarkFloats*4
+	_, err = wr.f.WriteAt(buf.Bytes(), off)
+	return err
+}
+
+func (wr *tipsyWriter) WriteX(i int, x [][3]float32) error {
+	file, err := wr.file(i, len(x))
+	if err != nil { return err }
+
+	L := float32(wr.context.L)
+	for j := range x {
+		for k := 0; k < 3; k++ {
+			file.recs[j*tipsyDarkFloats + 1 + k] = x[j][k]/L - 0.5
+		}
+	}
+
+	return wr.finishBlock(i)
+}
+
+func (wr *tipsyWriter) WriteV(i int, v [][3]float32) error {
+	file, err := wr.file(i, len(v))
+	if err != nil { return err }
+
+	vu := float32(wr.context.VelocityUnit)
+	for j := range v {
+		for k := 0; k < 3; k++ {
+			file.recs[j*tipsyDarkFloats + 4 + k] = v[j][k] / vu
+		}
+	}
+
+	return wr.finishBlock(i)
+}
+
+// WriteID only checks the number of IDs, since TIPSY files don't store IDs.
+func (wr *tipsyWriter) WriteID(i int, id []int64) error {
+	if _, err := wr.file(i, len(id)); err != nil { return err }
+	return wr.finishBlock(i)
+}
+
+func (wr *tipsyWriter) WriteMp(i int, mp []float32) error {
+	file, err := wr.file(i, len(mp))
+	if err != nil { return err }
+
+	mu := float32(wr.context.MassUnit)
+	for j := range mp { file.recs[j*tipsyDarkFloats] = mp[j] / mu }
+
+	return wr.finishBlock(i)
+}
+
+// Close closes the TIPSY file after checking that every particle in the
+// header was written.
+func (wr *tipsyWriter) Close() error {
+	if wr.f == nil { return fmt.Errorf("No files were written.") }
+	defer wr.f.Close()
+
+	for i := range wr.files {
+		return fmt.Errorf("Not every block of file %d was written.", i)
+	}
+	if wr.next != wr.nBodies {
+		return fmt.Errorf("Header has NTotal = %d, but %d particles were " +
+			"written.", wr.nBodies, wr.next)
+	}
+
+	return nil
+}
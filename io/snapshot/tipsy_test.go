@@ -0,0 +1,80 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadWriteTipsy(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_tipsy_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	contexts := []TipsyContext{ defaultTipsyContext, defaultTipsyContext }
+	contexts[1].Order = binary.LittleEndian
+
+	for i := range contexts {
+		contexts[i].L = 10
+		contexts[i].VelocityUnit = 2
+		contexts[i].MassUnit = 1e10
+		contexts[i].OmegaM, contexts[i].OmegaL, contexts[i].H100 = 0.3, 0.7, 0.7
+	}
+
+	for i, ctx := range contexts {
+		snap := newTestMockSnapshot()
+		fname := path.Join(dir, "test.tipsy")
+
+		err = WriteTipsy(fname, snap, ctx)
+		if err != nil { t.Fatal(err.Error()) }
+
+		tsnap, err := Tipsy(fname, ctx)
+		if err != nil { t.Fatal(err.Error()) }
+
+		hd, thd := snap.Header(), tsnap.Header()
+		if thd.NTotal != hd.NTotal || thd.Scale != hd.Scale ||
+			thd.L != hd.L || !tsnap.UniformMass() ||
+			!floatEq(float32(thd.UniformMp), float32(hd.UniformMp), 1e4) {
+			t.Errorf("%d) Header = %v, not %v", i, thd, hd)
+		}
+
+		x, _ := snap.ReadX(0)
+		tx, err := tsnap.ReadX(0)
+		if err != nil { t.Fatal(err.Error()) }
+		for j := range tx {
+			if !vecEq(tx[j], x[j], 1e-4) {
+				t.Errorf("%d) x[%d] = %g, not %g", i, j, tx[j], x[j])
+				break
+			}
+		}
+
+		v, _ := snap.ReadV(0)
+		tv, err := tsnap.ReadV(0)
+		if err != nil { t.Fatal(err.Error()) }
+		for j := range tv {
+			if !vecEq(tv[j], v[j], 1e-4) {
+				t.Errorf("%d) v[%d] = %g, not %g", i, j, tv[j], v[j])
+				break
+			}
+		}
+
+		id, _ := snap.ReadID(0)
+		tid, err := tsnap.ReadID(0)
+		if err != nil { t.Fatal(err.Error()) }
+		for j := range tid {
+			if tid[j] != id[j] {
+				t.Errorf("%d) id[%d] = %d, not %d", i, j, tid[j], id[j])
+				break
+			}
+		}
+	}
+
+	// Reading with the wrong byte order should fail instead of returning
+	// garbage.
+	_, err = Tipsy(path.Join(dir, "test.tipsy"))
+	if err == nil {
+		t.Errorf("Expected error when reading with the wrong byte order.")
+	}
+}
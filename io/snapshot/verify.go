@@ -0,0 +1,274 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// Kinds of problems found by Verify.
+const (
+	ReadProblem = iota // A block of a file couldn't be read.
+	RecordProblem // Fortran record markers or block sizes are wrong.
+	CountProblem // Particle counts disagree with each other or the header.
+	IDProblem // IDs are duplicated, missing, or outside the Lagrangian grid.
+	PositionProblem // Positions are non-finite or outside the box.
+	problemKinds
+)
+
+var problemNames = [problemKinds]string{
+	"read", "record", "count", "ID", "position",
+}
+
+// VerifyProblem is a single problem found by Verify.
+type VerifyProblem struct {
+	Kind int // One of ReadProblem, RecordProblem, etc.
+	File int // The file with the problem, or -1 for the whole snapshot.
+	Message string
+}
+
+func (p VerifyProblem) String() string {
+	name := problemNames[p.Kind]
+	if p.File < 0 { return fmt.Sprintf("%s: %s", name, p.Message) }
+	return fmt.Sprintf("%s, file %d: %s", name, p.File, p.Message)
+}
+
+// VerifyReport is the result of verifying a snapshot.
+type VerifyReport struct {
+	Files int // Number of files checked.
+	Particles int64 // Number of particles read.
+	// Problems lists the problems that were found. Only the first
+	// VerifyContext.MaxProblems of each kind are included.
+	Problems []VerifyProblem
+	// Counts is the total number of problems of each kind, including the
+	// ones which aren't in Problems.
+	Counts [problemKinds]int
+
+	maxProblems int
+}
+
+// OK returns true if no problems were found.
+func (r *VerifyReport) OK() bool { return len(r.Problems) == 0 }
+
+// String returns a human-readable summary of the report.
+func (r *VerifyReport) String() string {
+	buf := &bytes.Buffer{ }
+	fmt.Fprintf(buf, "Checked %d files with %d particles.\n",
+		r.Files, r.Particles)
+	if r.OK() {
+		fmt.Fprintf(buf, "No problems found.\n")
+		return buf.String()
+	}
+
+	for _, p := range r.Problems { fmt.Fprintf(buf, "%s\n", p) }
+	for kind, n := range r.Counts {
+		if n > 0 {
+			fmt.Fprintf(buf, "%d %s problems.\n", n, problemNames[kind])
+		}
+	}
+	return buf.String()
+}
+
+func (r *VerifyReport) add(kind, file int, format string, a ...interface{}) {
+	r.Counts[kind]++
+	if r.Counts[kind] > r.maxProblems { return }
+	r.Problems = append(r.Problems, VerifyProblem{
+		Kind: kind, File: file, Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// VerifyContext contains optional parameters for Verify.
+type VerifyContext struct {
+	// MaxProblems is the maximum number of problems of each kind listed in
+	// the report. If zero, 100 are listed.
+	MaxProblems int
+	// SkipIDs skips the ID checks, which need NSide^3 bits of memory.
+	SkipIDs bool
+}
+
+var defaultVerifyContext = VerifyContext{ MaxProblems: 100 }
+
+// recordVerifier is implemented by Snapshots which can check the Fortran
+// records of their files.
+type recordVerifier interface {
+	verifyRecords(i int) error
+}
+
+// zeroIndexedSnapshot is implemented by Snapshots whose IDs start at zero
+// instead of one.
+type zeroIndexedSnapshot interface {
+	zeroIndexedIDs()
+}
+
+// Verify scans every file in a snapshot and reports any problems it finds.
+// It checks Fortran record markers for formats that use them, checks that
+// each file has the same number of positions, velocities, IDs, and masses and
+// that these add up to the header's particle count, checks that IDs are
+// unique and cover the NSide^3 Lagrangian grid, and checks that positions are
+// finite and inside the box. An error is only returned if the snapshot
+// can't be verified at all. Additional information may be optionally offered
+// in the form of a VerifyContext instance.
+func Verify(
+	snap Snapshot, context ...VerifyContext,
+) (*VerifyReport, error) {
+	ctx := defaultVerifyContext
+	if len(context) > 0 { ctx = context[0] }
+	if ctx.MaxProblems <= 0 {
+		ctx.MaxProblems = defaultVerifyContext.MaxProblems
+	}
+
+	hd := snap.Header()
+	if hd.NSide < 0 || hd.NTotal < 0 {
+		return nil, fmt.Errorf("Header has NSide = %d and NTotal = %d.",
+			hd.NSide, hd.NTotal)
+	}
+
+	r := &VerifyReport{ Files: snap.Files(), maxProblems: ctx.MaxProblems }
+
+	n3 := hd.NSide*hd.NSide*hd.NSide
+	checkIDs := !ctx.SkipIDs
+	if n3 != hd.NTotal {
+		r.add(CountProblem, -1, "NTotal = %d, but NSide^3 = %d.",
+			hd.NTotal, n3)
+		checkIDs = false
+	}
+	ids := newVerifyIDSet(n3, checkIDs, snap)
+
+	complete := true
+	for i := 0; i < snap.Files(); i++ {
+		if rv, ok := snap.(recordVerifier); ok {
+			if err := rv.verifyRecords(i); err != nil {
+				r.add(RecordProblem, i, "%s", err.Error())
+				complete = false
+				continue
+			}
+		}
+
+		n, ok := verifyFile(snap, i, r, ids)
+		r.Particles += n
+		complete = complete && ok
+	}
+
+	if !complete { return r, nil }
+
+	if r.Particles != hd.NTotal {
+		r.add(CountProblem, -1, "%d particles were read, but NTotal = %d.",
+			r.Particles, hd.NTotal)
+	}
+	if ids != nil {
+		if missing, first := ids.missing(); missing > 0 {
+			r.add(IDProblem, -1, "%d IDs are missing, including %d.",
+				missing, first)
+		}
+	}
+
+	return r, nil
+}
+
+// verifyFile checks the blocks of file i and returns the number of particles
+// in it and whether every block could be read.
+func verifyFile(
+	snap Snapshot, i int, r *VerifyReport, ids *verifyIDSet,
+) (int64, bool) {
+	hd := snap.Header()
+	ok := true
+
+	id, err := snap.ReadID(i)
+	if err != nil {
+		r.add(ReadProblem, i, "IDs: %s", err.Error())
+		ok = false
+	} else if ids != nil {
+		ids.add(id, i, r)
+	}
+	n := len(id)
+
+	mp, err := snap.ReadMp(i)
+	if err != nil {
+		r.add(ReadProblem, i, "masses: %s", err.Error())
+		ok = false
+	} else if len(mp) != n && ok {
+		r.add(CountProblem, i, "%d masses, but %d IDs.", len(mp), n)
+	}
+
+	v, err := snap.ReadV(i)
+	if err != nil {
+		r.add(ReadProblem, i, "velocities: %s", err.Error())
+		ok = false
+	} else if len(v) != n && ok {
+		r.add(CountProblem, i, "%d velocities, but %d IDs.", len(v), n)
+	}
+
+	x, err := snap.ReadX(i)
+	if err != nil {
+		r.add(ReadProblem, i, "positions: %s", err.Error())
+		return int64(n), false
+	} else if len(x) != n && ok {
+		r.add(CountProblem, i, "%d positions, but %d IDs.", len(x), n)
+	}
+
+	L := float32(hd.L)
+	for j := range x {
+		for k := 0; k < 3; k++ {
+			xk := float64(x[j][k])
+			if math.IsNaN(xk) || math.IsInf(xk, 0) || x[j][k] < 0 ||
+				x[j][k] >= L {
+				r.add(PositionProblem, i, "particle %d has x = %g.", j, x[j])
+				break
+			}
+		}
+	}
+
+	return int64(n), ok
+}
+
+// verifyIDSet records which IDs on the Lagrangian grid have been seen.
+type verifyIDSet struct {
+	minID, n int64
+	seen []uint64
+	unique int64
+}
+
+// newVerifyIDSet returns a set for the IDs of snap on a grid with n points,
+// or nil if IDs aren't checked.
+func newVerifyIDSet(n int64, checkIDs bool, snap Snapshot) *verifyIDSet {
+	if !checkIDs { return nil }
+
+	set := &verifyIDSet{ minID: 1, n: n, seen: make([]uint64, (n + 63)/64) }
+	if _, ok := snap.(zeroIndexedSnapshot); ok { set.minID = 0 }
+	return set
+}
+
+// add adds the IDs in file i to the set and reports duplicates and IDs
+// outside the grid.
+func (set *verifyIDSet) add(id []int64, i int, r *VerifyReport) {
+	for _, x := range id {
+		j := x - set.minID
+		if j < 0 || j >= set.n {
+			r.add(IDProblem, i, "ID %d is outside the range [%d, %d].",
+				x, set.minID, set.minID + set.n - 1)
+			continue
+		}
+
+		word, bit := j / 64, uint64(1) << uint(j % 64)
+		if set.seen[word] & bit != 0 {
+			r.add(IDProblem, i, "ID %d is duplicated.", x)
+			continue
+		}
+		set.seen[word] |= bit
+		set.unique++
+	}
+}
+
+// missing returns the number of IDs which haven't been seen and the first of
+// them.
+func (set *verifyIDSet) missing() (int64, int64) {
+	missing := set.n - set.unique
+	if missing == 0 { return 0, 0 }
+
+	for j := int64(0); j < set.n; j++ {
+		if set.seen[j / 64] & (uint64(1) << uint(j % 64)) == 0 {
+			return missing, j + set.minID
+		}
+	}
+	panic("Impossible")
+}
@@ -0,0 +1,157 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// overwriteTestBytes overwrites the bytes of a file at a given offset with
+// data.
+func overwriteTestBytes(fname string, offset int64, data interface{}) {
+	f, err := os.OpenFile(fname, os.O_WRONLY, 0644)
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+
+	if _, err = f.Seek(offset, 0); err != nil { panic(err.Error()) }
+	err = binary.Write(f, binary.LittleEndian, data)
+	if err != nil { panic(err.Error()) }
+}
+
+func TestVerifyLGadget2(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_verify_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	err = Convert(newTestMockSnapshot(), LGadget2Writer(dir, "test.%03d"),
+		ConvertContext{ Files: 4 })
+	if err != nil { t.Fatal(err.Error()) }
+
+	snap, err := LGadget2(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	r, err := Verify(snap)
+	if err != nil { t.Fatal(err.Error()) }
+	if !r.OK() || r.Files != 4 || r.Particles != 1000 {
+		t.Errorf("Expected clean report, got %s", r)
+	}
+
+	n := int64(250)
+	xStart := lGadget2HeaderBytes + 4
+	vStart := xStart + 12*n + 8
+	idStart := vStart + 12*n + 8
+
+	// Give the second particle of file 1 the ID of the first.
+	fname1 := path.Join(dir, "test.001")
+	overwriteTestBytes(fname1, idStart + 8, int64(251))
+
+	snap, err = LGadget2(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	r, err = Verify(snap)
+	if err != nil { t.Fatal(err.Error()) }
+	if r.Counts[IDProblem] != 2 || len(r.Problems) != 2 ||
+		r.Problems[0].File != 1 || r.Problems[1].File != -1 ||
+		!strings.Contains(r.Problems[1].Message, "including 252") {
+		t.Errorf("Expected a duplicate and a missing ID, got %s", r)
+	}
+
+	// Move a particle in file 2 outside the box and break the footer of the
+	// velocity block in file 3.
+	fname2 := path.Join(dir, "test.002")
+	overwriteTestBytes(fname2, xStart + 12*7, float32(math.NaN()))
+	fname3 := path.Join(dir, "test.003")
+	overwriteTestBytes(fname3, vStart + 12*n, int32(7))
+
+	snap, err = LGadget2(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	r, err = Verify(snap, VerifyContext{ MaxProblems: 1 })
+	if err != nil { t.Fatal(err.Error()) }
+	if r.Counts[ReadProblem] != 1 || r.Counts[RecordProblem] != 1 ||
+		r.Counts[IDProblem] != 1 || len(r.Problems) != 3 {
+		t.Fatalf("Expected read, record, and ID problems, got %s", r)
+	}
+	for _, p := range r.Problems {
+		switch p.Kind {
+		case ReadProblem:
+			if p.File != 2 || !strings.Contains(p.Message, fname2) {
+				t.Errorf("Read problem %s doesn't name %s.", p, fname2)
+			}
+		case RecordProblem:
+			if p.File != 3 {
+				t.Errorf("Record problem %s isn't in file 3.", p)
+			}
+		}
+	}
+}
+
+func TestVerifyPositions(t *testing.T) {
+	snap := newTestMockSnapshot().(*mockSnapshot)
+	snap.x[0][3] = [3]float32{ 1, 10, 1 }
+	snap.x[0][5] = [3]float32{ -1, 0, 0 }
+	snap.x[0][9] = [3]float32{ float32(math.Inf(+1)), 0, 0 }
+
+	r, err := Verify(snap)
+	if err != nil { t.Fatal(err.Error()) }
+	if r.Counts[PositionProblem] != 3 || len(r.Problems) != 3 {
+		t.Errorf("Expected three position problems, got %s", r)
+	}
+
+	snap = newTestMockSnapshot().(*mockSnapshot)
+	snap.id[0][0] = 1001
+	r, err = Verify(snap)
+	if err != nil { t.Fatal(err.Error()) }
+	if r.Counts[IDProblem] != 2 {
+		t.Errorf("Expected out of range and missing IDs, got %s", r)
+	}
+
+	r, err = Verify(snap, VerifyContext{ SkipIDs: true })
+	if err != nil { t.Fatal(err.Error()) }
+	if !r.OK() { t.Errorf("Expected clean report, got %s", r) }
+}
+
+func TestVerifyLVec(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_verify_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	err = ConvertToLVec(newTestMockSnapshot(), 2, 5, 0.1, 0.01,
+		dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	snap, err := LVec(dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+
+	r, err := Verify(snap)
+	if err != nil { t.Fatal(err.Error()) }
+	if !r.OK() || r.Files != 8 || r.Particles != 1000 {
+		t.Errorf("Expected clean report, got %s", r)
+	}
+
+	// IDs line up with positions in every file.
+	for i := 0; i < snap.Files(); i++ {
+		x, err := snap.ReadX(i)
+		if err != nil { t.Fatal(err.Error()) }
+		id, err := snap.ReadID(i)
+		if err != nil { t.Fatal(err.Error()) }
+
+		mismatches := 0
+		for j := range id {
+			target := [3]float32{
+				float32(id[j] % 10), float32(id[j] / 10 % 10),
+				float32(id[j] / 100),
+			}
+			for k := 0; k < 3; k++ {
+				if math.Abs(float64(x[j][k] - target[k])) > 0.1 {
+					mismatches++
+					break
+				}
+			}
+		}
+		if mismatches > 0 {
+			t.Errorf("%d of %d IDs in file %d don't match their positions.",
+				mismatches, len(id), i)
+		}
+	}
+}
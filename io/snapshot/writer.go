@@ -0,0 +1,300 @@
+package snapshot
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+)
+
+// Writer writes a snapshot in a specific format. It mirrors Snapshot: file i
+// of the output is started with WriteHeader, after which its particles are
+// supplied by WriteX, WriteV, WriteID, and WriteMp, in any order. The slices
+// passed to these methods may be reused by the caller once they return. Close
+// must be called after every file has been written.
+type Writer interface {
+	// WriteHeader starts file i out of files. The file will contain n
+	// particles. rawHd is the raw header of the source snapshot, if any.
+	WriteHeader(i, files, n int, hd *Header, rawHd []byte) error
+	WriteX(i int, x [][3]float32) error // Write positions for file i.
+	WriteV(i int, v [][3]float32) error // Write velocities for file i.
+	WriteID(i int, id []int64) error // Write IDs for file i.
+	WriteMp(i int, mp []float32) error // Write particle masses for file i.
+	Close() error // Finish writing the snapshot.
+}
+
+// ConvertContext contains optional parameters for Convert.
+type ConvertContext struct {
+	// Files is the number of output files. If zero, the number of files in
+	// the source snapshot is used.
+	Files int
+	// Subsample is the stride used to subsample the Lagrangian grid. Only
+	// particles whose Lagrangian indices are all multiples of Subsample are
+	// kept. If zero, all particles are kept. Only a single species can be
+	// subsampled.
+	Subsample int64
+	// Species lists the particle species to convert. If empty, every
+	// particle is converted.
+	Species []int
+	// Provenance is stored in the converted snapshot if it's non-nil. The
+	// conversion parameters are added to it, and its time is set if it's
+	// zero. The Writers returned by LGadget2Writer and LVecWriter can store
+	// provenance metadata.
+	Provenance *Provenance
+}
+
+// Convert writes the particles in src to dst and closes dst. Particles are
+// written in the order they're read, split as evenly as possible between the
+// output files. If particles are subsampled, IDs are renumbered on the smaller
+// Lagrangian grid and masses are increased so that the total mass doesn't
+// change. If only some species are converted, NSide is set by the number of
+// selected particles and UniformMp is set if they all have the same mass.
+// Written IDs always start at one, so IDs from snapshots whose IDs start at
+// zero, like LVec snapshots, are shifted up by one. dst is closed even if an
+// error is returned. Additional information may be optionally offered in the
+// form of a ConvertContext instance.
+func Convert(src Snapshot, dst Writer, context ...ConvertContext) error {
+	ctx := ConvertContext{ }
+	if len(context) > 0 { ctx = context[0] }
+
+	files := ctx.Files
+	if files <= 0 { files = src.Files() }
+	sub := ctx.Subsample
+	if sub <= 0 { sub = 1 }
+
+	pw, ok := dst.(provenanceWriter)
+	if ctx.Provenance != nil && !ok {
+		dst.Close()
+		return fmt.Errorf("The output format can't store provenance " +
+			"metadata.")
+	}
+
+	if err := convertParticles(src, dst, files, sub, ctx); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil { return err }
+	if ctx.Provenance == nil { return nil }
+
+	return pw.writeProvenance(newProvenance(ctx.Provenance, map[string]float64{
+		"files": float64(files), "subsample": float64(sub),
+	}))
+}
+
+// convertParticles writes the particles in src to files output files of dst
+// with a subsampling stride of sub. It's the implementation of Convert, but
+// doesn't close dst.
+func convertParticles(
+	src Snapshot, dst Writer, files int, sub int64, ctx ConvertContext,
+) error {
+	hd := *src.Header()
+	species := ctx.Species
+	if len(species) == 0 {
+		species = []int{ -1 }
+	} else {
+		nSelected := int64(0)
+		for _, s := range species {
+			if s < 0 || s >= MaxSpecies {
+				return fmt.Errorf("Particle species %d is not in the range " +
+					"[0, %d).", s, MaxSpecies)
+			}
+			nSelected += hd.NPart[s]
+		}
+		hd.NSide = intCubeRoot(nSelected)
+	}
+
+	if sub > 1 && convertSpeciesCount(&hd, ctx.Species) > 1 {
+		return fmt.Errorf("Only a single species can be subsampled.")
+	} else if hd.NSide % sub != 0 {
+		return fmt.Errorf("Subsample = %d doesn't evenly divide NSide = %d.",
+			sub, hd.NSide)
+	}
+
+	idOffset := int64(0)
+	if _, ok := src.(zeroIndexedSnapshot); ok { idOffset = 1 }
+
+	// The first pass counts the particles that will be written so that each
+	// output file can be given its size up front.
+	n, nPart := int64(0), [MaxSpecies]int64{ }
+	mpMin, mpMax := float32(math.Inf(+1)), float32(math.Inf(-1))
+	for i := 0; i < src.Files(); i++ {
+		for _, s := range species {
+			id, err := src.ReadIDSpecies(i, s)
+			if err != nil { return err }
+			for _, x := range id {
+				_, ok := subsampleID(x + idOffset, hd.NSide, sub)
+				if !ok { continue }
+				n++
+				if s >= 0 { nPart[s]++ }
+			}
+
+			if s < 0 { continue }
+			mp, err := src.ReadMpSpecies(i, s)
+			if err != nil { return err }
+			for _, m := range mp {
+				if m < mpMin { mpMin = m }
+				if m > mpMax { mpMax = m }
+			}
+		}
+	}
+
+	subHd := hd
+	subHd.NTotal = n
+	subHd.NSide /= sub
+	subHd.NPart = convertNPart(&hd, ctx.Species, nPart, n)
+	if len(ctx.Species) > 0 && mpMin == mpMax {
+		subHd.UniformMp = float64(mpMin)
+	}
+	subHd.UniformMp *= float64(sub*sub*sub)
+
+	var rawHd []byte
+	if src.Files() > 0 { rawHd = src.RawHeader(0) }
+
+	buf := &convertBuffer{ idOffset: idOffset }
+	mpFactor := float32(sub*sub*sub)
+	out := 0
+
+	for i := 0; i < src.Files(); i++ {
+		runtime.GC()
+
+		for _, s := range species {
+			err := buf.read(src, i, s, hd.NSide, sub, mpFactor)
+			if err != nil { return err }
+		}
+
+		for ; out < files && len(buf.id) >= convertFileSize(out, files, n);
+			out++ {
+			err := buf.write(dst, out, files, &subHd, rawHd)
+			if err != nil { return err }
+		}
+	}
+
+	for ; out < files; out++ {
+		err := buf.write(dst, out, files, &subHd, rawHd)
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+// convertSpeciesCount returns the number of species with particles which are
+// converted.
+func convertSpeciesCount(hd *Header, species []int) int {
+	count := 0
+	if len(species) == 0 {
+		for s := range hd.NPart {
+			if hd.NPart[s] > 0 { count++ }
+		}
+	} else {
+		for _, s := range species {
+			if hd.NPart[s] > 0 { count++ }
+		}
+	}
+	return count
+}
+
+// convertNPart returns the number of particles of each species written by
+// Convert. nPart is the count of each selected species and n is the count of
+// all particles.
+func convertNPart(
+	hd *Header, species []int, nPart [MaxSpecies]int64, n int64,
+) [MaxSpecies]int64 {
+	if len(species) > 0 { return nPart }
+
+	out := [MaxSpecies]int64{ }
+	switch convertSpeciesCount(hd, nil) {
+	case 0:
+		out[DarkMatter] = n
+	case 1:
+		for s := range hd.NPart {
+			if hd.NPart[s] > 0 { out[s] = n }
+		}
+	default:
+		// Multiple species can't be subsampled, so nothing has changed.
+		out = hd.NPart
+	}
+
+	return out
+}
+
+// subsampleID returns the ID of a particle on a Lagrangian grid with the
+// given stride and whether the particle is on that grid. IDs start at one.
+func subsampleID(id, nSide, sub int64) (int64, bool) {
+	if sub == 1 { return id, true }
+
+	idx := id - 1
+	ix, iy, iz := idx % nSide, (idx / nSide) % nSide, idx / (nSide*nSide)
+	if ix % sub != 0 || iy % sub != 0 || iz % sub != 0 { return 0, false }
+
+	nSub := nSide / sub
+	return 1 + ix/sub + (iy/sub)*nSub + (iz/sub)*nSub*nSub, true
+}
+
+// convertFileSize returns the number of particles in output file i.
+func convertFileSize(i, files int, n int64) int {
+	return int(n*int64(i + 1)/int64(files) - n*int64(i)/int64(files))
+}
+
+// convertBuffer holds particles which have been read but not yet written.
+type convertBuffer struct {
+	x, v [][3]float32
+	mp []float32
+	id []int64
+	idOffset int64 // Added to IDs so that they start at one.
+}
+
+// read appends the particles of a single species in file i of src to the
+// buffer.
+func (buf *convertBuffer) read(
+	src Snapshot, i, species int, nSide, sub int64, mpFactor float32,
+) error {
+	x, err := src.ReadXSpecies(i, species)
+	if err != nil { return err }
+	x = append([][3]float32{ }, x...)
+	v, err := src.ReadVSpecies(i, species)
+	if err != nil { return err }
+	v = append([][3]float32{ }, v...)
+	mp, err := src.ReadMpSpecies(i, species)
+	if err != nil { return err }
+	mp = append([]float32{ }, mp...)
+	id, err := src.ReadIDSpecies(i, species)
+	if err != nil { return err }
+
+	for j := range id {
+		subID, ok := subsampleID(id[j] + buf.idOffset, nSide, sub)
+		if !ok { continue }
+		buf.x = append(buf.x, x[j])
+		buf.v = append(buf.v, v[j])
+		buf.id = append(buf.id, subID)
+		buf.mp = append(buf.mp, mp[j]*mpFactor)
+	}
+
+	return nil
+}
+
+// write writes the next file's worth of particles to dst and removes them
+// from the buffer.
+func (buf *convertBuffer) write(
+	dst Writer, i, files int, hd *Header, rawHd []byte,
+) error {
+	n := convertFileSize(i, files, hd.NTotal)
+	if n > len(buf.id) {
+		return fmt.Errorf("Output file %d needs %d particles, but only %d " +
+			"were read.", i, n, len(buf.id))
+	}
+
+	if err := dst.WriteHeader(i, files, n, hd, rawHd); err != nil {
+		return err
+	}
+	if err := dst.WriteX(i, buf.x[:n]); err != nil { return err }
+	if err := dst.WriteV(i, buf.v[:n]); err != nil { return err }
+	if err := dst.WriteID(i, buf.id[:n]); err != nil { return err }
+	if err := dst.WriteMp(i, buf.mp[:n]); err != nil { return err }
+
+	buf.x = buf.x[:copy(buf.x, buf.x[n:])]
+	buf.v = buf.v[:copy(buf.v, buf.v[n:])]
+	buf.id = buf.id[:copy(buf.id, buf.id[n:])]
+	buf.mp = buf.mp[:copy(buf.mp, buf.mp[n:])]
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestConvertLGadget2(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_convert_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	snap := newTestMockSnapshot()
+	err = Convert(snap, LGadget2Writer(dir, "test.%03d"),
+		ConvertContext{ Files: 3 })
+	if err != nil { t.Fatal(err.Error()) }
+
+	lsnap, err := LGadget2(dir)
+	if err != nil { t.Fatal(err.Error()) }
+	if lsnap.Files() != 3 || lsnap.Header().NTotal != 1000 {
+		t.Fatalf("Expected 3 files and 1000 particles, got %d and %d.",
+			lsnap.Files(), lsnap.Header().NTotal)
+	}
+
+	x, _ := snap.ReadX(0)
+	v, _ := snap.ReadV(0)
+	id, _ := snap.ReadID(0)
+
+	start := 0
+	for i, n := range []int{ 333, 333, 334 } {
+		lx, err := lsnap.ReadX(i)
+		if err != nil { t.Fatal(err.Error()) }
+		if len(lx) != n {
+			t.Fatalf("File %d has %d particles, not %d.", i, len(lx), n)
+		}
+		for j := range lx {
+			if !vecEq(lx[j], x[start + j], 1e-4) {
+				t.Errorf("%d) x[%d] = %g, not %g", i, j, lx[j], x[start + j])
+				break
+			}
+		}
+
+		lv, err := lsnap.ReadV(i)
+		if err != nil { t.Fatal(err.Error()) }
+		for j := range lv {
+			if !vecEq(lv[j], v[start + j], 1e-4) {
+				t.Errorf("%d) v[%d] = %g, not %g", i, j, lv[j], v[start + j])
+				break
+			}
+		}
+
+		lid, err := lsnap.ReadID(i)
+		if err != nil { t.Fatal(err.Error()) }
+		for j := range lid {
+			if lid[j] != id[start + j] {
+				t.Errorf("%d) id[%d] = %d, not %d",
+					i, j, lid[j], id[start + j])
+				break
+			}
+		}
+
+		start += n
+	}
+}
+
+func TestConvertSubsample(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_convert_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "test.tipsy")
+
+	snap := newTestMockSnapshot()
+	ctx := defaultTipsyContext
+	ctx.L, ctx.MassUnit = 10, 1e10
+
+	err = Convert(snap, TipsyWriter(fname, ctx), ConvertContext{ Subsample: 2 })
+	if err != nil { t.Fatal(err.Error()) }
+
+	tsnap, err := Tipsy(fname, ctx)
+	if err != nil { t.Fatal(err.Error()) }
+	hd := tsnap.Header()
+	if hd.NTotal != 125 || !tsnap.UniformMass() ||
+		!floatEq(float32(hd.UniformMp),
+			float32(8*snap.Header().UniformMp), 1e5) {
+		t.Fatalf("Header = %v", hd)
+	}
+
+	x, err := tsnap.ReadX(0)
+	if err != nil { t.Fatal(err.Error()) }
+	i := 0
+	for iz := 0; iz < 5; iz++ {
+		for iy := 0; iy < 5; iy++ {
+			for ix := 0; ix < 5; ix++ {
+				exp := [3]float32{ float32(2*ix), float32(2*iy), float32(2*iz) }
+				if !vecEq(x[i], exp, 1e-4) {
+					t.Fatalf("x[%d] = %g, not %g", i, x[i], exp)
+				}
+				i++
+			}
+		}
+	}
+
+	err = Convert(snap, TipsyWriter(fname, ctx), ConvertContext{ Subsample: 3 })
+	if err == nil {
+		t.Errorf("Expected error when Subsample doesn't divide NSide.")
+	}
+}
+
+func TestConvertLVec(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_convert_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	snap := newTestMockSnapshot()
+	err = Convert(snap, LVecWriter(dir, "test.%s.%d.lvec", 1, 2, 0.1, 0.01))
+	if err != nil { t.Fatal(err.Error()) }
+
+	lvec, err := LVec(dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+
+	checkTestQuantizedSnapshot(lvec, t)
+}
+
+func TestConvertFromLVec(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_convert_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	err = ConvertToLVec(newTestMockSnapshot(), 2, 1, 0.1, 0.01,
+		dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	lvec, err := LVec(dir, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+
+	// LVec IDs start at zero, but the converted IDs start at one.
+	for i, sub := range []int64{ 1, 2 } {
+		out := path.Join(dir, fmt.Sprintf("lgadget2_%d", sub))
+		if err = os.Mkdir(out, 0755); err != nil { t.Fatal(err.Error()) }
+		err = Convert(lvec, LGadget2Writer(out, "test.%03d"),
+			ConvertContext{ Subsample: sub })
+		if err != nil { t.Fatal(err.Error()) }
+
+		lsnap, err := LGadget2(out)
+		if err != nil { t.Fatal(err.Error()) }
+		nSide := 10 / sub
+		if n := lsnap.Header().NTotal; n != nSide*nSide*nSide {
+			t.Fatalf("%d) Converted snapshot has %d particles.", i, n)
+		}
+
+		for j := 0; j < lsnap.Files(); j++ {
+			x, err := lsnap.ReadX(j)
+			if err != nil { t.Fatal(err.Error()) }
+			id, err := lsnap.ReadID(j)
+			if err != nil { t.Fatal(err.Error()) }
+
+			for k := range id {
+				idx := id[k] - 1
+				xTarget := [3]float32{
+					float32(sub*(idx % nSide)),
+					float32(sub*((idx / nSide) % nSide)),
+					float32(sub*(idx / (nSide*nSide))),
+				}
+				if !vecEq(x[k], xTarget, 0.2) {
+					t.Fatalf("%d) particle with ID %d has x = %g, not %g.",
+						i, id[k], x[k], xTarget)
+				}
+			}
+		}
+	}
+
+	out := path.Join(dir, "lvec")
+	if err = os.Mkdir(out, 0755); err != nil { t.Fatal(err.Error()) }
+	err = Convert(lvec, LVecWriter(out, "test.%s.%d.lvec", 1, 1, 0.1, 0.01))
+	if err != nil { t.Fatal(err.Error()) }
+	lvecOut, err := LVec(out, "test.%s.%d.lvec")
+	if err != nil { t.Fatal(err.Error()) }
+	checkTestLVecPositions(lvecOut, t)
+}
+
+func TestConvertSpecies(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_convert_data")
+	if err != nil { panic(err.Error()) }
+	defer os.RemoveAll(dir)
+	writeTestGadget2Snapshot(dir)
+
+	snap, err := Gadget2(dir)
+	if err != nil { t.Fatal(err.Error()) }
+
+	fname := path.Join(dir, "test.tipsy")
+	ctx := defaultTipsyContext
+	ctx.L, ctx.MassUnit = 10, 1e10
+
+	err = Convert(snap, TipsyWriter(fname, ctx),
+		ConvertContext{ Species: []int{ DarkMatter } })
+	if err != nil { t.Fatal(err.Error()) }
+
+	tsnap, err := Tipsy(fname, ctx)
+	if err != nil { t.Fatal(err.Error()) }
+	hd := tsnap.Header()
+	if hd.NTotal != 3 || hd.NPart[DarkMatter] != 3 || !tsnap.UniformMass() ||
+		!floatEq(float32(hd.UniformMp), 2e10, 1e4) {
+		t.Fatalf("Header = %v", hd)
+	}
+
+	x, err := tsnap.ReadXSpecies(0, DarkMatter)
+	if err != nil { t.Fatal(err.Error()) }
+	for i := range x {
+		if !vecEq(x[i], [3]float32{ float32(i + 2), 1, 2 }, 1e-4) {
+			t.Errorf("x = %g", x)
+			break
+		}
+	}
+
+	gas, err := tsnap.ReadXSpecies(0, Gas)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(gas) != 0 {
+		t.Errorf("Expected no gas particles, got %d.", len(gas))
+	}
+
+	err = Convert(snap, TipsyWriter(fname, ctx),
+		ConvertContext{ Species: []int{ MaxSpecies } })
+	if err == nil {
+		t.Errorf("Expected error for an invalid species.")
+	}
+}
+
+func TestMockSnapshotFiles(t *testing.T) {
+	hd := &Header{ NTotal: 3, UniformMp: 2 }
+	x := [][][3]float32{ { }, make([][3]float32, 3) }
+	id := [][]int64{ { }, { 0, 1, 2 } }
+	snap := NewMockSnapshot(hd, x, x, id)
+
+	if hd.NPart != [MaxSpecies]int64{ } {
+		t.Errorf("NewMockSnapshot modified the header it was given.")
+	}
+	if !snap.UniformMass() {
+		t.Errorf("Expected uniform masses when file 0 is empty.")
+	}
+	for i := range x {
+		mp, err := snap.ReadMp(i)
+		if err != nil { t.Fatal(err.Error()) }
+		if len(mp) != len(x[i]) {
+			t.Errorf("File %d has %d masses, not %d.", i, len(mp), len(x[i]))
+		}
+	}
+}
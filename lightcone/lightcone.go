@@ -0,0 +1,305 @@
+/*package lightcone builds light-cone catalogues from the periodic outputs of
+cosmological simulations.*/
+package lightcone
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/phil-mansfield/nbody-utils/cosmo"
+)
+
+const (
+	// crossingIterations is the number of fixed-point iterations used to
+	// find the distance at which an object crosses the light-cone.
+	crossingIterations = 5
+	// maxDriftFrac is the largest fraction of a shell's thickness that an
+	// object is assumed to move while the light-cone crosses it.
+	maxDriftFrac = 0.01
+	// tableStep is the redshift spacing of distance tables.
+	tableStep = 1e-3
+)
+
+// Footprint is a region of the sky.
+type Footprint interface {
+	// Contains returns true if the point (ra, dec), in degrees, is in the
+	// footprint.
+	Contains(ra, dec float64) bool
+}
+
+// RADecBox is a Footprint bounded by lines of constant right ascension and
+// declination, in degrees. If RAMin > RAMax, the box wraps around RA = 0.
+type RADecBox struct {
+	RAMin, RAMax, DecMin, DecMax float64
+}
+
+// Contains returns true if the point (ra, dec) is in the box.
+func (b RADecBox) Contains(ra, dec float64) bool {
+	if dec < b.DecMin || dec > b.DecMax { return false }
+	if b.RAMin <= b.RAMax { return ra >= b.RAMin && ra <= b.RAMax }
+	return ra >= b.RAMin || ra <= b.RAMax
+}
+
+// Config contains the parameters used to build a light-cone.
+type Config struct {
+	// Observer is the position of the observer in the box in Mpc/h.
+	Observer [3]float64
+	// Footprint is the region of the sky covered by the light-cone. If nil,
+	// the full sky is used.
+	Footprint Footprint
+	OmegaM, OmegaL float64 // Cosmological parameters. Both must be set.
+	// ZMin is the redshift of the inner edge of the light-cone.
+	ZMin float64
+	// ZMax is the redshift of the outer edge of the light-cone. If zero, the
+	// light-cone ends at the earliest output.
+	ZMax float64
+}
+
+// Catalogue is a light-cone catalogue. Angles are in degrees.
+type Catalogue struct {
+	ID []int64
+	RA, Dec []float64
+	// Z is the cosmological redshift at which each object crosses the
+	// light-cone, and ZObs also includes the Doppler shift from its
+	// line-of-sight peculiar velocity.
+	Z, ZObs []float64
+}
+
+// Len returns the number of objects in the catalogue.
+func (cat *Catalogue) Len() int { return len(cat.ID) }
+
+// WriteText writes the catalogue as whitespace-separated text with one object
+// per line and a commented header line.
+func (cat *Catalogue) WriteText(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "# ID RA Dec Z ZObs\n")
+	for i := range cat.ID {
+		fmt.Fprintf(buf, "%d %.7f %.7f %.7f %.7f\n",
+			cat.ID[i], cat.RA[i], cat.Dec[i], cat.Z[i], cat.ZObs[i])
+	}
+	return buf.Flush()
+}
+
+// shell is the range of comoving distances covered by a single Source.
+type shell struct {
+	src Source
+	dSrc float64 // Comoving distance at the Source's scale factor.
+	dIn, dOut float64
+}
+
+// Build builds a light-cone from a sequence of outputs. Each output covers
+// the shell of comoving distances between the midpoints of its scale factor
+// and the scale factors of its neighbours, and the periodic box is
+// replicated as many times as needed to fill the shell. The distance at
+// which each object crosses the light-cone is found by moving it along its
+// velocity from the output's time.
+func Build(sources []Source, config Config) (*Catalogue, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("No outputs were given.")
+	} else if config.OmegaM <= 0 || config.OmegaL < 0 {
+		return nil, fmt.Errorf("OmegaM = %g and OmegaL = %g are not valid.",
+			config.OmegaM, config.OmegaL)
+	}
+
+	shells, table, err := newShells(sources, config)
+	if err != nil { return nil, err }
+
+	cat := &Catalogue{ }
+	for i := range shells {
+		err := addShell(cat, &shells[i], table, config)
+		if err != nil { return nil, err }
+	}
+
+	return cat, nil
+}
+
+// newShells sorts the sources by scale factor and finds the shell covered by
+// each of them.
+func newShells(
+	sources []Source, config Config,
+) ([]shell, *distanceTable, error) {
+	sources = append([]Source{ }, sources...)
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Scale() < sources[j].Scale()
+	})
+
+	n := len(sources)
+	edges := make([]float64, n + 1)
+	for i := 1; i < n; i++ {
+		edges[i] = (sources[i-1].Scale() + sources[i].Scale()) / 2
+	}
+	edges[n] = 1 / (1 + config.ZMin)
+	if config.ZMax > 0 {
+		edges[0] = 1 / (1 + config.ZMax)
+	} else {
+		edges[0] = sources[0].Scale()
+	}
+
+	if edges[0] <= 0 || edges[0] > edges[1] || edges[n-1] > edges[n] {
+		return nil, nil, fmt.Errorf("The redshift range [%g, %g] doesn't " +
+			"cover the outputs.", config.ZMin, config.ZMax)
+	}
+
+	om, ol := config.OmegaM, config.OmegaL
+	table := newDistanceTable(om, ol, 1/edges[0] - 1)
+
+	shells := make([]shell, n)
+	for i := range shells {
+		shells[i] = shell{
+			src: sources[i],
+			dSrc: cosmo.ComovingDistance(om, ol, 1/sources[i].Scale() - 1),
+			dIn: cosmo.ComovingDistance(om, ol, 1/edges[i+1] - 1),
+			dOut: cosmo.ComovingDistance(om, ol, 1/edges[i] - 1),
+		}
+	}
+
+	return shells, table, nil
+}
+
+// addShell adds every object which crosses the light-cone within a shell to
+// the catalogue.
+func addShell(
+	cat *Catalogue, sh *shell, table *distanceTable, config Config,
+) error {
+	if sh.dIn >= sh.dOut { return nil }
+	images := boxImages(sh, config.Observer)
+	cKms := cosmo.CMks / 1e3
+
+	for b := 0; b < sh.src.Blocks(); b++ {
+		x, v, id, err := sh.src.ReadBlock(b)
+		if err != nil { return err }
+
+		for j := range x {
+			vj := [3]float64{
+				float64(v[j][0]), float64(v[j][1]), float64(v[j][2]),
+			}
+
+			for _, off := range images {
+				xj := [3]float64{
+					float64(x[j][0]) + off[0] - config.Observer[0],
+					float64(x[j][1]) + off[1] - config.Observer[1],
+					float64(x[j][2]) + off[2] - config.Observer[2],
+				}
+				d, r := crossing(xj, vj, sh.dSrc, cKms)
+				if d < sh.dIn || d >= sh.dOut || d == 0 { continue }
+
+				ra, dec := skyAngles(r, d)
+				if config.Footprint != nil &&
+					!config.Footprint.Contains(ra, dec) {
+					continue
+				}
+
+				z := table.redshift(d)
+				vLOS := (vj[0]*r[0] + vj[1]*r[1] + vj[2]*r[2]) / d
+
+				cat.ID = append(cat.ID, id[j])
+				cat.RA, cat.Dec = append(cat.RA, ra), append(cat.Dec, dec)
+				cat.Z = append(cat.Z, z)
+				cat.ZObs = append(cat.ZObs, (1 + z)*(1 + vLOS/cKms) - 1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// boxImages returns the offsets of every periodic image of the box which
+// could contain objects in a shell.
+func boxImages(sh *shell, obs [3]float64) [][3]float64 {
+	L := sh.src.BoxSize()
+	margin := maxDriftFrac * math.Max(sh.dOut - sh.dSrc, sh.dSrc - sh.dIn)
+	dIn, dOut := sh.dIn - margin, sh.dOut + margin
+
+	nMax := int(math.Ceil(dOut / L)) + 1
+	images := [][3]float64{ }
+	for ix := -nMax; ix <= nMax; ix++ {
+		for iy := -nMax; iy <= nMax; iy++ {
+			for iz := -nMax; iz <= nMax; iz++ {
+				off := [3]float64{
+					float64(ix)*L, float64(iy)*L, float64(iz)*L,
+				}
+				lo, hi := cubeDistances(off, L, obs)
+				if lo < dOut && hi >= dIn { images = append(images, off) }
+			}
+		}
+	}
+
+	return images
+}
+
+// cubeDistances returns the smallest and largest distances between obs and a
+// cube of width L whose lowest corner is at origin.
+func cubeDistances(
+	origin [3]float64, L float64, obs [3]float64,
+) (lo, hi float64) {
+	lo2, hi2 := 0.0, 0.0
+	for k := 0; k < 3; k++ {
+		d0, d1 := origin[k] - obs[k], origin[k] + L - obs[k]
+		if d0 > 0 {
+			lo2 += d0*d0
+		} else if d1 < 0 {
+			lo2 += d1*d1
+		}
+		far := math.Max(math.Abs(d0), math.Abs(d1))
+		hi2 += far*far
+	}
+	return math.Sqrt(lo2), math.Sqrt(hi2)
+}
+
+// crossing returns the comoving distance at which an object crosses the
+// light-cone and its position relative to the observer at that time. x is
+// the object's position relative to the observer when the light-cone is at
+// the distance dSrc and v is its peculiar velocity. Comoving positions
+// change by v/c per unit of comoving distance travelled by light.
+func crossing(x, v [3]float64, dSrc, c float64) (float64, [3]float64) {
+	r := x
+	d := math.Sqrt(r[0]*r[0] + r[1]*r[1] + r[2]*r[2])
+	for i := 0; i < crossingIterations; i++ {
+		for k := 0; k < 3; k++ { r[k] = x[k] + v[k]/c*(dSrc - d) }
+		d = math.Sqrt(r[0]*r[0] + r[1]*r[1] + r[2]*r[2])
+	}
+	return d, r
+}
+
+// skyAngles returns the right ascension and declination of a position with
+// length d, in degrees.
+func skyAngles(r [3]float64, d float64) (ra, dec float64) {
+	ra = math.Atan2(r[1], r[0]) * 180 / math.Pi
+	if ra < 0 { ra += 360 }
+	dec = math.Asin(r[2]/d) * 180 / math.Pi
+	return ra, dec
+}
+
+// distanceTable converts comoving distances to redshifts.
+type distanceTable struct {
+	d []float64 // d[i] is the comoving distance at z = i*tableStep.
+}
+
+// newDistanceTable creates a table which covers the redshifts [0, zMax].
+func newDistanceTable(omegaM, omegaL, zMax float64) *distanceTable {
+	n := int(math.Ceil(zMax/tableStep)) + 2
+	t := &distanceTable{ d: make([]float64, n) }
+
+	f := func(z float64) float64 {
+		return 1 / cosmo.HubbleFrac(omegaM, omegaL, z)
+	}
+	for i := 1; i < n; i++ {
+		z0, z1 := float64(i - 1)*tableStep, float64(i)*tableStep
+		integral := (f(z0) + 4*f((z0 + z1)/2) + f(z1)) * tableStep / 6
+		t.d[i] = t.d[i-1] + cosmo.HubbleDistance()*integral
+	}
+
+	return t
+}
+
+// redshift returns the redshift at comoving distance d.
+func (t *distanceTable) redshift(d float64) float64 {
+	if d <= 0 { return 0 }
+	i := sort.SearchFloat64s(t.d, d) - 1
+	if i >= len(t.d) - 1 { i = len(t.d) - 2 }
+	frac := (d - t.d[i]) / (t.d[i+1] - t.d[i])
+	return (float64(i) + frac)*tableStep
+}
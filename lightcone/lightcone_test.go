@@ -0,0 +1,198 @@
+package lightcone
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/nbody-utils/cosmo"
+)
+
+// testSource is a Source which holds its objects in memory.
+type testSource struct {
+	scale, L float64
+	x, v [][][3]float32
+	id [][]int64
+}
+
+func (src *testSource) Scale() float64 { return src.scale }
+func (src *testSource) BoxSize() float64 { return src.L }
+func (src *testSource) Blocks() int { return len(src.x) }
+func (src *testSource) ReadBlock(
+	i int,
+) (x, v [][3]float32, id []int64, err error) {
+	return src.x[i], src.v[i], src.id[i], nil
+}
+
+// newTestSource creates a Source with n randomly placed objects split
+// across two blocks. Objects have the same positions and IDs in every
+// Source created with the same seed.
+func newTestSource(
+	scale, L float64, n int, seed int64, vel float32,
+) *testSource {
+	rng := rand.New(rand.NewSource(seed))
+	src := &testSource{
+		scale: scale, L: L,
+		x: make([][][3]float32, 2), v: make([][][3]float32, 2),
+		id: make([][]int64, 2),
+	}
+	for j := 0; j < n; j++ {
+		b := j % 2
+		x := [3]float32{ }
+		for k := range x { x[k] = float32(rng.Float64() * L) }
+		src.x[b] = append(src.x[b], x)
+		src.v[b] = append(src.v[b], [3]float32{ vel, 0, 0 })
+		src.id[b] = append(src.id[b], int64(j))
+	}
+	return src
+}
+
+func TestComovingDistance(t *testing.T) {
+	// Einstein-de Sitter has an analytic solution.
+	for _, z := range []float64{ 0, 0.1, 0.5, 1, 3 } {
+		d := cosmo.ComovingDistance(1, 0, z)
+		exact := 2*cosmo.HubbleDistance()*(1 - 1/math.Sqrt(1 + z))
+		if math.Abs(d - exact) > 1e-6*(1 + exact) {
+			t.Errorf("z = %g: expected D = %g, got %g.", z, exact, d)
+		}
+
+		table := newDistanceTable(1, 0, 3)
+		if zt := table.redshift(exact); math.Abs(zt - z) > 1e-6 {
+			t.Errorf("Expected redshift %g at D = %g, got %g.", z, exact, zt)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	L, n := 100.0, 200
+	obs := [3]float64{ 20, 50, 70 }
+	om, ol := 0.27, 0.73
+	scales := []float64{ 0.9, 0.95, 1.0 }
+
+	sources := []Source{ }
+	// Sources are given out of order.
+	for _, i := range []int{ 1, 2, 0 } {
+		sources = append(sources, newTestSource(scales[i], L, n, 1, 0))
+	}
+
+	config := Config{ Observer: obs, OmegaM: om, OmegaL: ol }
+	cat, err := Build(sources, config)
+	if err != nil { t.Fatal(err.Error()) }
+
+	// With stationary objects, every image of every object inside the
+	// outermost shell should appear exactly once.
+	dMax := cosmo.ComovingDistance(om, ol, 1/scales[0] - 1)
+	src := sources[0].(*testSource)
+	expected := map[[2]float64]int64{ }
+	nMax := int(math.Ceil(dMax / L)) + 1
+	for b := range src.x {
+		for j, x := range src.x[b] {
+			for ix := -nMax; ix <= nMax; ix++ {
+				for iy := -nMax; iy <= nMax; iy++ {
+					for iz := -nMax; iz <= nMax; iz++ {
+						r := [3]float64{
+							float64(x[0]) + float64(ix)*L - obs[0],
+							float64(x[1]) + float64(iy)*L - obs[1],
+							float64(x[2]) + float64(iz)*L - obs[2],
+						}
+						d := math.Sqrt(r[0]*r[0] + r[1]*r[1] + r[2]*r[2])
+						if d >= dMax { continue }
+						ra, dec := skyAngles(r, d)
+						expected[[2]float64{ ra, dec }] = src.id[b][j]
+					}
+				}
+			}
+		}
+	}
+
+	if cat.Len() != len(expected) {
+		t.Fatalf("Expected %d objects in the light-cone, got %d.",
+			len(expected), cat.Len())
+	}
+
+	for i := 0; i < cat.Len(); i++ {
+		id, ok := expected[[2]float64{ cat.RA[i], cat.Dec[i] }]
+		if !ok || id != cat.ID[i] {
+			t.Fatalf("Object %d at (%g, %g) with ID %d wasn't expected.",
+				i, cat.RA[i], cat.Dec[i], cat.ID[i])
+		}
+		if cat.Z[i] < 0 || cat.Z[i] > 1/scales[0] - 1 {
+			t.Errorf("Object %d has redshift %g.", i, cat.Z[i])
+		}
+		if math.Abs(cat.ZObs[i] - cat.Z[i]) > 1e-12 {
+			t.Errorf("Object %d has Z = %g, but ZObs = %g.",
+				i, cat.Z[i], cat.ZObs[i])
+		}
+		if cat.RA[i] < 0 || cat.RA[i] >= 360 ||
+			cat.Dec[i] < -90 || cat.Dec[i] > 90 {
+			t.Errorf("Object %d has (RA, Dec) = (%g, %g).",
+				i, cat.RA[i], cat.Dec[i])
+		}
+	}
+
+	// A footprint keeps only the objects inside it.
+	box := RADecBox{ RAMin: 300, RAMax: 60, DecMin: -10, DecMax: 30 }
+	config.Footprint = box
+	sub, err := Build(sources, config)
+	if err != nil { t.Fatal(err.Error()) }
+
+	inside := 0
+	for i := 0; i < cat.Len(); i++ {
+		if box.Contains(cat.RA[i], cat.Dec[i]) { inside++ }
+	}
+	if sub.Len() != inside || inside == 0 {
+		t.Errorf("Expected %d objects in the footprint, got %d.",
+			inside, sub.Len())
+	}
+	for i := 0; i < sub.Len(); i++ {
+		if !box.Contains(sub.RA[i], sub.Dec[i]) {
+			t.Errorf("Object %d at (%g, %g) is outside the footprint.",
+				i, sub.RA[i], sub.Dec[i])
+		}
+	}
+
+	buf := &bytes.Buffer{ }
+	if err = sub.WriteText(buf); err != nil { t.Fatal(err.Error()) }
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != sub.Len() + 1 || !strings.HasPrefix(lines[0], "#") {
+		t.Errorf("Expected a header and %d lines, got %d lines.",
+			sub.Len(), len(lines))
+	}
+}
+
+func TestBuildVelocity(t *testing.T) {
+	L, vel := 50.0, float32(3000)
+	om, ol := 0.27, 0.73
+	sources := []Source{
+		newTestSource(0.95, L, 100, 2, vel), newTestSource(1.0, L, 100, 2, vel),
+	}
+
+	config := Config{ OmegaM: om, OmegaL: ol, ZMax: 0.08 }
+	cat, err := Build(sources, config)
+	if err != nil { t.Fatal(err.Error()) }
+	if cat.Len() == 0 { t.Fatalf("The light-cone is empty.") }
+
+	c := cosmo.CMks / 1e3
+	for i := 0; i < cat.Len(); i++ {
+		if cat.Z[i] < 0 || cat.Z[i] > config.ZMax {
+			t.Errorf("Object %d has redshift %g.", i, cat.Z[i])
+		}
+
+		ra, dec := cat.RA[i]*math.Pi/180, cat.Dec[i]*math.Pi/180
+		vLOS := float64(vel) * math.Cos(ra) * math.Cos(dec)
+		zObs := (1 + cat.Z[i])*(1 + vLOS/c) - 1
+		if math.Abs(zObs - cat.ZObs[i]) > 1e-9 {
+			t.Errorf("Object %d: expected ZObs = %g, got %g.",
+				i, zObs, cat.ZObs[i])
+		}
+	}
+
+	_, err = Build(sources, Config{ OmegaM: om, OmegaL: ol, ZMax: 0.01 })
+	if err == nil {
+		t.Errorf("Expected an error when ZMax is below the outputs.")
+	}
+	_, err = Build(nil, config)
+	if err == nil { t.Errorf("Expected an error for an empty Build().") }
+}
@@ -0,0 +1,102 @@
+package lightcone
+
+import (
+	"github.com/phil-mansfield/nbody-utils/io/catalogue"
+	"github.com/phil-mansfield/nbody-utils/io/snapshot"
+)
+
+// Source is a single output of a simulation which is used to build a
+// light-cone. Objects are read in blocks.
+type Source interface {
+	Scale() float64 // Scale factor of the output.
+	BoxSize() float64 // Width of the box in Mpc/h.
+	Blocks() int // Number of blocks.
+	// ReadBlock returns the positions (Mpc/h), peculiar velocities (km/s),
+	// and IDs of the objects in block i. The returned slices may be
+	// overwritten by the next call.
+	ReadBlock(i int) (x, v [][3]float32, id []int64, err error)
+}
+
+type snapshotSource struct {
+	snap snapshot.Snapshot
+	xBuf [][3]float32
+}
+
+// SnapshotSource returns a Source for the particles in a snapshot. Each file
+// is a block.
+func SnapshotSource(snap snapshot.Snapshot) Source {
+	return &snapshotSource{ snap: snap }
+}
+
+func (src *snapshotSource) Scale() float64 { return src.snap.Header().Scale }
+func (src *snapshotSource) BoxSize() float64 { return src.snap.Header().L }
+func (src *snapshotSource) Blocks() int { return src.snap.Files() }
+
+func (src *snapshotSource) ReadBlock(
+	i int,
+) (x, v [][3]float32, id []int64, err error) {
+	// Some Snapshots share buffers between blocks, so positions are copied
+	// before velocities are read.
+	x, err = src.snap.ReadX(i)
+	if err != nil { return nil, nil, nil, err }
+	src.xBuf = append(src.xBuf[:0], x...)
+	v, err = src.snap.ReadV(i)
+	if err != nil { return nil, nil, nil, err }
+	id, err = src.snap.ReadID(i)
+	if err != nil { return nil, nil, nil, err }
+	return src.xBuf, v, id, nil
+}
+
+// CatalogueColumns gives the columns of a halo catalogue which hold each
+// halo's ID, position, and velocity.
+type CatalogueColumns struct {
+	ID int
+	X, V [3]int
+}
+
+// RockstarColumns are the columns of a Rockstar out_*.list or halos_*.ascii
+// file, or of halos_*.bin files read with catalogue.RockstarBinary.
+var RockstarColumns = CatalogueColumns{
+	ID: 0, X: [3]int{ 8, 9, 10 }, V: [3]int{ 11, 12, 13 },
+}
+
+type catalogueSource struct {
+	rd catalogue.Reader
+	scale, L float64
+	cols CatalogueColumns
+
+	x, v [][3]float32
+	id []int64
+}
+
+// CatalogueSource returns a Source for the halos in a catalogue with the
+// given scale factor and box size. Each block of the catalogue is a block
+// of the Source.
+func CatalogueSource(
+	rd catalogue.Reader, scale, L float64, cols CatalogueColumns,
+) Source {
+	return &catalogueSource{ rd: rd, scale: scale, L: L, cols: cols }
+}
+
+func (src *catalogueSource) Scale() float64 { return src.scale }
+func (src *catalogueSource) BoxSize() float64 { return src.L }
+func (src *catalogueSource) Blocks() int { return src.rd.Blocks() }
+
+func (src *catalogueSource) ReadBlock(
+	i int,
+) (x, v [][3]float32, id []int64, err error) {
+	c := src.cols
+	vals := src.rd.ReadFloat32Block([]int{
+		c.X[0], c.X[1], c.X[2], c.V[0], c.V[1], c.V[2],
+	}, i)
+	ids := src.rd.ReadIntBlock([]int{ c.ID }, i)[0]
+
+	src.x, src.v, src.id = src.x[:0], src.v[:0], src.id[:0]
+	for j := range ids {
+		src.x = append(src.x, [3]float32{ vals[0][j], vals[1][j], vals[2][j] })
+		src.v = append(src.v, [3]float32{ vals[3][j], vals[4][j], vals[5][j] })
+		src.id = append(src.id, int64(ids[j]))
+	}
+
+	return src.x, src.v, src.id, nil
+}
@@ -0,0 +1,267 @@
+/*package mergertree reconstructs and walks the merger trees in
+consistent-trees tree_*.dat files.*/
+package mergertree
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/phil-mansfield/nbody-utils/io/catalogue"
+)
+
+// Columns gives the columns of a merger tree file which hold each halo's
+// properties.
+type Columns struct {
+	Scale, ID, DescID, MMP, TreeRootID, Mass int
+}
+
+// ConsistentTreesColumns are the columns of a consistent-trees tree_*.dat
+// file. Mass is mvir.
+var ConsistentTreesColumns = Columns{
+	Scale: 0, ID: 1, DescID: 3, Mass: 10, MMP: 14, TreeRootID: 29,
+}
+
+// Forest is a collection of merger trees. Halos are referred to by their
+// index in the forest, which is the order they appear in the file.
+type Forest struct {
+	ID, DescID, TreeRootID []int
+	Scale, Mass []float64
+	MMP []bool // True if the halo is its descendant's most massive progenitor.
+
+	index map[int]int // Index of each ID.
+	desc []int // Index of each halo's descendant, or -1.
+	// progs[progStart[i]: progStart[i+1]] are the progenitors of halo i,
+	// with the main progenitor first.
+	progStart, progs []int
+	scales []float64 // Sorted, unique scale factors.
+}
+
+// ReadFile reads a consistent-trees tree_*.dat file. The line which gives
+// the number of trees is skipped.
+func ReadFile(fname string, cols ...Columns) (*Forest, error) {
+	f, err := os.Open(fname)
+	if err != nil { return nil, err }
+
+	// Find the first line which isn't a comment.
+	config := catalogue.DefaultConfig
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, config.MaxLineSize)
+	found := false
+	for scanner.Scan() {
+		config.SkipLines++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && line[0] != config.Comment {
+			found = true
+			break
+		}
+	}
+	err = scanner.Err()
+	f.Close()
+	if err != nil { return nil, err }
+	if !found {
+		return nil, fmt.Errorf("The file %s doesn't contain any trees.",
+			fname)
+	}
+
+	return Read(catalogue.TextFile(fname, config), cols...)
+}
+
+// Read reads a forest from a catalogue.Reader with one halo per row. If no
+// Columns are given, ConsistentTreesColumns is used.
+func Read(rd catalogue.Reader, cols ...Columns) (*Forest, error) {
+	c := ConsistentTreesColumns
+	if len(cols) > 0 { c = cols[0] }
+
+	ints := rd.ReadInts([]int{ c.ID, c.DescID, c.MMP, c.TreeRootID })
+	floats := rd.ReadFloat64s([]int{ c.Scale, c.Mass })
+
+	f := &Forest{
+		ID: ints[0], DescID: ints[1], TreeRootID: ints[3],
+		Scale: floats[0], Mass: floats[1],
+		MMP: make([]bool, len(ints[2])),
+	}
+	for i := range ints[2] { f.MMP[i] = ints[2][i] != 0 }
+
+	if err := f.link(); err != nil { return nil, err }
+	return f, nil
+}
+
+// link builds the indices that connect halos to their descendants and
+// progenitors.
+func (f *Forest) link() error {
+	n := len(f.ID)
+	f.index = make(map[int]int, n)
+	for i, id := range f.ID {
+		if _, ok := f.index[id]; ok {
+			return fmt.Errorf("The ID %d appears more than once.", id)
+		}
+		f.index[id] = i
+	}
+
+	f.desc = make([]int, n)
+	f.progStart = make([]int, n + 1)
+	for i := range f.ID {
+		f.desc[i] = -1
+		if f.DescID[i] < 0 { continue }
+
+		d, ok := f.index[f.DescID[i]]
+		if !ok {
+			return fmt.Errorf("The descendant (ID = %d) of the halo with " +
+				"ID %d isn't in the forest.", f.DescID[i], f.ID[i])
+		}
+		f.desc[i] = d
+		f.progStart[d + 1]++
+
+		root, ok := f.index[f.TreeRootID[i]]
+		if !ok || f.DescID[root] >= 0 {
+			return fmt.Errorf("The tree root (ID = %d) of the halo with " +
+				"ID %d isn't a root halo in the forest.",
+				f.TreeRootID[i], f.ID[i])
+		}
+	}
+
+	for i := 0; i < n; i++ { f.progStart[i + 1] += f.progStart[i] }
+	f.progs = make([]int, f.progStart[n])
+	next := append([]int{ }, f.progStart[:n]...)
+	for i, d := range f.desc {
+		if d == -1 { continue }
+		f.progs[next[d]] = i
+		next[d]++
+	}
+
+	for i := 0; i < n; i++ {
+		progs := f.progs[f.progStart[i]: f.progStart[i+1]]
+		sort.Sort(progenitorOrder{ f, progs })
+	}
+
+	scales := append([]float64{ }, f.Scale...)
+	sort.Float64s(scales)
+	for i, a := range scales {
+		if i == 0 || a != scales[i-1] { f.scales = append(f.scales, a) }
+	}
+
+	return nil
+}
+
+// progenitorOrder sorts progenitors so the halo flagged as the most massive
+// progenitor comes first, followed by the remaining halos in order of
+// decreasing mass.
+type progenitorOrder struct {
+	f *Forest
+	idx []int
+}
+
+func (p progenitorOrder) Len() int { return len(p.idx) }
+func (p progenitorOrder) Swap(i, j int) {
+	p.idx[i], p.idx[j] = p.idx[j], p.idx[i]
+}
+func (p progenitorOrder) Less(i, j int) bool {
+	hi, hj := p.idx[i], p.idx[j]
+	if p.f.MMP[hi] != p.f.MMP[hj] { return p.f.MMP[hi] }
+	if p.f.Mass[hi] != p.f.Mass[hj] { return p.f.Mass[hi] > p.f.Mass[hj] }
+	return p.f.ID[hi] < p.f.ID[hj]
+}
+
+// Len returns the number of halos in the forest.
+func (f *Forest) Len() int { return len(f.ID) }
+
+// Index returns the index of the halo with the given ID.
+func (f *Forest) Index(id int) (int, bool) {
+	i, ok := f.index[id]
+	return i, ok
+}
+
+// Scales returns the scale factors of every snapshot in the forest in
+// increasing order.
+func (f *Forest) Scales() []float64 { return f.scales }
+
+// Roots returns the indices of the halos which don't have descendants, i.e.
+// the root of every tree.
+func (f *Forest) Roots() []int {
+	roots := []int{ }
+	for i, d := range f.desc {
+		if d == -1 { roots = append(roots, i) }
+	}
+	return roots
+}
+
+// Root returns the index of the root of the tree which contains halo i.
+func (f *Forest) Root(i int) int {
+	if f.desc[i] == -1 { return i }
+	return f.index[f.TreeRootID[i]]
+}
+
+// Descendant returns the index of halo i's descendant, or -1 if it doesn't
+// have one.
+func (f *Forest) Descendant(i int) int { return f.desc[i] }
+
+// Progenitors returns the indices of halo i's direct progenitors. The main
+// progenitor is first. The returned slice must not be modified.
+func (f *Forest) Progenitors(i int) []int {
+	return f.progs[f.progStart[i]: f.progStart[i+1]]
+}
+
+// MainProgenitor returns the index of halo i's main progenitor, or -1 if it
+// doesn't have any progenitors. This is the halo flagged as the most massive
+// progenitor if there is one and the most massive progenitor otherwise.
+func (f *Forest) MainProgenitor(i int) int {
+	if f.progStart[i] == f.progStart[i+1] { return -1 }
+	return f.progs[f.progStart[i]]
+}
+
+// MainBranch returns the indices of the halos on halo i's main progenitor
+// branch, starting with i and moving backwards in time.
+func (f *Forest) MainBranch(i int) []int {
+	branch := []int{ }
+	for ; i != -1; i = f.MainProgenitor(i) { branch = append(branch, i) }
+	return branch
+}
+
+// ProgenitorsAt returns the indices of every progenitor of halo i in the
+// snapshot whose scale factor is closest to scale. If that snapshot is
+// halo i's own, only i is returned.
+func (f *Forest) ProgenitorsAt(i int, scale float64) []int {
+	target := f.nearestScale(scale)
+	out := []int{ }
+	if target > f.Scale[i] { return out }
+
+	stack := []int{ i }
+	for len(stack) > 0 {
+		j := stack[len(stack) - 1]
+		stack = stack[:len(stack) - 1]
+
+		if f.Scale[j] == target {
+			out = append(out, j)
+		} else if f.Scale[j] > target {
+			stack = append(stack, f.Progenitors(j)...)
+		}
+	}
+
+	sort.Ints(out)
+	return out
+}
+
+// nearestScale returns the snapshot scale factor which is closest to a.
+func (f *Forest) nearestScale(a float64) float64 {
+	j := sort.SearchFloat64s(f.scales, a)
+	if j == len(f.scales) { return f.scales[j - 1] }
+	if j > 0 && math.Abs(a - f.scales[j-1]) < math.Abs(f.scales[j] - a) {
+		return f.scales[j - 1]
+	}
+	return f.scales[j]
+}
+
+// MassHistory returns the scale factors and masses of the halos on halo i's
+// main progenitor branch, starting with i and moving backwards in time.
+func (f *Forest) MassHistory(i int) (scale, mass []float64) {
+	branch := f.MainBranch(i)
+	scale, mass = make([]float64, len(branch)), make([]float64, len(branch))
+	for k, j := range branch {
+		scale[k], mass[k] = f.Scale[j], f.Mass[j]
+	}
+	return scale, mass
+}
@@ -0,0 +1,165 @@
+package mergertree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testHalo is a single line of a test tree file.
+type testHalo struct {
+	scale float64
+	id, descID, mmp, root int
+	mass float64
+}
+
+// writeTestTrees writes a tree_*.dat file with the given trees.
+func writeTestTrees(fname string, trees [][]testHalo) error {
+	lines := []string{
+		"#scale(0) id(1) desc_scale(2) desc_id(3) num_prog(4) ...",
+		"#Omega_M = 0.270000; Omega_L = 0.730000; h0 = 0.700000",
+		"#Consistent Trees version 1.01",
+		fmt.Sprintf("%d", len(trees)),
+	}
+
+	for _, tree := range trees {
+		lines = append(lines, fmt.Sprintf("#tree %d", tree[0].id))
+		for _, h := range tree {
+			cols := make([]string, 35)
+			for i := range cols { cols[i] = "0" }
+			cols[0] = fmt.Sprintf("%.5f", h.scale)
+			cols[1], cols[3] = fmt.Sprint(h.id), fmt.Sprint(h.descID)
+			cols[10] = fmt.Sprintf("%.5e", h.mass)
+			cols[14], cols[29] = fmt.Sprint(h.mmp), fmt.Sprint(h.root)
+			lines = append(lines, strings.Join(cols, " "))
+		}
+	}
+
+	text := strings.Join(lines, "\n") + "\n"
+	return ioutil.WriteFile(fname, []byte(text), 0644)
+}
+
+// ids converts halo indices to IDs.
+func ids(f *Forest, idx []int) []int {
+	out := make([]int, len(idx))
+	for i := range idx { out[i] = f.ID[idx[i]] }
+	return out
+}
+
+func intsEq(x, y []int) bool {
+	if len(x) != len(y) { return false }
+	for i := range x {
+		if x[i] != y[i] { return false }
+	}
+	return true
+}
+
+func TestForest(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test_mergertree_data")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+
+	trees := [][]testHalo{
+		{
+			{ 1.0, 100, -1, 0, 100, 1e12 },
+			{ 0.5, 50, 100, 1, 100, 6e11 },
+			{ 0.5, 51, 100, 0, 100, 3e11 },
+			{ 0.25, 20, 50, 1, 100, 2e11 },
+			{ 0.25, 21, 50, 0, 100, 1e11 },
+			{ 0.25, 22, 51, 1, 100, 1e11 },
+		},
+		// No mmp flags, so the most massive progenitor is used.
+		{
+			{ 1.0, 200, -1, 0, 200, 5e11 },
+			{ 0.5, 60, 200, 0, 200, 4e11 },
+			{ 0.25, 30, 60, 0, 200, 1e11 },
+			{ 0.25, 31, 60, 0, 200, 2e11 },
+		},
+	}
+	fname := path.Join(dir, "tree_0_0_0.dat")
+	if err = writeTestTrees(fname, trees); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	f, err := ReadFile(fname)
+	if err != nil { t.Fatal(err.Error()) }
+	if f.Len() != 10 { t.Fatalf("Expected 10 halos, got %d.", f.Len()) }
+
+	if roots := ids(f, f.Roots()); !intsEq(roots, []int{ 100, 200 }) {
+		t.Errorf("Expected roots [100 200], got %d.", roots)
+	}
+	scales := f.Scales()
+	if len(scales) != 3 || scales[0] != 0.25 || scales[2] != 1 {
+		t.Errorf("Expected scales [0.25 0.5 1], got %g.", scales)
+	}
+
+	i100, _ := f.Index(100)
+	i200, _ := f.Index(200)
+	i22, _ := f.Index(22)
+	if f.Root(i22) != i100 || f.Root(i100) != i100 {
+		t.Errorf("Expected halo 22 to be in the tree rooted at 100.")
+	}
+	if d := f.Descendant(i22); d == -1 || f.ID[d] != 51 {
+		t.Errorf("Expected the descendant of 22 to be 51.")
+	}
+	if progs := ids(f, f.Progenitors(i100)); !intsEq(progs, []int{ 50, 51 }) {
+		t.Errorf("Expected progenitors [50 51] of 100, got %d.", progs)
+	}
+
+	tests := []struct{
+		root int
+		branch []int
+		at []float64
+		progs [][]int
+	}{
+		{ i100, []int{ 100, 50, 20 }, []float64{ 1, 0.49, 0.3, 0.01 },
+			[][]int{ { 100 }, { 50, 51 }, { 20, 21, 22 }, { 20, 21, 22 } } },
+		{ i200, []int{ 200, 60, 31 }, []float64{ 0.5, 0.25 },
+			[][]int{ { 60 }, { 30, 31 } } },
+	}
+
+	for i, test := range tests {
+		branch := ids(f, f.MainBranch(test.root))
+		if !intsEq(branch, test.branch) {
+			t.Errorf("%d) Expected main branch %d, got %d.",
+				i, test.branch, branch)
+		}
+
+		scale, mass := f.MassHistory(test.root)
+		for k, j := range f.MainBranch(test.root) {
+			if scale[k] != f.Scale[j] || mass[k] != f.Mass[j] {
+				t.Errorf("%d) Mass history element %d is (%g, %g), not " +
+					"(%g, %g).", i, k, scale[k], mass[k],
+					f.Scale[j], f.Mass[j])
+			}
+		}
+
+		for k, a := range test.at {
+			idx := f.ProgenitorsAt(test.root, a)
+			got := map[int]bool{ }
+			for _, id := range ids(f, idx) { got[id] = true }
+			ok := len(got) == len(test.progs[k])
+			for _, id := range test.progs[k] { ok = ok && got[id] }
+			if !ok {
+				t.Errorf("%d) Expected progenitors %d at a = %g, got %d.",
+					i, test.progs[k], a, ids(f, idx))
+			}
+		}
+	}
+
+	if progs := f.ProgenitorsAt(i22, 1); len(progs) != 0 {
+		t.Errorf("Expected no progenitors after a halo's own scale.")
+	}
+
+	// Missing descendants are detected.
+	trees[1] = trees[1][1:]
+	if err = writeTestTrees(fname, trees); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = ReadFile(fname); err == nil {
+		t.Errorf("Expected an error for a missing descendant.")
+	}
+}
@@ -0,0 +1,820 @@
+/*make_hdf5_fixtures writes the HDF5 files used by the tests of io/hdf5 and
+io/snapshot. Run it from the root of the repository:
+
+    go run scripts/make_hdf5_fixtures.go
+
+The files are assembled by hand following the HDF5 file format specification,
+so no HDF5 library is needed to regenerate them. Both contain a single
+Gadget-4-style snapshot file with five PartType1 particles.
+
+io/hdf5/test_files/gadget4.hdf5 uses the structures libhdf5 writes by default:
+a version 0 superblock, version 1 object headers, groups stored as symbol
+tables, version 1 attributes, and version 3 layouts. Coordinates and
+ParticleIDs are contiguous, and Velocities are stored in 2x3 chunks indexed by
+a version 1 B-tree with the shuffle and deflate filters, so the last chunk
+extends past the edge of the dataset. The same file is written to
+io/snapshot/test_files/gadget_hdf5/snap.0.hdf5.
+
+io/hdf5/test_files/gadget4_latest.hdf5 uses the structures libhdf5 writes
+with H5F_LIBVER_LATEST: a version 2 superblock, version 2 object headers
+(with a continuation block), groups stored as compact links, version 3
+attributes, version 2 dataspaces and filter pipelines, and version 4 layouts.
+Coordinates are big-endian float64s with a contiguous layout, Velocities are
+a single chunk with the shuffle, deflate, and Fletcher32 filters, ParticleIDs
+are stored in chunks of two with an implicit index, and Masses are compact.
+Checksums are written wherever the format has them.*/
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+)
+
+const (
+	undef = ^uint64(0)
+
+	// B-tree node sizes used by libhdf5 when the superblock doesn't set
+	// them.
+	groupLeafK = 4
+	groupInternalK = 16
+	chunkK = 32
+
+	nParticles = 5
+)
+
+// file is an HDF5 file being assembled in memory.
+type file struct {
+	b []byte
+}
+
+// alloc reserves n bytes at the next multiple of 8 and returns their address.
+func (f *file) alloc(n int) uint64 {
+	for len(f.b) % 8 != 0 { f.b = append(f.b, 0) }
+	addr := uint64(len(f.b))
+	f.b = append(f.b, make([]byte, n)...)
+	return addr
+}
+
+// write copies data into a newly allocated block and returns its address.
+func (f *file) write(data []byte) uint64 {
+	addr := f.alloc(len(data))
+	copy(f.b[addr:], data)
+	return addr
+}
+
+// enc builds a little-endian byte sequence.
+type enc struct {
+	bytes.Buffer
+}
+
+func (e *enc) u8(x uint64) { e.WriteByte(byte(x)) }
+func (e *enc) u16(x uint64) { binary.Write(e, binary.LittleEndian, uint16(x)) }
+func (e *enc) u32(x uint64) { binary.Write(e, binary.LittleEndian, uint32(x)) }
+func (e *enc) u64(x uint64) { binary.Write(e, binary.LittleEndian, x) }
+
+// pad8 pads the sequence to a multiple of 8 bytes.
+func (e *enc) pad8() {
+	for e.Len() % 8 != 0 { e.WriteByte(0) }
+}
+
+// msg is a header message.
+type msg struct {
+	typ int
+	data []byte
+}
+
+///////////////
+// Checksums //
+///////////////
+
+// lookup3 is Bob Jenkins' lookup3 hash with an initial value of zero, which
+// checksums version 2 metadata.
+func lookup3(k []byte) uint32 {
+	a := 0xdeadbeef + uint32(len(k))
+	b, c := a, a
+	rot := bits.RotateLeft32
+
+	for len(k) > 12 {
+		a += binary.LittleEndian.Uint32(k[0:])
+		b += binary.LittleEndian.Uint32(k[4:])
+		c += binary.LittleEndian.Uint32(k[8:])
+
+		a -= c; a ^= rot(c, 4); c += b
+		b -= a; b ^= rot(a, 6); a += c
+		c -= b; c ^= rot(b, 8); b += a
+		a -= c; a ^= rot(c, 16); c += b
+		b -= a; b ^= rot(a, 19); a += c
+		c -= b; c ^= rot(b, 4); b += a
+
+		k = k[12:]
+	}
+	if len(k) == 0 { return c }
+
+	tail := make([]byte, 12)
+	copy(tail, k)
+	a += binary.LittleEndian.Uint32(tail[0:])
+	b += binary.LittleEndian.Uint32(tail[4:])
+	c += binary.LittleEndian.Uint32(tail[8:])
+
+	c ^= b; c -= rot(b, 14)
+	a ^= c; a -= rot(c, 11)
+	b ^= a; b -= rot(a, 25)
+	c ^= b; c -= rot(b, 16)
+	a ^= c; a -= rot(c, 4)
+	b ^= a; b -= rot(a, 14)
+	c ^= b; c -= rot(b, 24)
+
+	return c
+}
+
+// fletcher32 is the checksum appended to chunks by the Fletcher32 filter.
+func fletcher32(data []byte) uint32 {
+	sum1, sum2 := uint32(0), uint32(0)
+	for i := 0; i + 1 < len(data); i += 2 {
+		sum1 += uint32(data[i]) << 8 | uint32(data[i + 1])
+		sum2 += sum1
+		sum1 = (sum1 & 0xffff) + (sum1 >> 16)
+		sum2 = (sum2 & 0xffff) + (sum2 >> 16)
+	}
+	if len(data) % 2 == 1 {
+		sum1 += uint32(data[len(data) - 1]) << 8
+		sum2 += sum1
+		sum1 = (sum1 & 0xffff) + (sum1 >> 16)
+		sum2 = (sum2 & 0xffff) + (sum2 >> 16)
+	}
+	sum1 = (sum1 & 0xffff) + (sum1 >> 16)
+	sum2 = (sum2 & 0xffff) + (sum2 >> 16)
+
+	return sum2 << 16 | sum1
+}
+
+////////////////////////
+// Messages and types //
+////////////////////////
+
+// fixedType returns a little-endian integer datatype.
+func fixedType(size int, signed bool) []byte {
+	e := &enc{ }
+	e.u8(0x10)
+	if signed { e.u8(0x08) } else { e.u8(0) }
+	e.u16(0)
+	e.u32(uint64(size))
+	e.u16(0)
+	e.u16(uint64(8*size))
+	return e.Bytes()
+}
+
+// floatType returns an IEEE floating point datatype.
+func floatType(size int, bigEndian bool) []byte {
+	e := &enc{ }
+	e.u8(0x11)
+	if bigEndian { e.u8(0x21) } else { e.u8(0x20) }
+	e.u8(uint64(8*size - 1))
+	e.u8(0)
+	e.u32(uint64(size))
+	e.u16(0)
+	e.u16(uint64(8*size))
+	if size == 4 {
+		e.u8(23); e.u8(8); e.u8(0); e.u8(23)
+		e.u32(127)
+	} else {
+		e.u8(52); e.u8(11); e.u8(0); e.u8(52)
+		e.u32(1023)
+	}
+	return e.Bytes()
+}
+
+// stringType returns a null-terminated ASCII string datatype.
+func stringType(size int) []byte {
+	e := &enc{ }
+	e.u8(0x13)
+	e.u8(0)
+	e.u16(0)
+	e.u32(uint64(size))
+	return e.Bytes()
+}
+
+// spaceV1 returns a version 1 dataspace. Scalars have no dimensions.
+func spaceV1(dims ...uint64) []byte {
+	e := &enc{ }
+	e.u8(1)
+	e.u8(uint64(len(dims)))
+	e.u8(0)
+	e.u8(0)
+	e.u32(0)
+	for _, d := range dims { e.u64(d) }
+	return e.Bytes()
+}
+
+// spaceV2 returns a version 2 dataspace. Scalars have no dimensions.
+func spaceV2(dims ...uint64) []byte {
+	e := &enc{ }
+	e.u8(2)
+	e.u8(uint64(len(dims)))
+	e.u8(0)
+	if len(dims) == 0 { e.u8(0) } else { e.u8(1) }
+	for _, d := range dims { e.u64(d) }
+	return e.Bytes()
+}
+
+// attrV1 returns a version 1 attribute message.
+func attrV1(name string, dt, ds, data []byte) msg {
+	e := &enc{ }
+	e.u8(1)
+	e.u8(0)
+	e.u16(uint64(len(name) + 1))
+	e.u16(uint64(len(dt)))
+	e.u16(uint64(len(ds)))
+	e.WriteString(name)
+	e.u8(0)
+	e.pad8()
+	e.Write(dt)
+	e.pad8()
+	e.Write(ds)
+	e.pad8()
+	e.Write(data)
+	return msg{ 0x0c, e.Bytes() }
+}
+
+// attrV3 returns a version 3 attribute message.
+func attrV3(name string, dt, ds, data []byte) msg {
+	e := &enc{ }
+	e.u8(3)
+	e.u8(0)
+	e.u16(uint64(len(name) + 1))
+	e.u16(uint64(len(dt)))
+	e.u16(uint64(len(ds)))
+	e.u8(0)
+	e.WriteString(name)
+	e.u8(0)
+	e.Write(dt)
+	e.Write(ds)
+	e.Write(data)
+	return msg{ 0x0c, e.Bytes() }
+}
+
+// fillValueV2 returns the version 2 fill value message libhdf5 writes when no
+// fill value is set.
+func fillValueV2(allocTime int) msg {
+	return msg{ 0x05, []byte{ 2, byte(allocTime), 2, 0 } }
+}
+
+// fillValueV3 returns the version 3 fill value message libhdf5 writes when no
+// fill value is set.
+func fillValueV3(allocTime int) msg {
+	return msg{ 0x05, []byte{ 3, byte(allocTime | 2 << 2) } }
+}
+
+// linkInfo returns a link info message for a group with compact links.
+func linkInfo() msg {
+	e := &enc{ }
+	e.u8(0)
+	e.u8(0)
+	e.u64(undef)
+	e.u64(undef)
+	return msg{ 0x02, e.Bytes() }
+}
+
+// attrInfo returns an attribute info message for an object with compact
+// attributes.
+func attrInfo() msg {
+	e := &enc{ }
+	e.u8(0)
+	e.u8(0)
+	e.u64(undef)
+	e.u64(undef)
+	return msg{ 0x15, e.Bytes() }
+}
+
+// link returns a hard link message.
+func link(name string, addr uint64) msg {
+	e := &enc{ }
+	e.u8(1)
+	e.u8(0)
+	e.u8(uint64(len(name)))
+	e.WriteString(name)
+	e.u64(addr)
+	return msg{ 0x06, e.Bytes() }
+}
+
+func f64s(x ...float64) []byte {
+	e := &enc{ }
+	for i := range x { e.u64(math.Float64bits(x[i])) }
+	return e.Bytes()
+}
+
+func f64sBig(x ...float64) []byte {
+	out := make([]byte, 8*len(x))
+	for i := range x {
+		binary.BigEndian.PutUint64(out[8*i:], math.Float64bits(x[i]))
+	}
+	return out
+}
+
+func f32s(x ...float32) []byte {
+	e := &enc{ }
+	for i := range x { e.u32(uint64(math.Float32bits(x[i]))) }
+	return e.Bytes()
+}
+
+func u64s(x ...uint64) []byte {
+	e := &enc{ }
+	for i := range x { e.u64(x[i]) }
+	return e.Bytes()
+}
+
+func i32s(x ...int32) []byte {
+	e := &enc{ }
+	for i := range x { e.u32(uint64(uint32(x[i]))) }
+	return e.Bytes()
+}
+
+// shuffle applies the shuffle filter to elements of the given size.
+func shuffle(data []byte, size int) []byte {
+	n := len(data) / size
+	out := make([]byte, len(data))
+	for j := 0; j < size; j++ {
+		for i := 0; i < n; i++ { out[j*n + i] = data[i*size + j] }
+	}
+	return out
+}
+
+// deflate applies the deflate filter.
+func deflate(data []byte) []byte {
+	buf := &bytes.Buffer{ }
+	wr, _ := zlib.NewWriterLevel(buf, 6)
+	wr.Write(data)
+	wr.Close()
+	return buf.Bytes()
+}
+
+//////////////////////////////////
+// Default (version 0) metadata //
+//////////////////////////////////
+
+// objectHeaderV1 writes a version 1 object header.
+func (f *file) objectHeaderV1(msgs []msg) uint64 {
+	body := &enc{ }
+	for _, m := range msgs {
+		data := append([]byte{ }, m.data...)
+		for len(data) % 8 != 0 { data = append(data, 0) }
+		body.u16(uint64(m.typ))
+		body.u16(uint64(len(data)))
+		body.u8(0)
+		body.Write([]byte{ 0, 0, 0 })
+		body.Write(data)
+	}
+
+	e := &enc{ }
+	e.u8(1)
+	e.u8(0)
+	e.u16(uint64(len(msgs)))
+	e.u32(1)
+	e.u32(uint64(body.Len()))
+	e.u32(0)
+	e.Write(body.Bytes())
+	return f.write(e.Bytes())
+}
+
+// symbolGroup writes a group stored as a symbol table and returns the
+// addresses of its object header, B-tree, and local heap.
+func (f *file) symbolGroup(
+	children map[string]uint64, extra []msg,
+) (addr, btree, heap uint64) {
+	names := []string{ }
+	for name := range children { names = append(names, name) }
+	sort.Strings(names)
+
+	// The local heap starts with the empty string.
+	heapData := &enc{ }
+	heapData.u64(0)
+	offsets := map[string]uint64{ }
+	for _, name := range names {
+		offsets[name] = uint64(heapData.Len())
+		heapData.WriteString(name)
+		heapData.u8(0)
+		heapData.pad8()
+	}
+	dataAddr := f.write(heapData.Bytes())
+
+	e := &enc{ }
+	e.WriteString("HEAP")
+	e.u8(0)
+	e.Write([]byte{ 0, 0, 0 })
+	e.u64(uint64(heapData.Len()))
+	e.u64(undef)
+	e.u64(dataAddr)
+	heap = f.write(e.Bytes())
+
+	e = &enc{ }
+	e.WriteString("SNOD")
+	e.u8(1)
+	e.u8(0)
+	e.u16(uint64(len(names)))
+	for _, name := range names {
+		e.u64(offsets[name])
+		e.u64(children[name])
+		e.u32(0)
+		e.u32(0)
+		e.Write(make([]byte, 16))
+	}
+	e.Write(make([]byte, 40*(2*groupLeafK - len(names))))
+	snod := f.write(e.Bytes())
+
+	// Group B-tree nodes have room for 2K children, even when empty.
+	e = &enc{ }
+	e.WriteString("TREE")
+	e.u8(0)
+	e.u8(0)
+	if len(names) == 0 { e.u16(0) } else { e.u16(1) }
+	e.u64(undef)
+	e.u64(undef)
+	e.u64(0)
+	if len(names) > 0 {
+		e.u64(snod)
+		e.u64(offsets[names[len(names) - 1]])
+	}
+	nodeSize := 24 + 8*2*groupInternalK + 8*(2*groupInternalK + 1)
+	e.Write(make([]byte, nodeSize - e.Len()))
+	btree = f.write(e.Bytes())
+
+	st := &enc{ }
+	st.u64(btree)
+	st.u64(heap)
+	msgs := append([]msg{ { 0x11, st.Bytes() } }, extra...)
+	return f.objectHeaderV1(msgs), btree, heap
+}
+
+// contiguousV3 writes a dataset with a version 3 contiguous layout.
+func (f *file) contiguousV3(dt, ds, data []byte) uint64 {
+	l := &enc{ }
+	l.u8(3)
+	l.u8(1)
+	l.u64(f.write(data))
+	l.u64(uint64(len(data)))
+	return f.objectHeaderV1([]msg{
+		{ 0x01, ds }, { 0x03, dt }, fillValueV2(2), { 0x08, l.Bytes() },
+	})
+}
+
+// chunkedV3 writes an n x 3 float32 dataset in chunks of rows x 3 with the
+// shuffle and deflate filters, indexed by a version 1 B-tree.
+func (f *file) chunkedV3(data []float32, rows int) uint64 {
+	n := len(data) / 3
+
+	// Chunk B-tree keys hold the chunk size, filter mask, and offset.
+	tree := &enc{ }
+	tree.WriteString("TREE")
+	tree.u8(1)
+	tree.u8(0)
+	tree.u16(uint64((n + rows - 1) / rows))
+	tree.u64(undef)
+	tree.u64(undef)
+	for start := 0; start < n; start += rows {
+		raw := make([]float32, 3*rows)
+		copy(raw, data[3*start:])
+		chunk := deflate(shuffle(f32s(raw...), 4))
+
+		tree.u32(uint64(len(chunk)))
+		tree.u32(0)
+		tree.u64(uint64(start))
+		tree.u64(0)
+		tree.u64(0)
+		tree.u64(f.write(chunk))
+	}
+	tree.u32(0)
+	tree.u32(0)
+	tree.u64(uint64(n))
+	tree.u64(0)
+	tree.u64(0)
+	nodeSize := 24 + 8*2*chunkK + 32*(2*chunkK + 1)
+	tree.Write(make([]byte, nodeSize - tree.Len()))
+
+	l := &enc{ }
+	l.u8(3)
+	l.u8(2)
+	l.u8(3)
+	l.u64(f.write(tree.Bytes()))
+	l.u32(uint64(rows))
+	l.u32(3)
+	l.u32(4)
+
+	fl := &enc{ }
+	fl.u8(1)
+	fl.u8(2)
+	fl.Write(make([]byte, 6))
+	fl.u16(2)
+	fl.u16(0)
+	fl.u16(0)
+	fl.u16(1)
+	fl.u32(4)
+	fl.u32(0)
+	fl.u16(1)
+	fl.u16(8)
+	fl.u16(0)
+	fl.u16(1)
+	fl.WriteString("deflate\x00")
+	fl.u32(6)
+	fl.u32(0)
+
+	return f.objectHeaderV1([]msg{
+		{ 0x01, spaceV1(uint64(n), 3) }, { 0x03, floatType(4, false) },
+		fillValueV2(3), { 0x08, l.Bytes() }, { 0x0b, fl.Bytes() },
+	})
+}
+
+// writeDefault writes gadget4.hdf5.
+func writeDefault(x, v []float32, id []uint64) []byte {
+	f := &file{ }
+	f.alloc(96)
+
+	coords := f.contiguousV3(floatType(4, false),
+		spaceV1(nParticles, 3), f32s(x...))
+	vels := f.chunkedV3(v, 2)
+	ids := f.contiguousV3(fixedType(8, false), spaceV1(nParticles), u64s(id...))
+	pt1, _, _ := f.symbolGroup(map[string]uint64{
+		"Coordinates": coords, "Velocities": vels, "ParticleIDs": ids,
+	}, nil)
+
+	header, _, _ := f.symbolGroup(nil, []msg{
+		attrV1("BoxSize", floatType(8, false), spaceV1(), f64s(10)),
+		attrV1("Time", floatType(8, false), spaceV1(), f64s(0.25)),
+		attrV1("Redshift", floatType(8, false), spaceV1(), f64s(3)),
+		attrV1("NumPart_ThisFile", fixedType(8, false), spaceV1(6),
+			u64s(0, nParticles, 0, 0, 0, 0)),
+		attrV1("NumPart_Total", fixedType(8, false), spaceV1(6),
+			u64s(0, nParticles, 0, 0, 0, 0)),
+		attrV1("MassTable", floatType(8, false), spaceV1(6),
+			f64s(0, 2, 0, 0, 0, 0)),
+		attrV1("NumFilesPerSnapshot", fixedType(4, true), spaceV1(),
+			i32s(1)),
+	})
+	params, _, _ := f.symbolGroup(nil, []msg{
+		attrV1("Omega0", floatType(8, false), spaceV1(), f64s(0.3)),
+		attrV1("OmegaLambda", floatType(8, false), spaceV1(), f64s(0.7)),
+		attrV1("HubbleParam", floatType(8, false), spaceV1(), f64s(0.7)),
+	})
+	root, btree, heap := f.symbolGroup(map[string]uint64{
+		"Header": header, "Parameters": params, "PartType1": pt1,
+	}, nil)
+
+	// The root group's symbol table entry caches its B-tree and heap.
+	sb := &enc{ }
+	sb.Write([]byte{ 0x89, 'H', 'D', 'F', '\r', '\n', 0x1a, '\n' })
+	sb.Write([]byte{ 0, 0, 0, 0, 0, 8, 8, 0 })
+	sb.u16(groupLeafK)
+	sb.u16(groupInternalK)
+	sb.u32(0)
+	sb.u64(0)
+	sb.u64(undef)
+	sb.u64(uint64(len(f.b)))
+	sb.u64(undef)
+	sb.u64(0)
+	sb.u64(root)
+	sb.u32(1)
+	sb.u32(0)
+	sb.u64(btree)
+	sb.u64(heap)
+	copy(f.b, sb.Bytes())
+
+	return f.b
+}
+
+/////////////////////////////////
+// Latest (version 2) metadata //
+/////////////////////////////////
+
+// v2Messages encodes messages for a version 2 object header or continuation
+// block. If order is true, messages store their creation order.
+func v2Messages(msgs []msg, order bool) []byte {
+	e := &enc{ }
+	for i, m := range msgs {
+		e.u8(uint64(m.typ))
+		e.u16(uint64(len(m.data)))
+		e.u8(0)
+		if order { e.u16(uint64(i)) }
+		e.Write(m.data)
+	}
+	return e.Bytes()
+}
+
+// objectHeaderV2 writes a version 2 object header with the given flags. The
+// last nCont messages are stored in a continuation block.
+func (f *file) objectHeaderV2(flags int, msgs []msg, nCont int) uint64 {
+	order := flags & 0x04 != 0
+	first := msgs[:len(msgs) - nCont]
+
+	if nCont > 0 {
+		e := &enc{ }
+		e.WriteString("OCHK")
+		e.Write(v2Messages(msgs[len(msgs) - nCont:], order))
+		e.u32(uint64(lookup3(e.Bytes())))
+		cont := &enc{ }
+		cont.u64(f.write(e.Bytes()))
+		cont.u64(uint64(e.Len()))
+		first = append(append([]msg{ }, first...), msg{ 0x10, cont.Bytes() })
+	}
+	body := v2Messages(first, order)
+
+	e := &enc{ }
+	e.WriteString("OHDR")
+	e.u8(2)
+	e.u8(uint64(flags))
+	if flags & 0x20 != 0 {
+		for i := 0; i < 4; i++ { e.u32(1262304000) }
+	}
+	if flags & 0x10 != 0 {
+		e.u16(8)
+		e.u16(6)
+	}
+	switch flags & 3 {
+	case 0: e.u8(uint64(len(body)))
+	case 1: e.u16(uint64(len(body)))
+	case 2: e.u32(uint64(len(body)))
+	case 3: e.u64(uint64(len(body)))
+	}
+	e.Write(body)
+	e.u32(uint64(lookup3(e.Bytes())))
+	return f.write(e.Bytes())
+}
+
+// linkGroup writes a group stored as compact links.
+func (f *file) linkGroup(
+	flags int, children map[string]uint64, extra []msg, nCont int,
+) uint64 {
+	names := []string{ }
+	for name := range children { names = append(names, name) }
+	sort.Strings(names)
+
+	msgs := []msg{ linkInfo(), { 0x0a, []byte{ 0, 0 } } }
+	for _, name := range names {
+		msgs = append(msgs, link(name, children[name]))
+	}
+	return f.objectHeaderV2(flags, append(msgs, extra...), nCont)
+}
+
+// datasetV4 writes a dataset with the given version 4 layout and filters.
+func (f *file) datasetV4(
+	dt, ds []byte, allocTime int, layout, filters []byte,
+) uint64 {
+	msgs := []msg{
+		{ 0x01, ds }, { 0x03, dt }, fillValueV3(allocTime),
+		{ 0x08, layout },
+	}
+	if filters != nil { msgs = append(msgs, msg{ 0x0b, filters }) }
+	return f.objectHeaderV2(0x02, msgs, 0)
+}
+
+// writeLatest writes gadget4_latest.hdf5.
+func writeLatest(x, v []float32, id []uint64) []byte {
+	f := &file{ }
+	f.alloc(48)
+
+	x64 := make([]float64, len(x))
+	for i := range x { x64[i] = float64(x[i]) }
+	l := &enc{ }
+	l.u8(4)
+	l.u8(1)
+	l.u64(f.write(f64sBig(x64...)))
+	l.u64(uint64(8*len(x64)))
+	coords := f.datasetV4(floatType(8, true), spaceV2(nParticles, 3), 2,
+		l.Bytes(), nil)
+
+	// A single chunk with shuffle, deflate, and Fletcher32 filters.
+	chunk := deflate(shuffle(f32s(v...), 4))
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, fletcher32(chunk))
+	chunk = append(chunk, sum...)
+	l = &enc{ }
+	l.u8(4)
+	l.u8(2)
+	l.u8(0x02)
+	l.u8(3)
+	l.u8(1)
+	l.u8(nParticles)
+	l.u8(3)
+	l.u8(4)
+	l.u8(1)
+	l.u64(uint64(len(chunk)))
+	l.u32(0)
+	l.u64(f.write(chunk))
+	// Each filter is an ID, a number of parameters, and the parameter.
+	filters := [][3]uint64{ { 2, 1, 4 }, { 1, 1, 6 }, { 3, 0, 0 } }
+	fl := &enc{ }
+	fl.u8(2)
+	fl.u8(uint64(len(filters)))
+	for _, filter := range filters {
+		fl.u16(filter[0])
+		fl.u16(0)
+		fl.u16(filter[1])
+		if filter[1] > 0 { fl.u32(filter[2]) }
+	}
+	vels := f.datasetV4(floatType(4, false), spaceV2(nParticles, 3), 3,
+		l.Bytes(), fl.Bytes())
+
+	// Chunks of two IDs stored one after another, so the last chunk extends
+	// past the edge of the dataset.
+	padded := append(append([]uint64{ }, id...), 0)
+	l = &enc{ }
+	l.u8(4)
+	l.u8(2)
+	l.u8(0)
+	l.u8(2)
+	l.u8(1)
+	l.u8(2)
+	l.u8(8)
+	l.u8(2)
+	l.u64(f.write(u64s(padded...)))
+	ids := f.datasetV4(fixedType(8, false), spaceV2(nParticles), 1,
+		l.Bytes(), nil)
+
+	masses := make([]float32, nParticles)
+	for i := range masses { masses[i] = 2 }
+	l = &enc{ }
+	l.u8(4)
+	l.u8(0)
+	l.u16(4*nParticles)
+	l.Write(f32s(masses...))
+	mp := f.datasetV4(floatType(4, false), spaceV2(nParticles), 1,
+		l.Bytes(), nil)
+
+	pt1 := f.linkGroup(0x00, map[string]uint64{
+		"Coordinates": coords, "Velocities": vels, "ParticleIDs": ids,
+		"Masses": mp,
+	}, nil, 0)
+
+	header := f.linkGroup(0x01, nil, []msg{
+		attrInfo(),
+		attrV3("BoxSize", floatType(8, false), spaceV2(), f64s(10)),
+		attrV3("Time", floatType(8, false), spaceV2(), f64s(0.25)),
+		attrV3("Redshift", floatType(8, false), spaceV2(), f64s(3)),
+		attrV3("NumPart_ThisFile", fixedType(8, false), spaceV2(6),
+			u64s(0, nParticles, 0, 0, 0, 0)),
+		attrV3("NumPart_Total", fixedType(8, false), spaceV2(6),
+			u64s(0, nParticles, 0, 0, 0, 0)),
+		attrV3("MassTable", floatType(8, false), spaceV2(6),
+			f64s(0, 0, 0, 0, 0, 0)),
+		attrV3("NumFilesPerSnapshot", fixedType(4, true), spaceV2(),
+			i32s(1)),
+	}, 0)
+
+	// The last two attributes are in a continuation block.
+	outputDir := make([]byte, 16)
+	copy(outputDir, "./output")
+	params := f.linkGroup(0x01, nil, []msg{
+		attrV3("Omega0", floatType(8, false), spaceV2(), f64s(0.3)),
+		attrV3("OmegaLambda", floatType(8, false), spaceV2(), f64s(0.7)),
+		attrV3("HubbleParam", floatType(8, false), spaceV2(), f64s(0.7)),
+		attrV3("OutputDir", stringType(16), spaceV2(), outputDir),
+	}, 2)
+
+	root := f.linkGroup(0x04 | 0x20, map[string]uint64{
+		"Header": header, "Parameters": params, "PartType1": pt1,
+	}, nil, 0)
+
+	sb := &enc{ }
+	sb.Write([]byte{ 0x89, 'H', 'D', 'F', '\r', '\n', 0x1a, '\n' })
+	sb.Write([]byte{ 2, 8, 8, 0 })
+	sb.u64(0)
+	sb.u64(undef)
+	sb.u64(uint64(len(f.b)))
+	sb.u64(root)
+	sb.u32(uint64(lookup3(sb.Bytes())))
+	copy(f.b, sb.Bytes())
+
+	return f.b
+}
+
+func main() {
+	x := make([]float32, 3*nParticles)
+	v := make([]float32, 3*nParticles)
+	id := make([]uint64, nParticles)
+	for i := 0; i < nParticles; i++ {
+		fi := float32(i)
+		x[3*i], x[3*i + 1], x[3*i + 2] = fi, fi + 0.5, 1
+		v[3*i], v[3*i + 1], v[3*i + 2] = 2*fi, -fi, 3
+		id[i] = uint64(i + 1)
+	}
+
+	files := []struct{
+		name string
+		data []byte
+	}{
+		{ "io/hdf5/test_files/gadget4.hdf5", writeDefault(x, v, id) },
+		{ "io/snapshot/test_files/gadget_hdf5/snap.0.hdf5",
+			writeDefault(x, v, id) },
+		{ "io/hdf5/test_files/gadget4_latest.hdf5", writeLatest(x, v, id) },
+	}
+
+	for _, out := range files {
+		if err := os.WriteFile(out.name, out.data, 0644); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+}
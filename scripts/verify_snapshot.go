@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/phil-mansfield/nbody-utils/io/snapshot"
+)
+
+const ErrorMessage = `Correct usage: verify_snapshot format path [lvec_format]
+
+format is one of lgadget2, gadget2, gadget_hdf5, lvec, abacus, ramses, or
+tipsy. path is the snapshot directory, or the file name for tipsy snapshots.
+LVec snapshots also need the file name format used to write them, e.g.
+"snap.%s.%d.lvec".
+
+The exit status is 1 if any problems are found.
+`
+
+// OpenSnapshot opens the snapshot at path with the given format.
+func OpenSnapshot(
+	format, path string, args []string,
+) (snapshot.Snapshot, error) {
+	switch format {
+	case "lgadget2": return snapshot.LGadget2(path)
+	case "gadget2": return snapshot.Gadget2(path)
+	case "gadget_hdf5": return snapshot.GadgetHDF5(path)
+	case "abacus": return snapshot.Abacus(path)
+	case "ramses": return snapshot.Ramses(path)
+	case "tipsy": return snapshot.Tipsy(path)
+	case "lvec":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("No LVec file name format was given.")
+		}
+		return snapshot.LVec(path, args[0])
+	}
+	return nil, fmt.Errorf("Unrecognized snapshot format '%s'.", format)
+}
+
+func main() {
+	if len(os.Args) < 3 || len(os.Args) > 4 {
+		io.WriteString(os.Stdout, ErrorMessage)
+		os.Exit(1)
+	}
+
+	snap, err := OpenSnapshot(os.Args[1], os.Args[2], os.Args[3:])
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	report, err := snapshot.Verify(snap)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Print(report)
+	if !report.OK() { os.Exit(1) }
+}